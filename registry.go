@@ -1,28 +1,239 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
 	"registry/api"
 	"registry/config"
+	"registry/layers"
 	"registry/logger"
 	"registry/storage"
+	"syscall"
 )
 
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-config file] [command]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  serve    run the registry (default)")
+	fmt.Fprintln(os.Stderr, "  migrate  copy all data to the storage of another config file")
+	fmt.Fprintln(os.Stderr, "  fsck     check the storage for inconsistencies")
+	fmt.Fprintln(os.Stderr, "  rekey    re-encrypt everything with the active key from the key file, while the registries")
+	fmt.Fprintln(os.Stderr, "           are read-only")
+	fmt.Fprintln(os.Stderr, "  dedup    move the layers of existing images to the content-addressed blob area")
+	fmt.Fprintln(os.Stderr, "  config check")
+	fmt.Fprintln(os.Stderr, "           validate the config file and the environment overrides, then exit")
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
+
 func main() {
 	var cfgFile string
 	flag.StringVar(&cfgFile, "config", "/etc/go-docker-registry/config.json", "config file")
+	flag.Usage = usage
 	flag.Parse()
 
+	args := flag.Args()
+	command := "serve"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	if command == "config" {
+		configCommand(cfgFile, args)
+		return
+	}
+
 	cfg, err := config.New(cfgFile)
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
+	logger.SetLevel(cfg.LogLevel)
+	logger.SetFormat(cfg.LogFormat)
+	switch command {
+	case "serve":
+		serve(cfgFile, cfg)
+	case "migrate":
+		migrate(cfg, args)
+	case "fsck":
+		fsck(cfg, args)
+	case "rekey":
+		rekey(cfg)
+	case "dedup":
+		dedup(cfg)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func configCommand(cfgFile string, args []string) {
+	if len(args) != 1 || args[0] != "check" {
+		usage()
+		os.Exit(2)
+	}
+	if _, err := config.New(cfgFile); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(cfgFile + ": OK")
+}
+
+func serve(cfgFile string, cfg *config.Config) {
+	registryStorage, err := storage.New(cfg.Storage)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	registryAPI := api.New(cfg.API, registryStorage)
+	go reloadOnHangup(cfgFile, cfg, registryAPI, registryStorage)
+	stopped := make(chan bool)
+	go shutdownOnTerm(registryAPI, registryStorage, stopped)
+	if err := registryAPI.ListenAndServe(); err != nil {
+		logger.Fatal(err.Error())
+	}
+	<-stopped
+}
+
+// drains running requests on SIGTERM or SIGINT, then removes temporary upload files
+func shutdownOnTerm(registryAPI *api.RegistryAPI, registryStorage storage.Storage, stopped chan bool) {
+	terms := make(chan os.Signal, 1)
+	signal.Notify(terms, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-terms
+	logger.Info("[Shutdown] received %s, waiting for running requests", sig.String())
+	if err := registryAPI.Shutdown(); err != nil {
+		logger.Error("[Shutdown] %s", err.Error())
+	}
+	if err := storage.Cleanup(registryStorage); err != nil {
+		logger.Error("[Shutdown] error removing temporary files: %s", err.Error())
+	}
+	logger.Info("[Shutdown] done")
+	close(stopped)
+}
+
+// re-reads the config file on SIGHUP and applies what can change without a restart. an invalid config is logged
+// and ignored.
+func reloadOnHangup(cfgFile string, cfg *config.Config, registryAPI *api.RegistryAPI, registryStorage storage.Storage) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for _ = range hangups {
+		logger.Info("[Reload] reloading %s", cfgFile)
+		newCfg, err := config.New(cfgFile)
+		if err != nil {
+			logger.Error("[Reload] keeping the current config: %s", err.Error())
+			continue
+		}
+		// storage first: if the new credentials don't work nothing else changes either
+		if err := storage.Reload(registryStorage, newCfg.Storage); err != nil {
+			logger.Error("[Reload] keeping the current config, error reloading storage: %s", err.Error())
+			continue
+		}
+		for _, change := range config.Diff(cfg, newCfg) {
+			if change.Reloadable() {
+				logger.Info("[Reload] %s", change.String())
+			} else {
+				logger.Info("[Reload] %s (ignored until restart)", change.String())
+			}
+		}
+		logger.SetLevel(newCfg.LogLevel)
+		logger.SetFormat(newCfg.LogFormat)
+		registryAPI.SetConfig(newCfg.API)
+		cfg = newCfg
+	}
+}
+
+func migrate(cfg *config.Config, args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	toFile := flags.String("to", "", "config file containing the destination storage")
+	statePath := flags.String("state", "migrate.state", "file recording migrated keys, used to resume and to run incrementally")
+	deleteRemoved := flags.Bool("delete", false, "remove keys from the destination that no longer exist in the source. "+
+		"use this for the final pass, while the registry is read-only")
+	flags.Parse(args)
+	if *toFile == "" {
+		logger.Fatal("migrate: -to is required")
+	}
+	toCfg, err := config.New(*toFile)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	source, err := storage.New(cfg.Storage)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	dest, err := storage.New(toCfg.Storage)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	migration := &storage.Migration{Source: source, Dest: dest, StatePath: *statePath, Delete: *deleteRemoved}
+	stats, err := migration.Run()
+	if stats != nil {
+		logger.Info("[Migrate] copied=%d skipped=%d deleted=%d failed=%d bytes=%d", stats.Copied, stats.Skipped,
+			stats.Deleted, stats.Failed, stats.Bytes)
+	}
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+}
+
+func fsck(cfg *config.Config, args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "repair the problems found instead of only reporting them")
+	staleAfter := flags.Duration("stale-after", api.FSCK_STALE_AFTER, "consider uploads in progress for longer than this abandoned")
+	flags.Parse(args)
 
 	storage, err := storage.New(cfg.Storage)
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
+	report, err := (&layers.Fsck{Storage: storage, Repair: *repair, StaleAfter: *staleAfter}).Run()
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	encoded, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	fmt.Println(string(encoded))
+	for _, problem := range report.Problems {
+		if !problem.Repaired {
+			os.Exit(1)
+		}
+	}
+}
 
-	registryAPI := api.New(cfg.API, storage)
-	logger.Fatal(registryAPI.ListenAndServe().Error())
+func rekey(cfg *config.Config) {
+	// a write landing while its object is re-encrypted would be overwritten with the old content
+	if !cfg.API.ReadOnly {
+		logger.Fatal("rekey: switch the registries to read-only first (PUT /v1/_admin/read_only), then run it with " +
+			"read_only set in the config or REGISTRY_API_READ_ONLY=true")
+	}
+	encrypted, err := storage.New(cfg.Storage)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	rekeyed, err := storage.Rekey(encrypted)
+	logger.Info("[Rekey] re-encrypted %d objects", rekeyed)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+}
+
+func dedup(cfg *config.Config) {
+	s, err := storage.New(cfg.Storage)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	converted, err := layers.ConvertToDedup(s)
+	logger.Info("[Dedup] converted %d layers", converted)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	stats, err := layers.GetDedupStats(s)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	logger.Info("[Dedup] blobs=%d references=%d stored_bytes=%d saved_bytes=%d", stats.Blobs, stats.References,
+		stats.StoredBytes, stats.SavedBytes)
 }
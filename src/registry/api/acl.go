@@ -0,0 +1,133 @@
+package api
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"registry/layers"
+	"strings"
+)
+
+const (
+	ACCESS_READ  = "read"
+	ACCESS_WRITE = "write" // includes read
+	ACCESS_ADMIN = "admin" // includes write, and the admin routes
+)
+
+var ACCESS_LEVELS = map[string]int{ACCESS_READ: 1, ACCESS_WRITE: 2, ACCESS_ADMIN: 3}
+
+// ACLRule grants an identity (see Identity) access to namespaces. Without any rules everyone can do everything.
+type ACLRule struct {
+	Identity   string   `json:"identity"`   // "*" for anyone, including anonymous clients
+	Namespaces []string `json:"namespaces"` // "*" for all of them
+	Access     string   `json:"access"`     // read, write or admin
+}
+
+func (rule *ACLRule) matches(identity, namespace string) bool {
+	if rule.Identity != "*" && rule.Identity != identity {
+		return false
+	}
+	for _, ns := range rule.Namespaces {
+		if ns == "*" || (ns == namespace && namespace != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed returns whether identity has access to namespace. "" is a request that can't be tied to a namespace, only
+// rules for all namespaces apply to it.
+func (a *RegistryAPI) allowed(identity, namespace, access string) bool {
+	acl := a.config().ACL
+	if len(acl) == 0 {
+		return true
+	}
+	for _, rule := range acl {
+		if ACCESS_LEVELS[rule.Access] >= ACCESS_LEVELS[access] && rule.matches(identity, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// explicitlyAllowed is allowed without the rules that cover anyone: identity itself has to be named. Without any
+// rules nobody is.
+func (a *RegistryAPI) explicitlyAllowed(identity, namespace, access string) bool {
+	if identity == "" {
+		return false
+	}
+	for _, rule := range a.config().ACL {
+		if rule.Identity == identity && ACCESS_LEVELS[rule.Access] >= ACCESS_LEVELS[access] &&
+			rule.matches(identity, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// Must wrap the router. Checks every request against the ACL: admin routes and image deletes need admin access,
+// everything else touching a repository or an image needs read access to GET it and write access to change it.
+// Images belong to no namespace: image routes are checked against the namespace of the index token the client sends
+// if it lists the image (see imageNamespace), and need a rule for all namespaces ("*") otherwise.
+// Routes that don't touch any (ping, status, users, search, the catalog, which filters itself) are open.
+func (a *RegistryAPI) Authorize(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		access, namespace, check := a.requiredAccess(router, r)
+		if check && !a.allowed(Identity(r), namespace, access) {
+			a.response(w, "Access denied", http.StatusForbidden, EMPTY_HEADERS)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
+
+// returns the access a request needs and to which namespace, or false if it needs none
+func (a *RegistryAPI) requiredAccess(router *mux.Router, r *http.Request) (string, string, bool) {
+	// deleting an image can break the tags of any namespace
+	isImageDelete := r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/v1/images/")
+	if strings.HasPrefix(r.URL.Path, "/v1/_admin/") || isImageDelete {
+		return ACCESS_ADMIN, "", true
+	}
+	access := ACCESS_WRITE
+	if r.Method == "GET" || r.Method == "HEAD" {
+		access = ACCESS_READ
+	}
+	if strings.HasPrefix(r.URL.Path, "/v1/images/") {
+		return access, a.imageNamespace(router, r, access), true
+	}
+	var match mux.RouteMatch
+	if (strings.HasPrefix(r.URL.Path, "/v1/repositories/") || strings.HasPrefix(r.URL.Path, "/v1/namespaces/")) &&
+		router.Match(r, &match) {
+		if isCopyRoute(match.Route) {
+			// copying a tag only reads the source, the handler checks the target
+			access = ACCESS_READ
+		}
+		namespace := match.Vars["namespace"]
+		if namespace == "" {
+			namespace = "library"
+		}
+		return access, namespace, true
+	}
+	return "", "", false
+}
+
+// images are shared between namespaces. a request for one belongs to the namespace of the index token it carries if
+// the repository of the token lists the image, and the token was handed out for writing if the request writes.
+// returns "" otherwise.
+func (a *RegistryAPI) imageNamespace(router *mux.Router, r *http.Request, access string) string {
+	namespace, repo, tokenAccess := a.tokenClaims(r)
+	if repo == "" || (access != ACCESS_READ && tokenAccess != ACCESS_WRITE) {
+		return ""
+	}
+	var match mux.RouteMatch
+	if !router.Match(r, &match) {
+		return ""
+	}
+	if listed, err := layers.IndexImagesContain(a.Storage, namespace, repo, match.Vars["imageID"]); err != nil || !listed {
+		return ""
+	}
+	return namespace
+}
+
+func isCopyRoute(route *mux.Route) bool {
+	return strings.HasSuffix(route.GetName(), "/tags/{tag}/copy")
+}
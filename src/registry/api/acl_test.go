@@ -0,0 +1,112 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"registry/storage"
+	"strings"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	a := newTestAPI(t, &Config{ACL: []*ACLRule{
+		{Identity: "*", Namespaces: []string{"library"}, Access: ACCESS_READ},
+		{Identity: "dev", Namespaces: []string{"team"}, Access: ACCESS_WRITE},
+		{Identity: "ci", Namespaces: []string{"*"}, Access: ACCESS_WRITE},
+		{Identity: "ops", Namespaces: []string{"*"}, Access: ACCESS_ADMIN},
+	}})
+	putTestImage(t, a, "base", "", 10)
+	putTestTag(t, a, "library", "base", "latest", "base")
+	putTestTag(t, a, "team", "app", "latest", "base")
+
+	for _, test := range []struct {
+		method, url, identity string
+		allowed               bool
+	}{
+		{"GET", "/v1/repositories/base/tags/latest", "", true},
+		{"GET", "/v1/repositories/library/base/tags/latest", "", true},
+		{"PUT", "/v1/repositories/base/tags/latest", "", false},
+		{"GET", "/v1/repositories/team/app/tags/latest", "", false},
+		{"GET", "/v1/repositories/team/app/tags/latest", "dev", true},
+		{"DELETE", "/v1/repositories/team/app/tags/latest", "dev", true},
+		{"DELETE", "/v1/repositories/library/base/tags/latest", "dev", false},
+		{"GET", "/v1/namespaces/team/repositories", "dev", true},
+		{"GET", "/v1/namespaces/other/repositories", "dev", false},
+		// images aren't tied to a namespace without a token
+		{"GET", "/v1/images/base/json", "dev", false},
+		{"GET", "/v1/images/base/json", "ci", true},
+		{"DELETE", "/v1/images/base", "ci", false},
+		{"GET", "/v1/_admin/usage", "ci", false},
+		{"GET", "/v1/_admin/usage", "ops", true},
+		{"GET", "/v1/_ping", "", true},
+	} {
+		w := serve(a, test.method, test.url, test.identity, "")
+		if (w.Code != http.StatusForbidden) != test.allowed {
+			t.Fatalf("%s %s as %q: expected allowed=%t, got %d", test.method, test.url, test.identity, test.allowed,
+				w.Code)
+		}
+	}
+}
+
+func TestAuthorizeImagesByToken(t *testing.T) {
+	a := newTestAPI(t, &Config{ACL: []*ACLRule{
+		{Identity: "dev", Namespaces: []string{"team"}, Access: ACCESS_WRITE},
+		{Identity: "reader", Namespaces: []string{"team"}, Access: ACCESS_READ},
+	}})
+	putTestImage(t, a, "base", "", 10)
+	putTestImage(t, a, "other", "", 10)
+	putTestTag(t, a, "team", "app", "latest", "base")
+	a.Storage.Put(storage.RepoIndexImagesPath("team", "app"), []byte(`[{"id":"base"}]`))
+
+	for _, test := range []struct {
+		method, url, identity, access string
+		allowed                       bool
+	}{
+		{"GET", "/v1/images/base/json", "dev", "", false},
+		{"GET", "/v1/images/base/json", "dev", "read", true},
+		{"GET", "/v1/images/base/json", "reader", "read", true},
+		// team/app doesn't list it
+		{"GET", "/v1/images/other/json", "dev", "read", false},
+		{"PUT", "/v1/images/base/json", "dev", "write", true},
+		{"PUT", "/v1/images/base/json", "dev", "read", false},
+		{"PUT", "/v1/images/base/json", "reader", "write", false},
+		{"DELETE", "/v1/images/base", "dev", "write", false},
+	} {
+		r := httptest.NewRequest(test.method, test.url, strings.NewReader(""))
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: test.identity}}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		if test.access != "" {
+			r.Header.Set("Authorization", a.IndexHeaders(r, "team", "app", test.access)["X-Docker-Token"][0])
+		}
+		w := httptest.NewRecorder()
+		a.Authorize(a.Router(ROUTE_GROUPS)).ServeHTTP(w, r)
+		if (w.Code != http.StatusForbidden) != test.allowed {
+			t.Fatalf("%s %s as %q with a %q token: expected allowed=%t, got %d", test.method, test.url,
+				test.identity, test.access, test.allowed, w.Code)
+		}
+	}
+}
+
+func TestTokenRepo(t *testing.T) {
+	a := newTestAPI(t, &Config{})
+	r := httptest.NewRequest("GET", "/v1/images/base/json", nil)
+	token := a.IndexHeaders(r, "team", "app", "write")["X-Docker-Token"][0]
+	r.Header.Set("Authorization", token)
+	if namespace, repo := a.tokenRepo(r); namespace != "team" || repo != "app" {
+		t.Fatalf("Expected team/app from a signed token, got %s/%s", namespace, repo)
+	}
+	for _, forged := range []string{
+		`Token signature=FAKESIGNATURE123,repository="team/app",access=write`,
+		`Token repository="team/app"`,
+		token[:len(token)-len("write")] + "read",
+		newTestAPI(t, &Config{}).IndexHeaders(r, "team", "app", "write")["X-Docker-Token"][0],
+	} {
+		r.Header.Set("Authorization", forged)
+		if namespace, repo := a.tokenRepo(r); namespace != "" || repo != "" {
+			t.Fatalf("Expected no repository from %s, got %s/%s", forged, namespace, repo)
+		}
+	}
+}
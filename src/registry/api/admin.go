@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net/http"
+	"registry/layers"
+	"registry/logger"
+	"sync"
+	"time"
+)
+
+// how long an image may stay marked as in progress before fsck considers the upload abandoned
+const FSCK_STALE_AFTER = 24 * time.Hour
+
+// the last fsck started through the admin endpoint. it hashes every layer, so it runs in the background and the
+// endpoint reports how it is going.
+type fsckJob struct {
+	sync.Mutex
+	status *FsckStatus
+}
+
+type FsckStatus struct {
+	Running  bool               `json:"running"`
+	Repair   bool               `json:"repair"`
+	Started  time.Time          `json:"started"`
+	Finished *time.Time         `json:"finished,omitempty"`
+	Report   *layers.FsckReport `json:"report,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// GET reports on the last run. POST starts one (?repair=true to repair what it finds, ?stale_after=<duration> for
+// uploads to count as abandoned) and answers 202 right away, or 409 if one is still running. Repairs are refused while
+// the registry is read-only.
+func (a *RegistryAPI) FsckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		a.fsck.Lock()
+		defer a.fsck.Unlock()
+		if a.fsck.status == nil {
+			a.response(w, "No fsck was started", http.StatusNotFound, EMPTY_HEADERS)
+			return
+		}
+		a.response(w, a.fsck.status, http.StatusOK, EMPTY_HEADERS)
+		return
+	}
+	fsck := &layers.Fsck{
+		Storage:    a.Storage,
+		Repair:     r.URL.Query().Get("repair") == "true",
+		StaleAfter: FSCK_STALE_AFTER,
+	}
+	if fsck.Repair && a.IsReadOnly() {
+		a.readOnlyResponse(w)
+		return
+	}
+	if stale := r.URL.Query().Get("stale_after"); stale != "" {
+		duration, err := time.ParseDuration(stale)
+		if err != nil {
+			a.response(w, "Invalid stale_after: "+err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
+			return
+		}
+		fsck.StaleAfter = duration
+	}
+	a.fsck.Lock()
+	defer a.fsck.Unlock()
+	if a.fsck.status != nil && a.fsck.status.Running {
+		a.response(w, a.fsck.status, http.StatusConflict, EMPTY_HEADERS)
+		return
+	}
+	status := &FsckStatus{Running: true, Repair: fsck.Repair, Started: time.Now().UTC()}
+	a.fsck.status = status
+	go func() {
+		report, err := fsck.Run()
+		finished := time.Now().UTC()
+		a.fsck.Lock()
+		defer a.fsck.Unlock()
+		status.Running, status.Finished, status.Report = false, &finished, report
+		if err != nil {
+			logger.Error("[Fsck] %s", err.Error())
+			status.Error = err.Error()
+		}
+	}()
+	a.response(w, status, http.StatusAccepted, EMPTY_HEADERS)
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"registry/storage"
+	"testing"
+	"time"
+)
+
+func TestFsckJob(t *testing.T) {
+	a := newTestAPI(t, &Config{})
+	putTestTag(t, a, "team", "app", "v1", "missing")
+
+	checkStatus(t, serve(a, "GET", "/v1/_admin/fsck", "", ""), http.StatusNotFound)
+	checkStatus(t, serve(a, "POST", "/v1/_admin/fsck?repair=true", "", ""), http.StatusAccepted)
+	status := waitForFsck(t, a)
+	if status.Running || status.Report == nil || len(status.Report.Problems) != 1 ||
+		!status.Report.Problems[0].Repaired {
+		t.Fatalf("Expected the tag on a missing image to be repaired, got %+v", status)
+	}
+	if exists, _ := a.Storage.Exists(storage.RepoTagPath("team", "app", "v1")); exists {
+		t.Fatal("Expected the tag to be removed")
+	}
+}
+
+// returns the status of the fsck started last, once it is done
+func waitForFsck(t *testing.T, a *RegistryAPI) *FsckStatus {
+	var status FsckStatus
+	for i := 0; i < 100; i++ {
+		w := serve(a, "GET", "/v1/_admin/fsck", "", "")
+		checkStatus(t, w, http.StatusOK)
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if !status.Running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return &status
+}
+
+func TestFsckReadOnly(t *testing.T) {
+	a := newTestAPI(t, &Config{ReadOnly: true})
+	putTestTag(t, a, "team", "app", "v1", "missing")
+	checkStatus(t, serve(a, "POST", "/v1/_admin/fsck?repair=true", "", ""), http.StatusServiceUnavailable)
+	// checking is what read-only mode is for
+	checkStatus(t, serve(a, "POST", "/v1/_admin/fsck", "", ""), http.StatusAccepted)
+	if status := waitForFsck(t, a); status.Running || status.Report == nil || len(status.Report.Problems) != 1 ||
+		status.Report.Problems[0].Repaired {
+		t.Fatalf("Expected the tag on a missing image to be reported only, got %+v", status)
+	}
+}
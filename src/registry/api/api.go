@@ -1,38 +1,161 @@
 package api
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
-	"github.com/cespare/go-apachelog"
 	"github.com/gorilla/mux"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"registry/audit"
+	"registry/layers"
+	"registry/logger"
 	"registry/storage"
+	"registry/webhooks"
+	"sync"
 )
 
 var USER_AGENT_REGEXP = regexp.MustCompile("([^\\s/]+)/([^\\s/]+)")
+
+// names that come from a request body rather than a route, which can't contain "/" anyway
+var REPO_NAME_REGEXP = regexp.MustCompile("^[a-z0-9_.-]+$")
+var TAG_NAME_REGEXP = regexp.MustCompile("^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$")
 var EMPTY_HEADERS = map[string][]string{}
 
 type Config struct {
 	Addr           string              `json:"addr"`
 	DefaultHeaders map[string][]string `json:"default_headers"`
+	// keyed by namespace, "*" applies to namespaces without their own policy
+	LayerPolicies map[string]*layers.Policy `json:"layer_policies"`
+	// start in read-only mode. it can be switched at runtime through /v1/_admin/read_only
+	ReadOnly bool `json:"read_only"`
+	// seconds clients are told to wait before retrying a write while read-only
+	ReadOnlyRetryAfter int `json:"read_only_retry_after"`
+	// seconds to wait for running requests on shutdown
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// serve on these instead of Addr
+	Listeners []*ListenerConfig `json:"listeners"`
+	// serve HTTPS instead of HTTP on Addr, and on listeners that ask for it
+	TLS *TLSConfig `json:"tls"`
+	ACL []*ACLRule `json:"acl"`
+	// notify HTTP endpoints of pushes, tags and deletes
+	Webhooks *webhooks.Config `json:"webhooks"`
+	// tag patterns (path.Match globs) that can't be moved or deleted once pushed, keyed by namespace or
+	// namespace/repo. patterns under "*" apply to every repository.
+	ImmutableTags map[string][]string `json:"immutable_tags"`
+	// keyed by namespace, "*" applies to namespaces without their own quota
+	Quotas map[string]*Quota `json:"quotas"`
+	// delete old tags, see RetentionConfig
+	Retention *RetentionConfig `json:"retention"`
+	// record mutating requests in the audit log, see /v1/_admin/audit. while read-only they are only logged.
+	Audit bool `json:"audit"`
+	// names the audit chain of this instance, the hostname if unset. instances sharing a storage need different ones.
+	// only takes effect on restart.
+	Instance string `json:"instance"`
+	// signs the tokens handed out by the index routes. instances behind the same load balancer need the same one,
+	// without it every start picks a random one, and pushes in progress fail once it changes. required with a
+	// storage that can be shared (s3, tiered).
+	TokenSecret string `json:"token_secret"`
 }
 
 type RegistryAPI struct {
-	*Config
+	*Config // read it through config(), it is swapped on reload
 	Storage storage.Storage
+
+	notifier   *webhooks.Notifier
+	audit      *audit.Log
+	usage      *layers.UsageTracker
+	configLock sync.RWMutex
+	tls        tlsState
+	dedupCache dedupStatsCache
+	fsck       fsckJob
+	readOnly   int32 // accessed atomically
+	tokenKey   []byte
+
+	listenerLock sync.Mutex
+	servers      []*http.Server
+	shuttingDown int32 // accessed atomically
 }
 
 func New(cfg *Config, storage storage.Storage) *RegistryAPI {
-	return &RegistryAPI{Config: cfg, Storage: storage}
+	a := &RegistryAPI{Config: cfg, Storage: storage, notifier: webhooks.New(cfg.Webhooks),
+		usage: layers.NewUsageTracker(storage), tokenKey: []byte(cfg.TokenSecret)}
+	instance := cfg.Instance
+	if instance == "" {
+		if instance, _ = os.Hostname(); instance == "" {
+			instance = "registry"
+		}
+	}
+	a.audit = audit.NewLog(storage, instance)
+	a.usage.ReadOnly = a.IsReadOnly
+	if cfg.TokenSecret == "" {
+		logger.Error("[Config] no token_secret, signing index tokens with a random key: tokens are only valid on " +
+			"this instance until it restarts")
+		a.tokenKey = make([]byte, 32)
+		rand.Read(a.tokenKey)
+	}
+	a.SetReadOnly(cfg.ReadOnly)
+	return a
+}
+
+func (a *RegistryAPI) config() *Config {
+	a.configLock.RLock()
+	defer a.configLock.RUnlock()
+	return a.Config
 }
 
-func (a *RegistryAPI) ListenAndServe() error {
+// SetConfig swaps in a new config while serving. Addr and Listeners only take effect on restart. ReadOnly is only
+// applied if it changed, so a reload doesn't undo a switch made through the admin endpoint.
+func (a *RegistryAPI) SetConfig(cfg *Config) {
+	a.configLock.Lock()
+	defer a.configLock.Unlock()
+	if cfg.ReadOnly != a.Config.ReadOnly {
+		a.SetReadOnly(cfg.ReadOnly)
+	}
+	a.notifier.SetConfig(cfg.Webhooks)
+	a.Config = cfg
+}
+
+// Router returns a router serving the given route groups
+func (a *RegistryAPI) Router(routes []string) *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/", a.HomeHandler)
+	// in this order, the registry routes take precedence over the index routes
+	for _, group := range ROUTE_GROUPS {
+		if !stringInSlice(group, routes) {
+			continue
+		}
+		switch group {
+		case ROUTES_STATUS:
+			a.statusRoutes(r)
+		case ROUTES_REGISTRY:
+			a.registryRoutes(r)
+		case ROUTES_INDEX:
+			a.indexRoutes(r)
+		case ROUTES_ADMIN:
+			a.adminRoutes(r)
+		case ROUTES_METRICS:
+			handle(r, "/metrics", a.MetricsHandler, "GET")
+		}
+	}
+	return r
+}
+
+// registers a route named after its path template, restricted to methods if any are given. mux can't give the
+// template or the methods of a route back, and the metrics and the audit log label requests with them (see
+// routeTemplate and methodLabel).
+func handle(r *mux.Router, template string, handler http.HandlerFunc, methods ...string) *mux.Route {
+	route := r.HandleFunc(template, handler).Name(template)
+	if len(methods) > 0 {
+		route.Methods(methods...)
+		routeMethods.add(template, methods)
+	}
+	return route
+}
+
+func (a *RegistryAPI) statusRoutes(r *mux.Router) {
+	handle(r, "/", a.HomeHandler)
 
 	//
 	// Registry APIs (http://docs.docker.io/en/latest/reference/api/registry_api/)
@@ -40,94 +163,126 @@ func (a *RegistryAPI) ListenAndServe() error {
 
 	// http://docs.docker.io/en/latest/reference/api/registry_api/#status
 	// Documented and implemented in docker-registry 0.6.5
-	r.HandleFunc("/_ping", a.PingHandler)
-	r.HandleFunc("/v1/_ping", a.PingHandler)
+	handle(r, "/_ping", a.PingHandler)
+	handle(r, "/v1/_ping", a.PingHandler)
 	// Undocumented but implemented in docker-registry 0.6.5
-	r.HandleFunc("/_status", a.StatusHandler)
-	r.HandleFunc("/v1/_status", a.StatusHandler)
+	handle(r, "/_status", a.StatusHandler)
+	handle(r, "/v1/_status", a.StatusHandler)
+}
 
+func (a *RegistryAPI) registryRoutes(r *mux.Router) {
 	// http://docs.docker.io/en/latest/reference/api/registry_api/#images
 	// Documented and implemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/images/{imageID}/layer", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageLayerHandler))).Methods("GET")
-	r.HandleFunc("/v1/images/{imageID}/layer", a.PutImageLayerHandler).Methods("PUT")
-	r.HandleFunc("/v1/images/{imageID}/json", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageJsonHandler))).Methods("GET")
-	r.HandleFunc("/v1/images/{imageID}/json", a.PutImageJsonHandler).Methods("PUT")
-	r.HandleFunc("/v1/images/{imageID}/ancestry", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageAncestryHandler))).Methods("GET")
+	handle(r, "/v1/images/{imageID}/layer", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageLayerHandler)), "GET")
+	handle(r, "/v1/images/{imageID}/layer", a.RequireWritable(a.PutImageLayerHandler), "PUT")
+	handle(r, "/v1/images/{imageID}/json", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageJsonHandler)), "GET")
+	handle(r, "/v1/images/{imageID}/json", a.RequireWritable(a.PutImageJsonHandler), "PUT")
+	handle(r, "/v1/images/{imageID}/ancestry", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageAncestryHandler)), "GET")
 	// Undocumented but implemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/images/{imageID}/checksum", a.PutImageChecksumHandler).Methods("PUT")
-	r.HandleFunc("/v1/images/{imageID}/files", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageFilesHandler))).Methods("GET")
-	r.HandleFunc("/v1/images/{imageID}/diff", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageDiffHandler))).Methods("GET")
+	handle(r, "/v1/images/{imageID}/checksum", a.RequireWritable(a.PutImageChecksumHandler), "PUT")
+	handle(r, "/v1/images/{imageID}/files", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageFilesHandler)), "GET")
+	handle(r, "/v1/images/{imageID}/diff", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageDiffHandler)), "GET")
+	// Undocumented and unimplemented (additional)
+	handle(r, "/v1/images/{imageID}", a.RequireWritable(a.DeleteImageHandler), "DELETE")
 
 	// http://docs.docker.io/en/latest/reference/api/registry_api/#tags
 	// Documented and implemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/repositories/{repo}/tags", a.GetRepoTagsHandler).Methods("GET")
-	r.HandleFunc("/v1/repositories/{repo}/tags/{tag}", a.GetRepoTagHandler).Methods("GET")
-	r.HandleFunc("/v1/repositories/{repo}/tags/{tag}", a.PutRepoTagHandler).Methods("PUT")
-	r.HandleFunc("/v1/repositories/{repo}/tags/{tag}", a.DeleteRepoTagHandler).Methods("DELETE")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags", a.GetRepoTagsHandler).Methods("GET")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags/{tag}", a.GetRepoTagHandler).Methods("GET")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags/{tag}/json", a.GetRepoTagJsonHandler).Methods("GET")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags/{tag}", a.PutRepoTagHandler).Methods("PUT")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags/{tag}", a.DeleteRepoTagHandler).Methods("DELETE")
+	handle(r, "/v1/repositories/{repo}/tags", a.GetRepoTagsHandler, "GET")
+	handle(r, "/v1/repositories/{repo}/tags/{tag}", a.GetRepoTagHandler, "GET")
+	handle(r, "/v1/repositories/{repo}/tags/{tag}", a.RequireWritable(a.PutRepoTagHandler), "PUT")
+	handle(r, "/v1/repositories/{repo}/tags/{tag}", a.RequireWritable(a.DeleteRepoTagHandler), "DELETE")
+	handle(r, "/v1/repositories/{namespace}/{repo}/tags", a.GetRepoTagsHandler, "GET")
+	handle(r, "/v1/repositories/{namespace}/{repo}/tags/{tag}", a.GetRepoTagHandler, "GET")
+	handle(r, "/v1/repositories/{namespace}/{repo}/tags/{tag}/json", a.GetRepoTagJsonHandler, "GET")
+	handle(r, "/v1/repositories/{namespace}/{repo}/tags/{tag}", a.RequireWritable(a.PutRepoTagHandler), "PUT")
+	handle(r, "/v1/repositories/{namespace}/{repo}/tags/{tag}", a.RequireWritable(a.DeleteRepoTagHandler), "DELETE")
+	// Undocumented and unimplemented (additional)
+	handle(r, "/v1/repositories/{repo}/tags/{tag}/history", a.GetRepoTagHistoryHandler, "GET")
+	handle(r, "/v1/repositories/{repo}/tags/{tag}/rollback", a.RequireWritable(a.RollbackRepoTagHandler), "POST")
+	handle(r, "/v1/repositories/{namespace}/{repo}/tags/{tag}/history", a.GetRepoTagHistoryHandler, "GET")
+	handle(r, "/v1/repositories/{namespace}/{repo}/tags/{tag}/rollback", a.RequireWritable(a.RollbackRepoTagHandler), "POST")
+	handle(r, "/v1/repositories/{repo}/tags/{tag}/copy", a.RequireWritable(a.CopyRepoTagHandler), "POST")
+	handle(r, "/v1/repositories/{namespace}/{repo}/tags/{tag}/copy", a.RequireWritable(a.CopyRepoTagHandler), "POST")
+	handle(r, "/v1/repositories/{repo}/tags/{tag}/export", a.ExportRepoTagHandler, "GET")
+	handle(r, "/v1/repositories/{namespace}/{repo}/tags/{tag}/export", a.ExportRepoTagHandler, "GET")
 	// Undocumented but implemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/repositories/{repo}/tags", a.DeleteRepoTagsHandler).Methods("DELETE")
-	r.HandleFunc("/v1/repositories/{repo}/json", a.GetRepoJsonHandler).Methods("GET")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags", a.DeleteRepoTagsHandler).Methods("DELETE")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/json", a.GetRepoJsonHandler).Methods("GET")
+	handle(r, "/v1/repositories/{repo}/tags", a.RequireWritable(a.DeleteRepoTagsHandler), "DELETE")
+	handle(r, "/v1/repositories/{repo}/json", a.GetRepoJsonHandler, "GET")
+	handle(r, "/v1/repositories/{namespace}/{repo}/tags", a.RequireWritable(a.DeleteRepoTagsHandler), "DELETE")
+	handle(r, "/v1/repositories/{namespace}/{repo}/json", a.GetRepoJsonHandler, "GET")
 	// Documented and unimplemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/repositories/{repo}/", a.DeleteRepoHandler).Methods("DELETE")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/", a.DeleteRepoHandler).Methods("DELETE")
+	handle(r, "/v1/repositories/{repo}/", a.RequireWritable(a.DeleteRepoHandler), "DELETE")
+	handle(r, "/v1/repositories/{namespace}/{repo}/", a.RequireWritable(a.DeleteRepoHandler), "DELETE")
+	// Undocumented and unimplemented (additional)
+	handle(r, "/v1/repositories/{repo}", a.RequireWritable(a.DeleteRepoHandler), "DELETE")
+	handle(r, "/v1/repositories/{namespace}/{repo}", a.RequireWritable(a.DeleteRepoHandler), "DELETE")
+
 	// Undocumented and unimplemented (additional)
-	r.HandleFunc("/v1/repositories/{repo}", a.DeleteRepoHandler).Methods("DELETE")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}", a.DeleteRepoHandler).Methods("DELETE")
+	handle(r, "/v1/_catalog", a.CatalogHandler, "GET")
+	handle(r, "/v1/namespaces/{namespace}/repositories", a.NamespaceRepositoriesHandler, "GET")
 
 	// Unused (for private images)
-	//r.HandleFunc("/v1/private_images/{imageID}/layer", a.GetPrivateImageLayerHandler).Methods("GET")
-	//r.HandleFunc("/v1/private_images/{imageID}/json", a.GetPrivateImageJsonHandler).Methods("GET")
-	//r.HandleFunc("/v1/private_images/{imageID}/files", a.GetPrivateImageFilesHandler).Methods("GET")
-	//r.HandleFunc("/v1/repositories/{repo}/properties", a.GetRepoPropertiesHandler).Methods("GET")
-	//r.HandleFunc("/v1/repositories/{repo}/properties", a.PutRepoPropertiesHandler).Methods("PUT")
-	//r.HandleFunc("/v1/repositories/{namespace}/{repo}/properties", a.GetRepoPropertiesHandler).Methods("GET")
-	//r.HandleFunc("/v1/repositories/{namespace}/{repo}/properties", a.PutRepoPropertiesHandler).Methods("PUT")
+	//handle(r, "/v1/private_images/{imageID}/layer", a.GetPrivateImageLayerHandler, "GET")
+	//handle(r, "/v1/private_images/{imageID}/json", a.GetPrivateImageJsonHandler, "GET")
+	//handle(r, "/v1/private_images/{imageID}/files", a.GetPrivateImageFilesHandler, "GET")
+	//handle(r, "/v1/repositories/{repo}/properties", a.GetRepoPropertiesHandler, "GET")
+	//handle(r, "/v1/repositories/{repo}/properties", a.PutRepoPropertiesHandler, "PUT")
+	//handle(r, "/v1/repositories/{namespace}/{repo}/properties", a.GetRepoPropertiesHandler, "GET")
+	//handle(r, "/v1/repositories/{namespace}/{repo}/properties", a.PutRepoPropertiesHandler, "PUT")
+}
 
+func (a *RegistryAPI) indexRoutes(r *mux.Router) {
 	//
 	// Index APIs (http://docs.docker.io/en/latest/reference/api/index_api/)
 	//
 
 	// http://docs.docker.io/en/latest/reference/api/index_api/#users
 	// Documented and implemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/users", a.LoginHandler).Methods("GET")
-	r.HandleFunc("/v1/users", a.CreateUserHandler).Methods("POST")
-	r.HandleFunc("/v1/users/", a.LoginHandler).Methods("GET")
-	r.HandleFunc("/v1/users/", a.CreateUserHandler).Methods("POST")
-	r.HandleFunc("/v1/users/{username}/", a.UpdateUserHandler).Methods("PUT")
+	handle(r, "/v1/users", a.LoginHandler, "GET")
+	handle(r, "/v1/users", a.CreateUserHandler, "POST")
+	handle(r, "/v1/users/", a.LoginHandler, "GET")
+	handle(r, "/v1/users/", a.CreateUserHandler, "POST")
+	handle(r, "/v1/users/{username}/", a.UpdateUserHandler, "PUT")
 
 	// http://docs.docker.io/en/latest/reference/api/index_api/#repository
 	// Documented and implemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/repositories/{repo}/", a.PutRepoHandler).Methods("PUT")
-	r.HandleFunc("/v1/repositories/{repo}/images", a.GetRepoImagesHandler).Methods("GET")
-	r.HandleFunc("/v1/repositories/{repo}/images", a.PutRepoImagesHandler).Methods("PUT")
-	r.HandleFunc("/v1/repositories/{repo}/auth", a.PutRepoAuthHandler).Methods("PUT")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/", a.PutRepoHandler).Methods("PUT")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/images", a.GetRepoImagesHandler).Methods("GET")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/images", a.PutRepoImagesHandler).Methods("PUT")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/auth", a.PutRepoAuthHandler).Methods("PUT")
+	handle(r, "/v1/repositories/{repo}/", a.RequireWritable(a.PutRepoHandler), "PUT")
+	handle(r, "/v1/repositories/{repo}/images", a.GetRepoImagesHandler, "GET")
+	handle(r, "/v1/repositories/{repo}/images", a.RequireWritable(a.PutRepoImagesHandler), "PUT")
+	handle(r, "/v1/repositories/{repo}/auth", a.PutRepoAuthHandler, "PUT")
+	handle(r, "/v1/repositories/{namespace}/{repo}/", a.RequireWritable(a.PutRepoHandler), "PUT")
+	handle(r, "/v1/repositories/{namespace}/{repo}/images", a.GetRepoImagesHandler, "GET")
+	handle(r, "/v1/repositories/{namespace}/{repo}/images", a.RequireWritable(a.PutRepoImagesHandler), "PUT")
+	handle(r, "/v1/repositories/{namespace}/{repo}/auth", a.PutRepoAuthHandler, "PUT")
 	// Undocumented but implemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/repositories/{repo}", a.PutRepoHandler).Methods("PUT")
-	r.HandleFunc("/v1/repositories/{repo}/images", a.DeleteRepoImagesHandler).Methods("DELETE")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}", a.PutRepoHandler).Methods("PUT")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/images", a.DeleteRepoImagesHandler).Methods("DELETE")
+	handle(r, "/v1/repositories/{repo}", a.RequireWritable(a.PutRepoHandler), "PUT")
+	handle(r, "/v1/repositories/{repo}/images", a.RequireWritable(a.DeleteRepoImagesHandler), "DELETE")
+	handle(r, "/v1/repositories/{namespace}/{repo}", a.RequireWritable(a.PutRepoHandler), "PUT")
+	handle(r, "/v1/repositories/{namespace}/{repo}/images", a.RequireWritable(a.DeleteRepoImagesHandler), "DELETE")
 
 	// http://docs.docker.io/en/latest/reference/api/index_api/#search
 	// Documented and implemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/search", a.SearchHandler).Methods("GET")
+	handle(r, "/v1/search", a.SearchHandler, "GET")
+}
+
+func (a *RegistryAPI) adminRoutes(r *mux.Router) {
+	//
+	// Admin APIs (additional)
+	//
 
-	log.Printf("Listening on %s", a.Config.Addr)
-	return http.ListenAndServe(a.Config.Addr, apachelog.NewHandler(r, os.Stderr))
+	// refuses to repair while read-only, checking is fine
+	handle(r, "/v1/_admin/fsck", a.FsckHandler, "GET", "POST")
+	handle(r, "/v1/_admin/read_only", a.ReadOnlyHandler, "GET", "PUT")
+	handle(r, "/v1/_admin/retention", a.RetentionHandler, "GET")
+	handle(r, "/v1/_admin/retention", a.RequireWritable(a.RetentionHandler), "POST")
+	handle(r, "/v1/_admin/usage", a.UsageHandler, "GET")
+	handle(r, "/v1/_admin/usage", a.RequireWritable(a.UsageHandler), "POST")
+	handle(r, "/v1/_admin/audit", a.AuditHandler, "GET")
+	handle(r, "/v1/_admin/audit/verify", a.AuditVerifyHandler, "GET")
 }
 
 func (a *RegistryAPI) response(w http.ResponseWriter, data interface{}, code int, headers map[string][]string) {
-	for name, values := range a.Config.DefaultHeaders {
+	for name, values := range a.config().DefaultHeaders {
 		w.Header()[name] = append(w.Header()[name], values...)
 	}
 	for name, values := range headers {
@@ -147,7 +302,8 @@ func (a *RegistryAPI) response(w http.ResponseWriter, data interface{}, code int
 		w.WriteHeader(code)
 		if code >= 400 {
 			// if error, jsonify
-			w.Write([]byte("{\"error\":\"" + typedData + "\"}"))
+			encoded, _ := json.Marshal(map[string]string{"error": typedData})
+			w.Write(encoded)
 		} else {
 			w.Write([]byte(typedData))
 		}
@@ -177,6 +333,26 @@ func NotImplementedHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Not Implemented", http.StatusNotImplemented)
 }
 
+// sends event to the webhooks, filling in who made the request
+func (a *RegistryAPI) notify(r *http.Request, event *webhooks.Event) {
+	event.Actor = Identity(r)
+	event.RequestID = logger.RequestID(r.Context())
+	a.notifier.Notify(event)
+}
+
+func (a *RegistryAPI) layerPolicy(namespace string) *layers.Policy {
+	cfg := a.config()
+	if policy, ok := cfg.LayerPolicies[namespace]; ok {
+		return policy
+	}
+	return cfg.LayerPolicies["*"]
+}
+
+// returns whether name can be used as a namespace or repository name in a storage path
+func validRepoName(name string) bool {
+	return REPO_NAME_REGEXP.MatchString(name) && name != "." && name != ".."
+}
+
 func parseRepo(r *http.Request, extra string) (string, string, string) {
 	vars := mux.Vars(r)
 	namespace := vars["namespace"]
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http/httptest"
+	"registry/storage"
+	"strings"
+	"testing"
+)
+
+func newTestAPI(t *testing.T, cfg *Config) *RegistryAPI {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(cfg, s)
+}
+
+// serves a request through the router and the ACL, as identity ("" for an anonymous client)
+func serve(a *RegistryAPI, method, url, identity, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	if identity != "" {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: identity}}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	w := httptest.NewRecorder()
+	a.Authorize(a.Router(ROUTE_GROUPS)).ServeHTTP(w, r)
+	return w
+}
+
+func checkStatus(t *testing.T, w *httptest.ResponseRecorder, expected int) {
+	if w.Code != expected {
+		t.Fatalf("Expected status %d, got %d: %s", expected, w.Code, w.Body.String())
+	}
+}
+
+// stores a complete image with a layer of size bytes
+func putTestImage(t *testing.T, a *RegistryAPI, imageID, parentID string, size int) {
+	ancestry := []string{imageID}
+	if parentID != "" {
+		parentAncestry := []string{}
+		content, err := a.Storage.Get(storage.ImageAncestryPath(parentID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.Unmarshal(content, &parentAncestry)
+		ancestry = append(ancestry, parentAncestry...)
+	}
+	ancestryJson, _ := json.Marshal(ancestry)
+	imageJson, _ := json.Marshal(map[string]string{"id": imageID, "parent": parentID})
+	for key, content := range map[string][]byte{
+		storage.ImageJsonPath(imageID):     imageJson,
+		storage.ImageAncestryPath(imageID): ancestryJson,
+		storage.ImageLayerPath(imageID):    make([]byte, size),
+	} {
+		if err := a.Storage.Put(key, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func putTestTag(t *testing.T, a *RegistryAPI, namespace, repo, tag, imageID string) {
+	if err := a.Storage.Put(storage.RepoTagPath(namespace, repo, tag), []byte(imageID)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	a := newTestAPI(t, &Config{})
+	w := httptest.NewRecorder()
+	a.response(w, `Tag "latest" not found`, 404, EMPTY_HEADERS)
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Invalid json error %s: %s", w.Body.String(), err.Error())
+	}
+	if body["error"] != `Tag "latest" not found` {
+		t.Fatalf("Unexpected error %q", body["error"])
+	}
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"net/http"
+	"registry/audit"
+	"registry/logger"
+	"registry/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Must wrap the router (handler is the router, possibly wrapped). Records every request that may change something in
+// the audit log, including the ones that were refused.
+func (a *RegistryAPI) Audit(router *mux.Router, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.config().Audit || r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		target := a.requestTarget(router, r)
+		start := time.Now().UTC()
+		entry := &audit.Entry{
+			RequestTime: &start,
+			Identity:    Identity(r),
+			RemoteAddr:  r.RemoteAddr,
+			UserAgent:   r.UserAgent(),
+			RequestID:   logger.RequestID(r.Context()),
+			Method:      r.Method,
+			Route:       routeTemplate(router, r),
+			Path:        r.URL.RequestURI(),
+			Namespace:   target["namespace"],
+			Repo:        target["repo"],
+			Tag:         target["tag"],
+			ImageID:     target["image_id"],
+		}
+		if namespace, repo := a.tokenRepo(r); repo != "" {
+			entry.Token = namespace + "/" + repo
+		}
+
+		// the handler fills in what it changed, see auditTag and auditRepo
+		ctx := context.WithValue(r.Context(), auditKey{}, &auditRecord{entry: entry})
+		recorder := &responseRecorder{ResponseWriter: w}
+		// whether the request could change anything is up to the mode it was served in. switching the mode is
+		// always recorded, whichever way it goes.
+		readOnly := a.IsReadOnly() && entry.Route != "/v1/_admin/read_only"
+		handler.ServeHTTP(recorder, r.WithContext(ctx))
+		entry.Status = recorder.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		if readOnly {
+			// the storage is left untouched, including the log
+			logger.ForRequest(r.Context()).Info("[Audit] read-only, not recorded: %s %s %d", r.Method, entry.Path,
+				entry.Status)
+			return
+		}
+		if err := a.audit.Append(entry); err != nil {
+			logger.ForRequest(r.Context()).Error("[Audit] error recording %s %s: %s", r.Method, entry.Path, err.Error())
+		}
+	})
+}
+
+type auditKey struct{}
+
+// the audit entry of a request, carried in its context
+type auditRecord struct {
+	entry  *audit.Entry
+	tagged bool
+}
+
+// records in the audit entry of r, if it is audited, that tag moved from oldTarget to newTarget ("" for none).
+// handlers call it with the lock of the tag held, so the targets are what the request actually changed. only the
+// first change is recorded: a move records the tag it created rather than the source it removed.
+func auditTag(r *http.Request, namespace, repo, tag, oldTarget, newTarget string) {
+	record, ok := r.Context().Value(auditKey{}).(*auditRecord)
+	if !ok || record.tagged {
+		return
+	}
+	record.tagged = true
+	record.entry.Namespace, record.entry.Repo, record.entry.Tag = namespace, repo, tag
+	record.entry.OldTarget, record.entry.NewTarget = oldTarget, newTarget
+}
+
+// records in the audit entry of r, if it is audited, the tags a request removing them all found
+func auditRepo(r *http.Request, oldTags map[string]string) {
+	if record, ok := r.Context().Value(auditKey{}).(*auditRecord); ok {
+		record.entry.OldTags = oldTags
+	}
+}
+
+// returns the image id tag points to, "" if it doesn't exist
+func (a *RegistryAPI) tagTarget(namespace, repo, tag string) string {
+	content, err := a.Storage.Get(storage.RepoTagPath(namespace, repo, tag))
+	if err != nil {
+		return ""
+	}
+	return string(content)
+}
+
+// GET /v1/_admin/audit?namespace=...&repo=...&since=...&until=...&limit=...
+// All filters are optional. Times are RFC 3339, repo may include the namespace.
+func (a *RegistryAPI) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := &audit.Query{Namespace: params.Get("namespace"), Repo: params.Get("repo")}
+	if parts := strings.SplitN(query.Repo, "/", 2); len(parts) == 2 {
+		query.Namespace, query.Repo = parts[0], parts[1]
+	}
+	for name, value := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if param := params.Get(name); param != "" {
+			parsed, err := time.Parse(time.RFC3339, param)
+			if err != nil {
+				a.response(w, "Invalid "+name+": "+err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
+				return
+			}
+			*value = parsed
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 0 {
+			a.response(w, "Invalid limit: "+limit, http.StatusBadRequest, EMPTY_HEADERS)
+			return
+		}
+		query.Limit = parsed
+	}
+	entries, err := audit.Find(a.Storage, query)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	a.response(w, entries, http.StatusOK, EMPTY_HEADERS)
+}
+
+// checks that no entry was removed from or modified in the audit log
+func (a *RegistryAPI) AuditVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := audit.Verify(a.Storage)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	a.response(w, report, http.StatusOK, EMPTY_HEADERS)
+}
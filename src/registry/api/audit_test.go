@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"registry/audit"
+	"strings"
+	"testing"
+)
+
+func TestAuditCopyRepoTag(t *testing.T) {
+	a := newTestAPI(t, &Config{Audit: true})
+	putTestImage(t, a, "1", "", 10)
+	putTestImage(t, a, "2", "", 10)
+	putTestTag(t, a, "team", "app", "v1", "1")
+	putTestTag(t, a, "prod", "app", "v1", "2")
+
+	router := a.Router(ROUTE_GROUPS)
+	for _, body := range []string{`{"namespace":"prod"}`, `{"tag":"v2","move":true}`} {
+		r := httptest.NewRequest("POST", "/v1/repositories/team/app/tags/v1/copy", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		a.Audit(router, router).ServeHTTP(w, r)
+		checkStatus(t, w, http.StatusOK)
+	}
+	entries, err := audit.Find(a.Storage, &audit.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %+v", entries)
+	}
+	// the target of the copy, not the source of the route
+	if e := entries[0]; e.Namespace != "prod" || e.Tag != "v1" || e.OldTarget != "2" || e.NewTarget != "1" {
+		t.Fatalf("Expected prod/app:v1 to move from 2 to 1, got %+v", e)
+	}
+	if e := entries[1]; e.Namespace != "team" || e.Tag != "v2" || e.OldTarget != "" || e.NewTarget != "1" {
+		t.Fatalf("Expected team/app:v2 to be created on 1, got %+v", e)
+	}
+}
+
+func TestAuditReadOnlySwitch(t *testing.T) {
+	a := newTestAPI(t, &Config{Audit: true})
+	router := a.Router(ROUTE_GROUPS)
+	for _, body := range []string{`{"read_only":true}`, `{"read_only":false}`} {
+		r := httptest.NewRequest("PUT", "/v1/_admin/read_only", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		a.Audit(router, router).ServeHTTP(w, r)
+		checkStatus(t, w, http.StatusOK)
+	}
+	entries, err := audit.Find(a.Storage, &audit.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Path != "/v1/_admin/read_only" || entries[1].Path != "/v1/_admin/read_only" {
+		t.Fatalf("Expected both switches to be recorded, got %+v", entries)
+	}
+}
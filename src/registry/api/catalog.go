@@ -0,0 +1,102 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"registry/layers"
+	"strconv"
+)
+
+const (
+	CATALOG_PAGE_SIZE     = 100
+	CATALOG_MAX_PAGE_SIZE = 1000
+)
+
+type catalogPage struct {
+	Repositories []*layers.RepositoryInfo `json:"repositories"`
+	// pass as last to get the next page, "" on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// GET /v1/_catalog?n=...&last=...
+func (a *RegistryAPI) CatalogHandler(w http.ResponseWriter, r *http.Request) {
+	repos, err := layers.Repositories(a.Storage)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	a.catalogResponse(w, r, repos)
+}
+
+// GET /v1/namespaces/{namespace}/repositories?n=...&last=...
+func (a *RegistryAPI) NamespaceRepositoriesHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, _, _ := parseRepo(r, "")
+	repos, err := layers.NamespaceRepositories(a.Storage, namespace)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	a.catalogResponse(w, r, repos)
+}
+
+// responds with the page of repos after the last one in the "last" parameter. repositories the client can't read
+// are left out, and so are private ones unless a rule names the client (see explicitlyAllowed). tags and sizes come
+// from the usage records, read once per namespace.
+func (a *RegistryAPI) catalogResponse(w http.ResponseWriter, r *http.Request, repos []*layers.Repository) {
+	size := CATALOG_PAGE_SIZE
+	if n := r.URL.Query().Get("n"); n != "" {
+		parsed, err := strconv.Atoi(n)
+		if err != nil || parsed <= 0 {
+			a.response(w, "Invalid n: "+n, http.StatusBadRequest, EMPTY_HEADERS)
+			return
+		}
+		size = parsed
+		if size > CATALOG_MAX_PAGE_SIZE {
+			size = CATALOG_MAX_PAGE_SIZE
+		}
+	}
+	last := r.URL.Query().Get("last")
+	layers.SortRepositories(repos)
+	identity := Identity(r)
+	page := &catalogPage{Repositories: []*layers.RepositoryInfo{}}
+	usages := map[string]map[string]*layers.RepositoryUsage{}
+	for _, repo := range repos {
+		if repo.FullName() <= last || !a.allowed(identity, repo.Namespace, ACCESS_READ) {
+			continue
+		}
+		private, err := layers.IsPrivate(a.Storage, repo)
+		if err != nil {
+			// a page that quietly leaves repositories out would pass for complete
+			a.internalError(w, err.Error())
+			return
+		}
+		if private && !a.explicitlyAllowed(identity, repo.Namespace, ACCESS_READ) {
+			continue
+		}
+		if len(page.Repositories) == size {
+			// there is at least one more
+			page.Next = page.Repositories[size-1].Namespace + "/" + page.Repositories[size-1].Name
+			break
+		}
+		if _, ok := usages[repo.Namespace]; !ok {
+			usage, err := a.usage.Repositories(repo.Namespace)
+			if err != nil {
+				a.internalError(w, err.Error())
+				return
+			}
+			usages[repo.Namespace] = usage
+		}
+		info, err := layers.GetRepositoryInfo(a.Storage, repo, usages[repo.Namespace][repo.Name])
+		if err != nil {
+			a.internalError(w, err.Error())
+			return
+		}
+		page.Repositories = append(page.Repositories, info)
+	}
+	headers := EMPTY_HEADERS
+	if page.Next != "" {
+		next := url.Values{"n": []string{strconv.Itoa(size)}, "last": []string{page.Next}}
+		headers = map[string][]string{"Link": []string{"<" + r.URL.Path + "?" + next.Encode() + `>; rel="next"`}}
+	}
+	a.response(w, page, http.StatusOK, headers)
+}
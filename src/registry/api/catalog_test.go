@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"registry/storage"
+	"testing"
+)
+
+func getCatalog(t *testing.T, a *RegistryAPI, url, identity string) *catalogPage {
+	w := serve(a, "GET", url, identity, "")
+	checkStatus(t, w, http.StatusOK)
+	page := &catalogPage{}
+	if err := json.Unmarshal(w.Body.Bytes(), page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func catalogNames(page *catalogPage) []string {
+	names := []string{}
+	for _, repo := range page.Repositories {
+		names = append(names, repo.Namespace+"/"+repo.Name)
+	}
+	return names
+}
+
+func TestCatalog(t *testing.T) {
+	a := newTestAPI(t, &Config{ACL: []*ACLRule{
+		{Identity: "*", Namespaces: []string{"*"}, Access: ACCESS_READ},
+		{Identity: "dev", Namespaces: []string{"team"}, Access: ACCESS_READ},
+	}})
+	putTestImage(t, a, "base", "", 10)
+	putTestImage(t, a, "child", "base", 20)
+	putTestTag(t, a, "library", "base", "latest", "base")
+	putTestTag(t, a, "team", "app", "latest", "child")
+	putTestTag(t, a, "team", "app", "v1", "base")
+	putTestTag(t, a, "team", "secret", "latest", "base")
+	if err := a.Storage.Put(storage.RepoPrivatePath("team", "secret"), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	page := getCatalog(t, a, "/v1/_catalog", "")
+	if names := catalogNames(page); len(names) != 2 || names[0] != "library/base" || names[1] != "team/app" {
+		t.Fatalf("Anonymous clients should only see public repositories, got %v", names)
+	}
+	if app := page.Repositories[1]; app.Tags != 2 || app.Size != 30 {
+		t.Fatalf("Expected 2 tags and 30 bytes for team/app, got %d tags and %d bytes", app.Tags, app.Size)
+	}
+	// a rule for anyone doesn't reveal private repositories, even to clients that identified themselves
+	if names := catalogNames(getCatalog(t, a, "/v1/_catalog", "ci")); len(names) != 2 {
+		t.Fatalf("Private repositories need a rule naming the client, got %v", names)
+	}
+	if names := catalogNames(getCatalog(t, a, "/v1/namespaces/team/repositories", "dev")); len(names) != 2 ||
+		names[1] != "team/secret" {
+		t.Fatalf("Expected dev to see team/secret, got %v", names)
+	}
+
+	w := serve(a, "GET", "/v1/_catalog?n=1", "", "")
+	checkStatus(t, w, http.StatusOK)
+	if link := w.Header().Get("Link"); link != `</v1/_catalog?last=library%2Fbase&n=1>; rel="next"` {
+		t.Fatalf("Unexpected Link header %q", link)
+	}
+	page = getCatalog(t, a, "/v1/_catalog?n=1&last=library/base", "")
+	if names := catalogNames(page); len(names) != 1 || names[0] != "team/app" || page.Next != "" {
+		t.Fatalf("The last page shouldn't point past what the client can see, got %v and %q", names, page.Next)
+	}
+	checkStatus(t, serve(a, "GET", "/v1/_catalog?n=0", "", ""), http.StatusBadRequest)
+}
+
+// fails to tell whether repositories are private
+type failingPrivate struct {
+	storage.Storage
+}
+
+func (s *failingPrivate) Exists(relpath string) (bool, error) {
+	if path.Base(relpath) == path.Base(storage.RepoPrivatePath("", "")) {
+		return false, errors.New("connection reset by peer")
+	}
+	return s.Storage.Exists(relpath)
+}
+
+func TestCatalogErrors(t *testing.T) {
+	a := newTestAPI(t, &Config{})
+	putTestImage(t, a, "1", "", 10)
+	putTestTag(t, a, "team", "app", "latest", "1")
+
+	// an incomplete listing is an error, not a shorter catalog
+	unlisted := New(&Config{}, &failingRepoList{a.Storage})
+	checkStatus(t, serve(unlisted, "GET", "/v1/_catalog", "", ""), http.StatusInternalServerError)
+	checkStatus(t, serve(unlisted, "GET", "/v1/namespaces/team/repositories", "", ""), http.StatusInternalServerError)
+	unknown := New(&Config{}, &failingPrivate{a.Storage})
+	checkStatus(t, serve(unknown, "GET", "/v1/_catalog", "", ""), http.StatusInternalServerError)
+}
@@ -11,7 +11,9 @@ import (
 	"net/http"
 	"registry/layers"
 	"registry/logger"
+	"registry/metrics"
 	"registry/storage"
+	"registry/webhooks"
 	"strconv"
 	"strings"
 )
@@ -36,7 +38,7 @@ func (a *RegistryAPI) GetImageLayerHandler(w http.ResponseWriter, r *http.Reques
 	vars := mux.Vars(r)
 	imageID := vars["imageID"]
 	headers := DefaultCacheHeaders()
-	reader, err := a.Storage.GetReader(storage.ImageLayerPath(imageID))
+	reader, err := layers.LayerReader(a.Storage, imageID)
 	if err != nil {
 		// every "Image not found" response in this file.
 		a.response(w, "Image not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
@@ -61,17 +63,74 @@ func (a *RegistryAPI) PutImageLayerHandler(w http.ResponseWriter, r *http.Reques
 		a.response(w, "Image already exists", http.StatusConflict, EMPTY_HEADERS)
 		return
 	}
+	if layerExists {
+		// a retried push. the layer about to be written replaces whatever blob the last attempt referred to
+		if err := layers.ReleaseLayer(r.Context(), a.Storage, imageID); err != nil {
+			logger.ForRequest(r.Context()).Error("[PutImageLayer][%s] error releasing previous layer: %s", imageID, err.Error())
+		}
+	}
 	// This next section reads the tarball from the body while computing various checksums. sha256Writer is used
 	// to compute a checksum of the entire tarball using a TeeReader which will read from the body while
 	// simultaneously writing what it read to sha256Writer. tarInfo will read the tar after it is put into the
-	// storage and checksum each individual file within it (and checksum those checksums with the jsonContent)
+	// storage and checksum each individual file within it (and checksum those checksums with the jsonContent).
+	// layerSha256Writer sees only the layer, which is what the layer is deduplicated by. The layer is written to
+	// the blob area right away and only becomes a blob once its sum is known.
 	sha256Writer := sha256.New()
 	sha256Writer.Write(append(jsonContent, '\n'))
-	teeReader := io.TeeReader(r.Body, sha256Writer)
+	layerSha256Writer := sha256.New()
+	teeReader := io.TeeReader(r.Body, io.MultiWriter(sha256Writer, layerSha256Writer))
 	// this will create the checksums for a tar and the json for tar file info
 	tarInfo := layers.NewTarInfo()
+	namespace, listed, err := a.pushNamespace(r, imageID)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	} else if !listed {
+		a.response(w, "Layer pushes need the token of a repository push listing the image", http.StatusForbidden,
+			EMPTY_HEADERS)
+		return
+	}
+	if policy := a.layerPolicy(namespace); policy != nil {
+		tarInfo.Policy = layers.NewPolicyCheck(policy)
+		// refused before reading anything if the client announced its size, and as soon as it goes past it if not
+		tarInfo.Policy.CheckSize(r.ContentLength)
+		if err := tarInfo.Policy.Err(); err != nil {
+			a.refusePolicy(w, err)
+			return
+		}
+		teeReader = tarInfo.Policy.LimitReader(teeReader)
+	}
+	// the layer only counts towards the quota once tagged, but it can't be larger than what is left of it
+	used, err := a.checkQuota(w, r, namespace, r.ContentLength)
+	if err != nil {
+		a.refuseQuota(w, err)
+		return
+	}
+	var limited *quotaReader
+	if quota := a.quota(namespace); namespace != "" && quota != nil && quota.Hard > 0 {
+		limited = &quotaReader{Reader: teeReader, remaining: quota.Hard - used,
+			err: &QuotaError{Namespace: namespace, Used: used, Limit: quota.Hard}}
+		teeReader = limited
+	}
+	uploadPath := storage.BlobUploadPath(imageID)
 	// PutReader takes a function that will run after the write finishes:
-	err = a.Storage.PutReader(layerPath, teeReader, tarInfo.Load)
+	err = a.Storage.PutReader(uploadPath, teeReader, func(file io.ReadSeeker) {
+		tarInfo.Load(r.Context(), file)
+	})
+	if limited != nil && limited.exceeded {
+		// the mark stays so the push can be retried
+		a.Storage.Remove(uploadPath)
+		a.refuseQuota(w, limited.err)
+		return
+	}
+	if tarInfo.Policy != nil {
+		if err := tarInfo.Policy.Err(); err != nil {
+			// get rid of whatever was written. the mark stays so the push can be retried.
+			a.Storage.Remove(uploadPath)
+			a.refusePolicy(w, err)
+			return
+		}
+	}
 	if err != nil {
 		a.response(w, "Internal Error: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
 		return
@@ -96,18 +155,30 @@ func (a *RegistryAPI) PutImageLayerHandler(w http.ResponseWriter, r *http.Reques
 				layers.SetImageFilesCache(a.Storage, imageID, filesJson)
 			}
 			// computing tarsum even if tarinfo.Error is nil as per python docker-registry
-			tarsum := tarInfo.TarSum.Compute(jsonContent)
+			tarsum := tarInfo.TarSum.Compute(r.Context(), jsonContent)
 			checksums = append(checksums, tarsum)
 		}
 	}
 
-	if err := layers.StoreChecksum(a.Storage, imageID, checksums); err != nil {
+	if err := layers.StoreChecksum(r.Context(), a.Storage, imageID, checksums); err != nil {
 		a.response(w, "Error storing Checksum: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
 		return
 	}
+	layerSum := hex.EncodeToString(layerSha256Writer.Sum(nil))
+	if err := layers.DedupLayer(r.Context(), a.Storage, imageID, uploadPath, layerSum); err != nil {
+		a.response(w, "Error storing Layer: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
+		return
+	}
 	a.response(w, true, http.StatusOK, EMPTY_HEADERS)
 }
 
+func (a *RegistryAPI) refusePolicy(w http.ResponseWriter, err error) {
+	a.response(w, map[string]interface{}{
+		"error":      err.Error(),
+		"violations": err.(*layers.PolicyError).Violations,
+	}, http.StatusForbidden, EMPTY_HEADERS)
+}
+
 // Must be wrapped by: RequiresCompletion, CheckIfModifiedSince
 // Sets: DefaultCacheHeaders
 func (a *RegistryAPI) GetImageJsonHandler(w http.ResponseWriter, r *http.Request) {
@@ -119,7 +190,7 @@ func (a *RegistryAPI) GetImageJsonHandler(w http.ResponseWriter, r *http.Request
 		a.response(w, "Image not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
 		return
 	}
-	size, err := a.Storage.Size(storage.ImageLayerPath(imageID))
+	size, err := layers.LayerSize(a.Storage, imageID)
 	if err != nil {
 		a.response(w, "Unable to Compute Layer Size: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
 		return
@@ -170,7 +241,7 @@ func (a *RegistryAPI) PutImageJsonHandler(w http.ResponseWriter, r *http.Request
 		a.response(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
 		return
 	}
-	logger.Debug("[PutImageJson] body:\n%s", bodyBytes)
+	logger.ForRequest(r.Context()).Debug("[PutImageJson] body:\n%s", bodyBytes)
 	if _, exists := data["id"]; !exists {
 		a.response(w, "Missing key 'id' in JSON", http.StatusBadRequest, EMPTY_HEADERS)
 		return
@@ -204,7 +275,7 @@ func (a *RegistryAPI) PutImageJsonHandler(w http.ResponseWriter, r *http.Request
 			return
 		}
 	}
-	err = a.Storage.Put(markPath, []byte("true"))
+	err = a.Storage.Put(markPath, layers.MarkContent())
 	if err != nil {
 		a.response(w, "Put Mark Error: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
 		return
@@ -216,7 +287,7 @@ func (a *RegistryAPI) PutImageJsonHandler(w http.ResponseWriter, r *http.Request
 		a.response(w, "Put Json Error: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
 		return
 	}
-	if err := layers.GenerateAncestry(a.Storage, imageID, parentID); err != nil {
+	if err := layers.GenerateAncestry(r.Context(), a.Storage, imageID, parentID); err != nil {
 		a.response(w, "Generate Ancestry Error: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
 		return
 	}
@@ -243,8 +314,8 @@ func (a *RegistryAPI) PutImageChecksumHandler(w http.ResponseWriter, r *http.Req
 
 	checksum := r.Header.Get("X-Docker-Checksum-Payload")
 
-	logger.Debug("X-Docker-Checksum-Payload " + checksum)
-	logger.Debug("X-Docker-Checksum " + r.Header.Get("X-Docker-Checksum"))
+	logger.ForRequest(r.Context()).Debug("X-Docker-Checksum-Payload " + checksum)
+	logger.ForRequest(r.Context()).Debug("X-Docker-Checksum " + r.Header.Get("X-Docker-Checksum"))
 
 	// compute checksum for docker < 0.10
 	docker_version, err := layers.DockerVersion(r.Header["User-Agent"])
@@ -277,7 +348,7 @@ func (a *RegistryAPI) PutImageChecksumHandler(w http.ResponseWriter, r *http.Req
 
 	checksums := loadChecksums(a, imageID)
 	if !stringInSlice(checksum, checksums) {
-		logger.Debug("[PutImageLayer]["+imageID+"] Wrong checksum:"+string(checksum)+" not in %#v", checksums)
+		logger.ForRequest(r.Context()).Debug("[PutImageLayer]["+imageID+"] Wrong checksum:"+string(checksum)+" not in %#v", checksums)
 		a.response(w, "Checksum mismatch, ignoring the layer", http.StatusBadRequest, EMPTY_HEADERS)
 		return
 	}
@@ -286,6 +357,8 @@ func (a *RegistryAPI) PutImageChecksumHandler(w http.ResponseWriter, r *http.Req
 		a.response(w, "Error removing Mark Path: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
 		return
 	}
+	namespace, repo := a.tokenRepo(r)
+	a.notify(r, &webhooks.Event{Action: webhooks.ACTION_PUSH, Namespace: namespace, Repo: repo, ImageID: imageID})
 	a.response(w, true, http.StatusOK, EMPTY_HEADERS)
 }
 
@@ -295,7 +368,7 @@ func (a *RegistryAPI) GetImageFilesHandler(w http.ResponseWriter, r *http.Reques
 	vars := mux.Vars(r)
 	imageID := vars["imageID"]
 	headers := DefaultCacheHeaders()
-	data, err := layers.GetImageFilesJson(a.Storage, imageID)
+	data, err := layers.GetImageFilesJson(r.Context(), a.Storage, imageID)
 	if err != nil {
 		switch err.(type) {
 		case layers.TarError:
@@ -321,9 +394,21 @@ func (a *RegistryAPI) GetImageDiffHandler(w http.ResponseWriter, r *http.Request
 		a.response(w, "Internal Error: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
 		return
 	}
-	if diffJson == nil {
+	if diffJson == nil && a.IsReadOnly() {
+		// the cache can't be filled, compute it for this request only
+		if diffJson, err = layers.ComputeDiff(r.Context(), a.Storage, imageID); err != nil {
+			a.internalError(w, err.Error())
+			return
+		}
+	} else if diffJson == nil {
 		// cache miss spawn goroutine to generate the diff and push it to S3
-		go layers.GenDiff(a.Storage, imageID)
+		// the job outlives the request, so it only keeps its id
+		ctx := logger.Detached(r.Context())
+		metrics.DiffJobs.Add(1)
+		go func() {
+			defer metrics.DiffJobs.Add(-1)
+			layers.GenDiff(ctx, a.Storage, imageID)
+		}()
 		diffJson = []byte{}
 	}
 	// copied from docker-registry. not sure why we would return StatusOK when the cache missed...
@@ -348,3 +433,66 @@ func stringInSlice(element string, list []string) bool {
 	}
 	return false
 }
+
+// Removes an image with everything stored for it. Refuses while a tag or another image still needs it, unless
+// ?force=true: that leaves those tags and images broken, which is the point when purging a layer that should never
+// have been pushed.
+func (a *RegistryAPI) DeleteImageHandler(w http.ResponseWriter, r *http.Request) {
+	imageID := mux.Vars(r)["imageID"]
+	if exists, _ := a.Storage.Exists(storage.ImageJsonPath(imageID)); !exists {
+		a.response(w, "Image not found", http.StatusNotFound, EMPTY_HEADERS)
+		return
+	}
+	// the scan goes through every repository and image, tag writes can't wait for it. the ones made meanwhile are
+	// checked again once they are locked out.
+	watch, unwatch := watchTags()
+	defer unwatch()
+	refs, err := layers.FindImageReferences(a.Storage, imageID)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	defer lockImages()()
+	for _, tag := range watch.written() {
+		if reached, err := layers.Reaches(a.Storage, tag.ImageID, imageID); err != nil {
+			refs.Unreadable = append(refs.Unreadable, tag.ImageID)
+		} else if reached {
+			refs.Tags = append(refs.Tags, tag)
+		}
+	}
+	if exists, _ := a.Storage.Exists(storage.ImageJsonPath(imageID)); !exists {
+		// deleted by another request meanwhile
+		a.response(w, "Image not found", http.StatusNotFound, EMPTY_HEADERS)
+		return
+	}
+	if !refs.Empty() && r.URL.Query().Get("force") != "true" {
+		a.response(w, map[string]interface{}{
+			"error":       "Image is still referenced, use force=true to delete it anyway",
+			"tags":        refs.Tags,
+			"descendants": refs.Descendants,
+			"unreadable":  refs.Unreadable,
+		}, http.StatusConflict, EMPTY_HEADERS)
+		return
+	}
+	if err := layers.DeleteImage(r.Context(), a.Storage, imageID); err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	if err := layers.RemoveIndexImage(a.Storage, imageID); err != nil {
+		logger.ForRequest(r.Context()).Error("[DeleteImage][%s] error updating _index_images: %s", imageID, err.Error())
+	}
+	// the tags still reaching the image can't be untracked incrementally without its ancestry
+	recomputed := map[string]bool{}
+	for _, tag := range refs.Tags {
+		if recomputed[tag.Namespace] {
+			continue
+		}
+		recomputed[tag.Namespace] = true
+		if _, err := a.usage.Recompute(tag.Namespace); err != nil {
+			logger.ForRequest(r.Context()).Error("[DeleteImage][%s] error recomputing the usage of %s: %s", imageID, tag.Namespace, err.Error())
+		}
+	}
+	a.notify(r, &webhooks.Event{Action: webhooks.ACTION_DELETE_IMAGE, ImageID: imageID})
+	// what was left broken, if forced
+	a.response(w, refs, http.StatusOK, EMPTY_HEADERS)
+}
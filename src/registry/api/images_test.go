@@ -0,0 +1,103 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"registry/layers"
+	"registry/storage"
+	"testing"
+	"time"
+)
+
+// a layer holding one file of size bytes
+func testLayer(size int) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	w.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(size), Typeflag: tar.TypeReg})
+	w.Write(make([]byte, size))
+	w.Close()
+	return buf.Bytes()
+}
+
+// pushes layer without announcing its size, with the token of a push to repository ("" for none)
+func putTestLayer(a *RegistryAPI, imageID, repository string, layer []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("PUT", "/v1/images/"+imageID+"/layer", bytes.NewReader(layer))
+	r.ContentLength = -1
+	r.Header.Set("User-Agent", "docker/1.6.0 go/go1.4")
+	if repository != "" {
+		token := a.IndexHeaders(r, "team", repository, "write")["X-Docker-Token"][0]
+		r.Header.Set("Authorization", token)
+	}
+	w := httptest.NewRecorder()
+	a.Authorize(a.Router(ROUTE_GROUPS)).ServeHTTP(w, r)
+	return w
+}
+
+func TestPutImageLayerPolicy(t *testing.T) {
+	a := newTestAPI(t, &Config{LayerPolicies: map[string]*layers.Policy{"team": {MaxSize: 4096}}})
+	checkStatus(t, serve(a, "PUT", "/v1/images/1/json", "", `{"id":"1"}`), http.StatusOK)
+	checkStatus(t, serve(a, "PUT", "/v1/repositories/team/app/", "", `[{"id":"1"}]`), http.StatusOK)
+
+	// leaving the token out or using one of another push doesn't dodge the policy of team
+	checkStatus(t, putTestLayer(a, "1", "", testLayer(10)), http.StatusForbidden)
+	checkStatus(t, putTestLayer(a, "1", "other", testLayer(10)), http.StatusForbidden)
+
+	checkStatus(t, putTestLayer(a, "1", "app", testLayer(8192)), http.StatusForbidden)
+	if exists, _ := a.Storage.Exists(storage.BlobUploadPath("1")); exists {
+		t.Fatal("Expected the refused layer to be removed")
+	}
+	checkStatus(t, putTestLayer(a, "1", "app", testLayer(10)), http.StatusOK)
+	if size, err := layers.LayerSize(a.Storage, "1"); err != nil || size != int64(len(testLayer(10))) {
+		t.Fatalf("Unexpected layer size %d (%v)", size, err)
+	}
+}
+
+func TestDeleteImageRacingTag(t *testing.T) {
+	a := newTestAPI(t, &Config{})
+	a = New(&Config{}, &slowTagStorage{a.Storage})
+	putTestImage(t, a, "1", "", 10)
+	done := make(chan int)
+	go func() {
+		done <- serve(a, "PUT", "/v1/repositories/team/app/tags/latest", "", `"1"`).Code
+	}()
+	time.Sleep(2 * time.Millisecond)
+	deleted := serve(a, "DELETE", "/v1/images/1", "", "").Code
+	tagged := <-done
+	tagExists, _ := a.Storage.Exists(storage.RepoTagPath("team", "app", "latest"))
+	imageExists, _ := a.Storage.Exists(storage.ImageJsonPath("1"))
+	if tagExists && !imageExists {
+		t.Fatalf("The tag was written on a deleted image (tag %d, delete %d)", tagged, deleted)
+	}
+}
+
+// tags an image while a delete lists the images, after it went through the tags
+type tagDuringScanStorage struct {
+	storage.Storage
+	tag func()
+}
+
+func (s *tagDuringScanStorage) List(relpath string) ([]string, error) {
+	if relpath == "images" && s.tag != nil {
+		tag := s.tag
+		s.tag = nil
+		tag()
+	}
+	return s.Storage.List(relpath)
+}
+
+func TestDeleteImageTaggedDuringScan(t *testing.T) {
+	a := newTestAPI(t, &Config{})
+	scanned := &tagDuringScanStorage{Storage: a.Storage}
+	a = New(&Config{}, scanned)
+	putTestImage(t, a, "1", "", 10)
+	putTestImage(t, a, "2", "1", 10)
+	scanned.tag = func() {
+		checkStatus(t, serve(a, "PUT", "/v1/repositories/team/app/tags/latest", "", `"2"`), http.StatusOK)
+	}
+	checkStatus(t, serve(a, "DELETE", "/v1/images/1", "", ""), http.StatusConflict)
+	if exists, _ := a.Storage.Exists(storage.ImageJsonPath("1")); !exists {
+		t.Fatal("Expected the image tagged during the scan to be kept")
+	}
+}
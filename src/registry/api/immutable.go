@@ -0,0 +1,203 @@
+package api
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"path"
+	"registry/layers"
+	"registry/storage"
+	"sort"
+	"sync"
+)
+
+// ImmutableTagError is returned when a request would move or remove a tag matching an immutable_tags pattern
+type ImmutableTagError struct {
+	Tag     string
+	Scope   string // the immutable_tags key the pattern is configured under
+	Pattern string
+}
+
+func (e *ImmutableTagError) Error() string {
+	return fmt.Sprintf("Tag '%s' is immutable: it matches '%s' in immutable_tags for '%s'", e.Tag, e.Pattern, e.Scope)
+}
+
+// returns the pattern making tag immutable, looking at the repository, its namespace and "*" in that order
+func (a *RegistryAPI) immutableTagRule(namespace, repo, tag string) *ImmutableTagError {
+	rules := a.config().ImmutableTags
+	for _, scope := range []string{path.Join(namespace, repo), namespace, "*"} {
+		for _, pattern := range rules[scope] {
+			if matched, _ := path.Match(pattern, tag); matched {
+				return &ImmutableTagError{Tag: tag, Scope: scope, Pattern: pattern}
+			}
+		}
+	}
+	return nil
+}
+
+// checking a tag and then writing it can't interleave with another request doing the same, or two first pushes of
+// an immutable tag would both find it free. the same goes for a repository delete and a first push into it. this
+// only covers one registry, like the blob locks.
+var (
+	repoLocks [256]sync.RWMutex
+	tagLocks  [256]sync.Mutex
+	// tag writes share it, an image delete takes it alone so no tag can start using the image in between the check
+	// for references and the delete
+	imagesLock sync.RWMutex
+)
+
+// the tags written while image deletes scan for references without holding imagesLock, see watchTags
+var tagWatches struct {
+	sync.Mutex
+	watches map[*tagWatch]bool
+}
+
+type tagWatch struct {
+	sync.Mutex
+	tags []*layers.TagReference
+}
+
+// records every tag written from now on until the returned function is called. the tags written before are
+// already in storage, since writes are recorded once done.
+func watchTags() (*tagWatch, func()) {
+	watch := &tagWatch{}
+	tagWatches.Lock()
+	defer tagWatches.Unlock()
+	if tagWatches.watches == nil {
+		tagWatches.watches = map[*tagWatch]bool{}
+	}
+	tagWatches.watches[watch] = true
+	return watch, func() {
+		tagWatches.Lock()
+		defer tagWatches.Unlock()
+		delete(tagWatches.watches, watch)
+	}
+}
+
+// called by tag writes under lockTags, after the write
+func tagWritten(namespace, repo, tag, imageID string) {
+	tagWatches.Lock()
+	defer tagWatches.Unlock()
+	for watch := range tagWatches.watches {
+		watch.Lock()
+		watch.tags = append(watch.tags, &layers.TagReference{Namespace: namespace, Repo: repo, Tag: tag,
+			ImageID: imageID})
+		watch.Unlock()
+	}
+}
+
+// the tags written since watchTags. complete once the caller holds lockImages.
+func (w *tagWatch) written() []*layers.TagReference {
+	w.Lock()
+	defer w.Unlock()
+	return append([]*layers.TagReference{}, w.tags...)
+}
+
+func lockStripe(name string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return int(hash.Sum32() % uint32(len(tagLocks)))
+}
+
+// locks the tags given as namespace, repo and tag triples, and their repositories against lockRepo, and returns the
+// function unlocking them. stripes are locked in order, so requests locking several tags can't deadlock.
+func lockTags(tags ...[3]string) func() {
+	repos, names := []int{}, []int{}
+	seenRepos, seenNames := map[int]bool{}, map[int]bool{}
+	for _, tag := range tags {
+		repo, name := lockStripe(path.Join(tag[0], tag[1])), lockStripe(path.Join(tag[0], tag[1])+":"+tag[2])
+		if !seenRepos[repo] {
+			seenRepos[repo] = true
+			repos = append(repos, repo)
+		}
+		if !seenNames[name] {
+			seenNames[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Ints(repos)
+	sort.Ints(names)
+	imagesLock.RLock()
+	for _, index := range repos {
+		repoLocks[index].RLock()
+	}
+	for _, index := range names {
+		tagLocks[index].Lock()
+	}
+	return func() {
+		for _, index := range names {
+			tagLocks[index].Unlock()
+		}
+		for _, index := range repos {
+			repoLocks[index].RUnlock()
+		}
+		imagesLock.RUnlock()
+	}
+}
+
+// keeps every tag from being written until the returned function is called. holders can't take lockTags as well.
+func lockImages() func() {
+	imagesLock.Lock()
+	return imagesLock.Unlock
+}
+
+// keeps every tag of the repository, including ones that don't exist yet, from changing until the returned function
+// is called. holders can't take lockTags as well.
+func lockRepo(namespace, repo string) func() {
+	lock := &repoLocks[lockStripe(path.Join(namespace, repo))]
+	lock.Lock()
+	return lock.Unlock
+}
+
+// returns an error if tag exists, points to something else than imageID ("" to remove it) and is immutable. callers
+// hold the lock of the tag (see lockTags) until they are done with it.
+func (a *RegistryAPI) checkTagMutable(namespace, repo, tag, imageID string) error {
+	current := a.tagTarget(namespace, repo, tag)
+	if current == "" || current == imageID {
+		return nil
+	}
+	if rule := a.immutableTagRule(namespace, repo, tag); rule != nil {
+		return rule
+	}
+	return nil
+}
+
+// returns an error if any tag of the repository is immutable. callers hold the lock of the repository (see
+// lockRepo) until they are done with it.
+func (a *RegistryAPI) checkRepoMutable(namespace, repo string) error {
+	if len(a.config().ImmutableTags) == 0 {
+		return nil
+	}
+	names, err := a.Storage.List(storage.RepoTagPath(namespace, repo, ""))
+	if os.IsNotExist(err) {
+		// no repository, no tags
+		return nil
+	} else if err != nil {
+		return err
+	}
+	tags, err := a.repoTags(names)
+	if err != nil {
+		return err
+	}
+	sorted := make([]string, 0, len(tags))
+	for tag := range tags {
+		sorted = append(sorted, tag)
+	}
+	sort.Strings(sorted)
+	for _, tag := range sorted {
+		if rule := a.immutableTagRule(namespace, repo, tag); rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+// responds 409 to a request refused because of an immutable tag
+func (a *RegistryAPI) refuseMutation(w http.ResponseWriter, err error) {
+	if _, ok := err.(*ImmutableTagError); ok {
+		a.response(w, err.Error(), http.StatusConflict, EMPTY_HEADERS)
+		return
+	}
+	a.internalError(w, err.Error())
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"registry/storage"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestImmutableTags(t *testing.T) {
+	a := newTestAPI(t, &Config{ImmutableTags: map[string][]string{"team/app": {"v*"}}})
+	putTestImage(t, a, "1", "", 10)
+	putTestImage(t, a, "2", "", 10)
+	checkStatus(t, serve(a, "PUT", "/v1/repositories/team/app/tags/v1", "", `"1"`), http.StatusOK)
+	checkStatus(t, serve(a, "PUT", "/v1/repositories/team/app/tags/latest", "", `"2"`), http.StatusOK)
+	// v9 was moved before it became immutable, so it has an image to roll back to
+	mutable := New(&Config{}, a.Storage)
+	checkStatus(t, serve(mutable, "PUT", "/v1/repositories/team/app/tags/v9", "", `"1"`), http.StatusOK)
+	checkStatus(t, serve(mutable, "PUT", "/v1/repositories/team/app/tags/v9", "", `"2"`), http.StatusOK)
+
+	// pushing the same image again is fine, anything that moves or removes the tag isn't
+	checkStatus(t, serve(a, "PUT", "/v1/repositories/team/app/tags/v1", "", `"1"`), http.StatusOK)
+	for _, request := range []struct{ method, url, body string }{
+		{"PUT", "/v1/repositories/team/app/tags/v1", `"2"`},
+		{"DELETE", "/v1/repositories/team/app/tags/v1", ""},
+		{"DELETE", "/v1/repositories/team/app/", ""},
+		{"POST", "/v1/repositories/team/app/tags/latest/copy", `{"tag":"v1","move":false}`},
+		{"POST", "/v1/repositories/team/app/tags/v1/copy", `{"tag":"moved","move":true}`},
+		{"POST", "/v1/repositories/team/app/tags/v9/rollback", ""},
+	} {
+		checkStatus(t, serve(a, request.method, request.url, "", request.body), http.StatusConflict)
+	}
+	if target := a.tagTarget("team", "app", "v1"); target != "1" {
+		t.Fatalf("Expected v1 to still point to 1, got %q", target)
+	}
+}
+
+// takes its time writing tags and removing repositories, so that requests checking tags before changing them overlap
+type slowTagStorage struct {
+	storage.Storage
+}
+
+func (s *slowTagStorage) Put(relpath string, data []byte) error {
+	if strings.HasPrefix(path.Base(relpath), storage.TAG_PREFIX) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s.Storage.Put(relpath, data)
+}
+
+func (s *slowTagStorage) RemoveAll(relpath string) error {
+	if strings.HasPrefix(relpath, "repositories/") {
+		time.Sleep(20 * time.Millisecond)
+	}
+	return s.Storage.RemoveAll(relpath)
+}
+
+func TestImmutableTagFirstPushes(t *testing.T) {
+	a := newTestAPI(t, &Config{})
+	a = New(&Config{ImmutableTags: map[string][]string{"*": {"v*"}}}, &slowTagStorage{a.Storage})
+	const pushes = 8
+	for i := 0; i < pushes; i++ {
+		putTestImage(t, a, fmt.Sprint(i), "", 10)
+	}
+	var wg sync.WaitGroup
+	statuses := make(chan int, pushes)
+	for i := 0; i < pushes; i++ {
+		wg.Add(1)
+		go func(imageID string) {
+			defer wg.Done()
+			statuses <- serve(a, "PUT", "/v1/repositories/team/app/tags/v1", "", `"`+imageID+`"`).Code
+		}(fmt.Sprint(i))
+	}
+	wg.Wait()
+	close(statuses)
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusConflict] != pushes-1 {
+		t.Fatalf("Expected one push to win and the others to conflict, got %v", counts)
+	}
+}
+
+func TestImmutableTagPushRacingRepoDelete(t *testing.T) {
+	for _, url := range []string{"/v1/repositories/team/app/tags", "/v1/repositories/team/app/"} {
+		a := newTestAPI(t, &Config{})
+		a = New(&Config{ImmutableTags: map[string][]string{"*": {"v*"}}}, &slowTagStorage{a.Storage})
+		putTestImage(t, a, "1", "", 10)
+		checkStatus(t, serve(a, "PUT", "/v1/repositories/team/app/tags/latest", "", `"1"`), http.StatusOK)
+
+		// the delete finds no immutable tag while the first push of v1 is on its way
+		pushed := make(chan int)
+		go func() { pushed <- serve(a, "PUT", "/v1/repositories/team/app/tags/v1", "", `"1"`).Code }()
+		time.Sleep(2 * time.Millisecond)
+		deleted := serve(a, "DELETE", url, "", "").Code
+		if <-pushed == http.StatusOK && a.tagTarget("team", "app", "v1") != "1" {
+			t.Fatalf("DELETE %s answered %d and removed the immutable tag pushed meanwhile", url, deleted)
+		}
+	}
+}
+
+// fails to list repositories, like a storage that is having trouble
+type failingRepoList struct {
+	storage.Storage
+}
+
+func (s *failingRepoList) List(relpath string) ([]string, error) {
+	if strings.HasPrefix(relpath, "repositories/") {
+		return nil, errors.New("connection reset by peer")
+	}
+	return s.Storage.List(relpath)
+}
+
+func TestImmutableTagsListError(t *testing.T) {
+	a := newTestAPI(t, &Config{ImmutableTags: map[string][]string{"team/app": {"v*"}}})
+	putTestImage(t, a, "1", "", 10)
+	checkStatus(t, serve(a, "PUT", "/v1/repositories/team/app/tags/v1", "", `"1"`), http.StatusOK)
+	a.Storage = &failingRepoList{a.Storage}
+	checkStatus(t, serve(a, "DELETE", "/v1/repositories/team/app/", "", ""), http.StatusInternalServerError)
+	if target := a.tagTarget("team", "app", "v1"); target != "1" {
+		t.Fatalf("Expected v1 to be kept when the tags can't be listed, got %q", target)
+	}
+}
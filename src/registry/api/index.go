@@ -1,23 +1,83 @@
 package api
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"registry/layers"
 	"registry/logger"
 	"registry/storage"
 	"io/ioutil"
 	"net/http"
+	"regexp"
+	"strings"
 )
 
-func IndexHeaders(r *http.Request, namespace, repo, access string) map[string][]string {
-	fakeToken := []string{"Token signature=FAKESIGNATURE123,repository=\"" + namespace + "/" + repo + "\",access=" + access}
+// The token docker gets from the index and sends back on image requests. It is signed so that the repository in it
+// can be trusted, which the repository routes checked the client's access to when they handed it out.
+func (a *RegistryAPI) IndexHeaders(r *http.Request, namespace, repo, access string) map[string][]string {
+	token := []string{"Token signature=" + a.tokenSignature(namespace+"/"+repo, access) + ",repository=\"" +
+		namespace + "/" + repo + "\",access=" + access}
 	return map[string][]string{
 		"X-Docker-Endpoints": []string{r.Host},
-		"WWW-Authenticate":   fakeToken,
-		"X-Docker-Token":     fakeToken,
+		"WWW-Authenticate":   token,
+		"X-Docker-Token":     token,
 	}
 }
 
+var TOKEN_REGEXP = regexp.MustCompile("signature=([0-9a-f]+),repository=\"([^\"]+)\",access=(\\w+)")
+
+func (a *RegistryAPI) tokenSignature(repository, access string) string {
+	mac := hmac.New(sha256.New, a.tokenKey)
+	mac.Write([]byte(repository + "," + access))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Docker sends back the token it got from the index (see IndexHeaders) on image requests. This returns the
+// namespace and repository in that token, or empty strings if there is none or it wasn't signed by this registry.
+func (a *RegistryAPI) tokenRepo(r *http.Request) (string, string) {
+	namespace, repo, _ := a.tokenClaims(r)
+	return namespace, repo
+}
+
+// tokenRepo, along with the access the token was handed out for
+func (a *RegistryAPI) tokenClaims(r *http.Request) (string, string, string) {
+	match := TOKEN_REGEXP.FindStringSubmatch(r.Header.Get("Authorization"))
+	if len(match) != 4 || !hmac.Equal([]byte(match[1]), []byte(a.tokenSignature(match[2], match[3]))) {
+		return "", "", ""
+	}
+	parts := strings.SplitN(match[2], "/", 2)
+	if len(parts) == 1 {
+		return "library", parts[0], match[3]
+	}
+	return parts[0], parts[1], match[3]
+}
+
+// Image routes carry no namespace, so the policy and quota of a layer push come from the namespace of the token the
+// repository routes handed out for the push, whose image list must include the image. Without a token the "*"
+// policy applies, unless namespaces have their own policies or quotas: those could be dodged by leaving the token
+// out, so it is required then. Returns whether the push may go on.
+func (a *RegistryAPI) pushNamespace(r *http.Request, imageID string) (string, bool, error) {
+	namespace, repo := a.tokenRepo(r)
+	if repo == "" {
+		return "", !a.namespaceScoped(), nil
+	}
+	listed, err := layers.IndexImagesContain(a.Storage, namespace, repo, imageID)
+	return namespace, listed, err
+}
+
+// whether any namespace has a policy or a quota of its own. quotas under "*" count, they apply per namespace.
+func (a *RegistryAPI) namespaceScoped() bool {
+	cfg := a.config()
+	for namespace := range cfg.LayerPolicies {
+		if namespace != "*" {
+			return true
+		}
+	}
+	return len(cfg.Quotas) > 0
+}
+
 func (a *RegistryAPI) putRepoImageHandler(w http.ResponseWriter, r *http.Request, successStatus int) {
 	namespace, repo, _ := parseRepo(r, "")
 	bodyBytes, err := ioutil.ReadAll(r.Body)
@@ -25,7 +85,7 @@ func (a *RegistryAPI) putRepoImageHandler(w http.ResponseWriter, r *http.Request
 		a.response(w, "Internal Error: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
 		return
 	}
-	logger.Debug("[PutRepoImage] body:\n%s", bodyBytes)
+	logger.ForRequest(r.Context()).Debug("[PutRepoImage] body:\n%s", bodyBytes)
 	var body []map[string]interface{}
 	if err := json.Unmarshal(bodyBytes, &body); err != nil {
 		a.response(w, "Error Decoding JSON: "+err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
@@ -35,7 +95,7 @@ func (a *RegistryAPI) putRepoImageHandler(w http.ResponseWriter, r *http.Request
 		a.response(w, "Internal Error: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
 		return
 	}
-	a.response(w, "", successStatus, IndexHeaders(r, namespace, repo, "write"))
+	a.response(w, "", successStatus, a.IndexHeaders(r, namespace, repo, "write"))
 }
 
 func (a *RegistryAPI) LoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -69,7 +129,7 @@ func (a *RegistryAPI) GetRepoImagesHandler(w http.ResponseWriter, r *http.Reques
 		a.response(w, "Image Not Found", http.StatusNotFound, EMPTY_HEADERS)
 		return
 	}
-	a.response(w, data, http.StatusOK, IndexHeaders(r, namespace, repo, "read"))
+	a.response(w, data, http.StatusOK, a.IndexHeaders(r, namespace, repo, "read"))
 }
 
 func (a *RegistryAPI) PutRepoImagesHandler(w http.ResponseWriter, r *http.Request) {
@@ -79,7 +139,7 @@ func (a *RegistryAPI) PutRepoImagesHandler(w http.ResponseWriter, r *http.Reques
 func (a *RegistryAPI) DeleteRepoImagesHandler(w http.ResponseWriter, r *http.Request) {
 	namespace, repo, _ := parseRepo(r, "")
 	// from docker-registry 0.6.5: Does nothing, this file will be removed when DELETE on repos
-	a.response(w, "", http.StatusNoContent, IndexHeaders(r, namespace, repo, "delete"))
+	a.response(w, "", http.StatusNoContent, a.IndexHeaders(r, namespace, repo, "delete"))
 }
 
 func (a *RegistryAPI) SearchHandler(w http.ResponseWriter, r *http.Request) {
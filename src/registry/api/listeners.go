@@ -0,0 +1,192 @@
+package api
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"registry/logger"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// route groups a listener can serve
+const (
+	ROUTES_STATUS   = "status"   // /, _ping and _status
+	ROUTES_REGISTRY = "registry" // images, tags and repositories
+	ROUTES_INDEX    = "index"    // users, repository indexes and search
+	ROUTES_ADMIN    = "admin"    // /v1/_admin/
+	ROUTES_METRICS  = "metrics"  // /metrics
+)
+
+var ROUTE_GROUPS = []string{ROUTES_STATUS, ROUTES_REGISTRY, ROUTES_INDEX, ROUTES_ADMIN, ROUTES_METRICS}
+
+// what docker clients need, served by listeners that don't say. admin and metrics have to be asked for.
+var CLIENT_ROUTE_GROUPS = []string{ROUTES_STATUS, ROUTES_REGISTRY, ROUTES_INDEX}
+
+const (
+	NETWORK_TCP     = "tcp"
+	NETWORK_UNIX    = "unix"
+	NETWORK_SYSTEMD = "systemd"
+)
+
+// the first file descriptor systemd passes (SD_LISTEN_FDS_START)
+const SYSTEMD_LISTEN_FDS_START = 3
+
+type ListenerConfig struct {
+	// tcp (the default), unix, or systemd for a socket passed by systemd socket activation
+	Network string `json:"network"`
+	// host:port, the path of the socket, or the FileDescriptorName of the systemd socket (or its index if it has
+	// none)
+	Addr string `json:"addr"`
+	// serve HTTPS using the tls config
+	TLS bool `json:"tls"`
+	// route groups to serve, CLIENT_ROUTE_GROUPS by default
+	Routes []string `json:"routes"`
+}
+
+func (l *ListenerConfig) String() string {
+	network := l.Network
+	if network == "" {
+		network = NETWORK_TCP
+	}
+	return network + ":" + l.Addr
+}
+
+// without listeners the registry serves the client routes on Addr
+func (a *RegistryAPI) listenerConfigs() []*ListenerConfig {
+	cfg := a.config()
+	if len(cfg.Listeners) > 0 {
+		return cfg.Listeners
+	}
+	return []*ListenerConfig{&ListenerConfig{Network: NETWORK_TCP, Addr: cfg.Addr, TLS: cfg.TLS != nil}}
+}
+
+func (a *RegistryAPI) ListenAndServe() error {
+	listenerConfigs := a.listenerConfigs()
+	listeners := []net.Listener{}
+	closeAll := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	for _, cfg := range listenerConfigs {
+		listener, err := a.listen(cfg)
+		if err != nil {
+			closeAll()
+			return errors.New("Error listening on " + cfg.String() + ": " + err.Error())
+		}
+		listeners = append(listeners, listener)
+	}
+	servers := []*http.Server{}
+	routeGroups := [][]string{}
+	for _, cfg := range listenerConfigs {
+		routes := cfg.Routes
+		if len(routes) == 0 {
+			routes = CLIENT_ROUTE_GROUPS
+		}
+		router := a.Router(routes)
+		handler := a.RequestID(a.AccessLog(router, a.Audit(router, a.Instrument(router, a.Authorize(router)))))
+		servers = append(servers, &http.Server{Handler: handler})
+		routeGroups = append(routeGroups, routes)
+	}
+	a.listenerLock.Lock()
+	if a.ShuttingDown() {
+		a.listenerLock.Unlock()
+		closeAll()
+		return nil
+	}
+	a.servers = servers
+	a.listenerLock.Unlock()
+
+	errs := make(chan error, len(listeners))
+	for i, cfg := range listenerConfigs {
+		go func(server *http.Server, listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(servers[i], listeners[i])
+		logger.Info("Listening on %s (%s)", cfg.String(), strings.Join(routeGroups[i], ", "))
+	}
+	go a.retentionLoop()
+	err := <-errs
+	if err == http.ErrServerClosed || a.ShuttingDown() {
+		// the listeners were closed on purpose
+		return nil
+	}
+	return err
+}
+
+func (a *RegistryAPI) listen(cfg *ListenerConfig) (net.Listener, error) {
+	var listener net.Listener
+	var err error
+	switch cfg.Network {
+	case "", NETWORK_TCP:
+		listener, err = net.Listen("tcp", cfg.Addr)
+	case NETWORK_UNIX:
+		if info, statErr := os.Stat(cfg.Addr); statErr == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, dialErr := net.Dial("unix", cfg.Addr); dialErr == nil {
+				conn.Close()
+				return nil, errors.New("Socket is in use by another process")
+			}
+			// left behind by a registry that didn't shut down cleanly
+			os.Remove(cfg.Addr)
+		}
+		listener, err = net.Listen("unix", cfg.Addr)
+	case NETWORK_SYSTEMD:
+		listener, err = systemdListener(cfg.Addr)
+	default:
+		err = errors.New("Invalid network: " + cfg.Network)
+	}
+	if err != nil || !cfg.TLS {
+		return listener, err
+	}
+	tlsConfig, err := a.serverTLSConfig()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+var systemdOnce sync.Once
+var systemdListeners map[string]net.Listener
+
+// returns the socket systemd passed with the given name (or index)
+func systemdListener(name string) (net.Listener, error) {
+	systemdOnce.Do(loadSystemdListeners)
+	listener, ok := systemdListeners[name]
+	if !ok {
+		return nil, errors.New("No socket named " + name + " was passed by systemd")
+	}
+	// each socket can only be served once
+	delete(systemdListeners, name)
+	return listener, nil
+}
+
+func loadSystemdListeners() {
+	systemdListeners = map[string]net.Listener{}
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return
+	}
+	count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < count; i++ {
+		file := os.NewFile(uintptr(SYSTEMD_LISTEN_FDS_START+i), "systemd socket "+strconv.Itoa(i))
+		listener, err := net.FileListener(file)
+		// FileListener has its own copy of the descriptor
+		file.Close()
+		if err != nil {
+			logger.Error("[Systemd] socket %d is not a listening socket: %s", i, err.Error())
+			continue
+		}
+		if i < len(names) && names[i] != "" {
+			systemdListeners[names[i]] = listener
+		}
+		systemdListeners[strconv.Itoa(i)] = listener
+	}
+	// not for child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+}
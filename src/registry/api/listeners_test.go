@@ -0,0 +1,95 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"registry/storage"
+	"testing"
+	"time"
+)
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	a := newTestAPI(t, &Config{})
+	cfg := &ListenerConfig{Network: NETWORK_UNIX, Addr: path.Join(t.TempDir(), "registry.sock")}
+	listener, err := a.listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, err := a.listen(cfg); err == nil {
+		second.Close()
+		t.Fatal("Expected the socket of a running registry to be left alone")
+	}
+	// a registry that didn't shut down cleanly
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = a.listen(cfg)
+	if err != nil {
+		t.Fatalf("Expected the stale socket to be replaced: %s", err.Error())
+	}
+	listener.Close()
+}
+
+// holds ancestry reads until released
+type blockingGet struct {
+	storage.Storage
+	started chan bool
+	release chan bool
+}
+
+func (s *blockingGet) Get(relpath string) ([]byte, error) {
+	if relpath == storage.ImageAncestryPath("1") {
+		s.started <- true
+		<-s.release
+	}
+	return s.Storage.Get(relpath)
+}
+
+func TestShutdownDrains(t *testing.T) {
+	a := newTestAPI(t, &Config{})
+	putTestImage(t, a, "1", "", 10)
+	socket := path.Join(t.TempDir(), "registry.sock")
+	blocking := &blockingGet{Storage: a.Storage, started: make(chan bool), release: make(chan bool)}
+	a = New(&Config{Listeners: []*ListenerConfig{{Network: NETWORK_UNIX, Addr: socket}}}, blocking)
+	served := make(chan error)
+	go func() { served <- a.ListenAndServe() }()
+	client := &http.Client{Transport: &http.Transport{Dial: func(string, string) (net.Conn, error) {
+		return net.Dial("unix", socket)
+	}}}
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	statuses := make(chan int)
+	go func() {
+		resp, err := client.Get("http://registry/v1/images/1/ancestry")
+		if err != nil {
+			statuses <- 0
+			return
+		}
+		resp.Body.Close()
+		statuses <- resp.StatusCode
+	}()
+	<-blocking.started
+	shutdown := make(chan error)
+	go func() { shutdown <- a.Shutdown() }()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	// nothing is accepted during the drain
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		t.Fatal("Expected new connections to be refused while shutting down")
+	}
+	close(blocking.release)
+	if status := <-statuses; status != http.StatusOK {
+		t.Fatalf("Expected the running request to finish, got status %d", status)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gorilla/mux"
+	"net/http"
+	"regexp"
+	"registry/logger"
+	"time"
+)
+
+// request ids passed in by clients or proxies are kept if they look like one
+var REQUEST_ID_REGEXP = regexp.MustCompile("^[A-Za-z0-9._:-]{1,128}$")
+
+// Must wrap everything else. Gives each request an id, returned in X-Request-ID and carried by the request context
+// for the lines logged about the request.
+func (a *RegistryAPI) RequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !REQUEST_ID_REGEXP.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		handler.ServeHTTP(w, r.WithContext(logger.WithRequestID(r.Context(), id)))
+	})
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Must wrap the router (handler is the router, possibly wrapped). Writes an access log line per request.
+func (a *RegistryAPI) AccessLog(router *mux.Router, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &countingReadCloser{ReadCloser: r.Body}
+		r.Body = body
+		recorder := &responseRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		fields := logger.Fields{
+			"method":        r.Method,
+			"path":          r.URL.RequestURI(),
+			"status":        recorder.status,
+			"bytes":         recorder.bytes,
+			"request_bytes": body.bytes,
+			"duration":      time.Since(start).Seconds(),
+			"remote_addr":   r.RemoteAddr,
+			"user_agent":    r.UserAgent(),
+		}
+		if identity := Identity(r); identity != "" {
+			fields["identity"] = identity
+		}
+		if id := logger.RequestID(r.Context()); id != "" {
+			fields["request_id"] = id
+		}
+		for name, value := range a.requestTarget(router, r) {
+			fields[name] = value
+		}
+		logger.Access(fields)
+	})
+}
+
+// returns the namespace, repo, tag and image id a request is about, as far as they are known
+func (a *RegistryAPI) requestTarget(router *mux.Router, r *http.Request) map[string]string {
+	target := map[string]string{}
+	var match mux.RouteMatch
+	if !router.Match(r, &match) {
+		return target
+	}
+	if repo := match.Vars["repo"]; repo != "" {
+		namespace := match.Vars["namespace"]
+		if namespace == "" {
+			namespace = "library"
+		}
+		target["namespace"], target["repo"] = namespace, repo
+	} else if namespace, repo := a.tokenRepo(r); repo != "" {
+		target["namespace"], target["repo"] = namespace, repo
+	}
+	if tag := match.Vars["tag"]; tag != "" {
+		target["tag"] = tag
+	}
+	if imageID := match.Vars["imageID"]; imageID != "" {
+		target["image_id"] = imageID
+	}
+	return target
+}
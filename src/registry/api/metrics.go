@@ -0,0 +1,132 @@
+package api
+
+import (
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"registry/metrics"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const LAYER_ROUTE = "/v1/images/{imageID}/layer"
+
+func (a *RegistryAPI) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WriteAll(w)
+}
+
+// records the status and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// records the size of a request body
+type countingReadCloser struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Must wrap the router (handler is the router, possibly wrapped). Counts requests and their latency by route, and
+// the bytes of layers pushed and pulled.
+func (a *RegistryAPI) Instrument(router *mux.Router, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route, method := routeTemplate(router, r), methodLabel(router, r)
+		isLayer := route == LAYER_ROUTE
+		body := &countingReadCloser{ReadCloser: r.Body}
+		r.Body = body
+		if isLayer && r.Method == "PUT" {
+			metrics.ActiveUploads.Add(1)
+			defer metrics.ActiveUploads.Add(-1)
+		}
+		writer := &responseRecorder{ResponseWriter: w}
+		handler.ServeHTTP(writer, r)
+		if writer.status == 0 {
+			writer.status = http.StatusOK
+		}
+		status := strconv.Itoa(writer.status)
+		metrics.HTTPRequests.Inc(method, route, status)
+		metrics.HTTPRequestDuration.ObserveSince(start, method, route, status)
+		if isLayer && r.Method == "PUT" {
+			metrics.BytesPushed.Add(float64(body.bytes))
+		} else if isLayer && r.Method == "GET" {
+			metrics.BytesPulled.Add(float64(writer.bytes))
+		}
+	})
+}
+
+// returns the path template of the route r matches, e.g. /v1/images/{imageID}/json, so there is one series per
+// route rather than per image. requests matching no route are all "other".
+func routeTemplate(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if !router.Match(r, &match) || match.Route == nil || match.Route.GetName() == "" {
+		return "other"
+	}
+	return match.Route.GetName()
+}
+
+var KNOWN_METHODS = map[string]bool{
+	"GET": true, "HEAD": true, "PUT": true, "POST": true, "DELETE": true, "PATCH": true, "OPTIONS": true,
+}
+
+// the methods handle restricted each route name to
+type methodSet struct {
+	sync.RWMutex
+	methods map[string]map[string]bool
+}
+
+var routeMethods = &methodSet{methods: map[string]map[string]bool{}}
+
+func (s *methodSet) add(name string, methods []string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.methods[name] == nil {
+		s.methods[name] = map[string]bool{}
+	}
+	for _, method := range methods {
+		s.methods[name][method] = true
+	}
+}
+
+func (s *methodSet) has(name, method string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.methods[name][method]
+}
+
+// returns the method of r as a label. routes without a method restriction (and requests matching no route) take
+// any method, which would make a series per made up method, so the unusual ones are all "other".
+func methodLabel(router *mux.Router, r *http.Request) string {
+	if KNOWN_METHODS[r.Method] {
+		return r.Method
+	}
+	var match mux.RouteMatch
+	if router.Match(r, &match) && match.Route != nil && routeMethods.has(match.Route.GetName(), r.Method) {
+		return r.Method
+	}
+	return "other"
+}
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteLabels(t *testing.T) {
+	router := newTestAPI(t, &Config{}).Router(ROUTE_GROUPS)
+	for _, test := range []struct{ method, url, route, label string }{
+		{"GET", "/v1/images/abc/json", "/v1/images/{imageID}/json", "GET"},
+		{"GET", "/v1/repositories/team/app/tags/app", "/v1/repositories/{namespace}/{repo}/tags/{tag}", "GET"},
+		{"GET", "/v1/nothing/here", "other", "GET"},
+		{"BREW", "/v1/_ping", "/v1/_ping", "other"},
+		{"BREW", "/v1/nothing/here", "other", "other"},
+	} {
+		r := httptest.NewRequest(test.method, test.url, nil)
+		if route := routeTemplate(router, r); route != test.route {
+			t.Errorf("Expected route %s for %s %s, got %s", test.route, test.method, test.url, route)
+		}
+		if label := methodLabel(router, r); label != test.label {
+			t.Errorf("Expected method %s for %s %s, got %s", test.label, test.method, test.url, label)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"registry/layers"
+	"registry/logger"
+)
+
+// Quota limits the bytes taken by the layers reachable from the tags of a namespace. Zero disables a limit.
+type Quota struct {
+	// past this, requests still succeed but carry an X-Registry-Quota-Warning header
+	Soft int64 `json:"soft"`
+	// requests that would go past this are refused
+	Hard int64 `json:"hard"`
+}
+
+type QuotaError struct {
+	Namespace string
+	Used      int64
+	Adding    int64 // -1 if unknown
+	Limit     int64
+}
+
+func (e *QuotaError) Error() string {
+	if e.Adding < 0 {
+		return fmt.Sprintf("Namespace '%s' is over its hard quota: %d bytes used, quota is %d bytes", e.Namespace,
+			e.Used, e.Limit)
+	}
+	return fmt.Sprintf("Namespace '%s' would exceed its hard quota: %d bytes used, %d more needed, quota is %d bytes",
+		e.Namespace, e.Used, e.Adding, e.Limit)
+}
+
+func (a *RegistryAPI) quota(namespace string) *Quota {
+	cfg := a.config()
+	if quota, ok := cfg.Quotas[namespace]; ok {
+		return quota
+	}
+	return cfg.Quotas["*"]
+}
+
+// checks that adding bytes (-1 if unknown yet) to namespace stays within its hard quota, and warns through w if it
+// goes past the soft one. returns the usage before adding.
+func (a *RegistryAPI) checkQuota(w http.ResponseWriter, r *http.Request, namespace string, adding int64) (int64, error) {
+	quota := a.quota(namespace)
+	if quota == nil || namespace == "" {
+		return 0, nil
+	}
+	usage, err := a.usage.Get(namespace)
+	if err != nil {
+		return 0, err
+	}
+	after := usage.Bytes
+	if adding > 0 {
+		after += adding
+	}
+	// nothing added, like a retag to an image already counted, is fine even over the quota
+	if quota.Hard > 0 && adding != 0 && (after > quota.Hard || usage.Bytes >= quota.Hard) {
+		return usage.Bytes, &QuotaError{Namespace: namespace, Used: usage.Bytes, Adding: adding, Limit: quota.Hard}
+	}
+	if quota.Soft > 0 && after > quota.Soft {
+		warning := fmt.Sprintf("namespace %s is over its soft quota: %d of %d bytes used", namespace, after, quota.Soft)
+		logger.ForRequest(r.Context()).Info("[Quota] %s", warning)
+		w.Header().Set("X-Registry-Quota-Warning", warning)
+	}
+	return usage.Bytes, nil
+}
+
+// responds to a request refused because of a quota: 413 if this request alone is too much, 507 if the namespace
+// is already full
+func (a *RegistryAPI) refuseQuota(w http.ResponseWriter, err error) {
+	quotaErr, ok := err.(*QuotaError)
+	if !ok {
+		a.internalError(w, err.Error())
+		return
+	}
+	code := http.StatusRequestEntityTooLarge
+	if quotaErr.Used >= quotaErr.Limit {
+		code = http.StatusInsufficientStorage
+	}
+	a.response(w, err.Error(), code, EMPTY_HEADERS)
+}
+
+// checks that tagging imageID in namespace stays within its hard quota
+func (a *RegistryAPI) checkTagQuota(w http.ResponseWriter, r *http.Request, namespace, imageID string) error {
+	if a.quota(namespace) == nil {
+		return nil
+	}
+	adding, err := a.usage.Adding(namespace, imageID)
+	if err != nil {
+		return err
+	}
+	_, err = a.checkQuota(w, r, namespace, adding)
+	return err
+}
+
+// records tag of namespace/repo moving from oldImageID to newImageID ("" for none) in the usage of namespace
+func (a *RegistryAPI) recordRetag(ctx context.Context, namespace, repo, tag, oldImageID, newImageID string) {
+	if err := a.usage.Retag(namespace, repo, tag, oldImageID, newImageID); err != nil {
+		logger.ForRequest(ctx).Error("[Quota] error updating the usage of %s: %s", namespace, err.Error())
+	}
+}
+
+// fails reads once more than remaining has been read
+type quotaReader struct {
+	io.Reader
+	err       *QuotaError
+	remaining int64
+	exceeded  bool
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.err.Adding += int64(n)
+	if r.err.Adding > r.remaining {
+		r.exceeded = true
+		return n, r.err
+	}
+	return n, err
+}
+
+type namespaceUsage struct {
+	Namespace string `json:"namespace"`
+	Bytes     int64  `json:"bytes"`
+	Images    int    `json:"images"`
+	Quota     *Quota `json:"quota,omitempty"`
+}
+
+// GET /v1/_admin/usage[?namespace=...] reports the usage of namespaces, POST recomputes it from scratch
+func (a *RegistryAPI) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	var usages []*layers.Usage
+	var err error
+	if namespace := r.URL.Query().Get("namespace"); namespace != "" && r.Method == "GET" {
+		var usage *layers.Usage
+		usage, err = a.usage.Get(namespace)
+		usages = []*layers.Usage{usage}
+	} else if r.Method == "POST" {
+		usages, err = a.usage.Rebuild()
+	} else {
+		usages, err = a.usage.All()
+	}
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	report := make([]*namespaceUsage, len(usages))
+	for i, usage := range usages {
+		report[i] = &namespaceUsage{
+			Namespace: usage.Namespace,
+			Bytes:     usage.Bytes,
+			Images:    len(usage.Images),
+			Quota:     a.quota(usage.Namespace),
+		}
+	}
+	a.response(w, report, http.StatusOK, EMPTY_HEADERS)
+}
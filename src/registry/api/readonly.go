@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+const DEFAULT_READ_ONLY_RETRY_AFTER = 60
+
+// Must wrap every route that writes to storage, so that read-only mode leaves the storage untouched
+func (a *RegistryAPI) RequireWritable(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.IsReadOnly() {
+			a.readOnlyResponse(w)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// refuses a write because the registry is read-only
+func (a *RegistryAPI) readOnlyResponse(w http.ResponseWriter) {
+	retryAfter := a.config().ReadOnlyRetryAfter
+	if retryAfter <= 0 {
+		retryAfter = DEFAULT_READ_ONLY_RETRY_AFTER
+	}
+	headers := map[string][]string{"Retry-After": []string{strconv.Itoa(retryAfter)}}
+	a.response(w, "Registry is in read-only mode, retry later", http.StatusServiceUnavailable, headers)
+}
+
+func (a *RegistryAPI) IsReadOnly() bool {
+	return atomic.LoadInt32(&a.readOnly) != 0
+}
+
+func (a *RegistryAPI) SetReadOnly(readOnly bool) {
+	var value int32
+	if readOnly {
+		value = 1
+	}
+	atomic.StoreInt32(&a.readOnly, value)
+}
+
+type readOnlyState struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+// GET returns whether the registry is read-only, PUT {"read_only": true|false} switches it
+func (a *RegistryAPI) ReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		var state readOnlyState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			a.response(w, "Error Decoding JSON: "+err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
+			return
+		}
+		a.SetReadOnly(state.ReadOnly)
+	}
+	a.response(w, &readOnlyState{ReadOnly: a.IsReadOnly()}, http.StatusOK, EMPTY_HEADERS)
+}
@@ -0,0 +1,28 @@
+package api
+
+import (
+	"net/http"
+	"registry/storage"
+	"testing"
+)
+
+func TestReadOnlyLeavesStorage(t *testing.T) {
+	a := newTestAPI(t, &Config{ReadOnly: true, Audit: true})
+	putTestImage(t, a, "1", "", 0)
+	a.Storage.Put(storage.ImageLayerPath("1"), testLayer(10))
+	putTestTag(t, a, "team", "app", "v1", "1")
+
+	checkStatus(t, serve(a, "PUT", "/v1/repositories/team/app/tags/v2", "", `"1"`), http.StatusServiceUnavailable)
+	checkStatus(t, serve(a, "POST", "/v1/_admin/fsck?repair=true", "", ""), http.StatusServiceUnavailable)
+	w := serve(a, "GET", "/v1/images/1/diff", "", "")
+	checkStatus(t, w, http.StatusOK)
+	if w.Body.Len() == 0 {
+		t.Fatal("Expected the diff to be computed for the request")
+	}
+	checkStatus(t, serve(a, "GET", "/v1/_admin/usage?namespace=team", "", ""), http.StatusOK)
+	for _, key := range []string{storage.ImageDiffPath("1"), storage.AUDIT_PATH, storage.USAGE_PATH} {
+		if exists, _ := a.Storage.Exists(key); exists {
+			t.Fatalf("Expected nothing written to %s while read-only", key)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"registry/audit"
+	"registry/layers"
+	"registry/logger"
+	"registry/webhooks"
+	"time"
+)
+
+// how often the retention loop looks at its config, so a reload takes effect without waiting a whole interval
+const RETENTION_CHECK_INTERVAL = time.Minute
+
+type RetentionConfig struct {
+	// keyed by namespace/repo or namespace, "*" applies to repositories without a rule of their own
+	Rules map[string]*layers.RetentionRule `json:"rules"`
+	// seconds between scheduled runs, 0 only runs them through /v1/_admin/retention
+	Interval int `json:"interval"`
+	// scheduled runs only log what they would delete
+	DryRun bool `json:"dry_run"`
+	// remove the images of deleted tags nothing else uses
+	GC bool `json:"gc"`
+}
+
+func (a *RegistryAPI) retention(cfg *RetentionConfig, dryRun bool) *layers.Retention {
+	return &layers.Retention{
+		Storage: a.Storage,
+		Rules:   cfg.Rules,
+		DryRun:  dryRun,
+		GC:      cfg.GC,
+		Protected: func(namespace, repo, tag string) bool {
+			return a.immutableTagRule(namespace, repo, tag) != nil
+		},
+		OnDelete: func(tag *layers.RetainedTag) {
+			a.recordRetag(context.Background(), tag.Namespace, tag.Repo, tag.Tag, tag.ImageID, "")
+			a.notifier.Notify(&webhooks.Event{Action: webhooks.ACTION_UNTAG, Actor: "retention",
+				Namespace: tag.Namespace, Repo: tag.Repo, Tag: tag.Tag, ImageID: tag.ImageID})
+			a.auditRetention(tag)
+		},
+		Lock: func(namespace, repo, tag string) func() {
+			return lockTags([3]string{namespace, repo, tag})
+		},
+		LockImages: lockImages,
+	}
+}
+
+// records a tag deleted by the retention rules in the audit log, like the request deleting it would have been
+func (a *RegistryAPI) auditRetention(tag *layers.RetainedTag) {
+	if !a.config().Audit {
+		return
+	}
+	entry := &audit.Entry{
+		Identity:  "retention",
+		Method:    "DELETE",
+		Route:     "retention",
+		Namespace: tag.Namespace,
+		Repo:      tag.Repo,
+		Tag:       tag.Tag,
+		OldTarget: tag.ImageID,
+		Status:    http.StatusOK,
+	}
+	if err := a.audit.Append(entry); err != nil {
+		logger.Error("[Retention] error recording the deletion of %s/%s:%s: %s", tag.Namespace, tag.Repo, tag.Tag,
+			err.Error())
+	}
+}
+
+// applies the retention rules every Interval, for as long as the registry runs
+func (a *RegistryAPI) retentionLoop() {
+	lastRun := time.Now()
+	for !a.ShuttingDown() {
+		time.Sleep(RETENTION_CHECK_INTERVAL)
+		cfg := a.config().Retention
+		if cfg == nil || cfg.Interval == 0 || time.Since(lastRun) < time.Duration(cfg.Interval)*time.Second {
+			continue
+		}
+		lastRun = time.Now()
+		if a.IsReadOnly() {
+			logger.Info("[Retention] skipping scheduled run, the registry is read-only")
+			continue
+		}
+		report, err := a.retention(cfg, cfg.DryRun).Run()
+		if err != nil {
+			logger.Error("[Retention] %s", err.Error())
+		}
+		if report == nil {
+			continue
+		}
+		if report.DryRun {
+			for _, tag := range report.Deleted {
+				logger.Info("[Retention] would delete %s/%s:%s (%s)", tag.Namespace, tag.Repo, tag.Tag, tag.ImageID)
+			}
+			for _, imageID := range report.DeletedImages {
+				logger.Info("[Retention] would delete image %s", imageID)
+			}
+		}
+		logger.Info("[Retention] dry_run=%t repositories=%d tags=%d deleted_tags=%d deleted_images=%d",
+			report.DryRun, report.Repositories, report.Tags, len(report.Deleted), len(report.DeletedImages))
+	}
+}
+
+// GET reports what the rules would delete, POST deletes it
+func (a *RegistryAPI) RetentionHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := a.config().Retention
+	if cfg == nil {
+		a.response(w, "No retention rules configured", http.StatusNotFound, EMPTY_HEADERS)
+		return
+	}
+	report, err := a.retention(cfg, r.Method != "POST").Run()
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	a.response(w, report, http.StatusOK, EMPTY_HEADERS)
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http"
+	"registry/audit"
+	"registry/layers"
+	"registry/storage"
+	"testing"
+)
+
+func TestRetentionAudit(t *testing.T) {
+	a := newTestAPI(t, &Config{Audit: true, Retention: &RetentionConfig{
+		Rules: map[string]*layers.RetentionRule{"team": {KeepLast: 1}},
+	}})
+	putTestImage(t, a, "1", "", 10)
+	for tag, json := range map[string]string{"v1": `{"last_update":100}`, "v2": `{"last_update":200}`} {
+		putTestTag(t, a, "team", "app", tag, "1")
+		a.Storage.Put(storage.RepoTagJsonPath("team", "app", tag), []byte(json))
+	}
+	checkStatus(t, serve(a, "POST", "/v1/_admin/retention", "", ""), http.StatusOK)
+	entries, err := audit.Find(a.Storage, &audit.Query{Namespace: "team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Identity != "retention" || entries[0].Tag != "v1" ||
+		entries[0].OldTarget != "1" {
+		t.Fatalf("Expected the deletion of v1 to be recorded, got %+v", entries)
+	}
+}
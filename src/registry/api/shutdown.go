@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_SHUTDOWN_TIMEOUT = 60
+
+func (a *RegistryAPI) ShuttingDown() bool {
+	return atomic.LoadInt32(&a.shuttingDown) != 0
+}
+
+// Shutdown stops every listener from accepting connections, closes the idle ones and waits up to ShutdownTimeout
+// seconds for running requests (pushes and pulls in particular) to finish. ListenAndServe returns as soon as
+// Shutdown is called.
+func (a *RegistryAPI) Shutdown() error {
+	if !atomic.CompareAndSwapInt32(&a.shuttingDown, 0, 1) {
+		return errors.New("Already shutting down")
+	}
+	timeout := a.config().ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_SHUTDOWN_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	a.listenerLock.Lock()
+	servers := a.servers
+	a.listenerLock.Unlock()
+	// all at once, so that no listener keeps accepting while another one drains
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			errs <- server.Shutdown(ctx)
+		}(server)
+	}
+	var err error
+	for range servers {
+		if serverErr := <-errs; serverErr != nil {
+			err = serverErr
+		}
+	}
+	if err == context.DeadlineExceeded {
+		return errors.New("Timed out waiting for requests to finish")
+	}
+	return err
+}
@@ -2,10 +2,49 @@ package api
 
 import (
 	"net/http"
+	"registry/layers"
+	"registry/logger"
+	"sync"
+	"time"
 )
 
+// walking every blob is expensive, so the stats are only recomputed this often
+const STATUS_DEDUP_TTL = 5 * time.Minute
+
+// the last dedup stats. they are computed in the background so that status probes never wait for the walk.
+type dedupStatsCache struct {
+	sync.Mutex
+	stats    *layers.DedupStats
+	computed time.Time
+	running  bool
+}
+
 func (a *RegistryAPI) StatusHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO[jigish] implement this
-	// informative data about the server should go here =P
-	NotImplementedHandler(w, r)
+	a.response(w, map[string]interface{}{"read_only": a.IsReadOnly(), "dedup": a.dedupStats()}, http.StatusOK,
+		EMPTY_HEADERS)
+}
+
+// returns the last stats computed, nil until the first walk is done, and starts a new walk if they are older than
+// STATUS_DEDUP_TTL
+func (a *RegistryAPI) dedupStats() *layers.DedupStats {
+	a.dedupCache.Lock()
+	defer a.dedupCache.Unlock()
+	if !a.dedupCache.running && time.Since(a.dedupCache.computed) >= STATUS_DEDUP_TTL {
+		a.dedupCache.running = true
+		go a.computeDedupStats()
+	}
+	return a.dedupCache.stats
+}
+
+func (a *RegistryAPI) computeDedupStats() {
+	stats, err := layers.GetDedupStats(a.Storage)
+	a.dedupCache.Lock()
+	defer a.dedupCache.Unlock()
+	// a failed walk waits for the TTL too, the storage is having trouble already
+	a.dedupCache.running, a.dedupCache.computed = false, time.Now()
+	if err != nil {
+		logger.Error("[Status] error computing dedup stats: %s", err.Error())
+		return
+	}
+	a.dedupCache.stats = stats
 }
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusDedupStats(t *testing.T) {
+	a := newTestAPI(t, &Config{})
+	// the walk runs in the background, the first probes answer without stats
+	w := serve(a, "GET", "/v1/_status", "", "")
+	checkStatus(t, w, http.StatusOK)
+	for i := 0; strings.Contains(w.Body.String(), `"dedup":null`); i++ {
+		if i == 100 {
+			t.Fatalf("Expected the stats to be computed, got %s", w.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+		w = serve(a, "GET", "/v1/_status", "", "")
+	}
+	if !strings.Contains(w.Body.String(), `"blobs":0`) {
+		t.Fatalf("Expected the dedup stats, got %s", w.Body.String())
+	}
+}
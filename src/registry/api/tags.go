@@ -5,8 +5,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path"
+	"registry/layers"
 	"registry/logger"
 	"registry/storage"
+	"registry/webhooks"
 	"strings"
 	"time"
 )
@@ -22,12 +24,22 @@ var EMPTY_REPO_JSON = map[string]interface{}{
 
 func (a *RegistryAPI) GetRepoTagsHandler(w http.ResponseWriter, r *http.Request) {
 	namespace, repo, _ := parseRepo(r, "")
-	logger.Debug("[GetRepoTags] namespace=%s; repository=%s", namespace, repo)
+	logger.ForRequest(r.Context()).Debug("[GetRepoTags] namespace=%s; repository=%s", namespace, repo)
 	names, err := a.Storage.List(storage.RepoTagPath(namespace, repo, ""))
 	if err != nil {
 		a.response(w, "Repository not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
 		return
 	}
+	data, err := a.repoTags(names)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	a.response(w, data, http.StatusOK, EMPTY_HEADERS)
+}
+
+// returns tag -> image id for the tags among names (the listing of a repository)
+func (a *RegistryAPI) repoTags(names []string) (map[string]string, error) {
 	data := map[string]string{}
 	for _, name := range names {
 		base := path.Base(name)
@@ -38,27 +50,50 @@ func (a *RegistryAPI) GetRepoTagsHandler(w http.ResponseWriter, r *http.Request)
 		tagName := strings.TrimPrefix(base, storage.TAG_PREFIX)
 		content, err := a.Storage.Get(name)
 		if err != nil {
-			a.internalError(w, err.Error())
-			return
+			return nil, err
 		}
 		data[tagName] = string(content)
 	}
-	a.response(w, data, http.StatusOK, EMPTY_HEADERS)
+	return data, nil
+}
+
+// returns tag -> image id for every tag of the repository, none if it doesn't exist
+func (a *RegistryAPI) currentTags(namespace, repo string) map[string]string {
+	names, err := a.Storage.List(storage.RepoTagPath(namespace, repo, ""))
+	if err != nil {
+		return map[string]string{}
+	}
+	tags, err := a.repoTags(names)
+	if err != nil {
+		return map[string]string{}
+	}
+	return tags
 }
 
 func (a *RegistryAPI) DeleteRepoTagsHandler(w http.ResponseWriter, r *http.Request) {
 	namespace, repo, _ := parseRepo(r, "")
-	logger.Debug("[DeleteRepoTags] namespace=%s; repository=%s", namespace, repo)
+	logger.ForRequest(r.Context()).Debug("[DeleteRepoTags] namespace=%s; repository=%s", namespace, repo)
+	defer lockRepo(namespace, repo)()
+	if err := a.checkRepoMutable(namespace, repo); err != nil {
+		a.refuseMutation(w, err)
+		return
+	}
+	previous := a.currentTags(namespace, repo)
+	auditRepo(r, previous)
 	if err := a.Storage.RemoveAll(storage.RepoTagPath(namespace, repo, "")); err != nil {
 		a.response(w, "Repository not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
 		return
 	}
+	for tag, imageID := range previous {
+		a.recordRetag(r.Context(), namespace, repo, tag, imageID, "")
+	}
+	a.notify(r, &webhooks.Event{Action: webhooks.ACTION_DELETE_TAGS, Namespace: namespace, Repo: repo})
 	a.response(w, true, http.StatusOK, EMPTY_HEADERS)
 }
 
 func (a *RegistryAPI) GetRepoTagHandler(w http.ResponseWriter, r *http.Request) {
 	namespace, repo, tag := parseRepo(r, "tag")
-	logger.Debug("[GetRepoTag] namespace=%s; repository=%s; tag=%s", namespace, repo, tag)
+	logger.ForRequest(r.Context()).Debug("[GetRepoTag] namespace=%s; repository=%s; tag=%s", namespace, repo, tag)
 	content, err := a.Storage.Get(storage.RepoTagPath(namespace, repo, tag))
 	if err != nil {
 		a.response(w, "Tag not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
@@ -69,7 +104,7 @@ func (a *RegistryAPI) GetRepoTagHandler(w http.ResponseWriter, r *http.Request)
 
 func (a *RegistryAPI) PutRepoTagHandler(w http.ResponseWriter, r *http.Request) {
 	namespace, repo, tag := parseRepo(r, "tag")
-	logger.Debug("[PutRepoTag] namespace=%s; repository=%s; tag=%s", namespace, repo, tag)
+	logger.ForRequest(r.Context()).Debug("[PutRepoTag] namespace=%s; repository=%s; tag=%s", namespace, repo, tag)
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		a.response(w, "Error reading request body: "+err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
@@ -78,49 +113,345 @@ func (a *RegistryAPI) PutRepoTagHandler(w http.ResponseWriter, r *http.Request)
 		a.response(w, "Empty data", http.StatusBadRequest, EMPTY_HEADERS)
 		return
 	}
-	logger.Debug("[PutRepoTag] body:\n%s", data)
+	logger.ForRequest(r.Context()).Debug("[PutRepoTag] body:\n%s", data)
 	imageID := strings.Trim(string(data), "\"") // trim quotes
-	if exists, err := a.Storage.Exists(storage.ImageJsonPath(imageID)); err != nil || !exists {
-		a.response(w, "Image not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+	// checked under the lock, which keeps the image from being deleted until the tag is written
+	defer lockTags([3]string{namespace, repo, tag})()
+	if exists, _ := a.Storage.Exists(storage.ImageJsonPath(imageID)); !exists {
+		a.response(w, "Image not found", http.StatusNotFound, EMPTY_HEADERS)
 		return
 	}
-	err = a.Storage.Put(storage.RepoTagPath(namespace, repo, tag), []byte(imageID))
-	if err != nil {
-		a.internalError(w, err.Error())
+	if err := a.checkTagMutable(namespace, repo, tag, imageID); err != nil {
+		a.refuseMutation(w, err)
 		return
 	}
-	uaStrings := r.Header["User-Agent"]
-	uaString := ""
-	if len(uaStrings) > 0 {
-		// just use the first one. there *should* only be one to begin with.
-		uaString = uaStrings[0]
+	if err := a.checkTagQuota(w, r, namespace, imageID); err != nil {
+		a.refuseQuota(w, err)
+		return
 	}
-	dataMap := CreateRepoJson(uaString)
-	jsonData, err := json.Marshal(&dataMap)
+	jsonData, err := clientJson(r.UserAgent())
 	if err != nil {
 		a.internalError(w, err.Error())
 		return
 	}
+	if err := a.setTag(r, namespace, repo, tag, imageID, jsonData, false); err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	a.response(w, true, http.StatusOK, EMPTY_HEADERS)
+}
+
+// the tag json for a tag set by the docker client in userAgent
+func clientJson(userAgent string) ([]byte, error) {
+	dataMap := CreateRepoJson(userAgent)
+	return json.Marshal(&dataMap)
+}
+
+// points tag at imageID and records it in the history of the tag. jsonData is the tag json, and the repository
+// json if tag is latest.
+func (a *RegistryAPI) setTag(r *http.Request, namespace, repo, tag, imageID string, jsonData []byte,
+	rollback bool) error {
+	previous := a.tagTarget(namespace, repo, tag)
+	err := a.Storage.Put(storage.RepoTagPath(namespace, repo, tag), []byte(imageID))
+	// once written, deletes that may have scanned before it have to know (even if the write failed part way)
+	tagWritten(namespace, repo, tag, imageID)
+	if err != nil {
+		return err
+	}
+	auditTag(r, namespace, repo, tag, previous, imageID)
+	a.recordRetag(r.Context(), namespace, repo, tag, previous, imageID)
 	a.Storage.Put(storage.RepoTagJsonPath(namespace, repo, tag), jsonData)
 	if tag == "latest" {
 		a.Storage.Put(storage.RepoJsonPath(namespace, repo), jsonData)
 	}
-	a.response(w, true, http.StatusOK, EMPTY_HEADERS)
+	entry := &layers.TagHistoryEntry{
+		ImageID:   imageID,
+		Time:      time.Now().UTC(),
+		Pusher:    Identity(r),
+		UserAgent: r.UserAgent(),
+		Rollback:  rollback,
+	}
+	if err := layers.AppendTagHistory(a.Storage, namespace, repo, tag, entry); err != nil {
+		// the tag itself is set, don't fail the request
+		logger.ForRequest(r.Context()).Error("[SetTag] error recording history of %s/%s:%s: %s", namespace, repo, tag, err.Error())
+	}
+	a.notify(r, &webhooks.Event{Action: webhooks.ACTION_TAG, Namespace: namespace, Repo: repo, Tag: tag, ImageID: imageID})
+	return nil
+}
+
+func (a *RegistryAPI) GetRepoTagHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, repo, tag := parseRepo(r, "tag")
+	logger.ForRequest(r.Context()).Debug("[GetRepoTagHistory] namespace=%s; repository=%s; tag=%s", namespace, repo, tag)
+	history, err := layers.GetTagHistory(a.Storage, namespace, repo, tag)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	if len(history) == 0 {
+		if exists, _ := a.Storage.Exists(storage.RepoTagPath(namespace, repo, tag)); !exists {
+			a.response(w, "Tag not found", http.StatusNotFound, EMPTY_HEADERS)
+			return
+		}
+	}
+	a.response(w, history, http.StatusOK, EMPTY_HEADERS)
+}
+
+type rollback struct {
+	ImageID string `json:"image_id"`
+}
+
+// Points a tag back at an image it pointed to before: the one in the request body ({"image_id": ...}), or without
+// a body, the last one before the current.
+func (a *RegistryAPI) RollbackRepoTagHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, repo, tag := parseRepo(r, "tag")
+	logger.ForRequest(r.Context()).Debug("[RollbackRepoTag] namespace=%s; repository=%s; tag=%s", namespace, repo, tag)
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		a.response(w, "Error reading request body: "+err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
+		return
+	}
+	var request rollback
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &request); err != nil {
+			a.response(w, "Error Decoding JSON: "+err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
+			return
+		}
+	}
+	defer lockTags([3]string{namespace, repo, tag})()
+	history, err := layers.GetTagHistory(a.Storage, namespace, repo, tag)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	current := ""
+	if content, err := a.Storage.Get(storage.RepoTagPath(namespace, repo, tag)); err == nil {
+		current = string(content)
+	}
+	target := layers.RollbackTarget(history, current, request.ImageID)
+	if target == nil {
+		a.response(w, "No previous image to roll back to", http.StatusNotFound, EMPTY_HEADERS)
+		return
+	}
+	if exists, _ := a.Storage.Exists(storage.ImageJsonPath(target.ImageID)); !exists {
+		a.response(w, "Image not found: "+target.ImageID, http.StatusNotFound, EMPTY_HEADERS)
+		return
+	}
+	if err := a.checkTagMutable(namespace, repo, tag, target.ImageID); err != nil {
+		a.refuseMutation(w, err)
+		return
+	}
+	if err := a.checkTagQuota(w, r, namespace, target.ImageID); err != nil {
+		a.refuseQuota(w, err)
+		return
+	}
+	jsonData, err := clientJson(target.UserAgent)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	if err := a.setTag(r, namespace, repo, tag, target.ImageID, jsonData, true); err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	a.response(w, &rollback{ImageID: target.ImageID}, http.StatusOK, EMPTY_HEADERS)
+}
+
+type tagCopy struct {
+	// where to copy the tag to. each defaults to the source
+	Namespace string `json:"namespace"`
+	Repo      string `json:"repo"`
+	Tag       string `json:"tag"`
+	// delete the source tag once copied
+	Move bool `json:"move"`
+}
+
+// Copies (or moves) a tag to another tag, possibly in another repository, without the image leaving the registry.
+// The target is checked like a tag push: the client needs write access to it, and immutability and quotas apply.
+func (a *RegistryAPI) CopyRepoTagHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, repo, tag := parseRepo(r, "tag")
+	logger.ForRequest(r.Context()).Debug("[CopyRepoTag] namespace=%s; repository=%s; tag=%s", namespace, repo, tag)
+	target := &tagCopy{}
+	if err := json.NewDecoder(r.Body).Decode(target); err != nil {
+		a.response(w, "Error Decoding JSON: "+err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
+		return
+	}
+	if target.Namespace == "" {
+		target.Namespace = namespace
+	}
+	if target.Repo == "" {
+		target.Repo = repo
+	}
+	if target.Tag == "" {
+		target.Tag = tag
+	}
+	if !validRepoName(target.Namespace) || !validRepoName(target.Repo) || !TAG_NAME_REGEXP.MatchString(target.Tag) {
+		a.response(w, "Invalid target namespace, repository or tag", http.StatusBadRequest, EMPTY_HEADERS)
+		return
+	}
+	if target.Namespace == namespace && target.Repo == repo && target.Tag == tag {
+		a.response(w, "Source and target are the same tag", http.StatusBadRequest, EMPTY_HEADERS)
+		return
+	}
+	// the router only checked read access to the source
+	identity := Identity(r)
+	if !a.allowed(identity, target.Namespace, ACCESS_WRITE) ||
+		(target.Move && !a.allowed(identity, namespace, ACCESS_WRITE)) {
+		a.response(w, "Access denied", http.StatusForbidden, EMPTY_HEADERS)
+		return
+	}
+	defer lockTags([3]string{namespace, repo, tag}, [3]string{target.Namespace, target.Repo, target.Tag})()
+	imageID := a.tagTarget(namespace, repo, tag)
+	if imageID == "" {
+		a.response(w, "Tag not found", http.StatusNotFound, EMPTY_HEADERS)
+		return
+	}
+	ancestry, err := layers.GetAncestry(a.Storage, imageID)
+	if err != nil {
+		a.response(w, "Image not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+		return
+	}
+	for _, id := range ancestry {
+		exists, _ := a.Storage.Exists(storage.ImageJsonPath(id))
+		inProgress, _ := a.Storage.Exists(storage.ImageMarkPath(id))
+		if !exists || inProgress {
+			a.response(w, "Image "+id+" in the ancestry of "+imageID+" is missing or incomplete", http.StatusNotFound,
+				EMPTY_HEADERS)
+			return
+		}
+	}
+	if err := a.checkTagMutable(target.Namespace, target.Repo, target.Tag, imageID); err != nil {
+		a.refuseMutation(w, err)
+		return
+	}
+	if target.Move {
+		if err := a.checkTagMutable(namespace, repo, tag, ""); err != nil {
+			a.refuseMutation(w, err)
+			return
+		}
+	}
+	if err := a.checkTagQuota(w, r, target.Namespace, imageID); err != nil {
+		a.refuseQuota(w, err)
+		return
+	}
+
+	// the target repository lists the images like a push would have
+	indexImages := a.indexImages(namespace, repo, ancestry)
+	indexBytes, err := json.Marshal(&indexImages)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	if err := layers.UpdateIndexImages(a.Storage, target.Namespace, target.Repo, indexBytes, indexImages); err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	// fresh tag json, the source's last_update would make the copy look as old as the source to retention
+	jsonData, err := clientJson(r.UserAgent())
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	if err := a.setTag(r, target.Namespace, target.Repo, target.Tag, imageID, jsonData, false); err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	if target.Move {
+		if err := a.deleteTag(r, namespace, repo, tag); err != nil {
+			a.internalError(w, "copied, but the source tag could not be deleted: "+err.Error())
+			return
+		}
+	}
+	a.response(w, map[string]string{
+		"namespace": target.Namespace,
+		"repo":      target.Repo,
+		"tag":       target.Tag,
+		"image_id":  imageID,
+	}, http.StatusOK, EMPTY_HEADERS)
+}
+
+// returns the _index_images entries of the repository for imageIDs, with just the id for images it doesn't list
+func (a *RegistryAPI) indexImages(namespace, repo string, imageIDs []string) []map[string]interface{} {
+	listed := map[string]map[string]interface{}{}
+	if content, err := a.Storage.Get(storage.RepoIndexImagesPath(namespace, repo)); err == nil {
+		var images []map[string]interface{}
+		json.Unmarshal(content, &images)
+		for _, image := range images {
+			if id, ok := image["id"].(string); ok {
+				listed[id] = image
+			}
+		}
+	}
+	entries := make([]map[string]interface{}, len(imageIDs))
+	for i, imageID := range imageIDs {
+		if image, ok := listed[imageID]; ok {
+			entries[i] = image
+		} else {
+			entries[i] = map[string]interface{}{"id": imageID}
+		}
+	}
+	return entries
+}
+
+// Streams the image a tag points to, with its ancestry, as a tarball docker load understands
+func (a *RegistryAPI) ExportRepoTagHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, repo, tag := parseRepo(r, "tag")
+	logger.ForRequest(r.Context()).Debug("[ExportRepoTag] namespace=%s; repository=%s; tag=%s", namespace, repo, tag)
+	imageID := a.tagTarget(namespace, repo, tag)
+	if imageID == "" {
+		a.response(w, "Tag not found", http.StatusNotFound, EMPTY_HEADERS)
+		return
+	}
+	export, err := layers.NewExport(a.Storage, imageID)
+	if err != nil {
+		a.response(w, "Image not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+		return
+	}
+	// docker leaves the namespace out for official repositories
+	repoName := path.Join(namespace, repo)
+	if namespace == "library" {
+		repoName = repo
+	}
+	for name, values := range a.config().DefaultHeaders {
+		w.Header()[name] = append(w.Header()[name], values...)
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.Replace(repoName, "/", "-", -1)+"-"+tag+`.tar"`)
+	w.WriteHeader(http.StatusOK)
+	if err := export.Write(w, repoName, tag); err != nil {
+		// too late for an error response, the client gets a truncated archive
+		logger.ForRequest(r.Context()).Error("[ExportRepoTag] error exporting %s:%s: %s", repoName, tag, err.Error())
+	}
 }
 
 func (a *RegistryAPI) DeleteRepoTagHandler(w http.ResponseWriter, r *http.Request) {
 	namespace, repo, tag := parseRepo(r, "tag")
-	logger.Debug("[DeleteRepoTag] namespace=%s; repository=%s; tag=%s", namespace, repo, tag)
-	if err := a.Storage.Remove(storage.RepoTagPath(namespace, repo, tag)); err != nil {
+	logger.ForRequest(r.Context()).Debug("[DeleteRepoTag] namespace=%s; repository=%s; tag=%s", namespace, repo, tag)
+	defer lockTags([3]string{namespace, repo, tag})()
+	if err := a.checkTagMutable(namespace, repo, tag, ""); err != nil {
+		a.refuseMutation(w, err)
+		return
+	}
+	if err := a.deleteTag(r, namespace, repo, tag); err != nil {
 		a.response(w, "Tag not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
 		return
 	}
 	a.response(w, true, http.StatusOK, EMPTY_HEADERS)
 }
 
+func (a *RegistryAPI) deleteTag(r *http.Request, namespace, repo, tag string) error {
+	previous := a.tagTarget(namespace, repo, tag)
+	if err := a.Storage.Remove(storage.RepoTagPath(namespace, repo, tag)); err != nil {
+		return err
+	}
+	auditTag(r, namespace, repo, tag, previous, "")
+	a.recordRetag(r.Context(), namespace, repo, tag, previous, "")
+	a.notify(r, &webhooks.Event{Action: webhooks.ACTION_UNTAG, Namespace: namespace, Repo: repo, Tag: tag})
+	return nil
+}
+
 func (a *RegistryAPI) GetRepoJsonHandler(w http.ResponseWriter, r *http.Request) {
 	namespace, repo, _ := parseRepo(r, "")
-	logger.Debug("[GetRepoJson] namespace=%s; repository=%s", namespace, repo)
+	logger.ForRequest(r.Context()).Debug("[GetRepoJson] namespace=%s; repository=%s", namespace, repo)
 	content, err := a.Storage.Get(storage.RepoJsonPath(namespace, repo))
 	if err != nil {
 		// docker-registry has this error ignored. so i guess we will too...
@@ -169,11 +500,22 @@ func CreateRepoJson(userAgent string) map[string]interface{} {
 
 func (a *RegistryAPI) DeleteRepoHandler(w http.ResponseWriter, r *http.Request) {
 	namespace, repo, _ := parseRepo(r, "")
-	err := a.Storage.RemoveAll(storage.RepoPath(namespace,repo))
-	if err != nil{
+	defer lockRepo(namespace, repo)()
+	if err := a.checkRepoMutable(namespace, repo); err != nil {
+		a.refuseMutation(w, err)
+		return
+	}
+	previous := a.currentTags(namespace, repo)
+	auditRepo(r, previous)
+	err := a.Storage.RemoveAll(storage.RepoPath(namespace, repo))
+	if err != nil {
 		a.response(w, err.Error(), http.StatusNotFound, EMPTY_HEADERS)
 		return
 	}
+	for tag, imageID := range previous {
+		a.recordRetag(r.Context(), namespace, repo, tag, imageID, "")
+	}
+	a.notify(r, &webhooks.Event{Action: webhooks.ACTION_DELETE_REPO, Namespace: namespace, Repo: repo})
 	a.response(w, true, http.StatusOK, EMPTY_HEADERS)
 	return
 }
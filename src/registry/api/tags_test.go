@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"registry/storage"
+	"testing"
+	"time"
+)
+
+func TestCopyRepoTag(t *testing.T) {
+	a := newTestAPI(t, &Config{ACL: []*ACLRule{
+		{Identity: "ci", Namespaces: []string{"team", "prod"}, Access: ACCESS_WRITE},
+		{Identity: "dev", Namespaces: []string{"team"}, Access: ACCESS_READ},
+		{Identity: "dev", Namespaces: []string{"prod"}, Access: ACCESS_WRITE},
+	}})
+	putTestImage(t, a, "base", "", 10)
+	putTestImage(t, a, "app", "base", 10)
+	putTestTag(t, a, "team", "app", "v1", "app")
+	old, _ := json.Marshal(map[string]interface{}{"last_update": 1})
+	a.Storage.Put(storage.RepoTagJsonPath("team", "app", "v1"), old)
+
+	checkStatus(t, serve(a, "POST", "/v1/repositories/team/app/tags/v1/copy", "", `{"namespace":"prod"}`),
+		http.StatusForbidden)
+	checkStatus(t, serve(a, "POST", "/v1/repositories/team/app/tags/v1/copy", "ci", `{}`), http.StatusBadRequest)
+	checkStatus(t, serve(a, "POST", "/v1/repositories/team/app/tags/v2/copy", "ci", `{"tag":"v3"}`),
+		http.StatusNotFound)
+
+	// reading the source is enough to copy, moving it away needs write access
+	checkStatus(t, serve(a, "POST", "/v1/repositories/team/app/tags/v1/copy", "dev", `{"namespace":"prod"}`),
+		http.StatusOK)
+	checkStatus(t, serve(a, "POST", "/v1/repositories/team/app/tags/v1/copy", "dev",
+		`{"namespace":"prod","tag":"v2","move":true}`), http.StatusForbidden)
+	if content, err := a.Storage.Get(storage.RepoTagPath("prod", "app", "v1")); err != nil || string(content) != "app" {
+		t.Fatalf("Expected prod/app:v1 to point to app, got %q (%v)", content, err)
+	}
+	var tagJson map[string]interface{}
+	content, _ := a.Storage.Get(storage.RepoTagJsonPath("prod", "app", "v1"))
+	json.Unmarshal(content, &tagJson)
+	if lastUpdate, _ := tagJson["last_update"].(float64); time.Now().Unix()-int64(lastUpdate) > 60 {
+		t.Fatalf("Expected a fresh last_update on the copy, got %v", tagJson["last_update"])
+	}
+
+	checkStatus(t, serve(a, "POST", "/v1/repositories/team/app/tags/v1/copy", "ci", `{"tag":"v2","move":true}`),
+		http.StatusOK)
+	if exists, _ := a.Storage.Exists(storage.RepoTagPath("team", "app", "v1")); exists {
+		t.Fatal("Expected the moved tag to be deleted")
+	}
+}
+
+func TestCopyRepoTagTarget(t *testing.T) {
+	a := newTestAPI(t, &Config{})
+	putTestImage(t, a, "app", "", 10)
+	putTestTag(t, a, "team", "app", "v1", "app")
+	for _, body := range []string{
+		`{"namespace":".."}`,
+		`{"namespace":"..","repo":"images/victim"}`,
+		`{"repo":"../../.."}`,
+		`{"repo":"Upper"}`,
+		`{"tag":"../v2"}`,
+		`{"tag":".."}`,
+		`{"namespace":"a/b"}`,
+	} {
+		w := serve(a, "POST", "/v1/repositories/team/app/tags/v1/copy", "", body)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %s to be refused with 400, got %d: %s", body, w.Code, w.Body.String())
+		}
+	}
+	if exists, _ := a.Storage.Exists("images/victim"); exists {
+		t.Fatal("Expected nothing to be written outside repositories")
+	}
+}
+
+func TestPutRepoTagQuota(t *testing.T) {
+	a := newTestAPI(t, &Config{Quotas: map[string]*Quota{"team": {Hard: 20}}})
+	putTestImage(t, a, "base", "", 10)
+	putTestImage(t, a, "app", "base", 10)
+	putTestImage(t, a, "other", "", 10)
+	checkStatus(t, serve(a, "PUT", "/v1/repositories/team/app/tags/v1", "", `"app"`), http.StatusOK)
+
+	// full, but these add nothing
+	checkStatus(t, serve(a, "PUT", "/v1/repositories/team/app/tags/v2", "", `"app"`), http.StatusOK)
+	checkStatus(t, serve(a, "PUT", "/v1/repositories/team/app/tags/v1", "", `"base"`), http.StatusOK)
+	checkStatus(t, serve(a, "PUT", "/v1/repositories/team/app/tags/v3", "", `"other"`),
+		http.StatusInsufficientStorage)
+}
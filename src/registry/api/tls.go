@@ -0,0 +1,176 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"registry/logger"
+	"sync"
+	"time"
+)
+
+// certificates are re-read from disk when they change, checking at most this often
+const TLS_RELOAD_INTERVAL = 10 * time.Second
+
+var TLS_VERSIONS = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// "1.0" to "1.3", defaults to "1.2"
+	MinVersion string `json:"min_version"`
+	// names as in crypto/tls (TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, ...), defaults to what crypto/tls prefers.
+	// TLS 1.3 suites are not configurable.
+	CipherSuites []string `json:"cipher_suites"`
+	// verify client certificates against the CAs in this PEM file. the subject common name of a verified
+	// certificate is the identity of the client (see Identity)
+	ClientCAFile string `json:"client_ca_file"`
+	// reject clients without a valid certificate instead of treating them as anonymous
+	RequireClientCert bool `json:"require_client_cert"`
+}
+
+func (c *TLSConfig) files() []string {
+	files := []string{c.CertFile, c.KeyFile}
+	if c.ClientCAFile != "" {
+		files = append(files, c.ClientCAFile)
+	}
+	return files
+}
+
+func (c *TLSConfig) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	loaded := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.MinVersion != "" {
+		version, ok := TLS_VERSIONS[c.MinVersion]
+		if !ok {
+			return nil, errors.New("Invalid TLS min_version: " + c.MinVersion)
+		}
+		loaded.MinVersion = version
+	}
+	if len(c.CipherSuites) > 0 {
+		ids := map[string]uint16{}
+		for _, suite := range tls.CipherSuites() {
+			ids[suite.Name] = suite.ID
+		}
+		for _, name := range c.CipherSuites {
+			id, ok := ids[name]
+			if !ok {
+				return nil, errors.New("Invalid or insecure TLS cipher suite: " + name)
+			}
+			loaded.CipherSuites = append(loaded.CipherSuites, id)
+		}
+	}
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		loaded.ClientCAs = x509.NewCertPool()
+		if !loaded.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + c.ClientCAFile)
+		}
+		loaded.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.RequireClientCert {
+			loaded.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return loaded, nil
+}
+
+// tlsState holds the loaded certificates and reloads them when the files on disk or the config change
+type tlsState struct {
+	lock     sync.Mutex
+	cfg      *TLSConfig
+	loaded   *tls.Config
+	modTimes []time.Time
+	checked  time.Time
+}
+
+func modTimes(files []string) []time.Time {
+	times := make([]time.Time, len(files))
+	for i, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
+
+func (s *tlsState) changed(files []string) bool {
+	current := modTimes(files)
+	if len(current) != len(s.modTimes) {
+		return true
+	}
+	for i := range current {
+		if !current[i].Equal(s.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the tls config to use for cfg. if reloading fails the previous config stays in use.
+func (s *tlsState) get(cfg *TLSConfig) (*tls.Config, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cfg == nil {
+		// TLS was removed from the config, that only takes effect on restart
+		cfg = s.cfg
+	}
+	if s.loaded != nil && s.cfg == cfg {
+		if time.Since(s.checked) < TLS_RELOAD_INTERVAL {
+			return s.loaded, nil
+		}
+		s.checked = time.Now()
+		if !s.changed(cfg.files()) {
+			return s.loaded, nil
+		}
+	}
+	// read the times first so that a write racing with the load gets picked up next time
+	times := modTimes(cfg.files())
+	loaded, err := cfg.load()
+	if err != nil {
+		if s.loaded != nil {
+			logger.Error("[TLS] keeping the current certificates, error reloading: %s", err.Error())
+			return s.loaded, nil
+		}
+		return nil, err
+	}
+	if s.loaded != nil {
+		logger.Info("[TLS] reloaded certificates from %s", cfg.CertFile)
+	}
+	s.cfg, s.loaded, s.modTimes, s.checked = cfg, loaded, times, time.Now()
+	return loaded, nil
+}
+
+// the tls.Config the listener uses. it hands out the current certificates on every handshake.
+func (a *RegistryAPI) serverTLSConfig() (*tls.Config, error) {
+	if _, err := a.tls.get(a.config().TLS); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return a.tls.get(a.config().TLS)
+		},
+	}, nil
+}
+
+// Identity returns who made the request: the subject common name of its verified client certificate, or "" for
+// anonymous requests
+func Identity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+// Validate reports every problem with the config at once
+func (cfg *Config) Validate() []error {
+	errs := []error{}
+	if cfg.Addr == "" && len(cfg.Listeners) == 0 {
+		errs = append(errs, errors.New("Please Specify an Address to Listen on"))
+	}
+	for i, listener := range cfg.Listeners {
+		switch listener.Network {
+		case "", NETWORK_TCP, NETWORK_UNIX, NETWORK_SYSTEMD:
+		default:
+			errs = append(errs, fmt.Errorf("listeners[%d]: invalid network %q", i, listener.Network))
+		}
+		if listener.Addr == "" {
+			errs = append(errs, fmt.Errorf("listeners[%d]: needs an addr", i))
+		}
+		if listener.TLS && cfg.TLS == nil {
+			errs = append(errs, fmt.Errorf("listeners[%d]: tls needs the tls config", i))
+		}
+		for _, group := range listener.Routes {
+			if !stringInSlice(group, ROUTE_GROUPS) {
+				errs = append(errs, fmt.Errorf("listeners[%d]: unknown route group %q", i, group))
+			}
+		}
+	}
+	if cfg.ShutdownTimeout < 0 {
+		errs = append(errs, errors.New("shutdown_timeout can't be negative"))
+	}
+	if cfg.ReadOnlyRetryAfter < 0 {
+		errs = append(errs, errors.New("read_only_retry_after can't be negative"))
+	}
+	if cfg.TLS != nil {
+		if cfg.TLS.CertFile == "" || cfg.TLS.KeyFile == "" {
+			errs = append(errs, errors.New("Please Specify both a cert_file and a key_file for TLS"))
+		} else if _, err := cfg.TLS.load(); err != nil {
+			errs = append(errs, errors.New("tls: "+err.Error()))
+		}
+		if cfg.TLS.RequireClientCert && cfg.TLS.ClientCAFile == "" {
+			errs = append(errs, errors.New("tls: require_client_cert needs a client_ca_file"))
+		}
+	}
+	for i, rule := range cfg.ACL {
+		if rule.Identity == "" || len(rule.Namespaces) == 0 {
+			errs = append(errs, fmt.Errorf("acl[%d]: needs an identity and namespaces", i))
+		}
+		if _, ok := ACCESS_LEVELS[rule.Access]; !ok {
+			errs = append(errs, fmt.Errorf("acl[%d]: access must be read, write or admin", i))
+		}
+	}
+	if cfg.Webhooks != nil {
+		for _, err := range cfg.Webhooks.Validate() {
+			errs = append(errs, errors.New("webhooks: "+err.Error()))
+		}
+	}
+	for scope, patterns := range cfg.ImmutableTags {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("immutable_tags for %q: invalid pattern %q", scope, pattern))
+			}
+		}
+	}
+	for namespace, quota := range cfg.Quotas {
+		if quota == nil {
+			errs = append(errs, fmt.Errorf("quota for %q is empty", namespace))
+			continue
+		}
+		if quota.Soft < 0 || quota.Hard < 0 {
+			errs = append(errs, fmt.Errorf("quota for %q can't be negative", namespace))
+		}
+		if quota.Soft > 0 && quota.Hard > 0 && quota.Soft > quota.Hard {
+			errs = append(errs, fmt.Errorf("quota for %q: soft is larger than hard", namespace))
+		}
+	}
+	if cfg.Retention != nil {
+		if cfg.Retention.Interval < 0 {
+			errs = append(errs, errors.New("retention: interval can't be negative"))
+		}
+		for scope, rule := range cfg.Retention.Rules {
+			if rule == nil {
+				errs = append(errs, fmt.Errorf("retention rule for %q is empty", scope))
+				continue
+			}
+			for _, err := range rule.Validate() {
+				errs = append(errs, fmt.Errorf("retention rule for %q: %s", scope, err.Error()))
+			}
+		}
+	}
+	for namespace, policy := range cfg.LayerPolicies {
+		if policy == nil {
+			errs = append(errs, fmt.Errorf("layer policy for %q is empty", namespace))
+			continue
+		}
+		if policy.MaxSize < 0 || policy.MaxFiles < 0 {
+			errs = append(errs, fmt.Errorf("layer policy for %q has a negative limit", namespace))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,296 @@
+// Package audit keeps an append-only log of mutating requests in the storage. Every entry carries the hash of the
+// one before it, so removing or editing an entry breaks the chain (see Verify). Each instance of the registry keeps
+// a chain of its own, so instances sharing a storage never write the same entry.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"registry/storage"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// entries are grouped by UTC day so that queries only list the days they cover
+const DAY_FORMAT = "2006-01-02"
+
+type Entry struct {
+	Instance string    `json:"instance"`
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"` // set by Append, so entries are in the order of the chain
+	// when the request started, which can be before the time of entries appended by requests started later
+	RequestTime *time.Time `json:"request_time,omitempty"`
+	Identity    string     `json:"identity"` // client certificate identity, "" if anonymous
+	Token       string     `json:"token"`    // repository of the index token the client sent, if any
+	RemoteAddr  string     `json:"remote_addr"`
+	UserAgent   string     `json:"user_agent"`
+	RequestID   string     `json:"request_id"`
+	Method      string     `json:"method"`
+	Route       string     `json:"route"`
+	Path        string     `json:"path"`
+	Namespace   string     `json:"namespace,omitempty"`
+	Repo        string     `json:"repo,omitempty"`
+	Tag         string     `json:"tag,omitempty"`
+	ImageID     string     `json:"image_id,omitempty"`
+	// what the tag pointed to before and after, "" if it didn't exist
+	OldTarget string `json:"old_target,omitempty"`
+	NewTarget string `json:"new_target,omitempty"`
+	// all tags of the repository before the request, for requests removing them all
+	OldTags  map[string]string `json:"old_tags,omitempty"`
+	Status   int               `json:"status"`
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+// the hash covers everything but the hash itself
+func (e *Entry) computeHash() string {
+	hash := e.Hash
+	e.Hash = ""
+	encoded, _ := json.Marshal(e)
+	e.Hash = hash
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// Log appends entries to the chain of one instance. The name must be unique among the instances sharing the storage.
+type Log struct {
+	Storage  storage.Storage
+	Instance string
+
+	lock     sync.Mutex
+	loaded   bool
+	seq      uint64
+	lastHash string
+	lastTime time.Time
+	now      func() time.Time
+}
+
+func NewLog(s storage.Storage, instance string) *Log {
+	return &Log{Storage: s, Instance: instance, now: time.Now}
+}
+
+// picks up the chain where the last entry in the storage left it
+func (l *Log) load() error {
+	last, err := lastEntry(l.Storage, l.Instance)
+	if err != nil {
+		return err
+	}
+	if last != nil {
+		l.seq, l.lastHash, l.lastTime = last.Seq, last.Hash, last.Time
+	}
+	l.loaded = true
+	return nil
+}
+
+func lastEntry(s storage.Storage, instance string) (*Entry, error) {
+	days, err := listSorted(s, storage.AUDIT_PATH)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(days) - 1; i >= 0; i-- {
+		names, err := listSorted(s, path.Join(days[i], instance))
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			continue
+		}
+		return readEntry(s, names[len(names)-1])
+	}
+	return nil, nil
+}
+
+// nothing under relpath yet is an empty list
+func listSorted(s storage.Storage, relpath string) ([]string, error) {
+	names, err := s.List(relpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func readEntry(s storage.Storage, name string) (*Entry, error) {
+	content, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return nil, errors.New("Invalid audit entry " + name + ": " + err.Error())
+	}
+	return &entry, nil
+}
+
+// Append numbers entry, stamps it with the current time, chains it to the previous one and writes it. the day it
+// is filed under comes from that time, so the entries of a chain are in the order of its days too.
+func (l *Log) Append(entry *Entry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.loaded {
+		if err := l.load(); err != nil {
+			return err
+		}
+	}
+	entry.Instance = l.Instance
+	entry.Seq = l.seq + 1
+	entry.Time = l.now().UTC()
+	if entry.Time.Before(l.lastTime) {
+		// the clock was set back
+		entry.Time = l.lastTime
+	}
+	entry.PrevHash = l.lastHash
+	entry.Hash = entry.computeHash()
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	entryPath := storage.AuditEntryPath(entry.Time.Format(DAY_FORMAT), l.Instance, entry.Seq)
+	// the chain is append-only. an entry already there means the head we know is stale (another registry with the
+	// same instance name, a listing that missed entries): read it again next time rather than overwrite anything.
+	if exists, err := l.Storage.Exists(entryPath); err != nil {
+		return err
+	} else if exists {
+		l.loaded = false
+		return fmt.Errorf("audit entry %d of %s already exists", entry.Seq, l.Instance)
+	}
+	if err := l.Storage.Put(entryPath, encoded); err != nil {
+		return err
+	}
+	l.seq, l.lastHash, l.lastTime = entry.Seq, entry.Hash, entry.Time
+	return nil
+}
+
+type Query struct {
+	Namespace string // all namespaces if ""
+	Repo      string // all repositories if ""
+	Since     time.Time
+	Until     time.Time // now if zero
+	Limit     int       // no limit if 0
+}
+
+// Find returns the entries matching q, oldest first
+func Find(s storage.Storage, q *Query) ([]*Entry, error) {
+	until := q.Until
+	if until.IsZero() {
+		until = time.Now()
+	}
+	entries := []*Entry{}
+	days, err := listSorted(s, storage.AUDIT_PATH)
+	if err != nil {
+		return nil, err
+	}
+	for _, day := range days {
+		date, err := time.Parse(DAY_FORMAT, path.Base(day))
+		if err != nil || date.Add(24*time.Hour).Before(q.Since) || date.After(until) {
+			continue
+		}
+		// the chains of all instances, merged
+		found := []*Entry{}
+		err = eachEntry(s, day, func(entry *Entry) error {
+			if entry.Time.Before(q.Since) || entry.Time.After(until) {
+				return nil
+			}
+			if (q.Namespace != "" && entry.Namespace != q.Namespace) || (q.Repo != "" && entry.Repo != q.Repo) {
+				return nil
+			}
+			found = append(found, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(found, func(i, j int) bool { return found[i].Time.Before(found[j].Time) })
+		entries = append(entries, found...)
+		if q.Limit > 0 && len(entries) >= q.Limit {
+			return entries[:q.Limit], nil
+		}
+	}
+	return entries, nil
+}
+
+// calls fn with the entries of day, instance by instance, each in the order of its chain
+func eachEntry(s storage.Storage, day string, fn func(*Entry) error) error {
+	instances, err := listSorted(s, day)
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		names, err := listSorted(s, instance)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			entry, err := readEntry(s, name)
+			if err != nil {
+				return err
+			}
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type VerifyReport struct {
+	Entries int    `json:"entries"`
+	Valid   bool   `json:"valid"`
+	Problem string `json:"problem,omitempty"` // the first break in a chain
+	// the hash of the last entry of every instance. the newest entries of a chain can be removed without leaving a
+	// break, only comparing these with a copy kept out of the storage shows it.
+	Heads map[string]string `json:"heads"`
+}
+
+// Verify walks the whole log and checks every entry's hash and its link to the previous one of its instance
+func Verify(s storage.Storage) (*VerifyReport, error) {
+	report := &VerifyReport{Valid: true, Heads: map[string]string{}}
+	days, err := listSorted(s, storage.AUDIT_PATH)
+	if err != nil {
+		return nil, err
+	}
+	previous := map[string]*Entry{}
+	for _, day := range days {
+		err := eachEntry(s, day, func(entry *Entry) error {
+			report.Entries++
+			seq := "entry " + strconv.FormatUint(entry.Seq, 10) + " of " + entry.Instance
+			last := previous[entry.Instance]
+			switch {
+			case entry.Hash != entry.computeHash():
+				report.Problem = seq + " was modified"
+			case last == nil && entry.PrevHash != "":
+				report.Problem = "entries before " + seq + " are missing"
+			case last != nil && (entry.PrevHash != last.Hash || entry.Seq != last.Seq+1):
+				report.Problem = "entries of " + entry.Instance + " between " + strconv.FormatUint(last.Seq, 10) +
+					" and " + strconv.FormatUint(entry.Seq, 10) + " are missing or were modified"
+			}
+			if report.Problem != "" {
+				return errBroken
+			}
+			previous[entry.Instance] = entry
+			report.Heads[entry.Instance] = entry.Hash
+			return nil
+		})
+		if err == errBroken {
+			report.Valid = false
+			return report, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// stops the walk at the first break
+var errBroken = errors.New("broken chain")
@@ -0,0 +1,167 @@
+package audit
+
+import (
+	"registry/storage"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	yesterday := time.Now().Add(-24 * time.Hour)
+	entries := []*Entry{
+		{Time: yesterday, Method: "PUT", Namespace: "library", Repo: "busybox", Tag: "latest", NewTarget: "1"},
+		{Time: time.Now(), Method: "PUT", Namespace: "library", Repo: "ubuntu", Tag: "latest", NewTarget: "2"},
+		{Time: time.Now(), Method: "PUT", Namespace: "library", Repo: "busybox", Tag: "latest", OldTarget: "1",
+			NewTarget: "3"},
+	}
+	log := NewLog(s, "a")
+	for _, entry := range entries[:2] {
+		// appended when they say
+		when := entry.Time
+		log.now = func() time.Time { return when }
+		if err := log.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a restarted registry continues the chain
+	if err := NewLog(s, "a").Append(entries[2]); err != nil {
+		t.Fatal(err)
+	}
+	if entries[2].Seq != 3 || entries[2].PrevHash != entries[1].Hash {
+		t.Fatalf("Entry 3 not chained to entry 2: %+v", entries[2])
+	}
+
+	found, err := Find(s, &Query{Namespace: "library", Repo: "busybox"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].NewTarget != "1" || found[1].NewTarget != "3" {
+		t.Fatalf("Unexpected entries for busybox: %+v", found)
+	}
+	found, _ = Find(s, &Query{Repo: "busybox", Since: yesterday.Add(time.Minute)})
+	if len(found) != 1 || found[0].Seq != 3 {
+		t.Fatalf("Unexpected entries since yesterday: %+v", found)
+	}
+
+	if report, err := Verify(s); err != nil {
+		t.Fatal(err)
+	} else if !report.Valid || report.Entries != 3 || report.Heads["a"] != entries[2].Hash {
+		t.Fatalf("Unexpected report for an intact log: %+v", report)
+	}
+	second := storage.AuditEntryPath(entries[1].Time.Format(DAY_FORMAT), "a", 2)
+	content, err := s.Get(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(second, []byte(strings.Replace(string(content), `"new_target":"2"`, `"new_target":"4"`, 1)))
+	if report, _ := Verify(s); report.Valid || report.Problem != "entry 2 of a was modified" {
+		t.Fatalf("Modified entry not detected: %+v", report)
+	}
+	s.Remove(second)
+	if report, _ := Verify(s); report.Valid || !strings.Contains(report.Problem, "between 1 and 3") {
+		t.Fatalf("Removed entry not detected: %+v", report)
+	}
+}
+
+func TestLogInstances(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two instances sharing the storage
+	var wg sync.WaitGroup
+	for _, instance := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(log *Log) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if err := log.Append(&Entry{Time: time.Now(), Method: "PUT", Repo: log.Instance}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(NewLog(s, instance))
+	}
+	wg.Wait()
+
+	found, err := Find(s, &Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 20 {
+		t.Fatalf("Expected every entry of both instances, got %d", len(found))
+	}
+	for i := 1; i < len(found); i++ {
+		if found[i].Time.Before(found[i-1].Time) {
+			t.Fatalf("Entries out of order: %+v before %+v", found[i-1], found[i])
+		}
+	}
+	report, err := Verify(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid || report.Entries != 20 || len(report.Heads) != 2 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+}
+
+func TestLogRequestTime(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := NewLog(s, "a")
+	// a long request started yesterday, finishing after a short one that started today
+	started := time.Now().Add(-24 * time.Hour)
+	for _, entry := range []*Entry{{Method: "PUT"}, {Method: "PUT", RequestTime: &started}} {
+		if err := log.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if report, err := Verify(s); err != nil {
+		t.Fatal(err)
+	} else if !report.Valid || report.Entries != 2 {
+		t.Fatalf("Expected the chain to stay in order, got %+v", report)
+	}
+	if last, err := lastEntry(s, "a"); err != nil || last.Seq != 2 || !last.RequestTime.Equal(started) {
+		t.Fatalf("Expected entry 2 to be the last one, with its request time, got %+v, %v", last, err)
+	}
+}
+
+func TestLogNoOverwrite(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two registries wrongly sharing an instance name
+	first, second := NewLog(s, "a"), NewLog(s, "a")
+	if err := first.Append(&Entry{Method: "PUT", Path: "/1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Append(&Entry{Method: "PUT", Path: "/2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Append(&Entry{Method: "PUT", Path: "/3"}); err == nil {
+		t.Fatal("Expected an error instead of overwriting entry 2")
+	}
+	found, err := Find(s, &Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[1].Path != "/2" {
+		t.Fatalf("Expected entry 2 to be kept, got %+v", found)
+	}
+	// the next append picks up the chain where it really is
+	entry := &Entry{Method: "PUT", Path: "/3"}
+	if err := first.Append(entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Seq != 3 || entry.PrevHash != found[1].Hash {
+		t.Fatalf("Entry 3 not chained to entry 2: %+v", entry)
+	}
+}
@@ -2,26 +2,91 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"registry/api"
+	"registry/logger"
 	"registry/storage"
-	"os"
+	"strings"
 )
 
 type Config struct {
-	API     *api.Config     `json:"api"`
-	Storage *storage.Config `json:"storage"`
+	LogLevel  string          `json:"log_level"`  // debug, info (the default) or error
+	LogFormat string          `json:"log_format"` // text (the default), logfmt or json
+	API       *api.Config     `json:"api"`
+	Storage   *storage.Config `json:"storage"`
 }
 
+// ValidationError holds every problem found in a config, so they can all be fixed in one go
+type ValidationError struct {
+	Errors []error
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return "Invalid config:\n  " + strings.Join(messages, "\n  ")
+}
+
+// New reads the config file, applies overrides from the environment (see ENV_PREFIX) and validates the result.
+// Unknown keys in the file are an error.
 func New(filename string) (*Config, error) {
 	// read in config
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
 	var cfg Config
-	if cfgFile, err := os.Open(filename); err != nil {
+	if err := json.Unmarshal(content, &cfg); err != nil {
 		return nil, err
-	} else {
-		dec := json.NewDecoder(cfgFile)
-		if err := dec.Decode(&cfg); err != nil {
-			return nil, err
-		}
+	}
+	errs := unknownKeys(raw, &cfg, "")
+	errs = append(errs, applyEnv(&cfg, ENV_PREFIX)...)
+	errs = append(errs, cfg.Validate()...)
+	if len(errs) > 0 {
+		return nil, &ValidationError{Errors: errs}
 	}
 	return &cfg, nil
 }
+
+func (cfg *Config) Validate() []error {
+	errs := []error{}
+	if _, ok := logger.LEVELS[cfg.LogLevel]; cfg.LogLevel != "" && !ok {
+		errs = append(errs, errors.New("log_level: must be debug, info or error"))
+	}
+	switch cfg.LogFormat {
+	case "", logger.FORMAT_TEXT, logger.FORMAT_LOGFMT, logger.FORMAT_JSON:
+	default:
+		errs = append(errs, errors.New("log_format: must be text, logfmt or json"))
+	}
+	if cfg.API == nil {
+		errs = append(errs, errors.New("api: missing"))
+	} else {
+		errs = append(errs, prefixErrors("api", cfg.API.Validate())...)
+	}
+	if cfg.Storage == nil {
+		errs = append(errs, errors.New("storage: missing"))
+	} else {
+		errs = append(errs, prefixErrors("storage", cfg.Storage.Validate())...)
+	}
+	if cfg.API != nil && cfg.Storage != nil && cfg.Storage.Shared() && cfg.API.TokenSecret == "" {
+		// a push going to another instance than the one that handed out its token would be refused
+		errs = append(errs, errors.New("api: token_secret: needed with storage type "+cfg.Storage.Type+
+			", every instance sharing the storage must sign index tokens with the same one"))
+	}
+	return errs
+}
+
+func prefixErrors(prefix string, errs []error) []error {
+	prefixed := make([]error, len(errs))
+	for i, err := range errs {
+		prefixed[i] = errors.New(prefix + ": " + err.Error())
+	}
+	return prefixed
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"registry/api"
+	"registry/webhooks"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "go-docker-registry-test-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(content)
+	file.Close()
+	return file.Name()
+}
+
+func TestEnvOverrides(t *testing.T) {
+	filename := writeConfig(t, `{"api": {"addr": ":5000"}, "storage": {"type": "s3"}}`)
+	defer os.Remove(filename)
+	for variable, value := range map[string]string{
+		"REGISTRY_STORAGE_S3_BUCKET":     "bucket",
+		"REGISTRY_STORAGE_S3_REGION":     "us-east-1",
+		"REGISTRY_STORAGE_S3_ROOT":       "/registry",
+		"REGISTRY_STORAGE_S3_BUFFER_DIR": "/tmp",
+		"REGISTRY_API_READ_ONLY":         "true",
+		"REGISTRY_API_TOKEN_SECRET":      "secret",
+	} {
+		os.Setenv(variable, value)
+		defer os.Setenv(variable, "")
+	}
+	cfg, err := New(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Storage.S3 == nil || cfg.Storage.S3.Bucket != "bucket" {
+		t.Fatalf("S3 config was not created from the environment: %+v", cfg.Storage.S3)
+	}
+	if !cfg.API.ReadOnly {
+		t.Fatal("read_only was not overridden")
+	}
+}
+
+func TestEnvUnknownVariables(t *testing.T) {
+	for variable, value := range map[string]string{
+		"REGISTRY_API_READ_ONLY":       "true",
+		"REGISTRY_API_READONLY":        "true",
+		"REGISTRY_STORAGE_S3_BUKET":    "bucket",
+		"REGISTRY_PORT":                "tcp://10.0.0.1:5000",
+		"REGISTRY_STORAGE_S3_BUCKET_2": "",
+	} {
+		os.Setenv(variable, value)
+		defer os.Setenv(variable, "")
+	}
+	cfg := &Config{}
+	errs, unknown := applyEnvVariables(cfg, ENV_PREFIX)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	expected := "REGISTRY_API_READONLY REGISTRY_PORT REGISTRY_STORAGE_S3_BUKET"
+	if strings.Join(unknown, " ") != expected {
+		t.Fatalf("Expected %s to be unknown, got %v", expected, unknown)
+	}
+	if cfg.API == nil || !cfg.API.ReadOnly {
+		t.Fatal("read_only was not overridden")
+	}
+}
+
+func TestAllErrorsReported(t *testing.T) {
+	filename := writeConfig(t, `{"api": {"adr": ":5000"}, "storage": {"type": "local", "local": {"rot": "/tmp"}}}`)
+	defer os.Remove(filename)
+	_, err := New(filename)
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	// two unknown keys, plus the missing addr and root they were meant to be
+	if len(validationErr.Errors) != 4 {
+		t.Fatalf("Expected 4 errors, got %s", validationErr.Error())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	oldCfg := &Config{API: &api.Config{Addr: ":5000", DefaultHeaders: map[string][]string{"X-A": []string{"1"}}}}
+	newCfg := &Config{API: &api.Config{Addr: ":5001", DefaultHeaders: map[string][]string{"X-B": []string{"2"}}}}
+	changes := Diff(oldCfg, newCfg)
+	if len(changes) != 3 {
+		t.Fatalf("Expected 3 changes, got %v", changes)
+	}
+	if changes[0].Key != "api.addr" || changes[0].Reloadable() {
+		t.Fatalf("Expected a change of api.addr that needs a restart, got %v", changes[0])
+	}
+	if changes[1].Key != "api.default_headers.X-A.0" || changes[1].New != "" || !changes[1].Reloadable() {
+		t.Fatalf("Expected X-A to be removed, got %v", changes[1])
+	}
+}
+
+func TestDiffSecrets(t *testing.T) {
+	oldCfg := &Config{API: &api.Config{Webhooks: &webhooks.Config{Endpoints: []*webhooks.Endpoint{
+		&webhooks.Endpoint{URL: "http://hooks", Secret: "old secret"},
+	}}}}
+	newCfg := &Config{API: &api.Config{Webhooks: &webhooks.Config{Endpoints: []*webhooks.Endpoint{
+		&webhooks.Endpoint{URL: "http://hooks", Secret: "new secret"},
+	}}}}
+	changes := Diff(oldCfg, newCfg)
+	if len(changes) != 1 || changes[0].Key != "api.webhooks.endpoints.0.secret" {
+		t.Fatalf("Expected the secret of the endpoint to change, got %v", changes)
+	}
+	if logged := changes[0].String(); strings.Contains(logged, "secret\"") {
+		t.Fatalf("Secret was logged: %s", logged)
+	}
+}
+
+func TestTokenSecretRequired(t *testing.T) {
+	storage := `"storage": {"type": "s3", "s3": {"bucket": "b", "region": "us-east-1", "root": "/", "buffer_dir": "/tmp"}}`
+	filename := writeConfig(t, `{"api": {"addr": ":5000"}, `+storage+`}`)
+	defer os.Remove(filename)
+	if _, err := New(filename); err == nil || !strings.Contains(err.Error(), "token_secret") {
+		t.Fatalf("Expected token_secret to be required with s3, got %v", err)
+	}
+	withSecret := writeConfig(t, `{"api": {"addr": ":5000", "token_secret": "secret"}, `+storage+`}`)
+	defer os.Remove(withSecret)
+	if _, err := New(withSecret); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// keys that take effect on reload. everything else is only read at startup.
+var RELOADABLE_KEYS = []string{
+	"log_format",
+	"log_level",
+	"api.acl",
+	"api.audit",
+	"api.default_headers",
+	"api.immutable_tags",
+	"api.layer_policies",
+	"api.quotas",
+	"api.read_only",
+	"api.read_only_retry_after",
+	"api.retention",
+	"api.shutdown_timeout",
+	"api.tls.cert_file",
+	"api.tls.cipher_suites",
+	"api.tls.client_ca_file",
+	"api.tls.key_file",
+	"api.tls.min_version",
+	"api.tls.require_client_cert",
+	"api.webhooks",
+	"storage.s3.access_key",
+	"storage.s3.secret_key",
+	"storage.tiered.s3.access_key",
+	"storage.tiered.s3.secret_key",
+}
+
+// values of these are never logged
+var SECRET_KEYS = []string{"access_key", "secret", "secret_key", "token_secret"}
+
+type Change struct {
+	Key string
+	Old string // JSON, or "" if the key was not set
+	New string
+}
+
+func (c *Change) String() string {
+	oldValue, newValue := c.Old, c.New
+	for _, secret := range SECRET_KEYS {
+		if strings.HasSuffix(c.Key, "."+secret) {
+			oldValue, newValue = "(secret)", "(secret)"
+		}
+	}
+	return c.Key + ": " + oldValue + " -> " + newValue
+}
+
+func (c *Change) Reloadable() bool {
+	for _, key := range RELOADABLE_KEYS {
+		if c.Key == key || strings.HasPrefix(c.Key, key+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff returns what changed between two configs, one entry per leaf value, sorted by key
+func Diff(oldCfg, newCfg *Config) []*Change {
+	oldValues, newValues := flatten(oldCfg), flatten(newCfg)
+	changes := []*Change{}
+	for key, oldValue := range oldValues {
+		if newValue := newValues[key]; newValue != oldValue {
+			changes = append(changes, &Change{Key: key, Old: oldValue, New: newValue})
+		}
+	}
+	for key, newValue := range newValues {
+		if _, ok := oldValues[key]; !ok {
+			changes = append(changes, &Change{Key: key, New: newValue})
+		}
+	}
+	sort.Sort(changesByKey(changes))
+	return changes
+}
+
+type changesByKey []*Change
+
+func (c changesByKey) Len() int           { return len(c) }
+func (c changesByKey) Less(i, j int) bool { return c[i].Key < c[j].Key }
+func (c changesByKey) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+func flatten(cfg *Config) map[string]string {
+	values := map[string]string{}
+	// the config was decoded from JSON, it can always be encoded again
+	encoded, _ := json.Marshal(cfg)
+	var decoded interface{}
+	json.Unmarshal(encoded, &decoded)
+	flattenValue(decoded, "", values)
+	return values
+}
+
+func flattenValue(value interface{}, path string, values map[string]string) {
+	if object, ok := value.(map[string]interface{}); ok {
+		for key, child := range object {
+			flattenValue(child, joinPath(path, key), values)
+		}
+		return
+	}
+	if array, ok := value.([]interface{}); ok {
+		// so that a secret in an array element is still under a key of its own
+		for i, child := range array {
+			flattenValue(child, joinPath(path, strconv.Itoa(i)), values)
+		}
+		return
+	}
+	if value == nil {
+		// same as not being set
+		return
+	}
+	encoded, _ := json.Marshal(value)
+	values[path] = string(encoded)
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"registry/logger"
+	"sort"
+	"strings"
+)
+
+// every field can be overridden by an environment variable named after its json keys, e.g. storage.s3.bucket is
+// REGISTRY_STORAGE_S3_BUCKET. strings are taken as is, everything else is parsed as JSON. empty variables are
+// ignored, and so are variables no field goes by, which are logged: platforms set some of their own under the same
+// prefix (a Kubernetes service named registry brings REGISTRY_PORT), so they can't be refused.
+const ENV_PREFIX = "REGISTRY"
+
+// returns the json name of a field, or "" if encoding/json ignores it
+func jsonName(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		// unexported
+		return ""
+	}
+	tag := strings.Split(field.Tag.Get("json"), ",")[0]
+	if tag == "-" {
+		return ""
+	}
+	if tag == "" {
+		return field.Name
+	}
+	return tag
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// unknownKeys returns an error for every key in raw (the decoded JSON) that has no field in v to go to
+func unknownKeys(raw interface{}, v interface{}, path string) []error {
+	return unknownKeysOfType(raw, reflect.TypeOf(v), path)
+}
+
+func unknownKeysOfType(raw interface{}, t reflect.Type, path string) []error {
+	t = indirectType(t)
+	errs := []error{}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			// type mismatches are reported by the decoder
+			return errs
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			if name := jsonName(t.Field(i)); name != "" {
+				// encoding/json matches keys case insensitively
+				fields[strings.ToLower(name)] = t.Field(i).Type
+			}
+		}
+		for key, value := range object {
+			fieldType, ok := fields[strings.ToLower(key)]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown key", joinPath(path, key)))
+				continue
+			}
+			errs = append(errs, unknownKeysOfType(value, fieldType, joinPath(path, key))...)
+		}
+	case reflect.Map:
+		if object, ok := raw.(map[string]interface{}); ok {
+			for key, value := range object {
+				errs = append(errs, unknownKeysOfType(value, t.Elem(), joinPath(path, key))...)
+			}
+		}
+	case reflect.Slice:
+		if array, ok := raw.([]interface{}); ok {
+			for i, value := range array {
+				errs = append(errs, unknownKeysOfType(value, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+	return errs
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// applyEnv sets the fields of v (a pointer to a struct) from the environment. structs that are missing from the
+// config file are created if a variable for one of their fields is set.
+func applyEnv(v interface{}, prefix string) []error {
+	errs, unknown := applyEnvVariables(v, prefix)
+	for _, variable := range unknown {
+		logger.Error("[Config] ignoring %s, it doesn't name any config field", variable)
+	}
+	return errs
+}
+
+// like applyEnv, also returning the variables under prefix that didn't name any field, sorted
+func applyEnvVariables(v interface{}, prefix string) ([]error, []string) {
+	env := map[string]string{}
+	for _, variable := range os.Environ() {
+		if parts := strings.SplitN(variable, "=", 2); len(parts) == 2 && parts[1] != "" &&
+			strings.HasPrefix(parts[0], prefix+"_") {
+			env[parts[0]] = parts[1]
+		}
+	}
+	if len(env) == 0 {
+		return nil, nil
+	}
+	used := map[string]bool{}
+	errs := applyEnvToStruct(reflect.ValueOf(v).Elem(), prefix, env, used)
+	unknown := []string{}
+	for variable := range env {
+		if !used[variable] {
+			unknown = append(unknown, variable)
+		}
+	}
+	sort.Strings(unknown)
+	return errs, unknown
+}
+
+func applyEnvToStruct(v reflect.Value, prefix string, env map[string]string, used map[string]bool) []error {
+	errs := []error{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		variable := prefix + "_" + strings.ToUpper(name)
+		field := v.Field(i)
+		if value, ok := env[variable]; ok {
+			used[variable] = true
+			if err := setFromEnv(field, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", variable, err.Error()))
+			}
+			continue
+		}
+		if indirectType(field.Type()).Kind() != reflect.Struct || !hasPrefix(env, variable+"_") {
+			continue
+		}
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		errs = append(errs, applyEnvToStruct(field, variable, env, used)...)
+	}
+	return errs
+}
+
+func hasPrefix(env map[string]string, prefix string) bool {
+	for variable := range env {
+		if strings.HasPrefix(variable, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func setFromEnv(field reflect.Value, value string) error {
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	return json.Unmarshal([]byte(value), field.Addr().Interface())
+}
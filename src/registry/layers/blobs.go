@@ -0,0 +1,211 @@
+package layers
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"registry/logger"
+	"registry/storage"
+	"strconv"
+	"sync"
+)
+
+// With deduplication on, layer bodies live once in storage.BlobLayerPath keyed by the sha256 of their content.
+// images/<id>/layer then only holds "sha256:<hex>", and every image using a blob has a reference in
+// storage.BlobRefPath so the blob can be removed once nothing uses it anymore.
+const LAYER_REF_PREFIX = "sha256:"
+
+var LAYER_REF_REGEXP = regexp.MustCompile("^sha256:([0-9a-f]{64})$")
+
+// returns the sum of the blob the layer of imageID refers to, or "" if the layer holds its own content
+func LayerRef(s storage.Storage, imageID string) (string, error) {
+	layerPath := storage.ImageLayerPath(imageID)
+	size, err := s.Size(layerPath)
+	if err != nil {
+		return "", err
+	}
+	if size != storage.LAYER_REF_SIZE {
+		// no need to read real layers
+		return "", nil
+	}
+	content, err := s.Get(layerPath)
+	if err != nil {
+		return "", err
+	}
+	if match := LAYER_REF_REGEXP.FindSubmatch(content); match != nil {
+		return string(match[1]), nil
+	}
+	return "", nil
+}
+
+// returns the path holding the content of the layer of imageID
+func LayerPath(s storage.Storage, imageID string) (string, error) {
+	sum, err := LayerRef(s, imageID)
+	if err != nil {
+		return "", err
+	}
+	if sum != "" {
+		return storage.BlobLayerPath(sum), nil
+	}
+	return storage.ImageLayerPath(imageID), nil
+}
+
+func LayerReader(s storage.Storage, imageID string) (io.ReadCloser, error) {
+	layerPath, err := LayerPath(s, imageID)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetReader(layerPath)
+}
+
+func LayerSize(s storage.Storage, imageID string) (int64, error) {
+	layerPath, err := LayerPath(s, imageID)
+	if err != nil {
+		return -1, err
+	}
+	return s.Size(layerPath)
+}
+
+// referencing a blob and releasing it can't interleave, or a release could remove a blob that was just found to
+// exist. this only covers one registry, instances sharing a storage still have a small window.
+var blobLocks [256]sync.Mutex
+
+func blobLock(sum string) *sync.Mutex {
+	index, _ := strconv.ParseUint(sum[:2], 16, 8)
+	return &blobLocks[index]
+}
+
+// DedupLayer points the layer of imageID to the blob sum. The content at contentPath (which hashes to sum) becomes
+// the blob unless the blob is already there, in which case it is removed. contentPath can be the layer itself.
+func DedupLayer(ctx context.Context, s storage.Storage, imageID, contentPath, sum string) error {
+	lock := blobLock(sum)
+	lock.Lock()
+	defer lock.Unlock()
+	layerPath := storage.ImageLayerPath(imageID)
+	blobPath := storage.BlobLayerPath(sum)
+	if err := s.Put(storage.BlobRefPath(sum, imageID), []byte(imageID)); err != nil {
+		return err
+	}
+	if exists, err := s.Exists(blobPath); err != nil {
+		return err
+	} else if exists {
+		logger.ForRequest(ctx).Debug("[DedupLayer][%s] blob %s already exists", imageID, sum)
+		if contentPath != layerPath {
+			s.Remove(contentPath)
+		}
+	} else if contentPath != layerPath {
+		if err := s.Rename(contentPath, blobPath); err != nil {
+			return err
+		}
+	} else if err := copyKey(s, layerPath, blobPath); err != nil {
+		// the layer has to stay readable until the reference replaces it
+		return err
+	}
+	return s.Put(layerPath, []byte(LAYER_REF_PREFIX+sum))
+}
+
+func copyKey(s storage.Storage, from, to string) error {
+	reader, err := s.GetReader(from)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return s.PutReader(to, reader, func(io.ReadSeeker) {})
+}
+
+// ReleaseLayer drops the reference the layer of imageID holds on its blob, removing the blob if it was the last
+// one. The layer itself is left alone.
+func ReleaseLayer(ctx context.Context, s storage.Storage, imageID string) error {
+	sum, err := LayerRef(s, imageID)
+	if err != nil || sum == "" {
+		return err
+	}
+	return releaseBlob(ctx, s, sum, imageID)
+}
+
+func releaseBlob(ctx context.Context, s storage.Storage, sum, imageID string) error {
+	lock := blobLock(sum)
+	lock.Lock()
+	defer lock.Unlock()
+	s.Remove(storage.BlobRefPath(sum, imageID))
+	refs, err := s.List(path.Dir(storage.BlobRefPath(sum, imageID)))
+	if err == nil && len(refs) > 0 {
+		return nil
+	} else if err != nil && !os.IsNotExist(err) {
+		// can't tell whether it is still used
+		return err
+	}
+	logger.ForRequest(ctx).Debug("[ReleaseLayer][%s] removing unreferenced blob %s", imageID, sum)
+	return s.RemoveAll(path.Dir(storage.BlobLayerPath(sum)))
+}
+
+type DedupStats struct {
+	Blobs        int   `json:"blobs"`
+	References   int   `json:"references"`
+	StoredBytes  int64 `json:"stored_bytes"`  // size of all blobs
+	LogicalBytes int64 `json:"logical_bytes"` // what the blobs would take without deduplication
+	SavedBytes   int64 `json:"saved_bytes"`
+}
+
+func GetDedupStats(s storage.Storage) (*DedupStats, error) {
+	stats := &DedupStats{}
+	blobs, err := s.List("blobs/sha256")
+	if err != nil {
+		// no blobs at all
+		return stats, nil
+	}
+	for _, blob := range blobs {
+		sum := path.Base(blob)
+		size, err := s.Size(storage.BlobLayerPath(sum))
+		if err != nil {
+			continue
+		}
+		refs, _ := s.List(path.Dir(storage.BlobRefPath(sum, "")))
+		stats.Blobs++
+		stats.References += len(refs)
+		stats.StoredBytes += size
+		stats.LogicalBytes += size * int64(len(refs))
+	}
+	stats.SavedBytes = stats.LogicalBytes - stats.StoredBytes
+	return stats, nil
+}
+
+// ConvertToDedup moves the layers of all existing images to the blob area. Returns how many layers it converted.
+func ConvertToDedup(s storage.Storage) (int, error) {
+	imageIDs, err := ImageIDs(s)
+	if err != nil {
+		return 0, err
+	}
+	converted := 0
+	for _, imageID := range imageIDs {
+		if exists, _ := s.Exists(storage.ImageMarkPath(imageID)); exists {
+			// still being pushed, it will be deduplicated when it completes
+			continue
+		}
+		if exists, _ := s.Exists(storage.ImageLayerPath(imageID)); !exists {
+			continue
+		}
+		if sum, err := LayerRef(s, imageID); err != nil {
+			return converted, err
+		} else if sum != "" {
+			continue
+		}
+		reader, err := s.GetReader(storage.ImageLayerPath(imageID))
+		if err != nil {
+			return converted, err
+		}
+		sum, err := sha256Hex(reader)
+		reader.Close()
+		if err != nil {
+			return converted, err
+		}
+		if err := DedupLayer(context.Background(), s, imageID, storage.ImageLayerPath(imageID), sum); err != nil {
+			return converted, err
+		}
+		converted++
+		logger.Debug("[ConvertToDedup][%s] converted to blob %s", imageID, sum)
+	}
+	return converted, nil
+}
@@ -0,0 +1,105 @@
+package layers
+
+import (
+	"context"
+	"io/ioutil"
+	"registry/storage"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDedupLayer(t *testing.T) {
+	s := newTestStorage(t)
+	for _, imageID := range []string{"1", "2"} {
+		putTestImage(t, s, imageID, "", "same layer")
+	}
+
+	if converted, err := ConvertToDedup(s); err != nil {
+		t.Fatal(err)
+	} else if converted != 2 {
+		t.Fatalf("Expected 2 layers to be converted, got %d", converted)
+	}
+	for _, imageID := range []string{"1", "2"} {
+		reader, err := LayerReader(s, imageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if string(content) != "same layer" {
+			t.Fatalf("Layer of %s reads as %q", imageID, content)
+		}
+		if size, _ := LayerSize(s, imageID); size != int64(len("same layer")) {
+			t.Fatalf("Layer of %s has size %d", imageID, size)
+		}
+	}
+	stats, err := GetDedupStats(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blobs != 1 || stats.References != 2 || stats.SavedBytes != int64(len("same layer")) {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	sum, _ := LayerRef(s, "1")
+	if err := ReleaseLayer(context.Background(), s, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := s.Exists(storage.BlobLayerPath(sum)); !exists {
+		t.Fatal("Blob was removed while image 2 still refers to it")
+	}
+	if err := ReleaseLayer(context.Background(), s, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := s.Exists(storage.BlobLayerPath(sum)); exists {
+		t.Fatal("Blob was not removed after its last reference was released")
+	}
+}
+
+func TestDedupUpload(t *testing.T) {
+	s := newTestStorage(t)
+	sum, _ := sha256Hex(strings.NewReader("uploaded layer"))
+	for _, imageID := range []string{"1", "2"} {
+		putTestImage(t, s, imageID, "", "")
+		s.Put(storage.BlobUploadPath(imageID), []byte("uploaded layer"))
+		if err := DedupLayer(context.Background(), s, imageID, storage.BlobUploadPath(imageID), sum); err != nil {
+			t.Fatal(err)
+		}
+		if exists, _ := s.Exists(storage.BlobUploadPath(imageID)); exists {
+			t.Fatalf("Expected the upload of %s to be gone", imageID)
+		}
+		if ref, _ := LayerRef(s, imageID); ref != sum {
+			t.Fatalf("Expected the layer of %s to refer to %s, got %q", imageID, sum, ref)
+		}
+	}
+	if content, _ := s.Get(storage.BlobLayerPath(sum)); string(content) != "uploaded layer" {
+		t.Fatalf("Unexpected blob content %q", content)
+	}
+
+	// releases racing with new references never leave a layer without its blob
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		imageID := strconv.Itoa(i + 3)
+		putTestImage(t, s, imageID, "", "")
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.Put(storage.BlobUploadPath(imageID), []byte("uploaded layer"))
+			if err := DedupLayer(context.Background(), s, imageID, storage.BlobUploadPath(imageID), sum); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func(imageID string) {
+			defer wg.Done()
+			ReleaseLayer(context.Background(), s, imageID)
+		}(strconv.Itoa(i + 1))
+	}
+	wg.Wait()
+	for i := 21; i < 23; i++ {
+		if _, err := LayerSize(s, strconv.Itoa(i)); err != nil {
+			t.Fatalf("Layer of %d lost its blob: %s", i, err.Error())
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package layers
+
+import (
+	"encoding/json"
+	"path"
+	"registry/storage"
+	"sort"
+)
+
+type RepositoryInfo struct {
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	Tags       int    `json:"tags"`
+	Size       int64  `json:"size"`        // bytes of the layers reachable from the tags, each counted once
+	LastUpdate int64  `json:"last_update"` // from the repository json, 0 if unknown
+	Private    bool   `json:"private"`
+}
+
+// SortRepositories sorts by namespace/name, the order catalog cursors rely on
+func SortRepositories(repos []*Repository) {
+	sort.Sort(byFullName(repos))
+}
+
+func (r *Repository) FullName() string {
+	return path.Join(r.Namespace, r.Name)
+}
+
+// IsPrivate returns an error when it can't be told, a private repository must not pass for a public one
+func IsPrivate(s storage.Storage, repo *Repository) (bool, error) {
+	return s.Exists(storage.RepoPrivatePath(repo.Namespace, repo.Name))
+}
+
+// GetRepositoryInfo describes repo, with the tags and size usage (from UsageTracker.Repositories) gives it. usage
+// is nil for a repository without tags.
+func GetRepositoryInfo(s storage.Storage, repo *Repository, usage *RepositoryUsage) (*RepositoryInfo, error) {
+	private, err := IsPrivate(s, repo)
+	if err != nil {
+		return nil, err
+	}
+	info := &RepositoryInfo{Namespace: repo.Namespace, Name: repo.Name, Private: private}
+	if usage != nil {
+		info.Tags, info.Size = usage.Tags, usage.Bytes
+	}
+	var repoJson struct {
+		LastUpdate int64 `json:"last_update"`
+	}
+	if content, err := s.Get(storage.RepoJsonPath(repo.Namespace, repo.Name)); err == nil {
+		json.Unmarshal(content, &repoJson)
+	}
+	info.LastUpdate = repoJson.LastUpdate
+	return info, nil
+}
+
+type byFullName []*Repository
+
+func (r byFullName) Len() int           { return len(r) }
+func (r byFullName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byFullName) Less(i, j int) bool { return r[i].FullName() < r[j].FullName() }
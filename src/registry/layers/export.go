@@ -0,0 +1,104 @@
+package layers
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"io"
+	"registry/storage"
+	"time"
+)
+
+// version of the per-image layout in docker save archives
+const EXPORT_IMAGE_VERSION = "1.0"
+
+// Export writes an image with its ancestry in the format of docker save, which docker load reads back
+type Export struct {
+	Storage  storage.Storage
+	Ancestry []string // the image first, then its parents
+
+	sizes map[string]int64
+}
+
+// NewExport checks that every image in the ancestry of imageID is complete, so that problems show up before
+// anything is streamed
+func NewExport(s storage.Storage, imageID string) (*Export, error) {
+	ancestry, err := GetAncestry(s, imageID)
+	if err != nil {
+		return nil, err
+	}
+	e := &Export{Storage: s, Ancestry: ancestry, sizes: map[string]int64{}}
+	for _, id := range ancestry {
+		if exists, _ := s.Exists(storage.ImageMarkPath(id)); exists {
+			return nil, errors.New("image " + id + " is incomplete")
+		}
+		if exists, _ := s.Exists(storage.ImageJsonPath(id)); !exists {
+			return nil, errors.New("image " + id + " does not exist")
+		}
+		size, err := LayerSize(s, id)
+		if err != nil {
+			return nil, errors.New("layer of " + id + " does not exist")
+		}
+		e.sizes[id] = size
+	}
+	return e, nil
+}
+
+// Write streams the archive to w, tagging the image repoName:tag
+func (e *Export) Write(w io.Writer, repoName, tag string) error {
+	archive := tar.NewWriter(w)
+	now := time.Now()
+	// parents first, like docker save
+	for i := len(e.Ancestry) - 1; i >= 0; i-- {
+		id := e.Ancestry[i]
+		if err := archive.WriteHeader(&tar.Header{Name: id + "/", Typeflag: tar.TypeDir, Mode: 0755,
+			ModTime: now}); err != nil {
+			return err
+		}
+		if err := writeFile(archive, id+"/VERSION", []byte(EXPORT_IMAGE_VERSION), now); err != nil {
+			return err
+		}
+		content, err := e.Storage.Get(storage.ImageJsonPath(id))
+		if err != nil {
+			return err
+		}
+		if err := writeFile(archive, id+"/json", content, now); err != nil {
+			return err
+		}
+		if err := e.writeLayer(archive, id, now); err != nil {
+			return err
+		}
+	}
+	repositories, err := json.Marshal(map[string]map[string]string{repoName: {tag: e.Ancestry[0]}})
+	if err != nil {
+		return err
+	}
+	if err := writeFile(archive, "repositories", repositories, now); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func (e *Export) writeLayer(archive *tar.Writer, id string, modTime time.Time) error {
+	reader, err := LayerReader(e.Storage, id)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	header := &tar.Header{Name: id + "/layer.tar", Mode: 0644, Size: e.sizes[id], ModTime: modTime}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	// the layer is stored as pushed, a tar docker load can read as is
+	_, err = io.Copy(archive, reader)
+	return err
+}
+
+func writeFile(archive *tar.Writer, name string, content []byte, modTime time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: modTime}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := archive.Write(content)
+	return err
+}
@@ -0,0 +1,59 @@
+package layers
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"registry/storage"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	s := newTestStorage(t)
+	putTestImage(t, s, "base", "", "layer of base")
+	putTestImage(t, s, "app", "base", "layer of app")
+	s.Put(storage.ImageMarkPath("base"), MarkContent())
+	if _, err := NewExport(s, "app"); err == nil {
+		t.Fatal("Exported an image with an incomplete parent")
+	}
+	s.Remove(storage.ImageMarkPath("base"))
+
+	export, err := NewExport(s, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := export.Write(&archive, "team/app", "1.0"); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"base/VERSION":   "1.0",
+		"base/json":      `{"id":"base"}`,
+		"base/layer.tar": "layer of base",
+		"app/VERSION":    "1.0",
+		"app/json":       `{"id":"app"}`,
+		"app/layer.tar":  "layer of app",
+		"repositories":   `{"team/app":{"1.0":"app"}}`,
+	}
+	reader := tar.NewReader(&archive)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		content, _ := ioutil.ReadAll(reader)
+		if expected[header.Name] != string(content) {
+			t.Fatalf("Unexpected content of %s: %q", header.Name, content)
+		}
+		delete(expected, header.Name)
+	}
+	if len(expected) != 0 {
+		t.Fatalf("Missing from the archive: %v", expected)
+	}
+}
@@ -0,0 +1,491 @@
+package layers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"registry/logger"
+	"registry/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PROBLEM_MISSING_TAG_IMAGE   = "tag_missing_image"
+	PROBLEM_MISSING_PARENT      = "missing_parent"
+	PROBLEM_BAD_ANCESTRY        = "bad_ancestry"
+	PROBLEM_CHECKSUM_MISMATCH   = "checksum_mismatch"
+	PROBLEM_ORPHAN_CACHE        = "orphan_cache"
+	PROBLEM_MISSING_INDEX_IMAGE = "index_missing_image"
+	PROBLEM_STALE_MARK          = "stale_mark"
+	PROBLEM_MISSING_BLOB        = "missing_blob"
+	PROBLEM_ORPHAN_BLOB         = "orphan_blob"
+	PROBLEM_STALE_BLOB_REF      = "stale_blob_ref"
+	PROBLEM_UNREADABLE          = "unreadable"
+)
+
+type Problem struct {
+	Kind     string `json:"kind"`
+	Key      string `json:"key"`
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired"`
+}
+
+type FsckReport struct {
+	Images       int       `json:"images"`
+	Repositories int       `json:"repositories"`
+	Tags         int       `json:"tags"`
+	Problems     []Problem `json:"problems"`
+}
+
+// Fsck checks the storage tree for inconsistencies. In repair mode it fixes what it finds:
+//   - tags pointing at missing images are removed
+//   - images with broken ancestry or a corrupt layer lose their layer and get marked as in progress again, so the
+//     next push of that image heals it
+//   - caches (_files, _diff) of images that don't exist are removed
+//   - _index_images entries for missing images are dropped
+//   - images still marked as in progress after StaleAfter are removed entirely, marks without a time never are
+//   - layers referring to a missing blob are handled like corrupt layers
+//   - blob references of images that don't use the blob anymore are removed, and so are blobs nothing refers to
+//
+// Only what is known not to exist is repaired. Keys that can't be read are reported as unreadable and left alone, a
+// storage error says nothing about what is there.
+//
+// Images being pushed (see pushing) are left alone, their layer and blob references are still being written.
+type Fsck struct {
+	Storage    storage.Storage
+	Repair     bool
+	StaleAfter time.Duration
+
+	report *FsckReport
+}
+
+func (f *Fsck) Run() (*FsckReport, error) {
+	f.report = &FsckReport{Problems: []Problem{}}
+	imageIDs, err := ImageIDs(f.Storage)
+	if err != nil {
+		return nil, err
+	}
+	f.report.Images = len(imageIDs)
+	for _, imageID := range imageIDs {
+		f.checkImage(imageID)
+	}
+	repos, err := Repositories(f.Storage)
+	if err != nil {
+		return nil, err
+	}
+	f.report.Repositories = len(repos)
+	for _, repo := range repos {
+		f.checkTags(repo)
+		f.checkIndexImages(repo)
+	}
+	f.checkBlobs()
+	return f.report, nil
+}
+
+func (f *Fsck) problem(kind, key, detail string, repair func() error) {
+	p := Problem{Kind: kind, Key: key, Detail: detail}
+	if f.Repair && repair != nil {
+		if err := repair(); err != nil {
+			logger.Error("[Fsck][%s] error repairing %s: %s", key, kind, err.Error())
+		} else {
+			p.Repaired = true
+		}
+	}
+	logger.Debug("[Fsck][%s] %s: %s (repaired=%t)", key, kind, detail, p.Repaired)
+	f.report.Problems = append(f.report.Problems, p)
+}
+
+func (f *Fsck) exists(key string) (bool, error) {
+	return f.Storage.Exists(key)
+}
+
+// reports key as unreadable, there is nothing to repair
+func (f *Fsck) unreadable(key string, err error) {
+	f.problem(PROBLEM_UNREADABLE, key, err.Error(), nil)
+}
+
+// returns whether key exists, reporting it as unreadable if that can't be told
+func (f *Fsck) check(key string) (exists bool, ok bool) {
+	exists, err := f.exists(key)
+	if err != nil {
+		f.unreadable(key, err)
+		return false, false
+	}
+	return exists, true
+}
+
+func (f *Fsck) checkImage(imageID string) {
+	jsonPath := storage.ImageJsonPath(imageID)
+	markPath := storage.ImageMarkPath(imageID)
+	exists, ok := f.check(jsonPath)
+	if !ok {
+		return
+	}
+	if !exists {
+		// nothing but leftovers here
+		for _, cachePath := range []string{storage.ImageFilesPath(imageID), storage.ImageDiffPath(imageID)} {
+			if exists, _ := f.check(cachePath); exists {
+				f.problem(PROBLEM_ORPHAN_CACHE, cachePath, "image json does not exist", func() error {
+					return f.Storage.Remove(cachePath)
+				})
+			}
+		}
+		return
+	}
+	marked, ok := f.check(markPath)
+	if !ok {
+		return
+	}
+	if marked {
+		if since, stale := f.markIsStale(markPath); stale {
+			f.problem(PROBLEM_STALE_MARK, markPath, "upload in progress since "+since, func() error {
+				// a layer that never became a blob
+				f.Storage.Remove(storage.BlobUploadPath(imageID))
+				return f.Storage.RemoveAll(path.Dir(jsonPath))
+			})
+		}
+		// the rest of the checks only make sense on completed images
+		return
+	}
+	// an image that can't be pulled correctly is marked as in progress so that a push can fix it
+	reset := func() error {
+		if pushing, err := f.pushing(imageID); err != nil {
+			return err
+		} else if pushing {
+			return errors.New("a push of the image started since it was checked")
+		}
+		if err := f.Storage.Put(markPath, MarkContent()); err != nil {
+			return err
+		}
+		// either might already be gone
+		f.Storage.Remove(storage.ImageChecksumPath(imageID))
+		ReleaseLayer(context.Background(), f.Storage, imageID)
+		f.Storage.Remove(storage.ImageLayerPath(imageID))
+		return nil
+	}
+	ancestryPath := storage.ImageAncestryPath(imageID)
+	content, err := f.Storage.Get(ancestryPath)
+	if err != nil && !os.IsNotExist(err) {
+		f.unreadable(ancestryPath, err)
+		return
+	}
+	var ancestry []string
+	if err == nil {
+		err = json.Unmarshal(content, &ancestry)
+	}
+	if err != nil || len(ancestry) == 0 || ancestry[0] != imageID {
+		f.problem(PROBLEM_BAD_ANCESTRY, ancestryPath, "ancestry is unreadable", reset)
+		return
+	}
+	for _, parentID := range ancestry[1:] {
+		if exists, ok := f.check(storage.ImageJsonPath(parentID)); !ok {
+			return
+		} else if !exists {
+			f.problem(PROBLEM_MISSING_PARENT, ancestryPath, "parent "+parentID+" does not exist", reset)
+			return
+		}
+	}
+	sum, err := LayerRef(f.Storage, imageID)
+	if err != nil && !os.IsNotExist(err) {
+		f.unreadable(storage.ImageLayerPath(imageID), err)
+		return
+	}
+	if err == nil && sum != "" {
+		if exists, ok := f.check(storage.BlobLayerPath(sum)); !ok {
+			return
+		} else if !exists {
+			f.problem(PROBLEM_MISSING_BLOB, storage.ImageLayerPath(imageID), "blob "+sum+" does not exist", reset)
+			return
+		}
+	}
+	if detail, err := f.verifyChecksum(imageID); err != nil {
+		f.unreadable(storage.ImageLayerPath(imageID), err)
+	} else if detail != "" {
+		f.problem(PROBLEM_CHECKSUM_MISMATCH, storage.ImageLayerPath(imageID), detail, reset)
+	}
+}
+
+// returns a description of the problem, or "" if the layer matches its checksum. errors are returned when the
+// layer couldn't be checked.
+func (f *Fsck) verifyChecksum(imageID string) (string, error) {
+	content, err := f.Storage.Get(storage.ImageChecksumPath(imageID))
+	if os.IsNotExist(err) {
+		return "checksum is missing", nil
+	} else if err != nil {
+		return "", err
+	}
+	var checksums []string
+	if err := json.Unmarshal(content, &checksums); err != nil {
+		return "checksum is unreadable", nil
+	}
+	expected := ""
+	for _, checksum := range checksums {
+		if strings.HasPrefix(checksum, "sha256:") {
+			expected = checksum
+		}
+	}
+	if expected == "" {
+		// only a tarsum, which can't be recomputed without the client's json. nothing to compare to.
+		return "", nil
+	}
+	// same computation as PutImageLayerHandler: sha256 of the json, a newline and then the layer
+	jsonContent, err := f.Storage.Get(storage.ImageJsonPath(imageID))
+	if err != nil {
+		return "", err
+	}
+	reader, err := LayerReader(f.Storage, imageID)
+	if os.IsNotExist(err) {
+		return "layer is missing", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	sha256Writer := sha256.New()
+	sha256Writer.Write(append(jsonContent, '\n'))
+	if _, err := io.Copy(sha256Writer, reader); err != nil {
+		return "", err
+	}
+	if actual := "sha256:" + hex.EncodeToString(sha256Writer.Sum(nil)); actual != expected {
+		return "layer hashes to " + actual + ", expected " + expected, nil
+	}
+	return "", nil
+}
+
+// whether imageID is being pushed: marked as in progress, or with its layer being uploaded
+func (f *Fsck) pushing(imageID string) (bool, error) {
+	if marked, err := f.exists(storage.ImageMarkPath(imageID)); err != nil || marked {
+		return marked, err
+	}
+	return f.exists(storage.BlobUploadPath(imageID))
+}
+
+func (f *Fsck) markIsStale(markPath string) (string, bool) {
+	content, err := f.Storage.Get(markPath)
+	if err != nil {
+		return "", false
+	}
+	timestamp, err := strconv.ParseInt(string(content), 10, 64)
+	if err != nil {
+		// marks written before they carried a timestamp. the push might have started a second ago.
+		return "an unknown time", false
+	}
+	since := time.Unix(timestamp, 0)
+	return since.UTC().Format(time.RFC3339), time.Now().Sub(since) > f.StaleAfter
+}
+
+func (f *Fsck) checkTags(repo *Repository) {
+	repoPath := storage.RepoPath(repo.Namespace, repo.Name)
+	names, err := f.Storage.List(repoPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			f.unreadable(repoPath, err)
+		}
+		return
+	}
+	for _, name := range names {
+		base := path.Base(name)
+		if !strings.HasPrefix(base, storage.TAG_PREFIX) {
+			continue
+		}
+		f.report.Tags++
+		tag := strings.TrimPrefix(base, storage.TAG_PREFIX)
+		content, err := f.Storage.Get(name)
+		if os.IsNotExist(err) {
+			// deleted since
+			continue
+		} else if err != nil {
+			f.unreadable(name, err)
+			continue
+		}
+		imageID := string(content)
+		if exists, ok := f.check(storage.ImageJsonPath(imageID)); ok && !exists {
+			tagPath := storage.RepoTagPath(repo.Namespace, repo.Name, tag)
+			f.problem(PROBLEM_MISSING_TAG_IMAGE, tagPath, "image "+imageID+" does not exist", func() error {
+				f.Storage.Remove(storage.RepoTagJsonPath(repo.Namespace, repo.Name, tag))
+				return f.Storage.Remove(tagPath)
+			})
+		}
+	}
+}
+
+func (f *Fsck) checkBlobs() {
+	blobs, err := f.Storage.List("blobs/sha256")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			f.unreadable("blobs/sha256", err)
+		}
+		return
+	}
+	for _, blob := range blobs {
+		sum := path.Base(blob)
+		refsPath := path.Dir(storage.BlobRefPath(sum, ""))
+		refs, err := f.Storage.List(refsPath)
+		if err != nil && !os.IsNotExist(err) {
+			f.unreadable(refsPath, err)
+			continue
+		}
+		used := 0
+		for _, ref := range refs {
+			imageID := path.Base(ref)
+			current, err := LayerRef(f.Storage, imageID)
+			if err != nil && !os.IsNotExist(err) {
+				// might well use the blob
+				f.unreadable(storage.ImageLayerPath(imageID), err)
+				used++
+				continue
+			}
+			// a push refers to the blob before its layer does (see DedupLayer)
+			pushing, pushErr := f.pushing(imageID)
+			if pushErr != nil {
+				f.unreadable(storage.ImageMarkPath(imageID), pushErr)
+			}
+			if (err == nil && current == sum) || pushing || pushErr != nil {
+				used++
+				continue
+			}
+			refPath := storage.BlobRefPath(sum, imageID)
+			f.problem(PROBLEM_STALE_BLOB_REF, refPath, "image "+imageID+" does not use this blob", func() error {
+				return f.Storage.Remove(refPath)
+			})
+		}
+		if used == 0 {
+			blobPath := storage.BlobLayerPath(sum)
+			f.problem(PROBLEM_ORPHAN_BLOB, blobPath, "no image refers to this blob", func() error {
+				// a push may have started using it since, like in releaseBlob
+				lock := blobLock(sum)
+				lock.Lock()
+				defer lock.Unlock()
+				if refs, err := f.Storage.List(refsPath); err == nil && len(refs) > 0 {
+					return errors.New("the blob is referred to again")
+				} else if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				return f.Storage.RemoveAll(path.Dir(blobPath))
+			})
+		}
+	}
+}
+
+func (f *Fsck) checkIndexImages(repo *Repository) {
+	indexPath := storage.RepoIndexImagesPath(repo.Namespace, repo.Name)
+	content, err := f.Storage.Get(indexPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			f.unreadable(indexPath, err)
+		}
+		return
+	}
+	var images []map[string]interface{}
+	if err := json.Unmarshal(content, &images); err != nil {
+		return
+	}
+	kept := []map[string]interface{}{}
+	missing := []string{}
+	for _, image := range images {
+		if id, ok := image["id"].(string); ok {
+			if exists, ok := f.check(storage.ImageJsonPath(id)); ok && !exists {
+				missing = append(missing, id)
+				continue
+			}
+		}
+		kept = append(kept, image)
+	}
+	if len(missing) == 0 {
+		return
+	}
+	f.problem(PROBLEM_MISSING_INDEX_IMAGE, indexPath, "images do not exist: "+strings.Join(missing, ", "),
+		func() error {
+			data, err := json.Marshal(&kept)
+			if err != nil {
+				return err
+			}
+			return f.Storage.Put(indexPath, data)
+		})
+}
+
+// content of the _inprogress mark: when the upload started, so abandoned uploads can be told apart
+func MarkContent() []byte {
+	return []byte(strconv.FormatInt(time.Now().Unix(), 10))
+}
+
+// PushAge returns how long ago the push of imageID started, and false if the image isn't being pushed. marks that
+// don't hold a time are as old as can be told, 0.
+func PushAge(s storage.Storage, imageID string) (time.Duration, bool) {
+	content, err := s.Get(storage.ImageMarkPath(imageID))
+	if err != nil {
+		return 0, false
+	}
+	started, err := strconv.ParseInt(string(content), 10, 64)
+	if err != nil {
+		return 0, true
+	}
+	return time.Since(time.Unix(started, 0)), true
+}
+
+type Repository struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+func sha256Hex(r io.Reader) (string, error) {
+	sha256Writer := sha256.New()
+	if _, err := io.Copy(sha256Writer, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sha256Writer.Sum(nil)), nil
+}
+
+func ImageIDs(s storage.Storage) ([]string, error) {
+	names, err := s.List("images")
+	if os.IsNotExist(err) {
+		// no images at all
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(names))
+	for i, name := range names {
+		ids[i] = path.Base(name)
+	}
+	return ids, nil
+}
+
+func Repositories(s storage.Storage) ([]*Repository, error) {
+	namespaces, err := s.List("repositories")
+	if os.IsNotExist(err) {
+		// no repositories at all
+		return []*Repository{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	repos := []*Repository{}
+	for _, namespace := range namespaces {
+		namespaceRepos, err := NamespaceRepositories(s, path.Base(namespace))
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, namespaceRepos...)
+	}
+	return repos, nil
+}
+
+func NamespaceRepositories(s storage.Storage, namespace string) ([]*Repository, error) {
+	names, err := s.List(path.Join("repositories", namespace))
+	if os.IsNotExist(err) {
+		return []*Repository{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	repos := make([]*Repository, len(names))
+	for i, name := range names {
+		repos[i] = &Repository{Namespace: namespace, Name: path.Base(name)}
+	}
+	return repos, nil
+}
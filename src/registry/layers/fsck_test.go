@@ -0,0 +1,155 @@
+package layers
+
+import (
+	"errors"
+	"registry/storage"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFsckStaleMarks(t *testing.T) {
+	s := newTestStorage(t)
+	day := strconv.FormatInt(time.Now().Add(-48*time.Hour).Unix(), 10)
+	for imageID, mark := range map[string]string{"abandoned": day, "legacy": "true", "pushing": string(MarkContent())} {
+		putTestImage(t, s, imageID, "", "")
+		s.Put(storage.ImageMarkPath(imageID), []byte(mark))
+		s.Put(storage.BlobUploadPath(imageID), []byte("layer of "+imageID))
+	}
+	report, err := (&Fsck{Storage: s, Repair: true, StaleAfter: 24 * time.Hour}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Key != storage.ImageMarkPath("abandoned") {
+		t.Fatalf("Expected only the mark of abandoned to be stale, got %+v", report.Problems)
+	}
+	for imageID, kept := range map[string]bool{"abandoned": false, "legacy": true, "pushing": true} {
+		if exists, _ := s.Exists(storage.ImageJsonPath(imageID)); exists != kept {
+			t.Fatalf("Expected %s to be kept: %t", imageID, kept)
+		}
+		if exists, _ := s.Exists(storage.BlobUploadPath(imageID)); exists != kept {
+			t.Fatalf("Expected the upload of %s to be kept: %t", imageID, kept)
+		}
+	}
+}
+
+func TestFsckLeavesPushes(t *testing.T) {
+	s := newTestStorage(t)
+	// DedupLayer has referred to the blob, the layer isn't pointed at it yet
+	putTestImage(t, s, "pushing", "", "")
+	s.Put(storage.ImageMarkPath("pushing"), MarkContent())
+	sum := strings.Repeat("a", 64)
+	s.Put(storage.BlobRefPath(sum, "pushing"), []byte("pushing"))
+	s.Put(storage.BlobLayerPath(sum), []byte("layer of pushing"))
+
+	report, err := (&Fsck{Storage: s, Repair: true, StaleAfter: 24 * time.Hour}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("Expected the push to be left alone, got %+v", report.Problems)
+	}
+	for _, key := range []string{storage.BlobRefPath(sum, "pushing"), storage.BlobLayerPath(sum)} {
+		if exists, _ := s.Exists(key); !exists {
+			t.Fatalf("Expected %s to be kept", key)
+		}
+	}
+}
+
+// fails to read keys, like a storage that is having trouble
+type failingKeys struct {
+	storage.Storage
+	keys map[string]bool
+}
+
+func (s *failingKeys) Exists(relpath string) (bool, error) {
+	if s.keys[relpath] {
+		return false, errors.New("connection reset by peer")
+	}
+	return s.Storage.Exists(relpath)
+}
+
+func (s *failingKeys) Size(relpath string) (int64, error) {
+	if s.keys[relpath] {
+		return -1, errors.New("connection reset by peer")
+	}
+	return s.Storage.Size(relpath)
+}
+
+func (s *failingKeys) Get(relpath string) ([]byte, error) {
+	// listed names start with a slash
+	if s.keys[strings.TrimPrefix(relpath, "/")] {
+		return nil, errors.New("connection reset by peer")
+	}
+	return s.Storage.Get(relpath)
+}
+
+func (s *failingKeys) List(relpath string) ([]string, error) {
+	if s.keys[relpath] {
+		return nil, errors.New("connection reset by peer")
+	}
+	return s.Storage.List(relpath)
+}
+
+func TestFsckLeavesUnreadable(t *testing.T) {
+	s := newTestStorage(t)
+	sum := strings.Repeat("a", 64)
+	putTestImage(t, s, "base", "", "sha256:"+sum)
+	putTestImage(t, s, "app", "base", "layer of app")
+	s.Put(storage.BlobRefPath(sum, "base"), []byte("base"))
+	s.Put(storage.BlobLayerPath(sum), []byte("layer of base"))
+
+	failing := &failingKeys{Storage: s, keys: map[string]bool{
+		storage.ImageLayerPath("base"): true,
+		storage.ImageJsonPath("base"):  true,
+	}}
+	report, err := (&Fsck{Storage: failing, Repair: true, StaleAfter: 24 * time.Hour}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range report.Problems {
+		if problem.Kind != PROBLEM_UNREADABLE || problem.Repaired {
+			t.Fatalf("Expected only unreadable keys, got %+v", report.Problems)
+		}
+	}
+	for _, key := range []string{storage.BlobRefPath(sum, "base"), storage.BlobLayerPath(sum),
+		storage.ImageLayerPath("app")} {
+		if exists, _ := s.Exists(key); !exists {
+			t.Fatalf("Expected %s to be kept", key)
+		}
+	}
+	if exists, _ := s.Exists(storage.ImageMarkPath("app")); exists {
+		t.Fatal("Expected app not to be reset over a parent that couldn't be checked")
+	}
+}
+
+func TestFsckReportsUnlisted(t *testing.T) {
+	s := newTestStorage(t)
+	putTestImage(t, s, "1", "", "layer")
+	s.Put(storage.RepoTagPath("team", "app", "latest"), []byte("1"))
+	s.Put(storage.RepoTagPath("team", "web", "latest"), []byte("1"))
+	s.Put(storage.RepoIndexImagesPath("team", "web"), []byte(`[{"id":"1"}]`))
+
+	// whatever couldn't be listed or read is in the report, rather than passed off as checked
+	failing := &failingKeys{Storage: s, keys: map[string]bool{
+		storage.RepoPath("team", "app"):              true,
+		storage.RepoTagPath("team", "web", "latest"): true,
+		storage.RepoIndexImagesPath("team", "web"):   true,
+	}}
+	report, err := (&Fsck{Storage: failing, StaleAfter: 24 * time.Hour}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreadable := map[string]bool{}
+	for _, problem := range report.Problems {
+		if problem.Kind == PROBLEM_UNREADABLE {
+			unreadable[strings.TrimPrefix(problem.Key, "/")] = true
+		}
+	}
+	for key := range failing.keys {
+		if !unreadable[key] {
+			t.Fatalf("Expected %s to be reported as unreadable, got %+v", key, report.Problems)
+		}
+	}
+}
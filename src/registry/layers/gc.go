@@ -0,0 +1,301 @@
+package layers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"registry/logger"
+	"registry/storage"
+	"strings"
+	"time"
+)
+
+// GetAncestry returns imageID followed by its parents, nearest first
+func GetAncestry(s storage.Storage, imageID string) ([]string, error) {
+	content, err := s.Get(storage.ImageAncestryPath(imageID))
+	if err != nil {
+		return nil, err
+	}
+	var ancestry []string
+	if err := json.Unmarshal(content, &ancestry); err != nil {
+		return nil, err
+	}
+	return ancestry, nil
+}
+
+// ImagesInUse returns every image a tag points to, along with its ancestors. Tags whose path is in ignore are
+// treated as deleted. Anything that can't be read is an error rather than unused, since the result decides what
+// gets deleted.
+func ImagesInUse(s storage.Storage, ignore map[string]bool) (map[string]bool, error) {
+	used := map[string]bool{}
+	repos, err := Repositories(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, repo := range repos {
+		names, err := s.List(storage.RepoPath(repo.Namespace, repo.Name))
+		if os.IsNotExist(err) {
+			// deleted since
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			tag := strings.TrimPrefix(path.Base(name), storage.TAG_PREFIX)
+			if tag == path.Base(name) || ignore[storage.RepoTagPath(repo.Namespace, repo.Name, tag)] {
+				continue
+			}
+			content, err := s.Get(name)
+			if err != nil {
+				return nil, err
+			}
+			imageID := string(content)
+			if used[imageID] {
+				continue
+			}
+			used[imageID] = true
+			ancestry, err := GetAncestry(s, imageID)
+			if err != nil {
+				// without it there's no telling which images the tag needs (fsck reports broken ancestries)
+				return nil, fmt.Errorf("ancestry of %s, tagged in %s: %s", imageID, repo.FullName(), err.Error())
+			}
+			for _, id := range ancestry {
+				used[id] = true
+			}
+		}
+	}
+	return used, nil
+}
+
+// DeleteImage removes an image with everything stored for it, releasing its blob if it was deduplicated. It
+// doesn't check whether anything still uses the image.
+func DeleteImage(ctx context.Context, s storage.Storage, imageID string) error {
+	if exists, _ := s.Exists(storage.ImageLayerPath(imageID)); exists {
+		if err := ReleaseLayer(ctx, s, imageID); err != nil {
+			return err
+		}
+	}
+	logger.ForRequest(ctx).Debug("[DeleteImage][%s] removing", imageID)
+	return s.RemoveAll(path.Dir(storage.ImageJsonPath(imageID)))
+}
+
+// how long an image can stay incomplete before its push counts as abandoned
+const GC_ABANDONED_PUSH_AGE = 24 * time.Hour
+
+// CollectImages removes the images among candidates (and their ancestors) that no tag uses anymore, and returns
+// their ids. Tags whose path is in ignore don't count, so a dry run can pretend they are already deleted. Only
+// images that were tagged are candidates, which keeps the images of pushes in progress out of reach. Pushes reusing
+// a candidate as a parent keep it too, see imagesBuiltOn.
+func CollectImages(s storage.Storage, candidates []string, ignore map[string]bool, dryRun bool) ([]string, error) {
+	used, err := ImagesInUse(s, ignore)
+	if err != nil {
+		return nil, err
+	}
+	ancestries := map[string][]string{}
+	collectable := map[string]bool{}
+	for _, candidate := range candidates {
+		ancestry, err := GetAncestry(s, candidate)
+		if err != nil {
+			ancestry = []string{candidate}
+		}
+		ancestries[candidate] = ancestry
+		for _, imageID := range ancestry {
+			collectable[imageID] = !used[imageID]
+		}
+	}
+	builtOn, err := imagesBuiltOn(s, used, collectable)
+	if err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	seen := map[string]bool{}
+	for _, candidate := range candidates {
+		for _, imageID := range ancestries[candidate] {
+			if seen[imageID] || used[imageID] || builtOn[imageID] {
+				continue
+			}
+			seen[imageID] = true
+			if exists, _ := s.Exists(storage.ImageJsonPath(imageID)); !exists {
+				continue
+			}
+			if !dryRun {
+				if err := DeleteImage(context.Background(), s, imageID); err != nil {
+					return removed, err
+				}
+			}
+			removed = append(removed, imageID)
+		}
+	}
+	if !dryRun && len(removed) > 0 {
+		// like DeleteImageHandler. the images are gone either way.
+		if err := RemoveIndexImage(s, removed...); err != nil {
+			logger.Error("[CollectImages] error updating _index_images: %s", err.Error())
+		}
+	}
+	return removed, nil
+}
+
+// returns the ancestors of the images that are neither tagged (in used) nor collected along with the candidates
+// (in collectable): mostly pushes that haven't put their tag yet. docker doesn't upload a parent that already
+// exists, so collecting it would leave the tag about to be put with a missing parent. pushes abandoned for longer than
+// GC_ABANDONED_PUSH_AGE don't count, untagged images that are complete always do.
+func imagesBuiltOn(s storage.Storage, used, collectable map[string]bool) (map[string]bool, error) {
+	builtOn := map[string]bool{}
+	imageIDs, err := ImageIDs(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, imageID := range imageIDs {
+		if used[imageID] || collectable[imageID] {
+			continue
+		}
+		if age, pushing := PushAge(s, imageID); pushing && age > GC_ABANDONED_PUSH_AGE {
+			continue
+		}
+		ancestry, err := GetAncestry(s, imageID)
+		if err != nil {
+			// can't tell what it builds on, the next run may
+			return nil, fmt.Errorf("ancestry of %s: %s", imageID, err.Error())
+		}
+		for _, ancestor := range ancestry {
+			if ancestor != imageID {
+				builtOn[ancestor] = true
+			}
+		}
+	}
+	return builtOn, nil
+}
+
+type TagReference struct {
+	Namespace string `json:"namespace"`
+	Repo      string `json:"repo"`
+	Tag       string `json:"tag"`
+	ImageID   string `json:"image_id"` // what the tag points to, imageID itself or a descendant
+}
+
+// ImageReferences is what still needs an image
+type ImageReferences struct {
+	Tags        []*TagReference `json:"tags"`
+	Descendants []string        `json:"descendants"` // images with the image in their ancestry
+	// images whose ancestry can't be read, so there's no telling whether they or the tags on them need the image
+	Unreadable []string `json:"unreadable"`
+}
+
+// Empty returns whether nothing needs the image. Unreadable images count, they may need it.
+func (r *ImageReferences) Empty() bool {
+	return len(r.Tags) == 0 && len(r.Descendants) == 0 && len(r.Unreadable) == 0
+}
+
+// Reaches returns whether imageID is id or one of its ancestors
+func Reaches(s storage.Storage, id, imageID string) (bool, error) {
+	ancestry, err := GetAncestry(s, id)
+	if err != nil {
+		return false, err
+	}
+	for _, ancestor := range ancestry {
+		if ancestor == imageID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// FindImageReferences scans every tag and every image for references to imageID. Images without a readable ancestry
+// (and the tags on them) are skipped and listed in Unreadable.
+func FindImageReferences(s storage.Storage, imageID string) (*ImageReferences, error) {
+	refs := &ImageReferences{Tags: []*TagReference{}, Descendants: []string{}, Unreadable: []string{}}
+	// ancestries are shared by many tags
+	reaches := map[string]bool{}
+	reachesImage := func(id string) bool {
+		if reached, ok := reaches[id]; ok {
+			return reached
+		}
+		reached, err := Reaches(s, id, imageID)
+		if err != nil {
+			refs.Unreadable = append(refs.Unreadable, id)
+		}
+		reaches[id] = reached
+		return reached
+	}
+	repos, err := Repositories(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, repo := range repos {
+		names, err := s.List(storage.RepoPath(repo.Namespace, repo.Name))
+		if os.IsNotExist(err) {
+			// deleted since
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			tag := strings.TrimPrefix(path.Base(name), storage.TAG_PREFIX)
+			if tag == path.Base(name) {
+				continue
+			}
+			content, err := s.Get(name)
+			if err != nil {
+				return nil, err
+			}
+			if reachesImage(string(content)) {
+				refs.Tags = append(refs.Tags, &TagReference{repo.Namespace, repo.Name, tag, string(content)})
+			}
+		}
+	}
+	imageIDs, err := ImageIDs(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range imageIDs {
+		if id == imageID {
+			continue
+		}
+		if reachesImage(id) {
+			refs.Descendants = append(refs.Descendants, id)
+		}
+	}
+	return refs, nil
+}
+
+// RemoveIndexImage drops imageIDs from the _index_images of every repository
+func RemoveIndexImage(s storage.Storage, imageIDs ...string) error {
+	repos, err := Repositories(s)
+	if err != nil {
+		return err
+	}
+	removed := map[string]bool{}
+	for _, imageID := range imageIDs {
+		removed[imageID] = true
+	}
+	for _, repo := range repos {
+		indexPath := storage.RepoIndexImagesPath(repo.Namespace, repo.Name)
+		content, err := s.Get(indexPath)
+		if err != nil {
+			continue
+		}
+		var images []map[string]interface{}
+		if err := json.Unmarshal(content, &images); err != nil {
+			continue
+		}
+		kept := []map[string]interface{}{}
+		for _, image := range images {
+			if id, _ := image["id"].(string); !removed[id] {
+				kept = append(kept, image)
+			}
+		}
+		if len(kept) == len(images) {
+			continue
+		}
+		data, err := json.Marshal(&kept)
+		if err != nil {
+			return err
+		}
+		if err := s.Put(indexPath, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package layers
+
+import (
+	"context"
+	"errors"
+	"registry/storage"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeleteImage(t *testing.T) {
+	s := newTestStorage(t)
+	// base <- leaked <- app, only app is tagged
+	for _, image := range [][2]string{{"base", ""}, {"leaked", "base"}, {"app", "leaked"}} {
+		putTestImage(t, s, image[0], image[1], "layer of "+image[0])
+	}
+	s.Put(storage.RepoTagPath("library", "app", "latest"), []byte("app"))
+	s.Put(storage.RepoIndexImagesPath("library", "app"), []byte(`[{"id":"base"},{"id":"leaked"},{"id":"app"}]`))
+
+	refs, err := FindImageReferences(s, "leaked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs.Tags) != 1 || refs.Tags[0].Tag != "latest" || refs.Tags[0].ImageID != "app" {
+		t.Fatalf("Expected latest to reference leaked through app, got %+v", refs.Tags)
+	}
+	if len(refs.Descendants) != 1 || refs.Descendants[0] != "app" {
+		t.Fatalf("Expected app to be the only descendant, got %v", refs.Descendants)
+	}
+	if refs, _ := FindImageReferences(s, "app"); len(refs.Descendants) != 0 {
+		t.Fatalf("app has no descendants, got %v", refs.Descendants)
+	}
+
+	if err := DeleteImage(context.Background(), s, "leaked"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveIndexImage(s, "leaked"); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := s.List("images/leaked"); len(names) != 0 {
+		t.Fatalf("Expected nothing left of the image, found %v", names)
+	}
+	content, _ := s.Get(storage.RepoIndexImagesPath("library", "app"))
+	if strings.Contains(string(content), "leaked") || !strings.Contains(string(content), "base") {
+		t.Fatalf("Unexpected _index_images: %s", content)
+	}
+}
+
+// fails to list path, like a storage that is having trouble
+type failingList struct {
+	storage.Storage
+	path string
+}
+
+func (s *failingList) List(relpath string) ([]string, error) {
+	if relpath == s.path {
+		return nil, errors.New("connection reset by peer")
+	}
+	return s.Storage.List(relpath)
+}
+
+func TestCollectImagesKeepsParentsOfPushes(t *testing.T) {
+	s := newTestStorage(t)
+	putTestImage(t, s, "base", "", "layer of base")
+	putTestImage(t, s, "app", "base", "layer of app")
+	// pushed on top of base, not tagged yet
+	putTestImage(t, s, "pushing", "base", "layer of pushing")
+	// abandoned long ago
+	putTestImage(t, s, "abandoned", "app", "")
+	s.Put(storage.ImageMarkPath("abandoned"), []byte(strconv.FormatInt(time.Now().Add(-48*time.Hour).Unix(), 10)))
+
+	removed, err := CollectImages(s, []string{"app"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != "app" {
+		t.Fatalf("Expected only app to be removed, got %v", removed)
+	}
+	if exists, _ := s.Exists(storage.ImageJsonPath("base")); !exists {
+		t.Fatal("Expected base to be kept for the push building on it")
+	}
+}
+
+func TestCollectImagesErrors(t *testing.T) {
+	s := newTestStorage(t)
+	putTestImage(t, s, "base", "", "layer of base")
+	putTestImage(t, s, "app", "base", "layer of app")
+	s.Put(storage.RepoTagPath("library", "app", "latest"), []byte("app"))
+
+	// none of these can tell that app and base are still used
+	for _, broken := range []storage.Storage{
+		&failingList{s, "repositories"},
+		&failingList{s, "repositories/library"},
+		&failingList{s, storage.RepoPath("library", "app")},
+	} {
+		if removed, err := CollectImages(broken, []string{"app"}, nil, false); err == nil {
+			t.Fatalf("Expected an error, got %v removed", removed)
+		}
+	}
+	s.Remove(storage.ImageAncestryPath("app"))
+	if removed, err := CollectImages(s, []string{"base"}, nil, false); err == nil {
+		t.Fatalf("Expected an error without the ancestry of app, got %v removed", removed)
+	}
+	if exists, _ := s.Exists(storage.ImageJsonPath("base")); !exists {
+		t.Fatal("Expected base to survive")
+	}
+}
+
+func TestFindImageReferencesErrors(t *testing.T) {
+	s := newTestStorage(t)
+	putTestImage(t, s, "base", "", "layer of base")
+	putTestImage(t, s, "app", "base", "layer of app")
+	s.Put(storage.RepoTagPath("library", "app", "latest"), []byte("app"))
+
+	if refs, err := FindImageReferences(&failingList{s, storage.RepoPath("library", "app")}, "base"); err == nil {
+		t.Fatalf("Expected an error, got %+v", refs)
+	}
+	s.Remove(storage.ImageAncestryPath("app"))
+	refs, err := FindImageReferences(s, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs.Unreadable) != 1 || refs.Unreadable[0] != "app" || len(refs.Tags) != 0 || len(refs.Descendants) != 0 {
+		t.Fatalf("Expected app to be reported as unreadable, got %+v", refs)
+	}
+}
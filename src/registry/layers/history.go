@@ -0,0 +1,63 @@
+package layers
+
+import (
+	"encoding/json"
+	"registry/storage"
+	"time"
+)
+
+// older entries are dropped, a tag can't be rolled back further than this
+const TAG_HISTORY_SIZE = 100
+
+// TagHistoryEntry records a tag being pointed at an image
+type TagHistoryEntry struct {
+	ImageID   string    `json:"image_id"`
+	Time      time.Time `json:"time"`
+	Pusher    string    `json:"pusher"` // "" if anonymous
+	UserAgent string    `json:"user_agent"`
+	Rollback  bool      `json:"rollback,omitempty"`
+}
+
+// GetTagHistory returns what tag pointed to over time, oldest first. Tags set before history was kept have none.
+func GetTagHistory(s storage.Storage, namespace, repo, tag string) ([]*TagHistoryEntry, error) {
+	history := []*TagHistoryEntry{}
+	content, err := s.Get(storage.RepoTagHistoryPath(namespace, repo, tag))
+	if err != nil {
+		if exists, _ := s.Exists(storage.RepoTagHistoryPath(namespace, repo, tag)); !exists {
+			return history, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func AppendTagHistory(s storage.Storage, namespace, repo, tag string, entry *TagHistoryEntry) error {
+	history, err := GetTagHistory(s, namespace, repo, tag)
+	if err != nil {
+		return err
+	}
+	history = append(history, entry)
+	if len(history) > TAG_HISTORY_SIZE {
+		history = history[len(history)-TAG_HISTORY_SIZE:]
+	}
+	content, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return s.Put(storage.RepoTagHistoryPath(namespace, repo, tag), content)
+}
+
+// RollbackTarget returns the entry a tag currently pointing at current would be rolled back to: the latest one for
+// imageID, or if imageID is "", the latest one for another image than current. nil if there is none.
+func RollbackTarget(history []*TagHistoryEntry, current, imageID string) *TagHistoryEntry {
+	for i := len(history) - 1; i >= 0; i-- {
+		entry := history[i]
+		if (imageID != "" && entry.ImageID == imageID) || (imageID == "" && entry.ImageID != current) {
+			return entry
+		}
+	}
+	return nil
+}
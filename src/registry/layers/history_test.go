@@ -0,0 +1,39 @@
+package layers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTagHistory(t *testing.T) {
+	s := newTestStorage(t)
+	if history, err := GetTagHistory(s, "library", "busybox", "latest"); err != nil || len(history) != 0 {
+		t.Fatalf("Expected no history, got %v, %v", history, err)
+	}
+	for _, imageID := range []string{"1", "2", "3", "3"} {
+		entry := &TagHistoryEntry{ImageID: imageID, Time: time.Now()}
+		if err := AppendTagHistory(s, "library", "busybox", "latest", entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, err := GetTagHistory(s, "library", "busybox", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 4 || history[0].ImageID != "1" || history[3].ImageID != "3" {
+		t.Fatalf("Unexpected history: %+v", history)
+	}
+
+	if target := RollbackTarget(history, "3", ""); target == nil || target.ImageID != "2" {
+		t.Fatalf("Expected to roll back to 2, got %+v", target)
+	}
+	if target := RollbackTarget(history, "", ""); target == nil || target.ImageID != "3" {
+		t.Fatalf("Expected a deleted tag to be restored to 3, got %+v", target)
+	}
+	if target := RollbackTarget(history, "3", "1"); target == nil || target.ImageID != "1" {
+		t.Fatalf("Expected to roll back to 1, got %+v", target)
+	}
+	if target := RollbackTarget(history, "3", "4"); target != nil {
+		t.Fatalf("Rolled back to an image the tag never pointed to: %+v", target)
+	}
+}
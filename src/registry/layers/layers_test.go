@@ -0,0 +1,32 @@
+package layers
+
+import (
+	"context"
+	"registry/storage"
+	"testing"
+)
+
+// a local storage that goes away with the test
+func newTestStorage(t *testing.T) storage.Storage {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// stores the json and ancestry of an image, and its layer unless layer is ""
+func putTestImage(t *testing.T, s storage.Storage, imageID, parentID, layer string) {
+	if err := s.Put(storage.ImageJsonPath(imageID), []byte(`{"id":"`+imageID+`"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateAncestry(context.Background(), s, imageID, parentID); err != nil {
+		t.Fatal(err)
+	}
+	if layer == "" {
+		return
+	}
+	if err := s.Put(storage.ImageLayerPath(imageID), []byte(layer)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,188 @@
+package layers
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// stop collecting violations after this many so a hostile layer can't blow up the error response
+const MAX_POLICY_VIOLATIONS = 100
+
+const (
+	RULE_FORMAT         = "format"
+	RULE_MAX_SIZE       = "max_size"
+	RULE_MAX_FILES      = "max_files"
+	RULE_FORBIDDEN_PATH = "forbidden_path"
+	RULE_SETUID         = "setuid"
+	RULE_DEVICE         = "device"
+	RULE_SYMLINK_ESCAPE = "symlink_escape"
+)
+
+// Policy describes what a layer is allowed to contain. Zero values disable the corresponding rule.
+type Policy struct {
+	MaxSize            int64    `json:"max_size"`  // bytes, as stored
+	MaxFiles           int      `json:"max_files"` // number of tar entries
+	ForbiddenPaths     []string `json:"forbidden_paths"`
+	DenySetuid         bool     `json:"deny_setuid"`
+	DenyDevices        bool     `json:"deny_devices"`
+	DenySymlinkEscapes bool     `json:"deny_symlink_escapes"`
+}
+
+type Violation struct {
+	Rule   string `json:"rule"`
+	Path   string `json:"path,omitempty"`
+	Detail string `json:"detail"`
+}
+
+type PolicyError struct {
+	Violations []Violation
+}
+
+func (e *PolicyError) Error() string {
+	rules := []string{}
+	seen := map[string]bool{}
+	for _, v := range e.Violations {
+		if !seen[v.Rule] {
+			seen[v.Rule] = true
+			rules = append(rules, v.Rule)
+		}
+	}
+	return "Layer rejected by policy: " + strings.Join(rules, ", ")
+}
+
+// PolicyCheck accumulates violations while a layer is read by TarInfo.Load
+type PolicyCheck struct {
+	policy     *Policy
+	files      int
+	violations []Violation
+}
+
+func NewPolicyCheck(policy *Policy) *PolicyCheck {
+	return &PolicyCheck{policy: policy, violations: []Violation{}}
+}
+
+func (c *PolicyCheck) violate(rule, name, detail string) {
+	if len(c.violations) >= MAX_POLICY_VIOLATIONS {
+		return
+	}
+	c.violations = append(c.violations, Violation{Rule: rule, Path: name, Detail: detail})
+}
+
+func (c *PolicyCheck) CheckSize(size int64) {
+	if c.policy.MaxSize > 0 && size > c.policy.MaxSize {
+		c.violate(RULE_MAX_SIZE, "", fmt.Sprintf("layer is %d bytes, limit is %d", size, c.policy.MaxSize))
+	}
+}
+
+// LimitReader fails reads once r went past the max_size of the policy, so that a layer that is too large is refused
+// before it is stored in full
+func (c *PolicyCheck) LimitReader(r io.Reader) io.Reader {
+	if c.policy.MaxSize <= 0 {
+		return r
+	}
+	return &policyLimitReader{Reader: r, check: c}
+}
+
+type policyLimitReader struct {
+	io.Reader
+	check    *PolicyCheck
+	read     int64
+	exceeded bool
+}
+
+func (r *policyLimitReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	if limit := r.check.policy.MaxSize; r.read > limit {
+		if !r.exceeded {
+			r.exceeded = true
+			r.check.violate(RULE_MAX_SIZE, "", fmt.Sprintf("layer is over the limit of %d bytes", limit))
+		}
+		return n, r.check.Err()
+	}
+	return n, err
+}
+
+// the layer could not be read as a tar, so none of the other rules can be verified
+func (c *PolicyCheck) Unreadable(err error) {
+	c.violate(RULE_FORMAT, "", "layer is not a readable tar archive: "+err.Error())
+}
+
+func (c *PolicyCheck) Append(header *tar.Header) {
+	c.files++
+	if c.policy.MaxFiles > 0 && c.files == c.policy.MaxFiles+1 {
+		c.violate(RULE_MAX_FILES, "", fmt.Sprintf("layer has more than %d files", c.policy.MaxFiles))
+	}
+	name := normalizeTarName(header.Name)
+	// every entry puts something at its path: an empty file, a link or a directory replaces what was there as much
+	// as a file with content does
+	for _, pattern := range c.policy.ForbiddenPaths {
+		if matched, _ := path.Match(pattern, name); matched {
+			c.violate(RULE_FORBIDDEN_PATH, name, "matches forbidden path "+pattern)
+			break
+		}
+	}
+	if c.policy.DenySetuid && header.Mode&(04000|02000) != 0 {
+		c.violate(RULE_SETUID, name, fmt.Sprintf("mode %o has setuid/setgid bits", header.Mode))
+	}
+	if c.policy.DenyDevices && (header.Typeflag == tar.TypeChar || header.Typeflag == tar.TypeBlock) {
+		c.violate(RULE_DEVICE, name, fmt.Sprintf("device node %d:%d", header.Devmajor, header.Devminor))
+	}
+	if c.policy.DenySymlinkEscapes {
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			if linkEscapes(path.Dir(name), header.Linkname) {
+				c.violate(RULE_SYMLINK_ESCAPE, name, "symlink points to "+header.Linkname)
+			}
+		case tar.TypeLink:
+			// hard link targets are relative to the root of the archive
+			if linkEscapes("/", header.Linkname) {
+				c.violate(RULE_SYMLINK_ESCAPE, name, "hard link points to "+header.Linkname)
+			}
+		}
+	}
+}
+
+// returns nil if the layer passed, a *PolicyError otherwise
+func (c *PolicyCheck) Err() error {
+	if len(c.violations) == 0 {
+		return nil
+	}
+	return &PolicyError{Violations: c.violations}
+}
+
+// same normalization as TarFilesInfo.Json: "./etc/shadow" and "etc/shadow" both become "/etc/shadow"
+func normalizeTarName(name string) string {
+	name = strings.TrimPrefix(name, "./")
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	return path.Clean(name)
+}
+
+func linkEscapes(dir, target string) bool {
+	if strings.HasPrefix(target, "/") {
+		return true
+	}
+	// walk the target relative to dir and see if it ever climbs out of the root
+	depth := len(strings.Split(strings.Trim(dir, "/"), "/"))
+	if strings.Trim(dir, "/") == "" {
+		depth = 0
+	}
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package layers
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"testing"
+)
+
+func buildTar(t *testing.T, headers []*tar.Header) io.ReadSeeker {
+	buf := &bytes.Buffer{}
+	writer := tar.NewWriter(buf)
+	for _, header := range headers {
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			writer.Write(bytes.Repeat([]byte("x"), int(header.Size)))
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func checkRules(t *testing.T, err error, expected []string) {
+	if len(expected) == 0 {
+		if err != nil {
+			t.Fatalf("Expected no violations, got %s", err.Error())
+		}
+		return
+	}
+	policyErr, ok := err.(*PolicyError)
+	if !ok {
+		t.Fatalf("Expected a *PolicyError, got %#v", err)
+	}
+	got := []string{}
+	for _, violation := range policyErr.Violations {
+		got = append(got, violation.Rule)
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected violations %+v, got %+v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("Expected violations %+v, got %+v", expected, got)
+		}
+	}
+}
+
+func TestPolicyClean(t *testing.T) {
+	tarInfo := NewTarInfo()
+	tarInfo.Policy = NewPolicyCheck(&Policy{
+		MaxFiles:           10,
+		ForbiddenPaths:     []string{"/etc/shadow"},
+		DenySetuid:         true,
+		DenyDevices:        true,
+		DenySymlinkEscapes: true,
+	})
+	tarInfo.Load(context.Background(), buildTar(t, []*tar.Header{
+		{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		{Name: "./usr/bin/vi", Typeflag: tar.TypeSymlink, Linkname: "../../bin/vim"},
+		{Name: "./usr/bin/view", Typeflag: tar.TypeLink, Linkname: "./usr/bin/vi"},
+	}))
+	checkRules(t, tarInfo.Policy.Err(), nil)
+}
+
+func TestPolicyViolations(t *testing.T) {
+	tarInfo := NewTarInfo()
+	tarInfo.Policy = NewPolicyCheck(&Policy{
+		MaxFiles:           4,
+		ForbiddenPaths:     []string{"/etc/shadow"},
+		DenySetuid:         true,
+		DenyDevices:        true,
+		DenySymlinkEscapes: true,
+	})
+	tarInfo.Load(context.Background(), buildTar(t, []*tar.Header{
+		{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0600, Size: 4},
+		{Name: "bin/su", Typeflag: tar.TypeReg, Mode: 04755, Size: 4},
+		{Name: "dev/sda", Typeflag: tar.TypeBlock, Mode: 0660, Devmajor: 8},
+		{Name: "lib/abs", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		{Name: "lib/rel", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"},
+	}))
+	checkRules(t, tarInfo.Policy.Err(), []string{
+		RULE_FORBIDDEN_PATH,
+		RULE_SETUID,
+		RULE_DEVICE,
+		RULE_SYMLINK_ESCAPE,
+		RULE_MAX_FILES,
+		RULE_SYMLINK_ESCAPE,
+	})
+}
+
+func TestPolicySize(t *testing.T) {
+	tarInfo := NewTarInfo()
+	tarInfo.Policy = NewPolicyCheck(&Policy{MaxSize: 512})
+	tarInfo.Load(context.Background(), buildTar(t, []*tar.Header{
+		{Name: "big", Typeflag: tar.TypeReg, Mode: 0644, Size: 1024},
+	}))
+	checkRules(t, tarInfo.Policy.Err(), []string{RULE_MAX_SIZE})
+}
+
+func TestPolicyUnreadable(t *testing.T) {
+	tarInfo := NewTarInfo()
+	tarInfo.Policy = NewPolicyCheck(&Policy{})
+	tarInfo.Load(context.Background(), bytes.NewReader(bytes.Repeat([]byte("not a tar"), 100)))
+	checkRules(t, tarInfo.Policy.Err(), []string{RULE_FORMAT})
+}
+
+func TestPolicyForbiddenPathTypes(t *testing.T) {
+	tarInfo := NewTarInfo()
+	tarInfo.Policy = NewPolicyCheck(&Policy{ForbiddenPaths: []string{"/etc/shadow", "/etc/sudoers"}})
+	tarInfo.Load(context.Background(), buildTar(t, []*tar.Header{
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		// no content of their own, but they still put something at the forbidden path
+		{Name: "etc/shadow", Typeflag: tar.TypeLink, Linkname: "etc/passwd"},
+		{Name: "./etc/shadow", Typeflag: tar.TypeSymlink, Linkname: "passwd"},
+		{Name: "etc/sudoers", Typeflag: tar.TypeReg, Mode: 0440},
+	}))
+	checkRules(t, tarInfo.Policy.Err(), []string{RULE_FORBIDDEN_PATH, RULE_FORBIDDEN_PATH, RULE_FORBIDDEN_PATH})
+}
@@ -0,0 +1,212 @@
+package layers
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"regexp"
+	"registry/logger"
+	"registry/storage"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionRule decides which tags of a repository to keep. A tag is kept if any of the conditions holds, the
+// others are deleted. Tags without a known last update are always kept.
+type RetentionRule struct {
+	KeepLast      int    `json:"keep_last"`       // the most recently updated tags
+	KeepNewerThan int64  `json:"keep_newer_than"` // seconds since the last update
+	KeepPattern   string `json:"keep_pattern"`    // regexp on the tag name
+}
+
+func (r *RetentionRule) Validate() []error {
+	errs := []error{}
+	if r.KeepLast < 0 || r.KeepNewerThan < 0 {
+		errs = append(errs, errors.New("keep_last and keep_newer_than can't be negative"))
+	}
+	if r.KeepLast == 0 && r.KeepNewerThan == 0 && r.KeepPattern == "" {
+		errs = append(errs, errors.New("would delete every tag, set keep_last, keep_newer_than or keep_pattern"))
+	}
+	if _, err := regexp.Compile(r.KeepPattern); err != nil {
+		errs = append(errs, errors.New("invalid keep_pattern: "+err.Error()))
+	}
+	return errs
+}
+
+type RetainedTag struct {
+	Namespace  string `json:"namespace"`
+	Repo       string `json:"repo"`
+	Tag        string `json:"tag"`
+	ImageID    string `json:"image_id"`
+	LastUpdate int64  `json:"last_update"`
+}
+
+type RetentionReport struct {
+	DryRun       bool           `json:"dry_run"`
+	Repositories int            `json:"repositories"` // repositories a rule applied to
+	Tags         int            `json:"tags"`
+	Deleted      []*RetainedTag `json:"deleted"`
+	// images no tag used anymore after the deletions, only collected with GC
+	DeletedImages []string `json:"deleted_images"`
+}
+
+// Retention applies retention rules to every repository. Rules are keyed by namespace/repo or namespace, "*"
+// applies to repositories without a rule of their own.
+type Retention struct {
+	Storage storage.Storage
+	Rules   map[string]*RetentionRule
+	DryRun  bool
+	// also remove the images the deleted tags pointed to if nothing else uses them
+	GC bool
+	// tags that are never deleted, whatever the rules say
+	Protected func(namespace, repo, tag string) bool
+	// called for every tag deleted (not in dry run mode)
+	OnDelete func(*RetainedTag)
+	// locks a tag against requests changing it, returning the function unlocking it. nil for no locking.
+	Lock func(namespace, repo, tag string) func()
+	// keeps every tag from being written while images are collected, so none is put on an image between the check
+	// that nothing uses it and its deletion. returns the function unlocking. nil for no locking.
+	LockImages func() func()
+}
+
+func (r *Retention) rule(namespace, repo string) *RetentionRule {
+	for _, key := range []string{path.Join(namespace, repo), namespace, "*"} {
+		if rule, ok := r.Rules[key]; ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *Retention) Run() (*RetentionReport, error) {
+	report := &RetentionReport{DryRun: r.DryRun, Deleted: []*RetainedTag{}, DeletedImages: []string{}}
+	repos, err := Repositories(r.Storage)
+	if err != nil {
+		return nil, err
+	}
+	for _, repo := range repos {
+		rule := r.rule(repo.Namespace, repo.Name)
+		if rule == nil {
+			continue
+		}
+		report.Repositories++
+		tags, err := r.tags(repo)
+		if err != nil {
+			return report, err
+		}
+		report.Tags += len(tags)
+		for _, tag := range r.expired(rule, tags) {
+			if !r.DryRun {
+				if deleted, err := r.deleteTag(tag); err != nil {
+					return report, err
+				} else if !deleted {
+					continue
+				}
+			}
+			report.Deleted = append(report.Deleted, tag)
+		}
+	}
+	if r.GC && len(report.Deleted) > 0 {
+		candidates := make([]string, len(report.Deleted))
+		deleted := map[string]bool{}
+		for i, tag := range report.Deleted {
+			candidates[i] = tag.ImageID
+			deleted[storage.RepoTagPath(tag.Namespace, tag.Repo, tag.Tag)] = true
+		}
+		if r.LockImages != nil && !r.DryRun {
+			defer r.LockImages()()
+		}
+		if report.DeletedImages, err = CollectImages(r.Storage, candidates, deleted, r.DryRun); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// returns the tags of repo, most recently updated first. tags updated at the same time are sorted by name, so the
+// same ones are kept every run.
+func (r *Retention) tags(repo *Repository) ([]*RetainedTag, error) {
+	names, err := r.Storage.List(storage.RepoPath(repo.Namespace, repo.Name))
+	if os.IsNotExist(err) {
+		return []*RetainedTag{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	tags := []*RetainedTag{}
+	for _, name := range names {
+		base := path.Base(name)
+		if !strings.HasPrefix(base, storage.TAG_PREFIX) {
+			continue
+		}
+		content, err := r.Storage.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		tag := &RetainedTag{
+			Namespace: repo.Namespace,
+			Repo:      repo.Name,
+			Tag:       strings.TrimPrefix(base, storage.TAG_PREFIX),
+			ImageID:   string(content),
+		}
+		// written by the tag handler, see CreateRepoJson
+		var tagJson struct {
+			LastUpdate int64 `json:"last_update"`
+		}
+		if content, err := r.Storage.Get(storage.RepoTagJsonPath(repo.Namespace, repo.Name, tag.Tag)); err == nil {
+			json.Unmarshal(content, &tagJson)
+		}
+		tag.LastUpdate = tagJson.LastUpdate
+		tags = append(tags, tag)
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		if tags[i].LastUpdate != tags[j].LastUpdate {
+			return tags[i].LastUpdate > tags[j].LastUpdate
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	return tags, nil
+}
+
+// returns the tags the rule doesn't keep
+func (r *Retention) expired(rule *RetentionRule, tags []*RetainedTag) []*RetainedTag {
+	keepPattern := regexp.MustCompile(rule.KeepPattern)
+	now := time.Now().Unix()
+	expired := []*RetainedTag{}
+	for i, tag := range tags {
+		switch {
+		case tag.LastUpdate == 0,
+			i < rule.KeepLast,
+			rule.KeepNewerThan > 0 && now-tag.LastUpdate < rule.KeepNewerThan,
+			rule.KeepPattern != "" && keepPattern.MatchString(tag.Tag),
+			r.Protected != nil && r.Protected(tag.Namespace, tag.Repo, tag.Tag):
+			continue
+		}
+		expired = append(expired, tag)
+	}
+	return expired
+}
+
+// deletes tag unless it was moved since it was listed, and returns whether it did
+func (r *Retention) deleteTag(tag *RetainedTag) (bool, error) {
+	if r.Lock != nil {
+		defer r.Lock(tag.Namespace, tag.Repo, tag.Tag)()
+	}
+	content, err := r.Storage.Get(storage.RepoTagPath(tag.Namespace, tag.Repo, tag.Tag))
+	if err != nil || string(content) != tag.ImageID {
+		// pushed or deleted meanwhile, the next run will see where it is now
+		logger.Info("[Retention] skipping %s/%s:%s, it changed since it was listed", tag.Namespace, tag.Repo, tag.Tag)
+		return false, nil
+	}
+	logger.Info("[Retention] deleting %s/%s:%s (%s)", tag.Namespace, tag.Repo, tag.Tag, tag.ImageID)
+	if err := r.Storage.Remove(storage.RepoTagPath(tag.Namespace, tag.Repo, tag.Tag)); err != nil {
+		return false, err
+	}
+	r.Storage.Remove(storage.RepoTagJsonPath(tag.Namespace, tag.Repo, tag.Tag))
+	r.Storage.Remove(storage.RepoTagHistoryPath(tag.Namespace, tag.Repo, tag.Tag))
+	if r.OnDelete != nil {
+		r.OnDelete(tag)
+	}
+	return true, nil
+}
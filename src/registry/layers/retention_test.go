@@ -0,0 +1,169 @@
+package layers
+
+import (
+	"registry/storage"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	s := newTestStorage(t)
+	// base is the parent of every image, each tag points to its own image
+	putTestImage(t, s, "base", "", "")
+	now := time.Now().Unix()
+	tags := map[string]int64{"c1": now - 400, "c2": now - 300, "c3": now - 200, "c4": now - 100, "v1.0": now - 500}
+	for tag, lastUpdate := range tags {
+		imageID := "image-" + tag
+		putTestImage(t, s, imageID, "base", "")
+		s.Put(storage.RepoTagPath("library", "app", tag), []byte(imageID))
+		s.Put(storage.RepoTagJsonPath("library", "app", tag),
+			[]byte(`{"last_update":`+strconv.FormatInt(lastUpdate, 10)+`}`))
+	}
+	// not covered by the rules
+	s.Put(storage.RepoTagPath("other", "app", "c1"), []byte("image-c1"))
+	s.Put(storage.RepoIndexImagesPath("library", "app"), []byte(`[{"id":"image-c1"},{"id":"image-c2"}]`))
+
+	retention := &Retention{
+		Storage: s,
+		Rules:   map[string]*RetentionRule{"library": {KeepLast: 2, KeepPattern: "^v"}},
+		DryRun:  true,
+		GC:      true,
+		Protected: func(namespace, repo, tag string) bool {
+			return tag == "c3"
+		},
+	}
+	report, err := retention.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// c4 and c3 are the last two, v1.0 matches the pattern, c1 is still tagged in other/app
+	if report.Repositories != 1 || report.Tags != 5 || len(report.Deleted) != 2 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	if report.Deleted[0].Tag != "c2" || report.Deleted[1].Tag != "c1" {
+		t.Fatalf("Expected c2 and c1 to be deleted, got %+v, %+v", report.Deleted[0], report.Deleted[1])
+	}
+	if len(report.DeletedImages) != 1 || report.DeletedImages[0] != "image-c2" {
+		t.Fatalf("Expected only image-c2 to be collected, got %v", report.DeletedImages)
+	}
+	if exists, _ := s.Exists(storage.RepoTagPath("library", "app", "c2")); !exists {
+		t.Fatal("Dry run deleted a tag")
+	}
+
+	retention.DryRun = false
+	if _, err := retention.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]bool{
+		storage.RepoTagPath("library", "app", "c1"): false,
+		storage.RepoTagPath("library", "app", "c2"): false,
+		storage.RepoTagPath("library", "app", "c3"): true,
+		storage.ImageJsonPath("image-c1"):           true,
+		storage.ImageJsonPath("image-c2"):           false,
+		storage.ImageJsonPath("base"):               true,
+	} {
+		if exists, _ := s.Exists(key); exists != expected {
+			t.Fatalf("Expected %s to exist: %t", key, expected)
+		}
+	}
+	if content, _ := s.Get(storage.RepoIndexImagesPath("library", "app")); string(content) != `[{"id":"image-c1"}]` {
+		t.Fatalf("Expected image-c2 to be dropped from _index_images, got %s", content)
+	}
+}
+
+func TestRetentionRacingPush(t *testing.T) {
+	s := newTestStorage(t)
+	putTestImage(t, s, "old", "", "layer of old")
+	putTestImage(t, s, "new", "", "layer of new")
+	for tag, lastUpdate := range map[string]int64{"c1": 100, "c2": 200} {
+		s.Put(storage.RepoTagPath("library", "app", tag), []byte("old"))
+		s.Put(storage.RepoTagJsonPath("library", "app", tag), []byte(`{"last_update":`+strconv.FormatInt(lastUpdate, 10)+`}`))
+	}
+	deleted := []string{}
+	retention := &Retention{
+		Storage: s,
+		Rules:   map[string]*RetentionRule{"library": {KeepLast: 1}},
+		GC:      true,
+		// c1 is pushed again between the listing and the delete
+		Lock: func(namespace, repo, tag string) func() {
+			s.Put(storage.RepoTagPath(namespace, repo, tag), []byte("new"))
+			return func() {}
+		},
+		OnDelete: func(tag *RetainedTag) { deleted = append(deleted, tag.Tag) },
+	}
+	report, err := retention.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Deleted) != 0 || len(deleted) != 0 || len(report.DeletedImages) != 0 {
+		t.Fatalf("Expected the pushed tag to be skipped, got %+v and %v", report, deleted)
+	}
+	if content, _ := s.Get(storage.RepoTagPath("library", "app", "c1")); string(content) != "new" {
+		t.Fatalf("Expected c1 to keep its new image, got %q", content)
+	}
+}
+
+// calls removing before removing anything
+type watchedRemoveAll struct {
+	storage.Storage
+	removing func(string)
+}
+
+func (s *watchedRemoveAll) RemoveAll(relpath string) error {
+	s.removing(relpath)
+	return s.Storage.RemoveAll(relpath)
+}
+
+func TestRetentionLocksImages(t *testing.T) {
+	backend := newTestStorage(t)
+	putTestImage(t, backend, "old", "", "layer of old")
+	for tag, lastUpdate := range map[string]int64{"c1": 100, "c2": 200} {
+		backend.Put(storage.RepoTagPath("library", "app", tag), []byte("old"))
+		backend.Put(storage.RepoTagJsonPath("library", "app", tag), []byte(`{"last_update":`+strconv.FormatInt(lastUpdate, 10)+`}`))
+	}
+	locked := false
+	s := &watchedRemoveAll{Storage: backend, removing: func(relpath string) {
+		if !locked {
+			t.Fatalf("Expected tags to be locked while %s is removed", relpath)
+		}
+	}}
+	retention := &Retention{
+		Storage: s,
+		Rules:   map[string]*RetentionRule{"library": {KeepLast: 0, KeepNewerThan: 1}},
+		GC:      true,
+		LockImages: func() func() {
+			locked = true
+			return func() { locked = false }
+		},
+	}
+	report, err := retention.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.DeletedImages) != 1 || locked {
+		t.Fatalf("Expected old to be collected and the lock released, got %+v, locked=%t", report, locked)
+	}
+}
+
+func TestRetentionOrder(t *testing.T) {
+	s := newTestStorage(t)
+	putTestImage(t, s, "1", "", "")
+	for _, tag := range []string{"b", "c", "a"} {
+		s.Put(storage.RepoTagPath("library", "app", tag), []byte("1"))
+		s.Put(storage.RepoTagJsonPath("library", "app", tag), []byte(`{"last_update":100}`))
+	}
+	retention := &Retention{Storage: s, Rules: map[string]*RetentionRule{"library": {KeepLast: 1}}, DryRun: true}
+	report, err := retention.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Deleted) != 2 || report.Deleted[0].Tag != "b" || report.Deleted[1].Tag != "c" {
+		t.Fatalf("Expected a to be kept as the first by name, got %+v", report.Deleted)
+	}
+
+	retention.Storage = &failingList{Storage: s, path: storage.RepoPath("library", "app")}
+	if _, err := retention.Run(); err == nil {
+		t.Fatal("Expected the listing error")
+	}
+}
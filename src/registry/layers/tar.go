@@ -3,6 +3,7 @@ package layers
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -25,6 +26,7 @@ func (e TarError) Error() string {
 type TarInfo struct {
 	TarSum       *TarSum
 	TarFilesInfo *TarFilesInfo
+	Policy       *PolicyCheck // optional, set before Load to enforce a layer policy
 	Error        error
 }
 
@@ -36,8 +38,12 @@ func NewTarInfo() *TarInfo {
 	}
 }
 
-func (t *TarInfo) Load(file io.ReadSeeker) {
+func (t *TarInfo) Load(ctx context.Context, file io.ReadSeeker) {
 	var reader *tar.Reader
+	if t.Policy != nil {
+		size, _ := file.Seek(0, 2)
+		t.Policy.CheckSize(size)
+	}
 	file.Seek(0, 0)
 	gzipReader, err := gzip.NewReader(file)
 	if err != nil {
@@ -54,11 +60,17 @@ func (t *TarInfo) Load(file io.ReadSeeker) {
 			break
 		} else if err != nil {
 			// error occured
-			logger.Debug("[TarInfoLoad] Error when reading tar stream tarsum. Disabling TarSum, TarFilesInfo. Error: %s", err.Error())
+			logger.ForRequest(ctx).Debug("[TarInfoLoad] Error when reading tar stream tarsum. Disabling TarSum, TarFilesInfo. Error: %s", err.Error())
 			t.Error = TarError(err.Error())
+			if t.Policy != nil {
+				t.Policy.Unreadable(err)
+			}
 			return
 		}
-		t.TarSum.Append(header, reader)
+		if t.Policy != nil {
+			t.Policy.Append(header)
+		}
+		t.TarSum.Append(ctx, header, reader)
 		t.TarFilesInfo.Append(header)
 	}
 }
@@ -79,7 +91,7 @@ func (t *TarSum) init() *TarSum {
 	return t
 }
 
-func (t *TarSum) Append(header *tar.Header, reader io.Reader) {
+func (t *TarSum) Append(ctx context.Context, header *tar.Header, reader io.Reader) {
 	headerStr := "name" + header.Name
 	headerStr += fmt.Sprintf("mode%d", header.Mode)
 	headerStr += fmt.Sprintf("uid%d", header.Uid)
@@ -97,7 +109,7 @@ func (t *TarSum) Append(header *tar.Header, reader io.Reader) {
 		t.sha.Write([]byte(headerStr))
 		_, err := io.Copy(t.sha, reader)
 		if err != nil {
-			logger.Debug("[TarSumAppend] error copying to sha: %s", err.Error())
+			logger.ForRequest(ctx).Debug("[TarSumAppend] error copying to sha: %s", err.Error())
 			t.sha.Reset()
 			t.sha.Write([]byte(headerStr))
 		}
@@ -107,8 +119,9 @@ func (t *TarSum) Append(header *tar.Header, reader io.Reader) {
 	t.hashes = append(t.hashes, hex.EncodeToString(t.sha.Sum(nil)))
 }
 
-func (t *TarSum) Compute(seed []byte) string {
-	logger.Debug("[TarSumCompute] seed:\n<<%s>>", seed)
+func (t *TarSum) Compute(ctx context.Context, seed []byte) string {
+	log := logger.ForRequest(ctx)
+	log.Debug("[TarSumCompute] seed:\n<<%s>>", seed)
 	sort.Strings(t.hashes)
 	t.sha.Reset()
 	t.sha.Write(seed)
@@ -116,7 +129,7 @@ func (t *TarSum) Compute(seed []byte) string {
 		t.sha.Write([]byte(hash))
 	}
 	tarsum := "tarsum+sha256:" + hex.EncodeToString(t.sha.Sum(nil))
-	logger.Debug("[TarSumCompute] return %s", tarsum)
+	log.Debug("[TarSumCompute] return %s", tarsum)
 	return tarsum
 }
 
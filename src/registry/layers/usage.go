@@ -0,0 +1,469 @@
+package layers
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"registry/storage"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long the usage of a namespace is kept in memory before it is read from the records again, which is how changes
+// made through other instances show up
+const USAGE_RECONCILE_INTERVAL = time.Minute
+
+// Usage is what the tags of a namespace take in the storage: the layers of every image reachable from them, each
+// counted once
+type Usage struct {
+	Namespace string                 `json:"namespace"`
+	Bytes     int64                  `json:"bytes"`
+	Images    map[string]*ImageUsage `json:"images"`
+}
+
+type ImageUsage struct {
+	Refs int   `json:"refs"` // tags this image is reachable from
+	Size int64 `json:"size"`
+}
+
+// UsageTracker keeps the usage of every namespace up to date as tags change, so that it never needs a full scan
+// unless the records are lost. Every tag has a record of its own under each image it reaches, holding the size of
+// the image's layer: moving a tag only writes and removes its own records, never ones another request or another
+// instance may be updating.
+//
+// Reading the records takes a round trip per image, so the usage of a namespace is kept in memory once read, updated
+// by the tags moved through this instance and read again every USAGE_RECONCILE_INTERVAL.
+type UsageTracker struct {
+	Storage storage.Storage
+	// while it returns true, scans are returned without being recorded
+	ReadOnly func() bool
+
+	lock   sync.Mutex
+	cached map[string]*cachedUsage
+	// bumped by every change to a namespace, so that a read racing one isn't kept
+	generations map[string]uint64
+}
+
+type cachedUsage struct {
+	usage *Usage
+	refs  usageRefs
+	read  time.Time
+}
+
+func NewUsageTracker(s storage.Storage) *UsageTracker {
+	return &UsageTracker{Storage: s}
+}
+
+// the "repo:tag" names reaching each image of a namespace
+type usageRefs map[string][]string
+
+// Get returns the usage of namespace, scanning it if it was never recorded
+func (t *UsageTracker) Get(namespace string) (*Usage, error) {
+	usage, _, err := t.get(namespace)
+	return usage, err
+}
+
+// returns copies of the usage of namespace and its refs, from memory if they were read recently enough
+func (t *UsageTracker) get(namespace string) (*Usage, usageRefs, error) {
+	t.lock.Lock()
+	if cached := t.cached[namespace]; cached != nil && time.Since(cached.read) < USAGE_RECONCILE_INTERVAL {
+		usage, refs := cached.copy()
+		t.lock.Unlock()
+		return usage, refs, nil
+	}
+	generation := t.generations[namespace]
+	t.lock.Unlock()
+	usage, refs, err := t.read(namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.remember(namespace, usage, refs, generation)
+	return usage, refs, nil
+}
+
+// keeps usage in memory unless namespace changed since generation, when what was read may already be stale
+func (t *UsageTracker) remember(namespace string, usage *Usage, refs usageRefs, generation uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.cached == nil {
+		t.cached, t.generations = map[string]*cachedUsage{}, map[string]uint64{}
+	}
+	if t.generations[namespace] != generation {
+		delete(t.cached, namespace)
+		return
+	}
+	cached := &cachedUsage{usage: usage, refs: refs, read: time.Now()}
+	t.cached[namespace] = cached
+	// handed out as well, so keep copies
+	cached.usage, cached.refs = cached.copy()
+}
+
+// drops what is kept of namespace, to be read again from the records. must be called with the lock held.
+func (t *UsageTracker) forget(namespace string) {
+	if t.cached == nil {
+		t.cached, t.generations = map[string]*cachedUsage{}, map[string]uint64{}
+	}
+	t.generations[namespace]++
+	delete(t.cached, namespace)
+}
+
+func (c *cachedUsage) copy() (*Usage, usageRefs) {
+	usage := &Usage{Namespace: c.usage.Namespace, Bytes: c.usage.Bytes, Images: map[string]*ImageUsage{}}
+	for id, image := range c.usage.Images {
+		usage.Images[id] = &ImageUsage{Refs: image.Refs, Size: image.Size}
+	}
+	refs := usageRefs{}
+	for id, names := range c.refs {
+		refs[id] = append([]string{}, names...)
+	}
+	return usage, refs
+}
+
+// applies ref moving from the images of oldAncestry to those of newAncestry, whose sizes are in sizes
+func (c *cachedUsage) retag(ref string, oldAncestry, newAncestry []string, sizes map[string]int64) {
+	kept := map[string]bool{}
+	for _, id := range newAncestry {
+		kept[id] = true
+		found := false
+		for _, name := range c.refs[id] {
+			found = found || name == ref
+		}
+		if !found {
+			c.refs[id] = append(c.refs[id], ref)
+		}
+		if c.usage.Images[id] == nil {
+			c.usage.Images[id] = &ImageUsage{Size: sizes[id]}
+			c.usage.Bytes += sizes[id]
+		}
+		c.usage.Images[id].Refs = len(c.refs[id])
+	}
+	for _, id := range oldAncestry {
+		if kept[id] || c.usage.Images[id] == nil {
+			continue
+		}
+		names := []string{}
+		for _, name := range c.refs[id] {
+			if name != ref {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			c.usage.Bytes -= c.usage.Images[id].Size
+			delete(c.usage.Images, id)
+			delete(c.refs, id)
+			continue
+		}
+		c.refs[id] = names
+		c.usage.Images[id].Refs = len(names)
+	}
+}
+
+// reads the usage of namespace from its records, scanning it if it was never recorded
+func (t *UsageTracker) read(namespace string) (*Usage, usageRefs, error) {
+	if scanned, err := t.Storage.Exists(storage.NamespaceUsageScannedPath(namespace)); err != nil {
+		return nil, nil, err
+	} else if !scanned {
+		return t.compute(namespace)
+	}
+	usage := &Usage{Namespace: namespace, Images: map[string]*ImageUsage{}}
+	imageRefs := usageRefs{}
+	images, err := t.Storage.List(storage.NamespaceUsagePath(namespace))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, image := range images {
+		if path.Base(image) == path.Base(storage.NamespaceUsageScannedPath(namespace)) {
+			continue
+		}
+		refs, err := t.Storage.List(image)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		} else if len(refs) == 0 {
+			// its last tag just moved away
+			continue
+		}
+		content, err := t.Storage.Get(refs[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		size, _ := strconv.ParseInt(string(content), 10, 64)
+		usage.Images[path.Base(image)] = &ImageUsage{Refs: len(refs), Size: size}
+		usage.Bytes += size
+		for _, ref := range refs {
+			imageRefs[path.Base(image)] = append(imageRefs[path.Base(image)], path.Base(ref))
+		}
+	}
+	return usage, imageRefs, nil
+}
+
+// scans every tag of namespace and records the result, unless the storage is read-only
+func (t *UsageTracker) compute(namespace string) (*Usage, usageRefs, error) {
+	usage := &Usage{Namespace: namespace, Images: map[string]*ImageUsage{}}
+	imageRefs := usageRefs{}
+	tags := []*TagReference{}
+	ancestries := map[string][]string{}
+	repos, err := t.Storage.List(path.Join("repositories", namespace))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, repo := range repos {
+		names, err := t.Storage.List(repo)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(path.Base(name), storage.TAG_PREFIX) {
+				continue
+			}
+			content, err := t.Storage.Get(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			imageID := string(content)
+			tag := strings.TrimPrefix(path.Base(name), storage.TAG_PREFIX)
+			tags = append(tags, &TagReference{Namespace: namespace, Repo: path.Base(repo), Tag: tag, ImageID: imageID})
+			if _, ok := ancestries[imageID]; !ok {
+				ancestries[imageID] = t.ancestry(imageID)
+			}
+			for _, id := range ancestries[imageID] {
+				imageRefs[id] = append(imageRefs[id], path.Base(repo)+":"+tag)
+				if image, ok := usage.Images[id]; ok {
+					image.Refs++
+					continue
+				}
+				size, _ := LayerSize(t.Storage, id)
+				usage.Images[id] = &ImageUsage{Refs: 1, Size: size}
+				usage.Bytes += size
+			}
+		}
+	}
+	if t.ReadOnly != nil && t.ReadOnly() {
+		return usage, imageRefs, nil
+	}
+	if _, err := t.Storage.List(storage.NamespaceUsagePath(namespace)); err == nil {
+		if err := t.Storage.RemoveAll(storage.NamespaceUsagePath(namespace)); err != nil {
+			return nil, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, tag := range tags {
+		if err := t.addRefs(namespace, tag.Repo, tag.Tag, ancestries[tag.ImageID], usage); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := t.Storage.Put(storage.NamespaceUsageScannedPath(namespace), []byte{}); err != nil {
+		return nil, nil, err
+	}
+	return usage, imageRefs, nil
+}
+
+func (t *UsageTracker) ancestry(imageID string) []string {
+	ancestry, err := GetAncestry(t.Storage, imageID)
+	if err != nil {
+		return []string{imageID}
+	}
+	return ancestry
+}
+
+// records repo:tag under the images of ancestry, whose sizes usage holds
+func (t *UsageTracker) addRefs(namespace, repo, tag string, ancestry []string, usage *Usage) error {
+	for _, id := range ancestry {
+		ref := storage.UsageRefPath(namespace, id, repo, tag)
+		if err := t.Storage.Put(ref, []byte(strconv.FormatInt(usage.Images[id].Size, 10))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Retag records tag of namespace/repo moving from oldImageID to newImageID, after the fact. Either is "" when the
+// tag was created or removed. If it fails, the records of namespace are dropped to be scanned again rather than
+// left half updated.
+func (t *UsageTracker) Retag(namespace, repo, tag, oldImageID, newImageID string) error {
+	if oldImageID == newImageID {
+		return nil
+	}
+	err := t.retag(namespace, repo, tag, oldImageID, newImageID)
+	if err != nil {
+		t.Storage.Remove(storage.NamespaceUsageScannedPath(namespace))
+		t.lock.Lock()
+		t.forget(namespace)
+		t.lock.Unlock()
+	}
+	return err
+}
+
+func (t *UsageTracker) retag(namespace, repo, tag, oldImageID, newImageID string) error {
+	if scanned, err := t.Storage.Exists(storage.NamespaceUsageScannedPath(namespace)); err != nil || !scanned {
+		// the scan will see the new state
+		t.lock.Lock()
+		t.forget(namespace)
+		t.lock.Unlock()
+		return err
+	}
+	// guessing an ancestry would leave records behind that nothing removes
+	var oldAncestry, newAncestry []string
+	var err error
+	if oldImageID != "" {
+		if oldAncestry, err = GetAncestry(t.Storage, oldImageID); err != nil {
+			return fmt.Errorf("ancestry of %s: %s", oldImageID, err.Error())
+		}
+	}
+	kept := map[string]bool{}
+	sizes := map[string]int64{}
+	if newImageID != "" {
+		if newAncestry, err = GetAncestry(t.Storage, newImageID); err != nil {
+			return fmt.Errorf("ancestry of %s: %s", newImageID, err.Error())
+		}
+		usage := &Usage{Images: map[string]*ImageUsage{}}
+		for _, id := range newAncestry {
+			size, _ := LayerSize(t.Storage, id)
+			usage.Images[id] = &ImageUsage{Size: size}
+			sizes[id] = size
+			kept[id] = true
+		}
+		// added first, the images both reach never look unused in between
+		if err := t.addRefs(namespace, repo, tag, newAncestry, usage); err != nil {
+			return err
+		}
+	}
+	for _, id := range oldAncestry {
+		if kept[id] {
+			continue
+		}
+		ref := storage.UsageRefPath(namespace, id, repo, tag)
+		if exists, err := t.Storage.Exists(ref); err != nil {
+			return err
+		} else if exists {
+			if err := t.Storage.Remove(ref); err != nil {
+				return err
+			}
+		}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if cached := t.cached[namespace]; cached != nil {
+		cached.retag(repo+":"+tag, oldAncestry, newAncestry, sizes)
+		t.generations[namespace]++
+	} else {
+		// a read in progress may have missed the records just written
+		t.forget(namespace)
+	}
+	return nil
+}
+
+// Adding returns how many bytes tagging imageID in namespace would add to its usage
+func (t *UsageTracker) Adding(namespace, imageID string) (int64, error) {
+	usage, err := t.Get(namespace)
+	if err != nil {
+		return 0, err
+	}
+	var adding int64
+	for _, id := range t.ancestry(imageID) {
+		if _, ok := usage.Images[id]; !ok {
+			size, _ := LayerSize(t.Storage, id)
+			adding += size
+		}
+	}
+	return adding, nil
+}
+
+// Recompute scans the tags of namespace again, for changes that can't be tracked incrementally
+func (t *UsageTracker) Recompute(namespace string) (*Usage, error) {
+	usage, _, err := t.recompute(namespace)
+	return usage, err
+}
+
+// compute, keeping the result in memory
+func (t *UsageTracker) recompute(namespace string) (*Usage, usageRefs, error) {
+	t.lock.Lock()
+	t.forget(namespace)
+	generation := t.generations[namespace]
+	t.lock.Unlock()
+	usage, refs, err := t.compute(namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.remember(namespace, usage, refs, generation)
+	return usage, refs, nil
+}
+
+// RepositoryUsage is the part of the usage of a namespace one of its repositories accounts for
+type RepositoryUsage struct {
+	Tags  int   // tags reaching at least one image
+	Bytes int64 // the layers reachable from them, each counted once
+}
+
+// Repositories splits the usage of namespace by repository, from the records rather than by walking every tag
+func (t *UsageTracker) Repositories(namespace string) (map[string]*RepositoryUsage, error) {
+	usage, imageRefs, err := t.get(namespace)
+	if err != nil {
+		return nil, err
+	}
+	repos := map[string]*RepositoryUsage{}
+	tags := map[string]bool{}
+	for imageID, refs := range imageRefs {
+		counted := map[string]bool{}
+		for _, ref := range refs {
+			i := strings.LastIndex(ref, ":")
+			if i < 0 {
+				continue
+			}
+			repo := ref[:i]
+			if repos[repo] == nil {
+				repos[repo] = &RepositoryUsage{}
+			}
+			if !tags[ref] {
+				tags[ref] = true
+				repos[repo].Tags++
+			}
+			if !counted[repo] {
+				counted[repo] = true
+				repos[repo].Bytes += usage.Images[imageID].Size
+			}
+		}
+	}
+	return repos, nil
+}
+
+// All returns the usage of every namespace
+func (t *UsageTracker) All() ([]*Usage, error) {
+	return t.each(t.get)
+}
+
+// Rebuild recomputes the usage of every namespace from scratch
+func (t *UsageTracker) Rebuild() ([]*Usage, error) {
+	return t.each(t.recompute)
+}
+
+func (t *UsageTracker) each(fn func(string) (*Usage, usageRefs, error)) ([]*Usage, error) {
+	namespaces := map[string]bool{}
+	// namespaces that lost all their repositories still have records
+	for _, root := range []string{"repositories", storage.USAGE_PATH} {
+		names, err := t.Storage.List(root)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, name := range names {
+			namespaces[path.Base(name)] = true
+		}
+	}
+	sorted := make([]string, 0, len(namespaces))
+	for namespace := range namespaces {
+		sorted = append(sorted, namespace)
+	}
+	sort.Strings(sorted)
+	usages := []*Usage{}
+	for _, namespace := range sorted {
+		usage, _, err := fn(namespace)
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
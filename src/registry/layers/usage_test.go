@@ -0,0 +1,190 @@
+package layers
+
+import (
+	"path"
+	"registry/storage"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestUsageTracker(t *testing.T) {
+	s := newTestStorage(t)
+	// base (10 bytes) <- app1 (100 bytes) <- app2 (1000 bytes)
+	for _, image := range []struct{ id, parent, layer string }{
+		{"base", "", "0123456789"},
+		{"app1", "base", string(make([]byte, 100))},
+		{"app2", "app1", string(make([]byte, 1000))},
+	} {
+		putTestImage(t, s, image.id, image.parent, image.layer)
+	}
+	s.Put(storage.RepoTagPath("team", "app", "v1"), []byte("app1"))
+
+	tracker := NewUsageTracker(s)
+	usage, err := tracker.Get("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes != 110 {
+		t.Fatalf("Expected 110 bytes from the scan, got %d", usage.Bytes)
+	}
+	if adding, _ := tracker.Adding("team", "app2"); adding != 1000 {
+		t.Fatalf("Expected tagging app2 to add 1000 bytes, got %d", adding)
+	}
+
+	s.Put(storage.RepoTagPath("team", "app", "v2"), []byte("app2"))
+	tracker.Retag("team", "app", "v2", "", "app2")
+	if usage, _ := tracker.Get("team"); usage.Bytes != 1110 || usage.Images["base"].Refs != 2 {
+		t.Fatalf("Unexpected usage after tagging v2: %+v", usage)
+	}
+	s.Remove(storage.RepoTagPath("team", "app", "v1"))
+	tracker.Retag("team", "app", "v1", "app1", "")
+	s.Remove(storage.RepoTagPath("team", "app", "v2"))
+	tracker.Retag("team", "app", "v2", "app2", "")
+	if usage, _ := tracker.Get("team"); usage.Bytes != 0 || len(usage.Images) != 0 {
+		t.Fatalf("Expected nothing used after removing every tag: %+v", usage)
+	}
+
+	// the incremental record agrees with a full scan
+	s.Put(storage.RepoTagPath("team", "app", "v2"), []byte("app2"))
+	tracker.Retag("team", "app", "v2", "", "app2")
+	usages, err := tracker.Rebuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 1 || usages[0].Bytes != 1110 {
+		t.Fatalf("Unexpected usage after rebuilding: %+v", usages)
+	}
+}
+
+func TestUsageTrackerConcurrentTags(t *testing.T) {
+	s := newTestStorage(t)
+	putTestImage(t, s, "base", "", "0123456789")
+	if _, err := NewUsageTracker(s).Get("team"); err != nil {
+		t.Fatal(err)
+	}
+	// tags pushed at once through different instances
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(tag string) {
+			defer wg.Done()
+			s.Put(storage.RepoTagPath("team", "app", tag), []byte("base"))
+			if err := NewUsageTracker(s).Retag("team", "app", tag, "", "base"); err != nil {
+				t.Error(err)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	usage, err := NewUsageTracker(s).Get("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes != 10 || usage.Images["base"].Refs != 20 {
+		t.Fatalf("Expected base to be reached by 20 tags, got %+v", usage.Images["base"])
+	}
+}
+
+// counts the listings that reach the storage
+type countingList struct {
+	storage.Storage
+	lists int
+}
+
+func (s *countingList) List(relpath string) ([]string, error) {
+	s.lists++
+	return s.Storage.List(relpath)
+}
+
+func TestUsageTrackerInMemory(t *testing.T) {
+	s := &countingList{Storage: newTestStorage(t)}
+	putTestImage(t, s, "base", "", "0123456789")
+	putTestImage(t, s, "app", "base", string(make([]byte, 100)))
+	s.Put(storage.RepoTagPath("team", "app", "v1"), []byte("base"))
+	tracker := NewUsageTracker(s)
+	if _, err := tracker.Get("team"); err != nil {
+		t.Fatal(err)
+	}
+	s.lists = 0
+	s.Put(storage.RepoTagPath("team", "app", "v2"), []byte("app"))
+	if err := tracker.Retag("team", "app", "v2", "", "app"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if adding, err := tracker.Adding("team", "app"); err != nil || adding != 0 {
+			t.Fatalf("Expected app to be counted already, got %d (%v)", adding, err)
+		}
+	}
+	usage, _ := tracker.Get("team")
+	if usage.Bytes != 110 || usage.Images["base"].Refs != 2 {
+		t.Fatalf("Unexpected usage after tagging v2: %+v", usage)
+	}
+	if s.lists != 0 {
+		t.Fatalf("Expected the usage to be kept in memory, listed %d times", s.lists)
+	}
+	// what is handed out is a copy
+	usage.Bytes = 0
+	if usage, _ := tracker.Get("team"); usage.Bytes != 110 {
+		t.Fatalf("Expected 110 bytes, got %d", usage.Bytes)
+	}
+	// another instance's view agrees
+	if usage, _ := NewUsageTracker(s).Get("team"); usage.Bytes != 110 {
+		t.Fatalf("Expected the records to hold 110 bytes, got %d", usage.Bytes)
+	}
+}
+
+func TestUsageTrackerRetagErrors(t *testing.T) {
+	s := newTestStorage(t)
+	putTestImage(t, s, "base", "", "0123456789")
+	putTestImage(t, s, "app", "base", string(make([]byte, 100)))
+	s.Put(storage.RepoTagPath("team", "app", "v1"), []byte("app"))
+	tracker := NewUsageTracker(s)
+	if _, err := tracker.Get("team"); err != nil {
+		t.Fatal(err)
+	}
+	s.Remove(storage.ImageAncestryPath("app"))
+	s.Remove(storage.RepoTagPath("team", "app", "v1"))
+	if err := tracker.Retag("team", "app", "v1", "app", ""); err == nil {
+		t.Fatal("Expected an error for the unreadable ancestry")
+	}
+	// instead of keeping base's record forever, the namespace is scanned again
+	if usage, err := tracker.Get("team"); err != nil || usage.Bytes != 0 {
+		t.Fatalf("Expected nothing used after the tag was removed, got %+v (%v)", usage, err)
+	}
+}
+
+// lists usage records without the scan marker, the way a listing cut short misses whatever sorts after the cut
+type markerlessList struct {
+	storage.Storage
+	scans int
+}
+
+func (s *markerlessList) List(relpath string) ([]string, error) {
+	if relpath == path.Join("repositories", "team") {
+		s.scans++
+	}
+	names, err := s.Storage.List(relpath)
+	kept := []string{}
+	for _, name := range names {
+		if path.Base(name) != path.Base(storage.NamespaceUsageScannedPath("team")) {
+			kept = append(kept, name)
+		}
+	}
+	return kept, err
+}
+
+func TestUsageTrackerScannedMarker(t *testing.T) {
+	s := &markerlessList{Storage: newTestStorage(t)}
+	putTestImage(t, s, "base", "", "0123456789")
+	s.Put(storage.RepoTagPath("team", "app", "v1"), []byte("base"))
+	if _, err := NewUsageTracker(s).Get("team"); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := NewUsageTracker(s).Get("team")
+	if err != nil || usage.Bytes != 10 {
+		t.Fatalf("Expected 10 bytes, got %+v (%v)", usage, err)
+	}
+	if s.scans != 1 {
+		t.Fatalf("Expected the records to be read rather than scanned again, scanned %d times", s.scans)
+	}
+}
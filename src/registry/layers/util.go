@@ -1,6 +1,7 @@
 package layers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"regexp"
@@ -69,6 +70,29 @@ func UpdateIndexImages(s storage.Storage, namespace, repo string, additionalByte
 	return s.Put(path, data)
 }
 
+// IndexImagesContain returns whether imageID is in the _index_images of namespace/repo, which pushes list their
+// images in before sending them
+func IndexImagesContain(s storage.Storage, namespace, repo, imageID string) (bool, error) {
+	path := storage.RepoIndexImagesPath(namespace, repo)
+	if exists, err := s.Exists(path); err != nil || !exists {
+		return false, err
+	}
+	content, err := s.Get(path)
+	if err != nil {
+		return false, err
+	}
+	var images []map[string]interface{}
+	if err := json.Unmarshal(content, &images); err != nil {
+		return false, err
+	}
+	for _, image := range images {
+		if id, _ := image["id"].(string); id == imageID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func GetImageFilesCache(s storage.Storage, imageID string) ([]byte, error) {
 	return s.Get(storage.ImageFilesPath(imageID))
 }
@@ -79,10 +103,10 @@ func SetImageFilesCache(s storage.Storage, imageID string, filesJson []byte) err
 
 // return json file listing for given image id
 // Download the specified layer and determine the file contents. If the cache already exists, just return it.
-func GetImageFilesJson(s storage.Storage, imageID string) ([]byte, error) {
+func GetImageFilesJson(ctx context.Context, s storage.Storage, imageID string) ([]byte, error) {
 	// if the files json exists in the cache, return it
 	filesJson, err := GetImageFilesCache(s, imageID)
-	if err != nil {
+	if err == nil {
 		return filesJson, nil
 	}
 
@@ -90,7 +114,7 @@ func GetImageFilesJson(s storage.Storage, imageID string) ([]byte, error) {
 	// docker-registry 0.6.5 has an lzma decompress here. it actually doesn't seem to be used so i've omitted it
 	// will add it later if need be.
 	tarFilesInfo := NewTarFilesInfo()
-	if reader, err := s.GetReader(storage.ImageLayerPath(imageID)); err != nil {
+	if reader, err := LayerReader(s, imageID); err != nil {
 		return nil, err
 	} else if err := tarFilesInfo.Load(reader); err != nil {
 		return nil, err
@@ -98,7 +122,7 @@ func GetImageFilesJson(s storage.Storage, imageID string) ([]byte, error) {
 	return tarFilesInfo.Json()
 }
 
-func StoreChecksum(s storage.Storage, imageID string, checksums []string) error {
+func StoreChecksum(ctx context.Context, s storage.Storage, imageID string, checksums []string) error {
 	for _, checksum := range checksums {
 		parts := strings.Split(checksum, ":")
 		if len(parts) != 2 {
@@ -109,11 +133,12 @@ func StoreChecksum(s storage.Storage, imageID string, checksums []string) error
 	if err != nil {
 		return err
 	}
+	logger.ForRequest(ctx).Debug("[StoreChecksum][%s] %s", imageID, strings.Join(checksums, ", "))
 	return s.Put(storage.ImageChecksumPath(imageID), content)
 }
 
-func GenerateAncestry(s storage.Storage, imageID, parentID string) (err error) {
-	logger.Debug("[GenerateAncestry] imageID=" + imageID + " parentID=" + parentID)
+func GenerateAncestry(ctx context.Context, s storage.Storage, imageID, parentID string) (err error) {
+	logger.ForRequest(ctx).Debug("[GenerateAncestry] imageID=" + imageID + " parentID=" + parentID)
 	path := storage.ImageAncestryPath(imageID)
 	if parentID == "" {
 		return s.Put(path, []byte(`["`+imageID+`"]`))
@@ -148,7 +173,27 @@ func SetImageDiffCache(s storage.Storage, imageID string, diffJson []byte) error
 	return s.Put(storage.ImageDiffPath(imageID), diffJson)
 }
 
-func GenDiff(s storage.Storage, imageID string) {
+// GenDiff computes the diff of imageID and stores it in the cache, if it isn't there yet
+func GenDiff(ctx context.Context, s storage.Storage, imageID string) {
+	log := logger.ForRequest(ctx)
+	diffJson, err := GetImageDiffCache(s, imageID)
+	if err == nil && diffJson != nil {
+		// cache hit, just return
+		log.Debug("[GenDiff][" + imageID + "] already exists")
+		return
+	}
+	if diffJson, err = ComputeDiff(ctx, s, imageID); err != nil {
+		log.Error("[GenDiff][" + imageID + "] " + err.Error())
+		return
+	}
+	if err := SetImageDiffCache(s, imageID, diffJson); err != nil {
+		log.Error("[GenDiff][" + imageID + "] error setting new diff cache: " + err.Error())
+		return
+	}
+}
+
+// ComputeDiff returns the diff json of imageID, without looking at or filling the cache
+func ComputeDiff(ctx context.Context, s storage.Storage, imageID string) ([]byte, error) {
 	// Comment from docker-registry 0.6.5
 	// get json describing file differences in layer
 	// Calculate the diff information for the files contained within
@@ -164,32 +209,19 @@ func GenDiff(s storage.Storage, imageID string) {
 	// - Ancestor contains deleted marked file:  CREATED
 	// - No ancestor contains file:              CREATED
 
-	diffJson, err := GetImageDiffCache(s, imageID)
-	if err == nil && diffJson != nil {
-		// cache hit, just return
-		logger.Debug("[GenDiff][" + imageID + "] already exists")
-		return
-	}
-
 	anPath := storage.ImageAncestryPath(imageID)
 	anContent, err := s.Get(anPath)
 	if err != nil {
-		// error fetching ancestry, just return
-		logger.Error("[GenDiff][" + imageID + "] error fetching ancestry: " + err.Error())
-		return
+		return nil, errors.New("error fetching ancestry: " + err.Error())
 	}
 	var ancestry []string
 	if err := json.Unmarshal(anContent, &ancestry); err != nil {
-		// json unmarshal fail, just return
-		logger.Error("[GenDiff][" + imageID + "] error unmarshalling ancestry json: " + err.Error())
-		return
+		return nil, errors.New("error unmarshalling ancestry json: " + err.Error())
 	}
 	// get map of file infos
-	infoMap, err := fileInfoMap(s, imageID)
+	infoMap, err := fileInfoMap(ctx, s, imageID)
 	if err != nil {
-		// error getting file info, just return
-		logger.Error("[GenDiff][" + imageID + "] error getting files info: " + err.Error())
-		return
+		return nil, errors.New("error getting files info: " + err.Error())
 	}
 
 	deleted := map[string][]interface{}{}
@@ -197,11 +229,9 @@ func GenDiff(s storage.Storage, imageID string) {
 	created := map[string][]interface{}{}
 
 	for _, anID := range ancestry {
-		anInfoMap, err := fileInfoMap(s, anID)
+		anInfoMap, err := fileInfoMap(ctx, s, anID)
 		if err != nil {
-			// error getting file info, just return
-			logger.Error("[GenDiff][" + imageID + "] error getting ancestor " + anID + " files info: " + err.Error())
-			return
+			return nil, errors.New("error getting ancestor " + anID + " files info: " + err.Error())
 		}
 		for fname, info := range infoMap {
 			isDeleted, isBool := (info[1]).(bool)
@@ -209,7 +239,7 @@ func GenDiff(s storage.Storage, imageID string) {
 			// technically isBool should never be false.
 			if !isBool || isDeleted {
 				if !isBool {
-					logger.Error("[GenDiff][" + imageID + "] file info is in a bad format")
+					logger.ForRequest(ctx).Error("[GenDiff][" + imageID + "] file info is in a bad format")
 				}
 				deleted[fname] = info
 				delete(infoMap, fname)
@@ -223,7 +253,7 @@ func GenDiff(s storage.Storage, imageID string) {
 			isDeleted, isBool = anInfo[1].(bool)
 			if !isBool || isDeleted {
 				if !isBool {
-					logger.Error("[GenDiff][" + imageID + "] file info is in a bad format")
+					logger.ForRequest(ctx).Error("[GenDiff][" + imageID + "] file info is in a bad format")
 				}
 				// deleted in ancestor, must be created now.
 				created[fname] = info
@@ -244,16 +274,7 @@ func GenDiff(s storage.Storage, imageID string) {
 		"changed": changed,
 		"created": created,
 	}
-	if diffJson, err = json.Marshal(&diff); err != nil {
-		// json marshal fail. just return
-		logger.Error("[GenDiff][" + imageID + "] error marshalling new diff json: " + err.Error())
-		return
-	}
-	if err := SetImageDiffCache(s, imageID, diffJson); err != nil {
-		// json marshal fail. just return
-		logger.Error("[GenDiff][" + imageID + "] error setting new diff cache: " + err.Error())
-		return
-	}
+	return json.Marshal(&diff)
 }
 
 // This function returns a map of file name -> file info for all files found in the image imageID.
@@ -270,8 +291,8 @@ func GenDiff(s storage.Storage, imageID string) {
 //   gid
 // ]
 // this function also strips filename out of the fileinfo before it sets it as a value in the map.
-func fileInfoMap(s storage.Storage, imageID string) (map[string][]interface{}, error) {
-	fContent, err := GetImageFilesJson(s, imageID)
+func fileInfoMap(ctx context.Context, s storage.Storage, imageID string) (map[string][]interface{}, error) {
+	fContent, err := GetImageFilesJson(ctx, s, imageID)
 	if err != nil {
 		return nil, err
 	}
@@ -1,33 +1,160 @@
 package logger
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var debug = false
+const (
+	LEVEL_DEBUG = "debug"
+	LEVEL_INFO  = "info"
+	LEVEL_ERROR = "error"
+)
+
+var LEVELS = map[string]int32{LEVEL_DEBUG: 0, LEVEL_INFO: 1, LEVEL_ERROR: 2}
+
+const (
+	FORMAT_TEXT   = "text" // the log package's format, fields appended as key=value
+	FORMAT_LOGFMT = "logfmt"
+	FORMAT_JSON   = "json"
+)
+
+// Fields are attached to a log line
+type Fields map[string]interface{}
+
+var level int32 = LEVELS[LEVEL_INFO] // accessed atomically, so the level can change while serving
+var format atomic.Value              // string
+
+var output io.Writer = os.Stderr
+var outputLock sync.Mutex
+
+func init() {
+	format.Store(FORMAT_TEXT)
+}
 
 func DebugOn() {
-	debug = true
+	atomic.StoreInt32(&level, LEVELS[LEVEL_DEBUG])
 }
 
 func DebugOff() {
-	debug = false
+	atomic.StoreInt32(&level, LEVELS[LEVEL_INFO])
+}
+
+// SetLevel only logs lines of the given level and above. unknown levels mean info.
+func SetLevel(name string) {
+	value, ok := LEVELS[name]
+	if !ok {
+		value = LEVELS[LEVEL_INFO]
+	}
+	atomic.StoreInt32(&level, value)
+}
+
+// SetFormat switches between text, logfmt and json. unknown formats mean text.
+func SetFormat(name string) {
+	if name != FORMAT_LOGFMT && name != FORMAT_JSON {
+		name = FORMAT_TEXT
+	}
+	format.Store(name)
+}
+
+func enabled(name string) bool {
+	return LEVELS[name] >= atomic.LoadInt32(&level)
 }
 
 func Info(fmt string, args ...interface{}) {
-	log.Printf("[INFO]  "+fmt, args...)
+	Log(LEVEL_INFO, sprintf(fmt, args), nil)
 }
 
 func Error(fmt string, args ...interface{}) {
-	log.Printf("[ERROR] "+fmt, args...)
+	Log(LEVEL_ERROR, sprintf(fmt, args), nil)
 }
 
 func Fatal(fmt string, args ...interface{}) {
-	log.Fatalf("[FATAL] "+fmt, args...)
+	Log("fatal", sprintf(fmt, args), nil)
+	os.Exit(1)
 }
 
 func Debug(fmt string, args ...interface{}) {
-	if debug {
-		log.Printf("[DEBUG] "+fmt, args...)
+	if enabled(LEVEL_DEBUG) {
+		Log(LEVEL_DEBUG, sprintf(fmt, args), nil)
+	}
+}
+
+// some callers build their message themselves and pass no args, so it must not go through Sprintf then
+func sprintf(format string, args []interface{}) string {
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Access logs a served request. These are written whatever the level.
+func Access(fields Fields) {
+	Log("access", "request", fields)
+}
+
+// Log writes msg with fields
+func Log(levelName, msg string, fields Fields) {
+	if _, known := LEVELS[levelName]; known && !enabled(levelName) {
+		return
+	}
+	switch format.Load().(string) {
+	case FORMAT_JSON:
+		line := Fields{"time": time.Now().UTC().Format(time.RFC3339Nano), "level": levelName, "msg": msg}
+		for key, value := range fields {
+			if _, reserved := line[key]; !reserved {
+				line[key] = value
+			}
+		}
+		encoded, err := json.Marshal(line)
+		if err != nil {
+			encoded, _ = json.Marshal(Fields{"level": LEVEL_ERROR, "msg": "unencodable log line: " + err.Error()})
+		}
+		write(append(encoded, '\n'))
+	case FORMAT_LOGFMT:
+		line := "time=" + time.Now().UTC().Format(time.RFC3339Nano) + " level=" + levelName + " msg=" +
+			strconv.Quote(msg) + logfmtFields(fields)
+		write([]byte(line + "\n"))
+	default:
+		prefix := "[" + strings.ToUpper(levelName) + "]"
+		if padding := 8 - len(prefix); padding > 1 {
+			prefix += strings.Repeat(" ", padding)
+		} else {
+			prefix += " "
+		}
+		log.Print(prefix + msg + logfmtFields(fields))
+	}
+}
+
+func write(line []byte) {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	output.Write(line)
+}
+
+// " key=value key2=value2", sorted by key
+func logfmtFields(fields Fields) string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	formatted := ""
+	for _, key := range keys {
+		value := fmt.Sprint(fields[key])
+		if value == "" || strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		formatted += " " + key + "=" + value
 	}
+	return formatted
 }
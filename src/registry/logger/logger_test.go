@@ -0,0 +1,57 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var out bytes.Buffer
+	output = &out
+	SetFormat(FORMAT_LOGFMT)
+	defer SetFormat(FORMAT_TEXT)
+
+	ctx := WithRequestID(context.Background(), "abc123")
+	ForRequest(ctx).Info("pushing %s", "layer")
+	done := make(chan bool)
+	go func() {
+		// goroutines handed the context keep the id
+		ForRequest(ctx).Info("in the background")
+		close(done)
+	}()
+	<-done
+	Info("elsewhere")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %q", out.String())
+	}
+	if !strings.HasSuffix(lines[0], `msg="pushing layer" request_id=abc123`) {
+		t.Fatalf("Request id missing: %s", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], `request_id=abc123`) {
+		t.Fatalf("Request id lost in the goroutine: %s", lines[1])
+	}
+	if strings.Contains(lines[2], "request_id") {
+		t.Fatalf("Request id leaked: %s", lines[2])
+	}
+}
+
+func TestUnencodableLine(t *testing.T) {
+	var out bytes.Buffer
+	output = &out
+	SetFormat(FORMAT_JSON)
+	defer SetFormat(FORMAT_TEXT)
+
+	Log(LEVEL_INFO, "bad", Fields{"value": func() {}})
+	var line map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("Invalid json %q: %s", out.String(), err.Error())
+	}
+	if line["level"] != LEVEL_ERROR {
+		t.Fatalf("Unexpected line %v", line)
+	}
+}
@@ -0,0 +1,55 @@
+package logger
+
+import (
+	"context"
+)
+
+// Request ids travel in the context of the request they belong to, so they follow it into any goroutine it is
+// passed to. Lines logged through ForRequest carry the id, code that isn't handed the context logs without it.
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the id carried by ctx, or ""
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Detached returns a context carrying the id of ctx but none of its cancellation, for work that outlives the request
+func Detached(ctx context.Context) context.Context {
+	return WithRequestID(context.Background(), RequestID(ctx))
+}
+
+// RequestLogger logs lines carrying the id of a request
+type RequestLogger struct {
+	id string
+}
+
+func ForRequest(ctx context.Context) *RequestLogger {
+	return &RequestLogger{id: RequestID(ctx)}
+}
+
+func (l *RequestLogger) fields() Fields {
+	if l.id == "" {
+		return nil
+	}
+	return Fields{"request_id": l.id}
+}
+
+func (l *RequestLogger) Info(fmt string, args ...interface{}) {
+	Log(LEVEL_INFO, sprintf(fmt, args), l.fields())
+}
+
+func (l *RequestLogger) Error(fmt string, args ...interface{}) {
+	Log(LEVEL_ERROR, sprintf(fmt, args), l.fields())
+}
+
+func (l *RequestLogger) Debug(fmt string, args ...interface{}) {
+	if enabled(LEVEL_DEBUG) {
+		Log(LEVEL_DEBUG, sprintf(fmt, args), l.fields())
+	}
+}
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	counter := &Counter{newVec("test_total", "A test counter.", "counter", []string{"method"})}
+	counter.Inc("GET")
+	counter.Add(2, "GET")
+	histogram := &Histogram{newVec("test_seconds", "A test histogram.", "histogram", []string{}), []float64{1, 5}}
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+	histogram.Observe(10)
+
+	var out bytes.Buffer
+	counter.write(&out)
+	histogram.write(&out)
+	expected := strings.Join([]string{
+		"# HELP test_total A test counter.",
+		"# TYPE test_total counter",
+		`test_total{method="GET"} 3`,
+		"# HELP test_seconds A test histogram.",
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="1"} 1`,
+		`test_seconds_bucket{le="5"} 2`,
+		`test_seconds_bucket{le="+Inf"} 3`,
+		"test_seconds_sum 13.5",
+		"test_seconds_count 3",
+		"",
+	}, "\n")
+	if out.String() != expected {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,34 @@
+package metrics
+
+// the metrics of the registry, by the package that updates them
+
+// api
+var (
+	HTTPRequests = NewCounter("registry_http_requests_total",
+		"HTTP requests by route and status.", "method", "route", "status")
+	HTTPRequestDuration = NewHistogram("registry_http_request_duration_seconds",
+		"Time to serve HTTP requests by route and status.", DEFAULT_BUCKETS, "method", "route", "status")
+	BytesPushed   = NewCounter("registry_layer_bytes_pushed_total", "Bytes of layers received.")
+	BytesPulled   = NewCounter("registry_layer_bytes_pulled_total", "Bytes of layers sent.")
+	ActiveUploads = NewGauge("registry_active_uploads", "Layer uploads in progress.")
+)
+
+// layers
+var (
+	DiffJobs = NewGauge("registry_diff_jobs", "Image diffs being generated in the background.")
+)
+
+// storage
+var (
+	StorageOperationDuration = NewHistogram("registry_storage_operation_duration_seconds",
+		"Time taken by storage operations, by backend and method.", DEFAULT_BUCKETS, "backend", "method")
+	StorageOperationErrors = NewCounter("registry_storage_operation_errors_total",
+		"Failed storage operations, by backend and method.", "backend", "method")
+	StorageOperationNotFound = NewCounter("registry_storage_operation_not_found_total",
+		"Storage operations on keys that don't exist, by backend and method.", "backend", "method")
+	TieredPendingUploads = NewGauge("registry_tiered_pending_uploads",
+		"Keys written to local disk and waiting to be uploaded to S3.")
+	TieredFailingUploads = NewGauge("registry_tiered_failing_uploads",
+		"Pending keys whose last upload to S3 failed, waiting to be retried.")
+	S3AuthRefreshes = NewCounter("registry_s3_auth_refreshes_total", "Refreshes of expiring S3 credentials.")
+)
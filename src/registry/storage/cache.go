@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"container/list"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_CACHE_MAX_BYTES = 64 * 1024 * 1024
+const DEFAULT_CACHE_MAX_OBJECT_SIZE = 1024 * 1024
+
+// these rarely change once an image is complete (json is rewritten when an image is pushed again), so they are
+// cached until evicted or written through this storage, or for ImageTTL if set
+var CACHE_IMMUTABLE_NAMES = map[string]bool{
+	"json":      true,
+	"ancestry":  true,
+	"_checksum": true,
+	"_files":    true,
+}
+
+type CacheConfig struct {
+	MaxBytes      int64 `json:"max_bytes"`       // total size of cached content
+	MaxObjectSize int64 `json:"max_object_size"` // larger objects are never cached
+	TagTTL        int   `json:"tag_ttl"`         // seconds to cache tags for, 0 disables caching tags
+	// seconds to cache image metadata and layer sizes for, 0 caches them until evicted
+	ImageTTL int `json:"image_ttl"`
+}
+
+// Cache is a read-through cache in front of another Storage. It keeps small immutable image metadata (and layer
+// sizes) in a bounded LRU and caches tags for a short time. Writes through this storage invalidate the cache.
+// Writes by other instances sharing the backend don't, so an image deleted or pushed again elsewhere is only seen
+// once its entries expire: deployments with several instances need both TagTTL and ImageTTL.
+type Cache struct {
+	*CacheConfig
+	backend Storage
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	bytes   int64
+	// bumped by every write, so a read that raced one doesn't store what it read before the write landed
+	generation uint64
+}
+
+type cacheEntry struct {
+	key     string
+	data    []byte // nil if only the size is known
+	size    int64
+	expires time.Time // zero if it never expires
+}
+
+// what an entry counts against MaxBytes. the key and bookkeeping are included so that size-only entries are not
+// free.
+func (e *cacheEntry) cost() int64 {
+	return int64(len(e.data) + len(e.key) + 64)
+}
+
+func NewCache(backend Storage, cfg *CacheConfig) *Cache {
+	return &Cache{CacheConfig: cfg, backend: backend}
+}
+
+func (c *Cache) init() error {
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = DEFAULT_CACHE_MAX_BYTES
+	}
+	if c.MaxObjectSize <= 0 {
+		c.MaxObjectSize = DEFAULT_CACHE_MAX_OBJECT_SIZE
+	}
+	c.entries = map[string]*list.Element{}
+	c.lru = list.New()
+	return nil
+}
+
+func cacheKey(relpath string) string {
+	return strings.TrimPrefix(path.Clean("/"+relpath), "/")
+}
+
+// returns whether key can be cached, and for how long (zero means until evicted)
+func (c *Cache) cacheable(key string) (bool, time.Duration) {
+	base := path.Base(key)
+	if strings.HasPrefix(key, "images/") && CACHE_IMMUTABLE_NAMES[base] {
+		return true, time.Duration(c.ImageTTL) * time.Second
+	}
+	if strings.HasPrefix(key, "repositories/") && strings.HasPrefix(base, "tag") && c.TagTTL > 0 {
+		// tag_<name> and tag<name>_json
+		return true, time.Duration(c.TagTTL) * time.Second
+	}
+	return false, 0
+}
+
+func (c *Cache) lookup(key string) *cacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.removeElement(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+func (c *Cache) currentGeneration() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.generation
+}
+
+// stores entry unless something was written since generation, when the read that produced it started
+func (c *Cache) store(entry *cacheEntry, ttl time.Duration, generation uint64) {
+	if int64(len(entry.data)) > c.MaxObjectSize {
+		return
+	}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.generation != generation {
+		return
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		c.removeElement(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.bytes += entry.cost()
+	for c.bytes > c.MaxBytes && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// must be called with the lock held
+func (c *Cache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.cost()
+}
+
+func (c *Cache) invalidate(relpath string) {
+	key := cacheKey(relpath)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *Cache) invalidateAll(relpath string) {
+	prefix := cacheKey(relpath)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	for key, elem := range c.entries {
+		if prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/") {
+			c.removeElement(elem)
+		}
+	}
+}
+
+func (c *Cache) Get(relpath string) ([]byte, error) {
+	key := cacheKey(relpath)
+	ok, ttl := c.cacheable(key)
+	if !ok {
+		return c.backend.Get(relpath)
+	}
+	if entry := c.lookup(key); entry != nil && entry.data != nil {
+		return entry.data, nil
+	}
+	generation := c.currentGeneration()
+	data, err := c.backend.Get(relpath)
+	if err != nil {
+		return nil, err
+	}
+	// full slice so that appending to what we hand out never writes into the cached copy
+	data = data[:len(data):len(data)]
+	c.store(&cacheEntry{key: key, data: data, size: int64(len(data))}, ttl, generation)
+	return data, nil
+}
+
+func (c *Cache) Put(relpath string, data []byte) error {
+	defer c.invalidate(relpath)
+	return c.backend.Put(relpath, data)
+}
+
+func (c *Cache) GetReader(relpath string) (io.ReadCloser, error) {
+	return c.backend.GetReader(relpath)
+}
+
+func (c *Cache) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSeeker)) error {
+	defer c.invalidate(relpath)
+	return c.backend.PutReader(relpath, r, afterWrite)
+}
+
+func (c *Cache) List(relpath string) ([]string, error) {
+	return c.backend.List(relpath)
+}
+
+func (c *Cache) Exists(relpath string) (bool, error) {
+	key := cacheKey(relpath)
+	if ok, _ := c.cacheable(key); ok {
+		if entry := c.lookup(key); entry != nil && entry.data != nil {
+			return true, nil
+		}
+	}
+	return c.backend.Exists(relpath)
+}
+
+func (c *Cache) Size(relpath string) (int64, error) {
+	key := cacheKey(relpath)
+	ok, ttl := c.cacheable(key)
+	isLayer := strings.HasPrefix(key, "images/") && path.Base(key) == "layer"
+	if !ok && !isLayer {
+		return c.backend.Size(relpath)
+	} else if isLayer {
+		ttl = time.Duration(c.ImageTTL) * time.Second
+	}
+	if entry := c.lookup(key); entry != nil {
+		return entry.size, nil
+	}
+	generation := c.currentGeneration()
+	size, err := c.backend.Size(relpath)
+	if err != nil {
+		return size, err
+	}
+	c.store(&cacheEntry{key: key, size: size}, ttl, generation)
+	return size, nil
+}
+
+func (c *Cache) Remove(relpath string) error {
+	defer c.invalidate(relpath)
+	return c.backend.Remove(relpath)
+}
+
+func (c *Cache) RemoveAll(relpath string) error {
+	defer c.invalidateAll(relpath)
+	return c.backend.RemoveAll(relpath)
+}
+
+func (c *Cache) Rename(from, to string) error {
+	defer c.invalidate(from)
+	defer c.invalidate(to)
+	return c.backend.Rename(from, to)
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// counts calls that reach the backend
+type countingStorage struct {
+	*Local
+	gets   int
+	sizes  int
+	exists int
+}
+
+func (s *countingStorage) Get(relpath string) ([]byte, error) {
+	s.gets++
+	return s.Local.Get(relpath)
+}
+
+func (s *countingStorage) Size(relpath string) (int64, error) {
+	s.sizes++
+	return s.Local.Size(relpath)
+}
+
+func (s *countingStorage) Exists(relpath string) (bool, error) {
+	s.exists++
+	return s.Local.Exists(relpath)
+}
+
+func TestCache(t *testing.T) {
+	testStorage(t, NewCache(&Local{Root: "/tmp/go-docker-registry-test"}, &CacheConfig{TagTTL: 1}))
+}
+
+func TestCacheHitsAndInvalidation(t *testing.T) {
+	backend := &countingStorage{Local: &Local{Root: "/tmp/go-docker-registry-test"}}
+	cache := NewCache(backend, &CacheConfig{TagTTL: 1})
+	if err := backend.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.init(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.RemoveAll("/")
+
+	cache.Put(ImageJsonPath("1"), []byte("{}"))
+	cache.Get(ImageJsonPath("1"))
+	cache.Get(ImageJsonPath("1"))
+	if exists, _ := cache.Exists(ImageJsonPath("1")); !exists {
+		t.Fatal("Key should exist")
+	}
+	if backend.gets != 1 || backend.exists != 0 {
+		t.Fatalf("Image json should be read from the backend once, got %d gets and %d exists", backend.gets,
+			backend.exists)
+	}
+	cache.Put(ImageJsonPath("1"), []byte(`{"id":"1"}`))
+	if content, _ := cache.Get(ImageJsonPath("1")); string(content) != `{"id":"1"}` {
+		t.Fatalf("Put should invalidate the cache, got %s", content)
+	}
+
+	cache.Put(ImageLayerPath("1"), []byte("layer"))
+	cache.Size(ImageLayerPath("1"))
+	if size, _ := cache.Size(ImageLayerPath("1")); size != 5 || backend.sizes != 1 {
+		t.Fatalf("Layer size should be read from the backend once, got size %d and %d sizes", size, backend.sizes)
+	}
+
+	// mutable things are not cached, tags only for a little while
+	cache.Put(ImageMarkPath("1"), []byte("1"))
+	cache.Get(ImageMarkPath("1"))
+	cache.Get(ImageMarkPath("1"))
+	if backend.gets != 4 {
+		t.Fatalf("Marks should not be cached, got %d gets", backend.gets)
+	}
+	cache.Put(RepoTagPath("library", "test", "latest"), []byte("1"))
+	cache.Get(RepoTagPath("library", "test", "latest"))
+	cache.Get(RepoTagPath("library", "test", "latest"))
+	if backend.gets != 5 {
+		t.Fatalf("Tags should be cached, got %d gets", backend.gets)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	cache.Get(RepoTagPath("library", "test", "latest"))
+	if backend.gets != 6 {
+		t.Fatalf("Tags should expire, got %d gets", backend.gets)
+	}
+
+	cache.RemoveAll("images/1")
+	if _, err := cache.Get(ImageJsonPath("1")); err == nil {
+		t.Fatal("RemoveAll should invalidate the cache")
+	}
+}
+
+func TestCacheImageTTL(t *testing.T) {
+	backend := &countingStorage{Local: &Local{Root: "/tmp/go-docker-registry-test"}}
+	cache := NewCache(backend, &CacheConfig{ImageTTL: 1})
+	if err := backend.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.init(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.RemoveAll("/")
+
+	cache.Put(ImageJsonPath("1"), []byte("{}"))
+	cache.Get(ImageJsonPath("1"))
+	// deleted by another instance
+	backend.RemoveAll("images/1")
+	if exists, _ := cache.Exists(ImageJsonPath("1")); !exists {
+		t.Fatal("Image json should still be cached")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if exists, _ := cache.Exists(ImageJsonPath("1")); exists {
+		t.Fatal("Image json should expire")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	backend := &countingStorage{Local: &Local{Root: "/tmp/go-docker-registry-test"}}
+	cache := NewCache(backend, &CacheConfig{MaxBytes: 1000})
+	backend.init()
+	cache.init()
+	defer cache.RemoveAll("/")
+
+	for _, id := range []string{"1", "2", "3", "4"} {
+		cache.Put(ImageJsonPath(id), make([]byte, 300))
+		cache.Get(ImageJsonPath(id))
+	}
+	if cache.bytes > cache.MaxBytes {
+		t.Fatalf("Cache holds %d bytes, more than the max of %d", cache.bytes, cache.MaxBytes)
+	}
+	backend.gets = 0
+	cache.Get(ImageJsonPath("4"))
+	cache.Get(ImageJsonPath("1"))
+	if backend.gets != 1 {
+		t.Fatalf("Only the least recently used entry should have been evicted, got %d gets", backend.gets)
+	}
+}
+
+// runs duringGet once, between reading an object and returning it
+type racingStorage struct {
+	*Local
+	duringGet func()
+}
+
+func (s *racingStorage) Get(relpath string) ([]byte, error) {
+	data, err := s.Local.Get(relpath)
+	if s.duringGet != nil {
+		duringGet := s.duringGet
+		s.duringGet = nil
+		duringGet()
+	}
+	return data, err
+}
+
+func TestCacheReadRacingWrite(t *testing.T) {
+	backend := &racingStorage{Local: &Local{Root: t.TempDir()}}
+	cache := NewCache(backend, &CacheConfig{})
+	if err := cache.init(); err != nil {
+		t.Fatal(err)
+	}
+	cache.Put(ImageJsonPath("1"), []byte(`{"id":"1"}`))
+	// the image is pushed again while a read of its json is in flight
+	backend.duringGet = func() { cache.Put(ImageJsonPath("1"), []byte(`{"id":"1","pushed":"again"}`)) }
+	if content, _ := cache.Get(ImageJsonPath("1")); string(content) != `{"id":"1"}` {
+		t.Fatalf("The read should return what it read, got %s", content)
+	}
+	if content, _ := cache.Get(ImageJsonPath("1")); string(content) != `{"id":"1","pushed":"again"}` {
+		t.Fatalf("The read racing the push shouldn't have been cached, got %s", content)
+	}
+}
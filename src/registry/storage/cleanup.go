@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// Cleanup removes the temporary files a storage keeps while uploads are in progress (S3 buffers, tiered fills). It
+// must only be called once nothing uses the storage anymore.
+func Cleanup(s Storage) error {
+	switch typed := s.(type) {
+	case *Cache:
+		return Cleanup(typed.backend)
+	case *Instrumented:
+		return Cleanup(typed.backend)
+	case *Encryption:
+		return Cleanup(typed.backend)
+	case *S3:
+		return typed.bufferDir.clear()
+	case *Tiered:
+		if err := clearDir(path.Join(typed.Local.Root, TIERED_TMP_DIR)); err != nil {
+			return err
+		}
+		if typed.S3 != nil && typed.S3.bufferDir != nil {
+			return typed.S3.bufferDir.clear()
+		}
+	}
+	return nil
+}
+
+func (b *BufferDir) clear() error {
+	b.Lock()
+	defer b.Unlock()
+	return clearDir(b.root)
+}
+
+func clearDir(dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := os.RemoveAll(path.Join(dir, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
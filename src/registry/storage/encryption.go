@@ -0,0 +1,554 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"registry/logger"
+	"sync"
+)
+
+// Encrypted objects are laid out as a fixed size header followed by chunks:
+//
+//	magic (4) | version (1) | key fingerprint (8) | salt (16) | chunk size (4)
+//	chunk 0 | chunk 1 | ... | final chunk
+//
+// Every chunk is ENCRYPTION_CHUNK_SIZE bytes of plaintext sealed with AES-256-GCM (so 16 bytes longer), except the
+// final one which is shorter or even empty. The final chunk is sealed with a different nonce so truncating an
+// object is detected. Each object gets its own key, derived from the master key and the random salt. Since both
+// the header and the overhead per chunk have a fixed size, the plaintext size can be computed from the stored size
+// without reading anything.
+const ENCRYPTION_MAGIC = "GDRE"
+const ENCRYPTION_VERSION = 1
+const ENCRYPTION_CHUNK_SIZE = 64 * 1024
+const ENCRYPTION_HEADER_SIZE = 4 + 1 + 8 + 16 + 4
+const ENCRYPTION_TAG_SIZE = 16
+
+type EncryptionConfig struct {
+	// JSON file with the keys: {"active": "<id>", "keys": {"<id>": "<base64 of 32 random bytes>", ...}}
+	// new objects are encrypted with the active key. older keys stay in the file for as long as objects use them.
+	KeyFile string `json:"key_file"`
+}
+
+type encryptionKeyFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// Encryption encrypts everything written to another Storage and decrypts everything read from it
+type Encryption struct {
+	*EncryptionConfig
+	backend Storage
+
+	lock   sync.RWMutex
+	active []byte            // fingerprint of the key used for writes
+	keys   map[string][]byte // fingerprint -> key
+}
+
+func NewEncryption(backend Storage, cfg *EncryptionConfig) *Encryption {
+	return &Encryption{EncryptionConfig: cfg, backend: backend}
+}
+
+func (e *Encryption) init() error {
+	if e.KeyFile == "" {
+		return errors.New("Please Specify a Key File for Encryption")
+	}
+	return e.loadKeys()
+}
+
+func (e *Encryption) loadKeys() error {
+	content, err := ioutil.ReadFile(e.KeyFile)
+	if err != nil {
+		return err
+	}
+	var keyFile encryptionKeyFile
+	if err := json.Unmarshal(content, &keyFile); err != nil {
+		return errors.New("Invalid Key File: " + err.Error())
+	}
+	keys := map[string][]byte{}
+	var active []byte
+	for id, encoded := range keyFile.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return errors.New("Invalid Key " + id + ": keys must be 32 bytes, base64 encoded")
+		}
+		fingerprint := keyFingerprint(key)
+		keys[string(fingerprint)] = key
+		if id == keyFile.Active {
+			active = fingerprint
+		}
+	}
+	if active == nil {
+		return errors.New("Active Key " + keyFile.Active + " not found in Key File")
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.active = active
+	e.keys = keys
+	return nil
+}
+
+func keyFingerprint(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:8]
+}
+
+// derives the key for a single object
+func objectCipher(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func plaintextSize(size int64) int64 {
+	payload := size - ENCRYPTION_HEADER_SIZE
+	if payload < ENCRYPTION_TAG_SIZE {
+		return -1
+	}
+	chunks := (payload + ENCRYPTION_CHUNK_SIZE + ENCRYPTION_TAG_SIZE - 1) / (ENCRYPTION_CHUNK_SIZE + ENCRYPTION_TAG_SIZE)
+	return payload - chunks*ENCRYPTION_TAG_SIZE
+}
+
+// returns the cipher for an object and its key fingerprint
+func (e *Encryption) readHeader(header []byte) (cipher.AEAD, []byte, error) {
+	if len(header) != ENCRYPTION_HEADER_SIZE || string(header[:4]) != ENCRYPTION_MAGIC {
+		return nil, nil, errors.New("Object is not encrypted")
+	}
+	if header[4] != ENCRYPTION_VERSION {
+		return nil, nil, errors.New("Unsupported encryption version")
+	}
+	if binary.BigEndian.Uint32(header[29:33]) != ENCRYPTION_CHUNK_SIZE {
+		return nil, nil, errors.New("Unsupported encryption chunk size")
+	}
+	fingerprint := header[5:13]
+	e.lock.RLock()
+	key, ok := e.keys[string(fingerprint)]
+	e.lock.RUnlock()
+	if !ok {
+		return nil, nil, errors.New("Object is encrypted with an unknown key")
+	}
+	aead, err := objectCipher(key, header[13:29])
+	return aead, fingerprint, err
+}
+
+func (e *Encryption) newHeader() ([]byte, cipher.AEAD, error) {
+	e.lock.RLock()
+	fingerprint := e.active
+	key := e.keys[string(fingerprint)]
+	e.lock.RUnlock()
+	header := make([]byte, ENCRYPTION_HEADER_SIZE)
+	copy(header, ENCRYPTION_MAGIC)
+	header[4] = ENCRYPTION_VERSION
+	copy(header[5:13], fingerprint)
+	if _, err := io.ReadFull(rand.Reader, header[13:29]); err != nil {
+		return nil, nil, err
+	}
+	binary.BigEndian.PutUint32(header[29:33], ENCRYPTION_CHUNK_SIZE)
+	aead, err := objectCipher(key, header[13:29])
+	return header, aead, err
+}
+
+// encrypts what is read from src
+type encryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	out     []byte // ciphertext not yet handed out
+	carry   []byte // plaintext read ahead to know whether a chunk is the final one
+	counter uint32
+	done    bool
+}
+
+func (e *Encryption) newEncryptReader(src io.Reader) (*encryptReader, error) {
+	header, aead, err := e.newHeader()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptReader{src: src, aead: aead, out: header}, nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *encryptReader) fill() error {
+	buf := make([]byte, ENCRYPTION_CHUNK_SIZE+1)
+	n := copy(buf, r.carry)
+	m, err := io.ReadFull(r.src, buf[n:])
+	n += m
+	final := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		final = true
+	} else if err != nil {
+		return err
+	}
+	plain := buf[:n]
+	r.carry = nil
+	if !final {
+		plain, r.carry = buf[:ENCRYPTION_CHUNK_SIZE], buf[ENCRYPTION_CHUNK_SIZE:]
+	}
+	r.out = r.aead.Seal(nil, chunkNonce(r.counter, final), plain, nil)
+	r.counter++
+	r.done = final
+	return nil
+}
+
+// decrypts a stream of chunks
+type decryptReader struct {
+	src     io.ReadCloser
+	aead    cipher.AEAD
+	out     []byte
+	carry   []byte
+	counter uint32
+	done    bool
+}
+
+func (e *Encryption) newDecryptReader(src io.ReadCloser) (*decryptReader, error) {
+	header := make([]byte, ENCRYPTION_HEADER_SIZE)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, errors.New("Object is not encrypted")
+	}
+	aead, _, err := e.readHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{src: src, aead: aead}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *decryptReader) fill() error {
+	buf := make([]byte, ENCRYPTION_CHUNK_SIZE+ENCRYPTION_TAG_SIZE+1)
+	n := copy(buf, r.carry)
+	m, err := io.ReadFull(r.src, buf[n:])
+	n += m
+	final := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		final = true
+	} else if err != nil {
+		return err
+	}
+	sealed := buf[:n]
+	r.carry = nil
+	if !final {
+		sealed, r.carry = buf[:ENCRYPTION_CHUNK_SIZE+ENCRYPTION_TAG_SIZE], buf[ENCRYPTION_CHUNK_SIZE+ENCRYPTION_TAG_SIZE:]
+	}
+	plain, err := r.aead.Open(nil, chunkNonce(r.counter, final), sealed, nil)
+	if err != nil {
+		return errors.New("Object failed to decrypt, it is corrupt or truncated")
+	}
+	r.out = plain
+	r.counter++
+	r.done = final
+	return nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.src.Close()
+}
+
+// decrypts an object that can be seeked in, needed to give afterWrite a plaintext view of what was written
+type decryptSeeker struct {
+	src       io.ReadSeeker
+	aead      cipher.AEAD
+	size      int64 // plaintext
+	pos       int64
+	chunk     []byte
+	chunkIdx  int64
+	lastChunk int64
+}
+
+func (e *Encryption) newDecryptSeeker(src io.ReadSeeker) (*decryptSeeker, error) {
+	cipherSize, err := src.Seek(0, 2)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, ENCRYPTION_HEADER_SIZE)
+	src.Seek(0, 0)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, errors.New("Object is not encrypted")
+	}
+	aead, _, err := e.readHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	size := plaintextSize(cipherSize)
+	// the final chunk holds up to a full chunk, it is only empty if the whole object is
+	lastChunk := int64(0)
+	if size > 0 {
+		lastChunk = (size - 1) / ENCRYPTION_CHUNK_SIZE
+	}
+	return &decryptSeeker{src: src, aead: aead, size: size, chunkIdx: -1, lastChunk: lastChunk}, nil
+}
+
+func (s *decryptSeeker) Read(p []byte) (int, error) {
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+	idx := s.pos / ENCRYPTION_CHUNK_SIZE
+	if idx != s.chunkIdx {
+		sealed := make([]byte, ENCRYPTION_CHUNK_SIZE+ENCRYPTION_TAG_SIZE)
+		s.src.Seek(ENCRYPTION_HEADER_SIZE+idx*int64(len(sealed)), 0)
+		n, err := io.ReadFull(s.src, sealed)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		plain, err := s.aead.Open(nil, chunkNonce(uint32(idx), idx == s.lastChunk), sealed[:n], nil)
+		if err != nil {
+			return 0, errors.New("Object failed to decrypt, it is corrupt or truncated")
+		}
+		s.chunk, s.chunkIdx = plain, idx
+	}
+	n := copy(p, s.chunk[s.pos-idx*ENCRYPTION_CHUNK_SIZE:])
+	s.pos += int64(n)
+	return n, nil
+}
+
+func (s *decryptSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += s.pos
+	case 2:
+		offset += s.size
+	default:
+		return s.pos, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return s.pos, errors.New("Negative position")
+	}
+	s.pos = offset
+	return s.pos, nil
+}
+
+func (e *Encryption) encrypt(data []byte) ([]byte, error) {
+	reader, err := e.newEncryptReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+func (e *Encryption) Get(relpath string) ([]byte, error) {
+	reader, err := e.GetReader(relpath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func (e *Encryption) Put(relpath string, data []byte) error {
+	encrypted, err := e.encrypt(data)
+	if err != nil {
+		return err
+	}
+	return e.backend.Put(relpath, encrypted)
+}
+
+func (e *Encryption) GetReader(relpath string) (io.ReadCloser, error) {
+	reader, err := e.backend.GetReader(relpath)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := e.newDecryptReader(reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return decrypted, nil
+}
+
+func (e *Encryption) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSeeker)) error {
+	encrypted, err := e.newEncryptReader(r)
+	if err != nil {
+		return err
+	}
+	return e.backend.PutReader(relpath, encrypted, func(file io.ReadSeeker) {
+		decrypted, err := e.newDecryptSeeker(file)
+		if err != nil {
+			logger.Error("[Encryption][%s] can't read back what was written: %s", relpath, err.Error())
+			return
+		}
+		afterWrite(decrypted)
+	})
+}
+
+func (e *Encryption) List(relpath string) ([]string, error) {
+	return e.backend.List(relpath)
+}
+
+func (e *Encryption) Exists(relpath string) (bool, error) {
+	return e.backend.Exists(relpath)
+}
+
+func (e *Encryption) Size(relpath string) (int64, error) {
+	size, err := e.backend.Size(relpath)
+	if err != nil {
+		return size, err
+	}
+	if size = plaintextSize(size); size < 0 {
+		return -1, errors.New("Object is not encrypted")
+	}
+	return size, nil
+}
+
+func (e *Encryption) Remove(relpath string) error {
+	return e.backend.Remove(relpath)
+}
+
+func (e *Encryption) RemoveAll(relpath string) error {
+	return e.backend.RemoveAll(relpath)
+}
+
+// objects don't depend on their key, they can be moved as they are
+func (e *Encryption) Rename(from, to string) error {
+	return e.backend.Rename(from, to)
+}
+
+// Rekey re-encrypts every object that isn't encrypted with the active key, so that older keys can be retired.
+// It reloads the key file first. Returns how many objects were re-encrypted. Registries must not write meanwhile
+// (run it while they are read-only): an object written between the last check and the move of its re-encrypted
+// copy would be reverted, see rekeyObject.
+func (e *Encryption) Rekey() (int, error) {
+	if err := e.loadKeys(); err != nil {
+		return 0, err
+	}
+	rekeyed := 0
+	// left by an interrupted run
+	if err := e.backend.RemoveAll(REKEY_PATH); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	err := Walk(e.backend, "/", func(key string) error {
+		reader, err := e.backend.GetReader(key)
+		if err != nil {
+			return err
+		}
+		header := make([]byte, ENCRYPTION_HEADER_SIZE)
+		_, err = io.ReadFull(reader, header)
+		reader.Close()
+		if err != nil {
+			return errors.New(key + ": object is not encrypted")
+		}
+		_, fingerprint, err := e.readHeader(header)
+		if err != nil {
+			return errors.New(key + ": " + err.Error())
+		}
+		e.lock.RLock()
+		current := bytes.Equal(fingerprint, e.active)
+		e.lock.RUnlock()
+		if current {
+			return nil
+		}
+		if replaced, err := e.rekeyObject(key, header); err != nil {
+			return errors.New(key + ": " + err.Error())
+		} else if replaced {
+			rekeyed++
+		}
+		return nil
+	})
+	return rekeyed, err
+}
+
+// where objects are re-encrypted to before they replace the original
+const REKEY_PATH = "_rekey"
+
+// streams the object through decryption and encryption into a temporary key of the backend, then moves it over the
+// original. a failure halfway leaves the original as it was. header is the one of the object that was checked: every
+// write gets a new salt, so a different header now means the object was written again since, with the active key,
+// and the copy is dropped. the check and the move aren't atomic, which is why Rekey needs writes to be stopped.
+// returns whether the object was replaced.
+func (e *Encryption) rekeyObject(key string, header []byte) (bool, error) {
+	reader, err := e.GetReader(key)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	tmpKey := path.Join(REKEY_PATH, key)
+	if err := e.PutReader(tmpKey, reader, func(io.ReadSeeker) {}); err != nil {
+		e.backend.Remove(tmpKey)
+		return false, err
+	}
+	if changed, err := e.headerChanged(key, header); err != nil || changed {
+		e.backend.Remove(tmpKey)
+		if changed {
+			logger.Info("[Rekey][%s] written while it was re-encrypted, leaving it", key)
+		}
+		return false, err
+	}
+	return true, e.backend.Rename(tmpKey, key)
+}
+
+// whether the object no longer starts with header, or is gone
+func (e *Encryption) headerChanged(key string, header []byte) (bool, error) {
+	reader, err := e.backend.GetReader(key)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	current := make([]byte, ENCRYPTION_HEADER_SIZE)
+	if _, err := io.ReadFull(reader, current); err != nil {
+		return true, nil
+	}
+	return !bytes.Equal(current, header), nil
+}
+
+// Rekey finds the encryption layer of s and re-encrypts everything with its active key
+func Rekey(s Storage) (int, error) {
+	switch typed := s.(type) {
+	case *Encryption:
+		return typed.Rekey()
+	case *Cache:
+		return Rekey(typed.backend)
+	case *Instrumented:
+		return Rekey(typed.backend)
+	}
+	return 0, errors.New("Storage is not encrypted")
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const TEST_KEY_FILE = "/tmp/go-docker-registry-test-keys.json"
+
+func writeTestKeys(t *testing.T, active string, ids ...string) {
+	keys := map[string]string{}
+	if content, err := ioutil.ReadFile(TEST_KEY_FILE); err == nil {
+		var existing encryptionKeyFile
+		json.Unmarshal(content, &existing)
+		keys = existing.Keys
+	}
+	for _, id := range ids {
+		key := make([]byte, 32)
+		rand.Read(key)
+		keys[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	content, _ := json.Marshal(&encryptionKeyFile{Active: active, Keys: keys})
+	if err := ioutil.WriteFile(TEST_KEY_FILE, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestEncryption(t *testing.T) (*Encryption, *Local) {
+	os.Remove(TEST_KEY_FILE)
+	writeTestKeys(t, "1", "1")
+	backend := &Local{Root: "/tmp/go-docker-registry-test"}
+	if err := backend.init(); err != nil {
+		t.Fatal(err)
+	}
+	encryption := NewEncryption(backend, &EncryptionConfig{KeyFile: TEST_KEY_FILE})
+	if err := encryption.init(); err != nil {
+		t.Fatal(err)
+	}
+	return encryption, backend
+}
+
+func TestEncryption(t *testing.T) {
+	encryption, _ := newTestEncryption(t)
+	defer os.Remove(TEST_KEY_FILE)
+	testStorage(t, encryption)
+}
+
+func TestEncryptionStreaming(t *testing.T) {
+	encryption, backend := newTestEncryption(t)
+	defer os.Remove(TEST_KEY_FILE)
+	defer backend.RemoveAll("/")
+
+	for _, size := range []int{0, 1, ENCRYPTION_CHUNK_SIZE, ENCRYPTION_CHUNK_SIZE + 1, 3*ENCRYPTION_CHUNK_SIZE + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		var seen []byte
+		err := encryption.PutReader("/layer", bytes.NewReader(plain), func(r io.ReadSeeker) {
+			if end, _ := r.Seek(0, 2); end != int64(size) {
+				t.Fatalf("afterWrite should see the plaintext size %d, got %d", size, end)
+			}
+			r.Seek(0, 0)
+			seen, _ = ioutil.ReadAll(r)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(seen, plain) {
+			t.Fatalf("afterWrite should see the plaintext (size %d)", size)
+		}
+		// short plaintexts may well show up in random ciphertext
+		if stored, _ := backend.Get("/layer"); size >= 16 && bytes.Contains(stored, plain) {
+			t.Fatal("Stored content should not contain the plaintext")
+		}
+		if got, err := encryption.Size("/layer"); err != nil || got != int64(size) {
+			t.Fatalf("Size should be the plaintext size %d, got %d (%v)", size, got, err)
+		}
+		reader, err := encryption.GetReader("/layer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("Reading back should return the plaintext (size %d): %v", size, err)
+		}
+	}
+
+	// truncating at a chunk boundary is detected
+	stored, _ := backend.Get("/layer")
+	backend.Put("/layer", stored[:ENCRYPTION_HEADER_SIZE+ENCRYPTION_CHUNK_SIZE+ENCRYPTION_TAG_SIZE])
+	if _, err := encryption.Get("/layer"); err == nil {
+		t.Fatal("Truncated objects should fail to decrypt")
+	}
+	// unencrypted objects are refused
+	backend.Put("/layer", []byte("plaintext that is long enough to look like a header"))
+	if _, err := encryption.Get("/layer"); err == nil {
+		t.Fatal("Unencrypted objects should fail to decrypt")
+	}
+}
+
+func TestEncryptionRekey(t *testing.T) {
+	encryption, backend := newTestEncryption(t)
+	defer os.Remove(TEST_KEY_FILE)
+	defer backend.RemoveAll("/")
+
+	encryption.Put("/old", []byte("old content"))
+	writeTestKeys(t, "2", "2")
+	rekeyed, err := encryption.Rekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rekeyed != 1 {
+		t.Fatalf("One object should have been re-encrypted, got %d", rekeyed)
+	}
+	if names, _ := backend.List(REKEY_PATH); len(names) != 0 {
+		t.Fatalf("Temporary objects left behind: %v", names)
+	}
+	encryption.Put("/new", []byte("new content"))
+
+	// with only the new key both are still readable
+	content, _ := ioutil.ReadFile(TEST_KEY_FILE)
+	var keyFile encryptionKeyFile
+	json.Unmarshal(content, &keyFile)
+	delete(keyFile.Keys, "1")
+	content, _ = json.Marshal(&keyFile)
+	ioutil.WriteFile(TEST_KEY_FILE, content, 0600)
+	if err := encryption.loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{"/old": "old content", "/new": "new content"} {
+		if got, err := encryption.Get(path); err != nil || string(got) != expected {
+			t.Fatalf("%s should read back as %q, got %q (%v)", path, expected, got, err)
+		}
+	}
+}
+
+// runs write when the first object is re-encrypted, like a registry writing while Rekey runs
+type writingDuringRekey struct {
+	*Local
+	write func()
+}
+
+func (s *writingDuringRekey) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSeeker)) error {
+	err := s.Local.PutReader(relpath, r, afterWrite)
+	if s.write != nil && strings.HasPrefix(strings.TrimPrefix(relpath, "/"), REKEY_PATH+"/") {
+		s.write()
+		s.write = nil
+	}
+	return err
+}
+
+func TestEncryptionRekeyConcurrentWrite(t *testing.T) {
+	_, local := newTestEncryption(t)
+	defer os.Remove(TEST_KEY_FILE)
+	defer local.RemoveAll("/")
+	backend := &writingDuringRekey{Local: local}
+	encryption := NewEncryption(backend, &EncryptionConfig{KeyFile: TEST_KEY_FILE})
+	if err := encryption.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	encryption.Put("/tag", []byte("old image"))
+	writeTestKeys(t, "2", "2")
+	backend.write = func() {
+		writer := NewEncryption(local, &EncryptionConfig{KeyFile: TEST_KEY_FILE})
+		writer.init()
+		writer.Put("/tag", []byte("new image"))
+	}
+	rekeyed, err := encryption.Rekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rekeyed != 0 {
+		t.Fatalf("The rewritten object should have been left alone, got %d re-encrypted", rekeyed)
+	}
+	if content, err := encryption.Get("/tag"); err != nil || string(content) != "new image" {
+		t.Fatalf("The concurrent write should survive, got %q (%v)", content, err)
+	}
+	if names, _ := local.List(REKEY_PATH); len(names) != 0 {
+		t.Fatalf("Temporary objects left behind: %v", names)
+	}
+}
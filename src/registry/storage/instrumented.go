@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"registry/metrics"
+	"time"
+)
+
+// Instrumented records the latency and errors of every operation on another Storage. Missing keys are counted
+// apart from errors, most of them are expected (cache misses, existence checks, empty directories).
+type Instrumented struct {
+	backend Storage
+	name    string // the backend label of the metrics
+}
+
+func NewInstrumented(backend Storage, name string) *Instrumented {
+	return &Instrumented{backend: backend, name: name}
+}
+
+func (s *Instrumented) init() error {
+	return nil
+}
+
+func (s *Instrumented) observe(method string, start time.Time, err error) {
+	metrics.StorageOperationDuration.ObserveSince(start, s.name, method)
+	if os.IsNotExist(err) {
+		metrics.StorageOperationNotFound.Inc(s.name, method)
+	} else if err != nil {
+		metrics.StorageOperationErrors.Inc(s.name, method)
+	}
+}
+
+func (s *Instrumented) Get(relpath string) ([]byte, error) {
+	start := time.Now()
+	data, err := s.backend.Get(relpath)
+	s.observe("Get", start, err)
+	return data, err
+}
+
+func (s *Instrumented) Put(relpath string, data []byte) error {
+	start := time.Now()
+	err := s.backend.Put(relpath, data)
+	s.observe("Put", start, err)
+	return err
+}
+
+// only the time until the reader is returned, not how long reading it takes
+func (s *Instrumented) GetReader(relpath string) (io.ReadCloser, error) {
+	start := time.Now()
+	reader, err := s.backend.GetReader(relpath)
+	s.observe("GetReader", start, err)
+	return reader, err
+}
+
+func (s *Instrumented) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSeeker)) error {
+	start := time.Now()
+	err := s.backend.PutReader(relpath, r, afterWrite)
+	s.observe("PutReader", start, err)
+	return err
+}
+
+func (s *Instrumented) List(relpath string) ([]string, error) {
+	start := time.Now()
+	names, err := s.backend.List(relpath)
+	s.observe("List", start, err)
+	return names, err
+}
+
+func (s *Instrumented) Exists(relpath string) (bool, error) {
+	start := time.Now()
+	exists, err := s.backend.Exists(relpath)
+	s.observe("Exists", start, err)
+	return exists, err
+}
+
+func (s *Instrumented) Size(relpath string) (int64, error) {
+	start := time.Now()
+	size, err := s.backend.Size(relpath)
+	s.observe("Size", start, err)
+	return size, err
+}
+
+func (s *Instrumented) Remove(relpath string) error {
+	start := time.Now()
+	err := s.backend.Remove(relpath)
+	s.observe("Remove", start, err)
+	return err
+}
+
+func (s *Instrumented) RemoveAll(relpath string) error {
+	start := time.Now()
+	err := s.backend.RemoveAll(relpath)
+	s.observe("RemoveAll", start, err)
+	return err
+}
+
+func (s *Instrumented) Rename(from, to string) error {
+	start := time.Now()
+	err := s.backend.Rename(from, to)
+	s.observe("Rename", start, err)
+	return err
+}
@@ -1,12 +1,12 @@
 package storage
 
 import (
-	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"syscall"
 )
 
 type Local struct {
@@ -60,12 +60,15 @@ func (s *Local) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSe
 func (s *Local) List(relpath string) ([]string, error) {
 	abspath := path.Join(s.Root, relpath)
 	infos, err := ioutil.ReadDir(abspath)
-	if err != nil {
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENOTDIR {
+		// a key, which S3 can't list either
+		return nil, &os.PathError{Op: "open", Path: abspath, Err: syscall.ENOENT}
+	} else if err != nil {
 		return nil, err
 	}
 	if len(infos) == 0 {
 		// to be consistent with S3, return no such file or directory here. from docker-registry 0.6.5
-		return nil, errors.New("open " + abspath + ": no such file or directory")
+		return nil, &os.PathError{Op: "open", Path: abspath, Err: syscall.ENOENT}
 	}
 	list := make([]string, len(infos))
 	for i, info := range infos {
@@ -97,7 +100,7 @@ func (s *Local) Size(relpath string) (int64, error) {
 func (s *Local) Remove(relpath string) error {
 	// this is not abspath because Exists uses relpath
 	if ok, err := s.Exists(relpath); !ok || err != nil {
-		return errors.New("no such file or directory: " + relpath)
+		return &os.PathError{Op: "remove", Path: relpath, Err: syscall.ENOENT}
 	}
 	abspath := path.Join(s.Root, relpath)
 	err := os.Remove(abspath)
@@ -114,7 +117,7 @@ func (s *Local) Remove(relpath string) error {
 func (s *Local) RemoveAll(relpath string) error {
 	// this is not abspath because Exists uses relpath
 	if ok, err := s.Exists(relpath); !ok || err != nil {
-		return errors.New("no such file or directory: " + relpath)
+		return &os.PathError{Op: "remove", Path: relpath, Err: syscall.ENOENT}
 	}
 	abspath := path.Join(s.Root, relpath)
 	err := os.RemoveAll(abspath)
@@ -128,6 +131,20 @@ func (s *Local) RemoveAll(relpath string) error {
 	return nil
 }
 
+func (s *Local) Rename(from, to string) error {
+	absfrom, absto := path.Join(s.Root, from), path.Join(s.Root, to)
+	if err := os.MkdirAll(path.Dir(absto), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(absfrom, absto); err != nil {
+		return err
+	}
+	for absdir := path.Dir(absfrom); s.removeIfEmpty(absdir); absdir = path.Dir(absdir) {
+		// like Remove, don't leave empty directories behind
+	}
+	return nil
+}
+
 func (s *Local) removeIfEmpty(dir string) bool {
 	infos, err := ioutil.ReadDir(dir)
 	if err != nil {
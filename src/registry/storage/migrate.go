@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"registry/logger"
+)
+
+// Migration copies every key from Source to Dest. Every copied key is appended to a state file so an interrupted
+// migration can be resumed and later runs only copy what changed in the meantime.
+type Migration struct {
+	Source    Storage
+	Dest      Storage
+	StatePath string
+	// remove keys from Dest that no longer exist in Source. meant for the final pass, once the registry no longer
+	// accepts writes.
+	Delete bool
+
+	state map[string]*migratedKey
+}
+
+type MigrationStats struct {
+	Copied  int   `json:"copied"`
+	Skipped int   `json:"skipped"`
+	Deleted int   `json:"deleted"`
+	Failed  int   `json:"failed"`
+	Bytes   int64 `json:"bytes"`
+}
+
+type migratedKey struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+func (m *Migration) loadState() error {
+	m.state = map[string]*migratedKey{}
+	file, err := os.Open(m.StatePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry migratedKey
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// most likely a line cut short by an interruption. the key will simply be copied again.
+			continue
+		}
+		if entry.Size < 0 {
+			// removed during a previous final pass
+			delete(m.state, entry.Key)
+			continue
+		}
+		m.state[entry.Key] = &entry
+	}
+	return scanner.Err()
+}
+
+func (m *Migration) Run() (*MigrationStats, error) {
+	if err := m.loadState(); err != nil {
+		return nil, err
+	}
+	stateFile, err := os.OpenFile(m.StatePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer stateFile.Close()
+	stateEnc := json.NewEncoder(stateFile)
+
+	stats := &MigrationStats{}
+	seen := map[string]bool{}
+	err = Walk(m.Source, "/", func(key string) error {
+		seen[key] = true
+		entry, copied, err := m.migrateKey(key)
+		if err != nil {
+			logger.Error("[Migrate][%s] %s", key, err.Error())
+			stats.Failed++
+			return nil
+		}
+		if !copied {
+			stats.Skipped++
+			return nil
+		}
+		stats.Copied++
+		stats.Bytes += entry.Size
+		m.state[key] = entry
+		if (stats.Copied % 1000) == 0 {
+			logger.Info("[Migrate] copied %d keys (%d bytes) so far", stats.Copied, stats.Bytes)
+		}
+		return stateEnc.Encode(entry)
+	})
+	if err != nil {
+		return stats, err
+	}
+	if m.Delete && stats.Failed > 0 {
+		// a key that failed to migrate might look like one that is gone from the source
+		logger.Error("[Migrate] not removing keys from the destination, %d keys failed to migrate", stats.Failed)
+	} else if m.Delete {
+		// deletes are recorded too, otherwise a key that comes back with the same content would be skipped
+		found := 0
+		err = Walk(m.Dest, "/", func(key string) error {
+			if seen[key] {
+				found++
+				return nil
+			}
+			if err := m.Dest.Remove(key); err != nil {
+				logger.Error("[Migrate][%s] error removing: %s", key, err.Error())
+				stats.Failed++
+				return nil
+			}
+			stats.Deleted++
+			delete(m.state, key)
+			return stateEnc.Encode(&migratedKey{Key: key, Size: -1})
+		})
+		if err != nil {
+			return stats, err
+		}
+		// every key was just copied or checked, a walk missing some of them didn't see the whole destination
+		if migrated := stats.Copied + stats.Skipped; found != migrated {
+			return stats, fmt.Errorf("the destination listed %d of the %d migrated keys, its listing is incomplete",
+				found, migrated)
+		}
+	}
+	if stats.Failed > 0 {
+		return stats, fmt.Errorf("%d keys failed to migrate", stats.Failed)
+	}
+	return stats, nil
+}
+
+// copies key if needed. returns whether it was actually copied.
+func (m *Migration) migrateKey(key string) (*migratedKey, bool, error) {
+	size, err := m.Source.Size(key)
+	if err != nil {
+		return nil, false, err
+	}
+	previous := m.state[key]
+	if previous != nil && previous.Size == size {
+		// matching sizes are enough to skip layer content, reading it all on every run would make them as slow as
+		// the first one. everything else is small and compared by checksum: tags keep their size when they are
+		// moved, and so do layer refs pointed elsewhere.
+		unchanged := layerContent(key, size)
+		if !unchanged {
+			_, sum, err := sumKey(m.Source, key)
+			if err != nil {
+				return nil, false, err
+			}
+			unchanged = sum == previous.Sha256
+		}
+		if exists, _ := m.Dest.Exists(key); unchanged && exists {
+			return previous, false, nil
+		}
+	}
+	reader, err := m.Source.GetReader(key)
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
+
+	sha := sha256.New()
+	var written int64
+	err = m.Dest.PutReader(key, io.TeeReader(reader, sha), func(r io.ReadSeeker) {
+		written, _ = r.Seek(0, 2)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	entry := &migratedKey{Key: key, Size: written, Sha256: hex.EncodeToString(sha.Sum(nil))}
+	if written != size {
+		return nil, false, fmt.Errorf("size mismatch after copy: source has %d bytes, copied %d", size, written)
+	}
+	if err := verifyKey(m.Dest, entry); err != nil {
+		return nil, false, err
+	}
+	return entry, true, nil
+}
+
+// whether key holds layer content, which is never rewritten with the same size: blobs are named by their content,
+// and layers that hold their own content (pushed before blobs) are only ever replaced by a layer ref
+func layerContent(key string, size int64) bool {
+	return IsBlobLayerPath(key) || (IsImageLayerPath(key) && size != LAYER_REF_SIZE)
+}
+
+// reads back what was written to make sure it made it to the destination intact
+func verifyKey(s Storage, entry *migratedKey) error {
+	size, sum, err := sumKey(s, entry.Key)
+	if err != nil {
+		return err
+	}
+	if size != entry.Size {
+		return fmt.Errorf("size mismatch in destination: expected %d bytes, found %d", entry.Size, size)
+	}
+	if sum != entry.Sha256 {
+		return errors.New("checksum mismatch in destination")
+	}
+	return nil
+}
+
+func sumKey(s Storage, key string) (int64, string, error) {
+	reader, err := s.GetReader(key)
+	if err != nil {
+		return -1, "", err
+	}
+	defer reader.Close()
+	sha := sha256.New()
+	size, err := io.Copy(sha, reader)
+	if err != nil {
+		return -1, "", err
+	}
+	return size, hex.EncodeToString(sha.Sum(nil)), nil
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMigration(t *testing.T) {
+	source := &Local{Root: "/tmp/go-docker-registry-test-migrate-source"}
+	dest := &Local{Root: "/tmp/go-docker-registry-test-migrate-dest"}
+	statePath := "/tmp/go-docker-registry-test-migrate.state"
+	for _, s := range []*Local{source, dest} {
+		os.RemoveAll(s.Root)
+		if err := s.init(); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(s.Root)
+	}
+	os.Remove(statePath)
+	defer os.Remove(statePath)
+
+	source.Put("images/1/json", []byte("{}"))
+	source.Put("images/1/layer", []byte("layer1"))
+	source.Put("repositories/library/test/tag_latest", []byte("1"))
+
+	migration := &Migration{Source: source, Dest: dest, StatePath: statePath}
+	if stats, err := migration.Run(); err != nil {
+		t.Fatal(err)
+	} else if stats.Copied != 3 || stats.Skipped != 0 {
+		t.Fatalf("Expected 3 keys to be copied, got %+v", stats)
+	}
+	if content, err := dest.Get("images/1/layer"); err != nil || string(content) != "layer1" {
+		t.Fatalf("Layer was not copied: %s, %v", content, err)
+	}
+
+	// second run only picks up what changed, including a tag that kept its size
+	source.Put("repositories/library/test/tag_latest", []byte("2"))
+	source.Put("images/2/layer", []byte("layer2"))
+	source.Remove("images/1/json")
+	migration = &Migration{Source: source, Dest: dest, StatePath: statePath}
+	if stats, err := migration.Run(); err != nil {
+		t.Fatal(err)
+	} else if stats.Copied != 2 || stats.Skipped != 1 || stats.Deleted != 0 {
+		t.Fatalf("Expected 2 keys to be copied and 1 skipped, got %+v", stats)
+	}
+	if content, _ := dest.Get("repositories/library/test/tag_latest"); string(content) != "2" {
+		t.Fatalf("Tag should have been updated, got %s", content)
+	}
+	if exists, _ := dest.Exists("images/1/json"); !exists {
+		t.Fatal("Keys should not be removed unless Delete is set")
+	}
+
+	// final pass
+	migration = &Migration{Source: source, Dest: dest, StatePath: statePath, Delete: true}
+	if stats, err := migration.Run(); err != nil {
+		t.Fatal(err)
+	} else if stats.Copied != 0 || stats.Skipped != 3 || stats.Deleted != 1 {
+		t.Fatalf("Expected nothing copied and 1 key deleted, got %+v", stats)
+	}
+	if exists, _ := dest.Exists("images/1/json"); exists {
+		t.Fatal("Key removed from the source should be removed from the destination")
+	}
+}
+
+func TestMigrationLayerRefs(t *testing.T) {
+	source := &Local{Root: "/tmp/go-docker-registry-test-migrate-source"}
+	dest := &Local{Root: "/tmp/go-docker-registry-test-migrate-dest"}
+	statePath := "/tmp/go-docker-registry-test-migrate.state"
+	for _, s := range []*Local{source, dest} {
+		os.RemoveAll(s.Root)
+		if err := s.init(); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(s.Root)
+	}
+	os.Remove(statePath)
+	defer os.Remove(statePath)
+
+	source.Put(ImageLayerPath("1"), []byte("sha256:"+strings.Repeat("a", 64)))
+	source.Put(BlobLayerPath(strings.Repeat("a", 64)), []byte("layer1"))
+	if _, err := (&Migration{Source: source, Dest: dest, StatePath: statePath}).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a re-push points the image at another blob, the ref keeps its size
+	ref := "sha256:" + strings.Repeat("b", 64)
+	source.Put(ImageLayerPath("1"), []byte(ref))
+	if stats, err := (&Migration{Source: source, Dest: dest, StatePath: statePath}).Run(); err != nil {
+		t.Fatal(err)
+	} else if stats.Copied != 1 || stats.Skipped != 1 {
+		t.Fatalf("Expected the ref to be copied and the blob skipped, got %+v", stats)
+	}
+	if content, _ := dest.Get(ImageLayerPath("1")); string(content) != ref {
+		t.Fatalf("Layer ref should have been updated, got %s", content)
+	}
+
+	// layers holding their own content are skipped without reading them
+	source.Put(ImageLayerPath("2"), []byte("layer2"))
+	if _, err := (&Migration{Source: source, Dest: dest, StatePath: statePath}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	reading := &readingStorage{Storage: source, read: map[string]bool{}}
+	if stats, err := (&Migration{Source: reading, Dest: dest, StatePath: statePath}).Run(); err != nil {
+		t.Fatal(err)
+	} else if stats.Copied != 0 {
+		t.Fatalf("Expected nothing to be copied, got %+v", stats)
+	}
+	if reading.read[ImageLayerPath("2")] || reading.read[BlobLayerPath(strings.Repeat("a", 64))] {
+		t.Fatalf("Expected layer content not to be read, read %v", reading.read)
+	}
+	if !reading.read[ImageLayerPath("1")] {
+		t.Fatal("Expected the layer ref to be compared by checksum")
+	}
+}
+
+// records the keys read
+type readingStorage struct {
+	Storage
+	read map[string]bool
+}
+
+func (s *readingStorage) GetReader(relpath string) (io.ReadCloser, error) {
+	s.read[strings.TrimPrefix(relpath, "/")] = true
+	return s.Storage.GetReader(relpath)
+}
+
+// fails to list path, like a storage that is having trouble
+type failingList struct {
+	Storage
+	path string
+}
+
+func (s *failingList) List(relpath string) ([]string, error) {
+	if relpath == s.path {
+		return nil, errors.New("connection reset by peer")
+	}
+	return s.Storage.List(relpath)
+}
+
+func TestMigrationListErrors(t *testing.T) {
+	source := &Local{Root: "/tmp/go-docker-registry-test-migrate-source"}
+	dest := &Local{Root: "/tmp/go-docker-registry-test-migrate-dest"}
+	statePath := "/tmp/go-docker-registry-test-migrate.state"
+	for _, s := range []*Local{source, dest} {
+		os.RemoveAll(s.Root)
+		if err := s.init(); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(s.Root)
+	}
+	os.Remove(statePath)
+	defer os.Remove(statePath)
+
+	source.Put("images/1/json", []byte("{}"))
+	source.Put("repositories/library/test/tag_latest", []byte("1"))
+	if _, err := (&Migration{Source: source, Dest: dest, StatePath: statePath}).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a listing that fails must not pass the subtree off as a key, or as gone from the source
+	flaky := &failingList{Storage: source, path: "/images/1"}
+	if _, err := (&Migration{Source: flaky, Dest: dest, StatePath: statePath, Delete: true}).Run(); err == nil {
+		t.Fatal("Expected the listing error")
+	}
+	if exists, _ := dest.Exists("images/1/json"); !exists {
+		t.Fatal("Keys under a subtree that couldn't be listed should not be removed")
+	}
+}
+
+// cuts every listing after max names, like an S3 listing that isn't followed past its first page
+type truncatedList struct {
+	Storage
+	max int
+}
+
+func (s *truncatedList) List(relpath string) ([]string, error) {
+	names, err := s.Storage.List(relpath)
+	if len(names) > s.max {
+		names = names[:s.max]
+	}
+	return names, err
+}
+
+func TestMigrationCompleteWalk(t *testing.T) {
+	source := &Local{Root: "/tmp/go-docker-registry-test-migrate-source"}
+	dest := &Local{Root: "/tmp/go-docker-registry-test-migrate-dest"}
+	statePath := "/tmp/go-docker-registry-test-migrate.state"
+	for _, s := range []*Local{source, dest} {
+		os.RemoveAll(s.Root)
+		if err := s.init(); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(s.Root)
+	}
+	os.Remove(statePath)
+	defer os.Remove(statePath)
+
+	// more keys in one directory than S3 returns in one page
+	const keys = 1500
+	for i := 0; i < keys; i++ {
+		source.Put(fmt.Sprintf("images/%04d/json", i), []byte("{}"))
+	}
+	dest.Put("images/gone/json", []byte("{}"))
+	stats, err := (&Migration{Source: source, Dest: dest, StatePath: statePath, Delete: true}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != keys || stats.Deleted != 1 {
+		t.Fatalf("Expected %d keys copied and 1 deleted, got %+v", keys, stats)
+	}
+	if names, _ := dest.List("images"); len(names) != keys {
+		t.Fatalf("Expected %d images in the destination, found %d", keys, len(names))
+	}
+
+	// a destination that doesn't list everything fails the final pass instead of passing for complete
+	truncated := &truncatedList{Storage: dest, max: 1000}
+	if _, err := (&Migration{Source: source, Dest: truncated, StatePath: statePath, Delete: true}).Run(); err == nil {
+		t.Fatal("Expected an error for the incomplete listing of the destination")
+	}
+}
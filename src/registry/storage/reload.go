@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"errors"
+)
+
+// Reload applies the settings of cfg that can change while serving: S3 credentials and the encryption keys
+// (re-read from the key file). Everything else needs a restart. s must have been created from a config of the
+// same type.
+func Reload(s Storage, cfg *Config) error {
+	switch typed := s.(type) {
+	case *Cache:
+		return Reload(typed.backend, cfg)
+	case *Instrumented:
+		return Reload(typed.backend, cfg)
+	case *Encryption:
+		if err := typed.loadKeys(); err != nil {
+			return err
+		}
+		return Reload(typed.backend, cfg)
+	case *S3:
+		if cfg.S3 == nil {
+			return errors.New("No config for storage type 's3' found")
+		}
+		return typed.setCredentials(cfg.S3.AccessKey, cfg.S3.SecretKey)
+	case *Tiered:
+		if cfg.Tiered == nil || cfg.Tiered.S3 == nil {
+			return errors.New("No s3 config for storage type 'tiered' found")
+		}
+		return typed.S3.setCredentials(cfg.Tiered.S3.AccessKey, cfg.Tiered.S3.SecretKey)
+	}
+	return nil
+}
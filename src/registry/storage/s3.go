@@ -9,13 +9,19 @@ import (
 	"io"
 	"os"
 	"path"
+	"registry/metrics"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 const S3_CONTENT_TYPE = "application/binary"
 
+// the largest object S3 copies in one request, and the size of the parts larger ones are copied in
+const S3_MAX_COPY_SIZE = 5 << 30
+const S3_COPY_PART_SIZE = 1 << 30
+
 var S3_OPTIONS = s3.Options{}
 var EMPTY_HEADERS = map[string][]string{}
 
@@ -52,6 +58,25 @@ func (s *S3) updateAuth() {
 	}
 }
 
+// switches to new credentials, keeping the old ones if the new ones don't work
+func (s *S3) setCredentials(accessKey, secretKey string) error {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	if accessKey == s.AccessKey && secretKey == s.SecretKey {
+		return nil
+	}
+	// static keys are never refused by GetAuth, so try them on the bucket before using them
+	auth, err := aws.GetAuth(accessKey, secretKey, "", time.Time{})
+	if err != nil {
+		return err
+	}
+	if _, err := s3.New(auth, s.region).Bucket(s.Bucket).List(s.root, "/", "", 1); err != nil {
+		return fmt.Errorf("new S3 credentials don't work: %s", err.Error())
+	}
+	s.AccessKey, s.SecretKey = accessKey, secretKey
+	return s.getAuth()
+}
+
 func (s *S3) updateAuthLoop() {
 	// this function just updates the auth. s.auth should be set before this is called
 	// this is primarily used for role tagged ec2 instances who get an expiry with their auth.
@@ -64,6 +89,7 @@ func (s *S3) updateAuthLoop() {
 		if diff := s.auth.Expiration().Sub(time.Now()); diff < 0 {
 			// if we're past the expiration time, update the auth
 			s.updateAuth()
+			metrics.S3AuthRefreshes.Inc()
 		} else {
 			// if we're not past the expiration time, sleep until the expiration time is up
 			time.Sleep(diff)
@@ -72,23 +98,11 @@ func (s *S3) updateAuthLoop() {
 }
 
 func (s *S3) init() error {
-	if s.Bucket == "" {
-		return errors.New("Please Specify an S3 Bucket")
-	}
-	if s.Region == "" {
-		return errors.New("Please Specify an S3 Region")
-	}
-	if s.Root == "" {
-		return errors.New("Please Specify an S3 Root Path")
-	}
-	if s.BufferDir == "" {
-		return errors.New("Please Specify a Buffer Directory to use for Uploads")
+	if errs := s.validate(); len(errs) > 0 {
+		return errs[0]
 	}
 
-	var ok bool
-	if s.region, ok = aws.Regions[s.Region]; !ok {
-		return errors.New("Invalid Region: " + s.Region)
-	}
+	s.region = aws.Regions[s.Region]
 	err := s.getAuth()
 	if err != nil {
 		return err
@@ -144,22 +158,33 @@ func (s *S3) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSeeke
 	return s.bucket.PutReader(s.key(relpath), buffer, length, S3_CONTENT_TYPE, s3.Private, S3_OPTIONS)
 }
 
+// uploads a file whose length is already known, skipping the buffer PutReader needs
+func (s *S3) putFile(relpath string, file *os.File, length int64) error {
+	s.authLock.RLock()
+	defer s.authLock.RUnlock()
+	file.Seek(0, 0)
+	return s.bucket.PutReader(s.key(relpath), file, length, S3_CONTENT_TYPE, s3.Private, S3_OPTIONS)
+}
+
 func (s *S3) List(relpath string) ([]string, error) {
 	s.authLock.RLock()
 	defer s.authLock.RUnlock()
-	result, err := s.bucket.List(s.key(relpath)+"/", "/", "", 0)
+	prefix := s.key(relpath) + "/"
+	keys, prefixes, err := listAll(func(marker string) (*s3.ListResp, error) {
+		return s.bucket.List(prefix, "/", marker, 0)
+	})
 	if err != nil {
 		return nil, err
 	}
-	names := make([]string, len(result.Contents)+len(result.CommonPrefixes))
-	for i, key := range result.Contents {
-		names[i] = strings.TrimPrefix(key.Key, s.root)
+	names := make([]string, len(keys)+len(prefixes))
+	for i, key := range keys {
+		names[i] = strings.TrimPrefix(key, s.root)
 		if !strings.HasPrefix(names[i], "/") {
 			names[i] = "/" + names[i]
 		}
 	}
-	for i, prefix := range result.CommonPrefixes {
-		prefixIdx := i+len(result.Contents)
+	for i, prefix := range prefixes {
+		prefixIdx := i + len(keys)
 		// trim trailing "/" and preceeding s.root
 		names[prefixIdx] = strings.TrimPrefix(strings.TrimSuffix(prefix, "/"), s.root)
 		// if there is no preceeding / then add it
@@ -168,12 +193,47 @@ func (s *S3) List(relpath string) ([]string, error) {
 		}
 	}
 	if len(names) == 0 {
-		// nothing there. return an error.
-		return nil, errors.New("No keys exist in " + s.key(relpath))
+		// nothing there. return an error, the same one Local does.
+		return nil, &os.PathError{Op: "list", Path: s.key(relpath), Err: syscall.ENOENT}
 	}
 	return names, nil
 }
 
+// listAll follows a truncated listing page by page (S3 returns at most 1000 names per request) and returns every
+// key and common prefix of it
+func listAll(list func(marker string) (*s3.ListResp, error)) ([]string, []string, error) {
+	keys := []string{}
+	prefixes := []string{}
+	marker := ""
+	for {
+		result, err := list(marker)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, key := range result.Contents {
+			keys = append(keys, key.Key)
+		}
+		prefixes = append(prefixes, result.CommonPrefixes...)
+		if !result.IsTruncated {
+			return keys, prefixes, nil
+		}
+		// NextMarker is only sent when there is a delimiter, otherwise the listing goes on after its last name
+		next := result.NextMarker
+		if next == "" {
+			if len(result.Contents) > 0 {
+				next = result.Contents[len(result.Contents)-1].Key
+			}
+			if n := len(result.CommonPrefixes); n > 0 && result.CommonPrefixes[n-1] > next {
+				next = result.CommonPrefixes[n-1]
+			}
+		}
+		if next == "" || next <= marker {
+			return nil, nil, errors.New("truncated listing without a marker to continue from after " + marker)
+		}
+		marker = next
+	}
+}
+
 func (s *S3) Exists(relpath string) (bool, error) {
 	s.authLock.RLock()
 	defer s.authLock.RUnlock()
@@ -193,8 +253,10 @@ func (s *S3) Size(relpath string) (int64, error) {
 func (s *S3) Remove(relpath string) error {
 	s.authLock.RLock()
 	defer s.authLock.RUnlock()
-	if exists, err := s.bucket.Exists(s.key(relpath)); !exists || err != nil {
-		return errors.New("no such file or directory: " + relpath)
+	if exists, err := s.bucket.Exists(s.key(relpath)); err != nil {
+		return err
+	} else if !exists {
+		return &os.PathError{Op: "remove", Path: relpath, Err: syscall.ENOENT}
 	}
 	return s.bucket.Del(s.key(relpath))
 }
@@ -203,21 +265,74 @@ func (s *S3) RemoveAll(relpath string) error {
 	// find and remove everything "under" it
 	s.authLock.RLock()
 	defer s.authLock.RUnlock()
-	result, err := s.bucket.List(s.key(relpath)+"/", "", "", 0)
+	prefix := s.key(relpath) + "/"
+	keys, _, err := listAll(func(marker string) (*s3.ListResp, error) {
+		return s.bucket.List(prefix, "", marker, 0)
+	})
 	if err != nil {
 		return err
 	}
-	if len(result.Contents) == 0 {
+	if len(keys) == 0 {
 		// nothing under it, return error
-		return errors.New("no such file or directory " + relpath)
+		return &os.PathError{Op: "remove", Path: relpath, Err: syscall.ENOENT}
 	}
-	for _, key := range result.Contents {
-		s.bucket.Del(key.Key)
+	for _, key := range keys {
+		if err := s.bucket.Del(key); err != nil {
+			return err
+		}
 	}
 	// finally, remove it if needed
 	return s.bucket.Del(s.key(relpath))
 }
 
+// copies within the bucket, nothing goes through us. objects over 5GB can't be copied in one request, those are
+// copied in parts.
+func (s *S3) Rename(from, to string) error {
+	s.authLock.RLock()
+	defer s.authLock.RUnlock()
+	source := s.bucket.Name + "/" + s.key(from)
+	resp, err := s.bucket.Head(s.key(from), EMPTY_HEADERS)
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength > S3_MAX_COPY_SIZE {
+		err = s.copyParts(to, source, resp.ContentLength)
+	} else {
+		_, err = s.bucket.PutCopy(s.key(to), s3.Private, s3.CopyOptions{ContentType: S3_CONTENT_TYPE}, source)
+	}
+	if err != nil {
+		return err
+	}
+	return s.bucket.Del(s.key(from))
+}
+
+// multipart copy of the size bytes of source to relpath
+func (s *S3) copyParts(relpath, source string, size int64) error {
+	multi, err := s.bucket.InitMulti(s.key(relpath), S3_CONTENT_TYPE, s3.Private, S3_OPTIONS)
+	if err != nil {
+		return err
+	}
+	parts := []s3.Part{}
+	for start := int64(0); start < size; start += S3_COPY_PART_SIZE {
+		end := start + S3_COPY_PART_SIZE
+		if end > size {
+			end = size
+		}
+		options := s3.CopyOptions{CopySourceOptions: fmt.Sprintf("bytes=%d-%d", start, end-1)}
+		_, part, err := multi.PutPartCopy(len(parts)+1, options, source)
+		if err != nil {
+			multi.Abort()
+			return err
+		}
+		parts = append(parts, part)
+	}
+	if err := multi.Complete(parts); err != nil {
+		multi.Abort()
+		return err
+	}
+	return nil
+}
+
 // This will ensure that we don't try to upload the same thing from two different requests at the same time
 type BufferDir struct {
 	sync.Mutex
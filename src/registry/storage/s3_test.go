@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"github.com/crowdmob/goamz/s3"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -14,3 +17,51 @@ func TestS3(t *testing.T) {
 	}
 	testStorage(t, &s3)
 }
+
+// pages of a listing, cut after every 2 names like S3 cuts them after 1000
+type pagedListing struct {
+	names   []string
+	markers []string
+}
+
+func (l *pagedListing) list(marker string) (*s3.ListResp, error) {
+	l.markers = append(l.markers, marker)
+	result := &s3.ListResp{Marker: marker}
+	for _, name := range l.names {
+		if name <= marker {
+			continue
+		}
+		if len(result.Contents)+len(result.CommonPrefixes) == 2 {
+			result.IsTruncated = true
+			break
+		}
+		if strings.HasSuffix(name, "/") {
+			result.CommonPrefixes = append(result.CommonPrefixes, name)
+		} else {
+			result.Contents = append(result.Contents, s3.Key{Key: name})
+		}
+	}
+	return result, nil
+}
+
+func TestS3ListPages(t *testing.T) {
+	listing := &pagedListing{names: []string{"a", "b/", "c", "d/", "e"}}
+	keys, prefixes, err := listAll(listing.list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "c", "e"}) || !reflect.DeepEqual(prefixes, []string{"b/", "d/"}) {
+		t.Fatalf("Expected every name of the listing, got keys %v and prefixes %v", keys, prefixes)
+	}
+	if !reflect.DeepEqual(listing.markers, []string{"", "b/", "d/"}) {
+		t.Fatalf("Expected the listing to go on after the last name of every page, got markers %v", listing.markers)
+	}
+
+	// a truncated page that gives no way to go on is an error, not a shorter listing
+	_, _, err = listAll(func(marker string) (*s3.ListResp, error) {
+		return &s3.ListResp{IsTruncated: true}, nil
+	})
+	if err == nil {
+		t.Fatal("Expected an error for a truncated listing that can't be continued")
+	}
+}
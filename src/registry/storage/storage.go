@@ -4,11 +4,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path"
+	"strings"
 )
 
 const TAG_PREFIX = "tag_"
 
+// the audit log, one directory per day and instance
+const AUDIT_PATH = "audit"
+
+// usage records, one directory per namespace
+const USAGE_PATH = "usage"
+
 type Storage interface {
 	init() error
 
@@ -16,20 +24,53 @@ type Storage interface {
 	Put(string, []byte) error
 	GetReader(string) (io.ReadCloser, error)
 	PutReader(string, io.Reader, func(io.ReadSeeker)) error
+	// the error satisfies os.IsNotExist if there is nothing under the path
 	List(string) ([]string, error)
 	Exists(string) (bool, error)
 	Size(string) (int64, error)
+	// both fail with an error satisfying os.IsNotExist if there is nothing to remove
 	Remove(string) error
 	RemoveAll(string) error
+	// moves a key over another one, if there is one
+	Rename(string, string) error
 }
 
 type Config struct {
-	Type  string `json:"type"`
-	Local *Local `json:"local"`
-	S3    *S3    `json:"s3"`
+	Type       string            `json:"type"`
+	Local      *Local            `json:"local"`
+	S3         *S3               `json:"s3"`
+	Tiered     *Tiered           `json:"tiered"`
+	Encryption *EncryptionConfig `json:"encryption"`
+	Cache      *CacheConfig      `json:"cache"`
+}
+
+// whether several instances can use the storage at once, which S3 is made for
+func (cfg *Config) Shared() bool {
+	return cfg.Type == "s3" || cfg.Type == "tiered"
 }
 
 func New(cfg *Config) (Storage, error) {
+	storage, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	storage = NewInstrumented(storage, cfg.Type)
+	if cfg.Encryption != nil {
+		encryption := NewEncryption(storage, cfg.Encryption)
+		if err := encryption.init(); err != nil {
+			return nil, err
+		}
+		storage = encryption
+	}
+	// the cache goes last so that it holds plaintext
+	if cfg.Cache != nil {
+		cache := NewCache(storage, cfg.Cache)
+		return cache, cache.init()
+	}
+	return storage, nil
+}
+
+func newBackend(cfg *Config) (Storage, error) {
 	switch cfg.Type {
 	case "local":
 		if cfg.Local != nil {
@@ -41,6 +82,11 @@ func New(cfg *Config) (Storage, error) {
 			return cfg.S3, cfg.S3.init()
 		}
 		return nil, errors.New("No config for storage type 's3' found")
+	case "tiered":
+		if cfg.Tiered != nil {
+			return cfg.Tiered, cfg.Tiered.init()
+		}
+		return nil, errors.New("No config for storage type 'tiered' found")
 	default:
 		return nil, errors.New("Invalid storage type: " + cfg.Type)
 	}
@@ -62,6 +108,15 @@ func ImageLayerPath(id string) string {
 	return fmt.Sprintf("images/%s/layer", id)
 }
 
+// whether relpath is the ImageLayerPath of some image
+func IsImageLayerPath(relpath string) bool {
+	key := strings.TrimPrefix(path.Clean("/"+relpath), "/")
+	return path.Base(key) == "layer" && key == ImageLayerPath(path.Base(path.Dir(key)))
+}
+
+// size of a layer that refers to a blob rather than holding its content: "sha256:" and the hex sum
+const LAYER_REF_SIZE = 7 + 64
+
 func ImageAncestryPath(id string) string {
 	return fmt.Sprintf("images/%s/ancestry", id)
 }
@@ -74,6 +129,43 @@ func ImageDiffPath(id string) string {
 	return fmt.Sprintf("images/%s/_diff", id)
 }
 
+func BlobLayerPath(sum string) string {
+	return fmt.Sprintf("blobs/sha256/%s/layer", sum)
+}
+
+// whether relpath is the BlobLayerPath of some sum, whose content never changes
+func IsBlobLayerPath(relpath string) bool {
+	key := strings.TrimPrefix(path.Clean("/"+relpath), "/")
+	return path.Base(key) == "layer" && key == BlobLayerPath(path.Base(path.Dir(key)))
+}
+
+// where a layer is written to until its sum is known
+func BlobUploadPath(imageID string) string {
+	return fmt.Sprintf("blobs/uploads/%s", imageID)
+}
+
+func BlobRefPath(sum, imageID string) string {
+	return fmt.Sprintf("blobs/sha256/%s/_refs/%s", sum, imageID)
+}
+
+func AuditEntryPath(day, instance string, seq uint64) string {
+	return fmt.Sprintf("%s/%s/%s/%020d", AUDIT_PATH, day, instance, seq)
+}
+
+func NamespaceUsagePath(namespace string) string {
+	return fmt.Sprintf("%s/%s", USAGE_PATH, namespace)
+}
+
+// written once the usage of namespace was scanned, from then on its records are kept up to date
+func NamespaceUsageScannedPath(namespace string) string {
+	return fmt.Sprintf("%s/%s/_scanned", USAGE_PATH, namespace)
+}
+
+// the record of a tag reaching imageID
+func UsageRefPath(namespace, imageID, repo, tag string) string {
+	return fmt.Sprintf("%s/%s/%s/%s:%s", USAGE_PATH, namespace, imageID, repo, tag)
+}
+
 func RepoImagesListPath(namespace, repo string) string {
 	return fmt.Sprintf("repositories/%s/_images_list", path.Join(namespace, repo))
 }
@@ -85,6 +177,10 @@ func RepoTagPath(namespace, repo, tag string) string {
 	return fmt.Sprintf("repositories/%s/%s", path.Join(namespace, repo), TAG_PREFIX+tag)
 }
 
+func RepoTagHistoryPath(namespace, repo, tag string) string {
+	return fmt.Sprintf("repositories/%s/_history_%s", path.Join(namespace, repo), tag)
+}
+
 func RepoJsonPath(namespace, repo string) string {
 	return fmt.Sprintf("repositories/%s/json", path.Join(namespace, repo))
 }
@@ -104,4 +200,34 @@ func RepoTagJsonPath(namespace, repo, tag string) string {
 
 func RepoPath(namespace, repo string) string {
 	return fmt.Sprintf("repositories/%s", path.Join(namespace, repo))
-}
\ No newline at end of file
+}
+
+// Walk calls fn for every key under root. Storages have no real notion of directories (S3 is a key-value store
+// and Local removes empty directories), so anything that can be listed is treated as a directory and anything that
+// doesn't exist as a directory is a key. Any other listing error is returned, a subtree that can't be read is not a
+// key.
+func Walk(s Storage, root string, fn func(string) error) error {
+	names, err := s.List(root)
+	if err != nil {
+		return err
+	}
+	return walkNames(s, names, fn)
+}
+
+func walkNames(s Storage, names []string, fn func(string) error) error {
+	for _, name := range names {
+		children, err := s.List(name)
+		if os.IsNotExist(err) {
+			if err := fn(name); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := walkNames(s, children, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -48,6 +49,7 @@ func testStorage(t *testing.T, storage Storage) {
 	testGetPutExistsSizeRemove(t, storage)
 	testGetPutReaders(t, storage)
 	testListRemoveAll(t, storage)
+	testRename(t, storage)
 
 	// cleanup
 	storage.RemoveAll("/")
@@ -102,13 +104,13 @@ func testGetPutReaders(t *testing.T, storage Storage) {
 		t.Fatal("Removing something that doesn't exist should cause an error")
 	}
 	fileSize := int64(-1)
-	afterWrite := func(file *os.File) {
-		info, err := file.Stat()
+	afterWrite := func(file io.ReadSeeker) {
+		size, err := file.Seek(0, 2)
 		if err != nil {
 			fileSize = -2
 			return
 		}
-		fileSize = info.Size()
+		fileSize = size
 	}
 	if err := storage.PutReader("/dir/1", bytes.NewBufferString("lolwtfdir"), afterWrite); err != nil {
 		t.Fatal(err)
@@ -219,3 +221,21 @@ func testListRemoveAll(t *testing.T, storage Storage) {
 		t.Fatal("According to docker 0.6.5, listing an empty directory should return an error")
 	}
 }
+
+func testRename(t *testing.T, storage Storage) {
+	if err := storage.Rename("/tmp/1", "/dest/1"); err == nil {
+		t.Fatal("Renaming something that doesn't exist should cause an error")
+	}
+	storage.Put("/tmp/1", []byte("new"))
+	storage.Put("/dest/1", []byte("old"))
+	if err := storage.Rename("/tmp/1", "/dest/1"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := storage.Exists("/tmp/1"); exists {
+		t.Fatal("Renamed key should be gone")
+	}
+	if content, err := storage.Get("/dest/1"); err != nil || string(content) != "new" {
+		t.Fatalf("Renamed key should replace the target, got %q (%v)", content, err)
+	}
+	storage.RemoveAll("/dest")
+}
@@ -0,0 +1,648 @@
+package storage
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"registry/logger"
+	"registry/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// directories under the local root that hold tiered bookkeeping instead of keys
+const TIERED_PENDING_DIR = "_tiered_pending"
+const TIERED_TMP_DIR = "_tiered_tmp"
+
+// failed write-behind uploads go back to the end of the queue and are retried after this, doubling with every
+// failure of the key up to TIERED_MAX_RETRY_DELAY
+const TIERED_RETRY_DELAY = 5 * time.Second
+const TIERED_MAX_RETRY_DELAY = 5 * time.Minute
+
+// Tiered keeps a hot copy of layers on local disk in front of S3, which stays the source of truth. Only blobs are
+// kept locally: they are named by the sum of their content, so no registry sharing the bucket can change one behind
+// our back. Everything else (image json that a new push rewrites, layer refs, blob refs, tags, marks) is read from
+// and written to S3 directly. Layer uploads (BlobUploadPath) only ever live on local disk: the request pushing one
+// renames it to its blob once it is complete, which is when it goes to S3 (in the background with WriteBehind).
+type Tiered struct {
+	Local *Local `json:"local"`
+	S3    *S3    `json:"s3"`
+	// bytes of local disk to use. least recently used keys are evicted past this.
+	MaxSize int64 `json:"max_size"`
+	// acknowledge writes once they are on local disk and upload them to S3 in the background
+	WriteBehind bool `json:"write_behind"`
+
+	remote  Storage // the source of truth, S3 unless testing
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	size    int64
+	pending map[string]int // key -> generation of the write waiting for upload
+	uploads chan string
+	// key -> failed upload attempts, for the keys waiting to be retried
+	failures   map[string]int
+	retryDelay time.Duration
+}
+
+type tieredEntry struct {
+	key  string
+	size int64
+}
+
+func (t *Tiered) init() error {
+	if t.remote == nil {
+		if t.S3 == nil {
+			return errors.New("No s3 config for storage type 'tiered' found")
+		}
+		t.remote = t.S3
+	}
+	if t.Local == nil {
+		return errors.New("No local config for storage type 'tiered' found")
+	}
+	if t.MaxSize <= 0 {
+		return errors.New("Please Specify a Max Size for Tiered Storage")
+	}
+	if err := t.Local.init(); err != nil {
+		return err
+	}
+	if err := t.remote.init(); err != nil {
+		return err
+	}
+	for _, dir := range []string{TIERED_PENDING_DIR, TIERED_TMP_DIR} {
+		if err := os.MkdirAll(path.Join(t.Local.Root, dir), 0755); err != nil {
+			return err
+		}
+	}
+	// uploads left over from before a restart were abandoned with the requests writing them
+	if err := os.RemoveAll(path.Join(t.Local.Root, path.Dir(BlobUploadPath("id")))); err != nil {
+		return err
+	}
+	t.entries = map[string]*list.Element{}
+	t.lru = list.New()
+	t.pending = map[string]int{}
+	t.uploads = make(chan string, 1024)
+	t.failures = map[string]int{}
+	if t.retryDelay == 0 {
+		t.retryDelay = TIERED_RETRY_DELAY
+	}
+	if err := t.loadLocal(); err != nil {
+		return err
+	}
+	go t.uploadLoop()
+	return t.loadPending()
+}
+
+// rebuilds the LRU from what is on disk, most recently modified (we touch files on read) first
+func (t *Tiered) loadLocal() error {
+	files := tieredFiles{}
+	blobsDir := path.Join(t.Local.Root, path.Dir(path.Dir(BlobLayerPath("sum"))))
+	err := filepath.Walk(blobsDir, func(abspath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		key := strings.TrimPrefix(strings.TrimPrefix(abspath, t.Local.Root), "/")
+		if !info.IsDir() && tierable(key) {
+			files = append(files, &tieredFile{key: key, size: info.Size(), mtime: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Sort(files)
+	for _, file := range files {
+		t.entries[file.key] = t.lru.PushBack(&tieredEntry{key: file.key, size: file.size})
+		t.size += file.size
+	}
+	return nil
+}
+
+type tieredFile struct {
+	key   string
+	size  int64
+	mtime time.Time
+}
+
+// sorts newest first
+type tieredFiles []*tieredFile
+
+func (f tieredFiles) Len() int           { return len(f) }
+func (f tieredFiles) Less(i, j int) bool { return f[i].mtime.After(f[j].mtime) }
+func (f tieredFiles) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// queues the uploads that were still pending when we last stopped
+func (t *Tiered) loadPending() error {
+	infos, err := ioutil.ReadDir(path.Join(t.Local.Root, TIERED_PENDING_DIR))
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		content, err := ioutil.ReadFile(path.Join(t.Local.Root, TIERED_PENDING_DIR, info.Name()))
+		if err != nil {
+			return err
+		}
+		t.enqueue(string(content))
+	}
+	return nil
+}
+
+// only blobs are kept locally, the one thing that can't change once written
+func tierable(relpath string) bool {
+	return IsBlobLayerPath(relpath)
+}
+
+// uploads are written locally and only reach S3 as the blob they are renamed to
+func staged(relpath string) bool {
+	return strings.HasPrefix(tieredKey(relpath), path.Dir(BlobUploadPath("id"))+"/")
+}
+
+func tieredKey(relpath string) string {
+	return strings.TrimPrefix(path.Clean("/"+relpath), "/")
+}
+
+func (t *Tiered) pendingPath(key string) string {
+	return path.Join(t.Local.Root, TIERED_PENDING_DIR, fmt.Sprintf("%x", sha256.Sum256([]byte(key))))
+}
+
+// records a local key in the LRU and evicts what doesn't fit anymore
+func (t *Tiered) added(relpath string, size int64) {
+	key := tieredKey(relpath)
+	evicted := []string{}
+	t.lock.Lock()
+	if elem, ok := t.entries[key]; ok {
+		t.size -= elem.Value.(*tieredEntry).size
+		t.lru.Remove(elem)
+	}
+	t.entries[key] = t.lru.PushFront(&tieredEntry{key: key, size: size})
+	t.size += size
+	for elem := t.lru.Back(); elem != nil && t.size > t.MaxSize; {
+		entry := elem.Value.(*tieredEntry)
+		prev := elem.Prev()
+		// pending keys are not in S3 yet and can't be evicted
+		if _, isPending := t.pending[entry.key]; !isPending {
+			evicted = append(evicted, entry.key)
+			t.lru.Remove(elem)
+			delete(t.entries, entry.key)
+			t.size -= entry.size
+		}
+		elem = prev
+	}
+	t.lock.Unlock()
+	// removing files can be slow, so it's done without holding up every other request
+	for _, key := range evicted {
+		t.lock.Lock()
+		_, readded := t.entries[key]
+		_, isPending := t.pending[key]
+		t.lock.Unlock()
+		if !readded && !isPending {
+			t.Local.Remove(key)
+		}
+	}
+}
+
+func (t *Tiered) removed(relpath string) {
+	key := tieredKey(relpath)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for entryKey, elem := range t.entries {
+		if entryKey == key || strings.HasPrefix(entryKey, key+"/") {
+			t.size -= elem.Value.(*tieredEntry).size
+			t.lru.Remove(elem)
+			delete(t.entries, entryKey)
+		}
+	}
+	for pendingKey := range t.pending {
+		if pendingKey == key || strings.HasPrefix(pendingKey, key+"/") {
+			delete(t.pending, pendingKey)
+			delete(t.failures, pendingKey)
+			os.Remove(t.pendingPath(pendingKey))
+		}
+	}
+	t.updateMetrics()
+}
+
+// returns whether the key is on local disk, marking it as recently used
+func (t *Tiered) touch(relpath string) bool {
+	key := tieredKey(relpath)
+	t.lock.Lock()
+	elem, ok := t.entries[key]
+	if ok {
+		t.lru.MoveToFront(elem)
+	}
+	t.lock.Unlock()
+	if ok {
+		// so that the order survives a restart
+		now := time.Now()
+		os.Chtimes(path.Join(t.Local.Root, key), now, now)
+	}
+	return ok
+}
+
+func (t *Tiered) enqueue(relpath string) {
+	key := tieredKey(relpath)
+	t.lock.Lock()
+	t.pending[key]++
+	t.updateMetrics()
+	t.lock.Unlock()
+	go func() { t.uploads <- key }()
+}
+
+// called with the lock held, whenever pending or failures change
+func (t *Tiered) updateMetrics() {
+	metrics.TieredPendingUploads.Set(float64(len(t.pending)))
+	metrics.TieredFailingUploads.Set(float64(len(t.failures)))
+}
+
+// uploads the queued keys one at a time. a key that fails is queued again after a delay instead of being retried
+// right away, so one bad key (refused by S3, say) doesn't hold up every write made after it.
+func (t *Tiered) uploadLoop() {
+	for key := range t.uploads {
+		err := t.upload(key)
+		t.lock.Lock()
+		if err == nil {
+			delete(t.failures, key)
+			t.updateMetrics()
+			t.lock.Unlock()
+			continue
+		}
+		t.failures[key]++
+		failures := t.failures[key]
+		t.updateMetrics()
+		t.lock.Unlock()
+		delay := t.retryDelay
+		for i := 1; i < failures && delay < TIERED_MAX_RETRY_DELAY; i++ {
+			delay *= 2
+		}
+		if delay > TIERED_MAX_RETRY_DELAY {
+			delay = TIERED_MAX_RETRY_DELAY
+		}
+		logger.Error("[Tiered][%s] error uploading to S3 (attempt %d), retrying in %s: %s", key, failures, delay,
+			err.Error())
+		time.AfterFunc(delay, func() { t.uploads <- key })
+	}
+}
+
+func (t *Tiered) upload(key string) error {
+	t.lock.Lock()
+	generation, ok := t.pending[key]
+	t.lock.Unlock()
+	if !ok {
+		// removed before we got to it
+		return nil
+	}
+	file, err := os.Open(path.Join(t.Local.Root, key))
+	if os.IsNotExist(err) {
+		// lost the local copy (e.g. removed while we were stopped), nothing we can upload
+		logger.Error("[Tiered][%s] local copy is gone, dropping upload", key)
+		t.lock.Lock()
+		delete(t.pending, key)
+		t.updateMetrics()
+		t.lock.Unlock()
+		os.Remove(t.pendingPath(key))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := t.putRemote(key, file, info.Size()); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if current, ok := t.pending[key]; !ok {
+		// removed while uploading
+		t.remote.Remove(key)
+	} else if current == generation {
+		delete(t.pending, key)
+		os.Remove(t.pendingPath(key))
+		t.updateMetrics()
+	}
+	// else rewritten while uploading, the newer write is queued as well
+	return nil
+}
+
+// after a key was written locally, get it to S3
+func (t *Tiered) store(relpath string, size int64) error {
+	if t.WriteBehind {
+		key := tieredKey(relpath)
+		if err := ioutil.WriteFile(t.pendingPath(key), []byte(key), 0644); err != nil {
+			t.Local.Remove(relpath)
+			return err
+		}
+		// pending keys are never evicted, so this has to come first
+		t.enqueue(relpath)
+		t.added(relpath, size)
+		return nil
+	}
+	file, err := os.Open(path.Join(t.Local.Root, relpath))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := t.putRemote(relpath, file, size); err != nil {
+		t.Local.Remove(relpath)
+		t.removed(relpath)
+		return err
+	}
+	t.added(relpath, size)
+	return nil
+}
+
+func (t *Tiered) putRemote(relpath string, file *os.File, size int64) error {
+	if s3, ok := t.remote.(*S3); ok {
+		// we already have the file, no need to have S3 buffer it again
+		return s3.putFile(relpath, file, size)
+	}
+	return t.remote.PutReader(relpath, file, func(io.ReadSeeker) {})
+}
+
+func (t *Tiered) Get(relpath string) ([]byte, error) {
+	if staged(relpath) {
+		return t.Local.Get(relpath)
+	}
+	if !tierable(relpath) {
+		return t.remote.Get(relpath)
+	}
+	if t.touch(relpath) {
+		if data, err := t.Local.Get(relpath); err == nil {
+			return data, nil
+		}
+	}
+	data, err := t.remote.Get(relpath)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Local.Put(relpath, data); err == nil {
+		t.added(relpath, int64(len(data)))
+	}
+	return data, nil
+}
+
+func (t *Tiered) Put(relpath string, data []byte) error {
+	if staged(relpath) {
+		return t.Local.Put(relpath, data)
+	}
+	if !tierable(relpath) {
+		return t.remote.Put(relpath, data)
+	}
+	if err := t.Local.Put(relpath, data); err != nil {
+		return err
+	}
+	return t.store(relpath, int64(len(data)))
+}
+
+func (t *Tiered) GetReader(relpath string) (io.ReadCloser, error) {
+	if staged(relpath) {
+		return t.Local.GetReader(relpath)
+	}
+	if !tierable(relpath) {
+		return t.remote.GetReader(relpath)
+	}
+	if t.touch(relpath) {
+		if reader, err := t.Local.GetReader(relpath); err == nil {
+			return reader, nil
+		}
+	}
+	reader, err := t.remote.GetReader(relpath)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(path.Join(t.Local.Root, TIERED_TMP_DIR), "fill")
+	if err != nil {
+		// can't fill the local copy, still serve from S3
+		return reader, nil
+	}
+	return &tieredFill{tiered: t, relpath: relpath, reader: reader, tmp: tmp}, nil
+}
+
+// copies what is read from S3 to local disk. the copy is only kept if everything was read.
+type tieredFill struct {
+	tiered  *Tiered
+	relpath string
+	reader  io.ReadCloser
+	tmp     *os.File
+	size    int64
+	failed  bool
+	done    bool
+}
+
+func (f *tieredFill) Read(p []byte) (int, error) {
+	n, err := f.reader.Read(p)
+	if n > 0 && !f.failed {
+		if _, werr := f.tmp.Write(p[:n]); werr != nil {
+			f.failed = true
+		}
+		f.size += int64(n)
+	}
+	if err == io.EOF {
+		f.done = true
+	}
+	return n, err
+}
+
+func (f *tieredFill) Close() error {
+	err := f.reader.Close()
+	f.tmp.Close()
+	if !f.done || f.failed {
+		os.Remove(f.tmp.Name())
+		return err
+	}
+	abspath := path.Join(f.tiered.Local.Root, f.relpath)
+	if mkErr := os.MkdirAll(path.Dir(abspath), 0755); mkErr != nil {
+		os.Remove(f.tmp.Name())
+		return err
+	}
+	if os.Rename(f.tmp.Name(), abspath) == nil {
+		f.tiered.added(f.relpath, f.size)
+	}
+	return err
+}
+
+func (t *Tiered) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSeeker)) error {
+	if staged(relpath) {
+		return t.Local.PutReader(relpath, r, afterWrite)
+	}
+	if !tierable(relpath) {
+		return t.remote.PutReader(relpath, r, afterWrite)
+	}
+	var size int64
+	err := t.Local.PutReader(relpath, r, func(file io.ReadSeeker) {
+		size, _ = file.Seek(0, 2)
+		file.Seek(0, 0)
+		afterWrite(file)
+	})
+	if err != nil {
+		t.Local.Remove(relpath)
+		return err
+	}
+	return t.store(relpath, size)
+}
+
+func (t *Tiered) List(relpath string) ([]string, error) {
+	names, err := t.remote.List(relpath)
+	if err != nil && !os.IsNotExist(err) {
+		// don't pass off what is pending as the whole listing
+		return nil, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.pending) == 0 {
+		return names, err
+	}
+	// add what is waiting to be uploaded
+	prefix := tieredKey(relpath)
+	seen := map[string]bool{}
+	for _, name := range names {
+		seen[name] = true
+	}
+	for key := range t.pending {
+		if prefix != "" && !strings.HasPrefix(key, prefix+"/") {
+			continue
+		}
+		rest := strings.TrimPrefix(strings.TrimPrefix(key, prefix), "/")
+		name := "/" + path.Join(prefix, strings.Split(rest, "/")[0])
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (t *Tiered) Exists(relpath string) (bool, error) {
+	if staged(relpath) {
+		return t.Local.Exists(relpath)
+	}
+	if tierable(relpath) && t.touch(relpath) {
+		return true, nil
+	}
+	return t.remote.Exists(relpath)
+}
+
+func (t *Tiered) Size(relpath string) (int64, error) {
+	if staged(relpath) {
+		return t.Local.Size(relpath)
+	}
+	if tierable(relpath) && t.touch(relpath) {
+		if size, err := t.Local.Size(relpath); err == nil {
+			return size, nil
+		}
+	}
+	return t.remote.Size(relpath)
+}
+
+func (t *Tiered) Remove(relpath string) error {
+	if staged(relpath) {
+		return t.Local.Remove(relpath)
+	}
+	t.lock.Lock()
+	_, isPending := t.pending[tieredKey(relpath)]
+	t.lock.Unlock()
+	localErr := t.Local.Remove(relpath)
+	t.removed(relpath)
+	s3Err := t.remote.Remove(relpath)
+	if s3Err != nil && isPending && localErr == nil {
+		// never made it to S3
+		return nil
+	}
+	return s3Err
+}
+
+func (t *Tiered) RemoveAll(relpath string) error {
+	localErr := t.Local.RemoveAll(relpath)
+	t.removed(relpath)
+	// the bookkeeping directories live under the local root too, put them back
+	for _, dir := range []string{TIERED_PENDING_DIR, TIERED_TMP_DIR} {
+		os.MkdirAll(path.Join(t.Local.Root, dir), 0755)
+	}
+	s3Err := t.remote.RemoveAll(relpath)
+	if os.IsNotExist(s3Err) && localErr == nil {
+		// none of it made it to S3
+		return nil
+	}
+	return s3Err
+}
+
+// Rename moves the key in S3, and on local disk if it is kept there
+func (t *Tiered) Rename(from, to string) error {
+	if staged(from) {
+		return t.renameStaged(from, to)
+	}
+	key := tieredKey(from)
+	t.lock.Lock()
+	_, isPending := t.pending[key]
+	t.lock.Unlock()
+	if isPending && tierable(to) {
+		// S3 doesn't have it yet, upload it under the new key instead
+		if err := t.Local.Rename(from, to); err != nil {
+			return err
+		}
+		size, _ := t.Local.Size(to)
+		t.removed(from)
+		return t.store(to, size)
+	}
+	if isPending {
+		if err := t.upload(key); err != nil {
+			return err
+		}
+	}
+	if err := t.remote.Rename(from, to); err != nil {
+		return err
+	}
+	// whatever was kept of the target is stale now
+	t.Local.Remove(to)
+	t.removed(to)
+	if tierable(to) && t.touch(from) && t.Local.Rename(from, to) == nil {
+		size, _ := t.Local.Size(to)
+		t.removed(from)
+		t.added(to, size)
+		return nil
+	}
+	t.Local.Remove(from)
+	t.removed(from)
+	return nil
+}
+
+// an upload goes from local disk to wherever its target is kept
+func (t *Tiered) renameStaged(from, to string) error {
+	if tierable(to) {
+		if err := t.Local.Rename(from, to); err != nil {
+			return err
+		}
+		size, err := t.Local.Size(to)
+		if err != nil {
+			return err
+		}
+		return t.store(to, size)
+	}
+	file, err := os.Open(path.Join(t.Local.Root, tieredKey(from)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := t.putRemote(to, file, info.Size()); err != nil {
+		return err
+	}
+	return t.Local.Remove(from)
+}
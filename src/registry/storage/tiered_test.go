@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestTiered(t *testing.T, maxSize int64, writeBehind bool) (*Tiered, *Local) {
+	remote := &Local{Root: "/tmp/go-docker-registry-test-tiered-remote"}
+	local := &Local{Root: "/tmp/go-docker-registry-test-tiered-local"}
+	os.RemoveAll(remote.Root)
+	os.RemoveAll(local.Root)
+	tiered := &Tiered{Local: local, MaxSize: maxSize, WriteBehind: writeBehind, remote: remote}
+	if err := tiered.init(); err != nil {
+		t.Fatal(err)
+	}
+	return tiered, remote
+}
+
+func TestTiered(t *testing.T) {
+	tiered, remote := newTestTiered(t, 1024, false)
+	defer os.RemoveAll(remote.Root)
+	defer os.RemoveAll(tiered.Local.Root)
+	testStorage(t, tiered)
+}
+
+func TestTieredFillAndEvict(t *testing.T) {
+	tiered, remote := newTestTiered(t, 25, false)
+	defer os.RemoveAll(remote.Root)
+	defer os.RemoveAll(tiered.Local.Root)
+
+	if err := tiered.Put(BlobLayerPath("1"), []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := remote.Get(BlobLayerPath("1")); string(content) != "0123456789" {
+		t.Fatal("Writes should go to the remote storage")
+	}
+	tiered.Put(BlobLayerPath("2"), []byte("0123456789"))
+	tiered.Put(BlobLayerPath("3"), []byte("0123456789"))
+	if exists, _ := tiered.Local.Exists(BlobLayerPath("1")); exists {
+		t.Fatal("Least recently used key should have been evicted")
+	}
+	if exists, _ := tiered.Local.Exists(BlobLayerPath("3")); !exists {
+		t.Fatal("Most recently used key should be on local disk")
+	}
+
+	// a miss is filled in from the remote storage once it's been read completely
+	reader, err := tiered.GetReader(BlobLayerPath("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadAll(reader); string(content) != "0123456789" {
+		t.Fatalf("Read the wrong content: %s", content)
+	}
+	reader.Close()
+	if content, _ := tiered.Local.Get(BlobLayerPath("1")); string(content) != "0123456789" {
+		t.Fatal("Key should have been filled in on local disk")
+	}
+
+	// mutable keys are never kept locally
+	for _, key := range []string{
+		RepoTagPath("library", "test", "latest"), ImageJsonPath("1"), ImageLayerPath("1"), BlobRefPath("1", "1"),
+	} {
+		tiered.Put(key, []byte("1"))
+		if exists, _ := tiered.Local.Exists(key); exists {
+			t.Fatalf("%s should not be kept on local disk", key)
+		}
+	}
+}
+
+func TestTieredWriteBehind(t *testing.T) {
+	tiered, remote := newTestTiered(t, 5, true)
+	defer os.RemoveAll(remote.Root)
+	defer os.RemoveAll(tiered.Local.Root)
+
+	var size int64
+	err := tiered.PutReader(BlobLayerPath("1"), bytes.NewBufferString("0123456789"), func(r io.ReadSeeker) {
+		size, _ = r.Seek(0, 2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 10 {
+		t.Fatalf("afterWrite should see the whole content, saw %d bytes", size)
+	}
+	if names, err := tiered.List(path.Dir(BlobLayerPath("1"))); err != nil || len(names) != 1 {
+		t.Fatalf("Pending keys should be listed, got %+v, %v", names, err)
+	}
+	for i := 0; i < 100; i++ {
+		if exists, _ := remote.Exists(BlobLayerPath("1")); exists {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if content, _ := remote.Get(BlobLayerPath("1")); string(content) != "0123456789" {
+		t.Fatal("Key should have been uploaded in the background")
+	}
+	tiered.Put(BlobLayerPath("2"), []byte("01234"))
+	for i := 0; i < 100; i++ {
+		if exists, _ := remote.Exists(BlobLayerPath("2")); exists {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if exists, _ := tiered.Local.Exists(BlobLayerPath("1")); exists {
+		t.Fatal("Uploaded keys over the max size should be evicted")
+	}
+}
+
+func TestTieredUploads(t *testing.T) {
+	for _, writeBehind := range []bool{false, true} {
+		tiered, remote := newTestTiered(t, 1024, writeBehind)
+		err := tiered.PutReader(BlobUploadPath("1"), bytes.NewBufferString("0123456789"), func(io.ReadSeeker) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists, _ := remote.Exists(BlobUploadPath("1")); exists {
+			t.Fatal("Uploads should stay on local disk")
+		}
+		if content, _ := tiered.Get(BlobUploadPath("1")); string(content) != "0123456789" {
+			t.Fatalf("Read the wrong upload: %s", content)
+		}
+		if err := tiered.Rename(BlobUploadPath("1"), BlobLayerPath("1")); err != nil {
+			t.Fatal(err)
+		}
+		if exists, _ := tiered.Local.Exists(BlobLayerPath("1")); !exists {
+			t.Fatal("The pushed blob should be kept on local disk")
+		}
+		if exists, _ := tiered.Local.Exists(BlobUploadPath("1")); exists {
+			t.Fatal("The upload should be gone")
+		}
+		if !writeBehind {
+			if content, _ := remote.Get(BlobLayerPath("1")); string(content) != "0123456789" {
+				t.Fatal("The pushed blob should be in the remote storage")
+			}
+		} else if names, err := tiered.List(path.Dir(BlobLayerPath("1"))); err != nil || len(names) != 1 {
+			t.Fatalf("The pushed blob should be pending, got %+v, %v", names, err)
+		}
+		os.RemoveAll(remote.Root)
+		os.RemoveAll(tiered.Local.Root)
+	}
+}
+
+// fails to remove anything, like an S3 that refuses the credentials
+type failingRemove struct {
+	Storage
+}
+
+func (s *failingRemove) RemoveAll(relpath string) error {
+	return errors.New("access denied")
+}
+
+func TestTieredRemoveAllErrors(t *testing.T) {
+	tiered, remote := newTestTiered(t, 1024, false)
+	defer os.RemoveAll(remote.Root)
+	defer os.RemoveAll(tiered.Local.Root)
+	if err := tiered.Put(BlobLayerPath("1"), []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	tiered.remote = &failingRemove{remote}
+	if err := tiered.RemoveAll(path.Dir(BlobLayerPath("1"))); err == nil {
+		t.Fatal("Expected the remote error even though the local copy was removed")
+	}
+	if exists, _ := remote.Exists(BlobLayerPath("1")); !exists {
+		t.Fatal("Expected the remote copy to be left")
+	}
+}
+
+// refuses to store one key, like S3 refusing an object
+type refusingPut struct {
+	Storage
+	lock sync.Mutex
+	key  string
+}
+
+func (s *refusingPut) refuse(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.key = key
+}
+
+func (s *refusingPut) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSeeker)) error {
+	s.lock.Lock()
+	refused := tieredKey(relpath) == s.key
+	s.lock.Unlock()
+	if refused {
+		return errors.New("access denied")
+	}
+	return s.Storage.PutReader(relpath, r, afterWrite)
+}
+
+func TestTieredUploadRetries(t *testing.T) {
+	remote := &Local{Root: "/tmp/go-docker-registry-test-tiered-remote"}
+	local := &Local{Root: "/tmp/go-docker-registry-test-tiered-local"}
+	os.RemoveAll(remote.Root)
+	os.RemoveAll(local.Root)
+	defer os.RemoveAll(remote.Root)
+	defer os.RemoveAll(local.Root)
+	refusing := &refusingPut{Storage: remote, key: BlobLayerPath("1")}
+	tiered := &Tiered{Local: local, MaxSize: 1024, WriteBehind: true, remote: refusing,
+		retryDelay: 10 * time.Millisecond}
+	if err := tiered.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tiered.Put(BlobLayerPath("1"), []byte("0123456789"))
+	tiered.Put(BlobLayerPath("2"), []byte("01234"))
+	for i := 0; i < 100; i++ {
+		if exists, _ := remote.Exists(BlobLayerPath("2")); exists {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if exists, _ := remote.Exists(BlobLayerPath("2")); !exists {
+		t.Fatal("A key that fails to upload shouldn't hold up the ones after it")
+	}
+	tiered.lock.Lock()
+	failures := tiered.failures[BlobLayerPath("1")]
+	tiered.lock.Unlock()
+	if failures == 0 {
+		t.Fatal("Expected the failing key to be waiting for a retry")
+	}
+
+	// once S3 takes it, the retry goes through
+	refusing.refuse("")
+	for i := 0; i < 300; i++ {
+		if exists, _ := remote.Exists(BlobLayerPath("1")); exists {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if content, _ := remote.Get(BlobLayerPath("1")); string(content) != "0123456789" {
+		t.Fatal("Expected the failed key to be uploaded on a retry")
+	}
+}
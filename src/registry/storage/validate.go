@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"errors"
+	"github.com/crowdmob/goamz/aws"
+)
+
+// Validate reports every problem with the config at once, without touching the storage itself
+func (cfg *Config) Validate() []error {
+	errs := []error{}
+	switch cfg.Type {
+	case "local":
+		if cfg.Local == nil {
+			errs = append(errs, errors.New("No config for storage type 'local' found"))
+		} else {
+			errs = append(errs, cfg.Local.validate()...)
+		}
+	case "s3":
+		if cfg.S3 == nil {
+			errs = append(errs, errors.New("No config for storage type 's3' found"))
+		} else {
+			errs = append(errs, cfg.S3.validate()...)
+		}
+	case "tiered":
+		if cfg.Tiered == nil {
+			errs = append(errs, errors.New("No config for storage type 'tiered' found"))
+		} else {
+			errs = append(errs, cfg.Tiered.validate()...)
+		}
+	default:
+		errs = append(errs, errors.New("Invalid storage type: "+cfg.Type))
+	}
+	if cfg.Encryption != nil {
+		if cfg.Encryption.KeyFile == "" {
+			errs = append(errs, errors.New("Please Specify a Key File for Encryption"))
+		} else if err := NewEncryption(nil, cfg.Encryption).loadKeys(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cfg.Cache != nil {
+		if cfg.Cache.MaxBytes < 0 || cfg.Cache.MaxObjectSize < 0 || cfg.Cache.TagTTL < 0 || cfg.Cache.ImageTTL < 0 {
+			errs = append(errs, errors.New("Cache sizes and TTLs can't be negative"))
+		}
+	}
+	return errs
+}
+
+func (s *Local) validate() []error {
+	if s.Root == "" {
+		return []error{errors.New("Please Specify a Local Root Path")}
+	}
+	return nil
+}
+
+func (s *S3) validate() []error {
+	errs := []error{}
+	if s.Bucket == "" {
+		errs = append(errs, errors.New("Please Specify an S3 Bucket"))
+	}
+	if s.Region == "" {
+		errs = append(errs, errors.New("Please Specify an S3 Region"))
+	} else if _, ok := aws.Regions[s.Region]; !ok {
+		errs = append(errs, errors.New("Invalid Region: "+s.Region))
+	}
+	if s.Root == "" {
+		errs = append(errs, errors.New("Please Specify an S3 Root Path"))
+	}
+	if s.BufferDir == "" {
+		errs = append(errs, errors.New("Please Specify a Buffer Directory to use for Uploads"))
+	}
+	return errs
+}
+
+func (t *Tiered) validate() []error {
+	errs := []error{}
+	if t.S3 == nil {
+		errs = append(errs, errors.New("No s3 config for storage type 'tiered' found"))
+	} else {
+		errs = append(errs, t.S3.validate()...)
+	}
+	if t.Local == nil {
+		errs = append(errs, errors.New("No local config for storage type 'tiered' found"))
+	} else {
+		errs = append(errs, t.Local.validate()...)
+	}
+	if t.MaxSize <= 0 {
+		errs = append(errs, errors.New("Please Specify a Max Size for Tiered Storage"))
+	}
+	return errs
+}
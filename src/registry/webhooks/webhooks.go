@@ -0,0 +1,386 @@
+// Package webhooks delivers registry events to HTTP endpoints. Events are written to an outbox on local disk before
+// anything is sent, so they survive restarts, and are retried with exponential backoff until the endpoint accepts
+// them or MaxAttempts is reached.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"registry/logger"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ACTION_PUSH         = "push"         // an image finished uploading
+	ACTION_TAG          = "tag"          // a tag was created or moved
+	ACTION_UNTAG        = "untag"        // a tag was deleted
+	ACTION_DELETE_TAGS  = "delete_tags"  // all tags of a repository were deleted
+	ACTION_DELETE_REPO  = "delete_repo"  // a repository was deleted
+	ACTION_DELETE_IMAGE = "delete_image" // an image was deleted
+)
+
+const DEFAULT_MAX_ATTEMPTS = 10
+const DEFAULT_MAX_BACKOFF = 600 // seconds
+const DEFAULT_TIMEOUT = 10      // seconds
+
+// how often the outbox is checked for retries that became due
+const POLL_INTERVAL = time.Second
+
+type Endpoint struct {
+	URL string `json:"url"`
+	// if set, every request carries X-Registry-Signature: sha256=<hex HMAC-SHA256 of the body with this secret>
+	Secret string `json:"secret"`
+	// only send events of these namespaces, all of them if empty
+	Namespaces []string `json:"namespaces"`
+	// seconds to wait for the endpoint to respond
+	Timeout int `json:"timeout"`
+}
+
+func (e *Endpoint) wants(event *Event) bool {
+	if len(e.Namespaces) == 0 {
+		return true
+	}
+	for _, namespace := range e.Namespaces {
+		if namespace == event.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+type Config struct {
+	Endpoints []*Endpoint `json:"endpoints"`
+	// where events wait to be delivered. it must be on local disk and only used by this registry.
+	OutboxDir string `json:"outbox_dir"`
+	// give up on an event after this many failed deliveries
+	MaxAttempts int `json:"max_attempts"`
+	// the delay between attempts doubles from a second up to this many seconds
+	MaxBackoff int `json:"max_backoff"`
+}
+
+func (c *Config) Validate() []error {
+	errs := []error{}
+	if c.OutboxDir == "" {
+		errs = append(errs, errors.New("Please Specify an Outbox Directory for Webhooks"))
+	}
+	for i, endpoint := range c.Endpoints {
+		if !strings.HasPrefix(endpoint.URL, "http://") && !strings.HasPrefix(endpoint.URL, "https://") {
+			errs = append(errs, fmt.Errorf("endpoints[%d]: url must be http or https", i))
+		}
+	}
+	if c.MaxAttempts < 0 || c.MaxBackoff < 0 {
+		errs = append(errs, errors.New("max_attempts and max_backoff can't be negative"))
+	}
+	return errs
+}
+
+type Event struct {
+	ID        string    `json:"id"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor"` // the identity that made the request, "" if anonymous
+	Namespace string    `json:"namespace"`
+	Repo      string    `json:"repo"`
+	Tag       string    `json:"tag,omitempty"`
+	ImageID   string    `json:"image_id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// a delivery of an event to one endpoint, as stored in the outbox
+type delivery struct {
+	URL         string          `json:"url"`
+	Event       json.RawMessage `json:"event"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+}
+
+type Notifier struct {
+	lock sync.RWMutex
+	cfg  *Config
+	wake chan bool
+	busy map[string]bool // endpoints being delivered to
+}
+
+// New starts delivering the events in the outbox. A nil config disables webhooks until SetConfig is called.
+func New(cfg *Config) *Notifier {
+	n := &Notifier{cfg: cfg, wake: make(chan bool, 1)}
+	go n.deliverLoop()
+	return n
+}
+
+func (n *Notifier) config() *Config {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.cfg
+}
+
+func (n *Notifier) SetConfig(cfg *Config) {
+	n.lock.Lock()
+	n.cfg = cfg
+	n.lock.Unlock()
+	n.poke()
+}
+
+func (n *Notifier) poke() {
+	select {
+	case n.wake <- true:
+	default:
+		// already awake
+	}
+}
+
+// Notify puts event in the outbox once for every endpoint that wants it
+func (n *Notifier) Notify(event *Event) {
+	cfg := n.config()
+	if cfg == nil || len(cfg.Endpoints) == 0 {
+		return
+	}
+	if event.ID == "" {
+		event.ID = newID()
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	log := logger.ForRequest(logger.WithRequestID(context.Background(), event.RequestID))
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		log.Error("[Webhooks] error encoding event: %s", err.Error())
+		return
+	}
+	if err := os.MkdirAll(cfg.OutboxDir, 0755); err != nil {
+		log.Error("[Webhooks] error creating outbox: %s", err.Error())
+		return
+	}
+	for i, endpoint := range cfg.Endpoints {
+		if !endpoint.wants(event) {
+			continue
+		}
+		// names sort in the order events happened
+		name := fmt.Sprintf("%020d-%s-%d", event.Timestamp.UnixNano(), event.ID, i)
+		d := &delivery{URL: endpoint.URL, Event: encoded, NextAttempt: event.Timestamp}
+		if err := writeDelivery(path.Join(cfg.OutboxDir, name), d); err != nil {
+			log.Error("[Webhooks] error writing %s event for %s to the outbox: %s", event.Action, endpoint.URL,
+				err.Error())
+		}
+	}
+	n.poke()
+}
+
+func newID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// writes to a temporary file first, so that a crash never leaves half a delivery behind
+func writeDelivery(filename string, d *delivery) error {
+	encoded, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(filename), "."+path.Base(filename)+".tmp")
+	if err := ioutil.WriteFile(tmp, encoded, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func (n *Notifier) deliverLoop() {
+	ticker := time.NewTicker(POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.wake:
+		}
+		if cfg := n.config(); cfg != nil {
+			n.deliverDue(cfg)
+		}
+	}
+}
+
+// starts delivering what is due to every endpoint that isn't busy with an earlier pass, so that a slow or dead
+// endpoint only holds up its own deliveries. the returned WaitGroup is done once they are delivered or rescheduled.
+func (n *Notifier) deliverDue(cfg *Config) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	infos, err := ioutil.ReadDir(cfg.OutboxDir)
+	if err != nil {
+		// nothing was ever queued
+		return wg
+	}
+	names := []string{}
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), ".") {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	endpoints := map[string]*Endpoint{}
+	for _, endpoint := range cfg.Endpoints {
+		endpoints[endpoint.URL] = endpoint
+	}
+	now := time.Now()
+	due := map[string][]string{} // url -> names, oldest first
+	for _, name := range names {
+		filename := path.Join(cfg.OutboxDir, name)
+		d, err := readDelivery(filename)
+		if os.IsNotExist(err) {
+			// delivered since
+			continue
+		} else if err != nil {
+			logger.Error("[Webhooks] dropping unreadable delivery %s: %s", name, err.Error())
+			os.Remove(filename)
+			continue
+		}
+		if _, ok := endpoints[d.URL]; !ok {
+			logger.Info("[Webhooks] dropping delivery %s, %s is no longer configured", name, d.URL)
+			os.Remove(filename)
+			continue
+		}
+		if !d.NextAttempt.After(now) {
+			due[d.URL] = append(due[d.URL], name)
+		}
+	}
+	for url, names := range due {
+		if !n.claim(url) {
+			continue
+		}
+		wg.Add(1)
+		go func(endpoint *Endpoint, names []string) {
+			defer wg.Done()
+			defer n.release(endpoint.URL)
+			n.deliverTo(cfg, endpoint, names)
+		}(endpoints[url], names)
+	}
+	return wg
+}
+
+// marks the endpoint busy, returns false if it already was
+func (n *Notifier) claim(url string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.busy == nil {
+		n.busy = map[string]bool{}
+	}
+	if n.busy[url] {
+		return false
+	}
+	n.busy[url] = true
+	return true
+}
+
+func (n *Notifier) release(url string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.busy, url)
+}
+
+// sends the deliveries in names to endpoint in order, up to the first one that fails
+func (n *Notifier) deliverTo(cfg *Config, endpoint *Endpoint, names []string) {
+	for _, name := range names {
+		filename := path.Join(cfg.OutboxDir, name)
+		d, err := readDelivery(filename)
+		if err != nil {
+			continue
+		}
+		err = send(endpoint, d.Event)
+		if err == nil {
+			os.Remove(filename)
+			continue
+		}
+		d.Attempts++
+		maxAttempts := cfg.MaxAttempts
+		if maxAttempts <= 0 {
+			maxAttempts = DEFAULT_MAX_ATTEMPTS
+		}
+		if d.Attempts >= maxAttempts {
+			logger.Error("[Webhooks] giving up on delivery %s to %s after %d attempts: %s", name, d.URL, d.Attempts,
+				err.Error())
+			os.Remove(filename)
+			continue
+		}
+		d.NextAttempt = time.Now().Add(backoff(d.Attempts, cfg.MaxBackoff))
+		logger.Error("[Webhooks] delivery %s to %s failed (attempt %d), retrying at %s: %s", name, d.URL, d.Attempts,
+			d.NextAttempt.Format(time.RFC3339), err.Error())
+		if err := writeDelivery(filename, d); err != nil {
+			logger.Error("[Webhooks] error updating delivery %s: %s", name, err.Error())
+		}
+		// the rest would most likely fail the same way
+		return
+	}
+}
+
+func readDelivery(filename string) (*delivery, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	d := &delivery{}
+	return d, json.Unmarshal(content, d)
+}
+
+func backoff(attempts, maxBackoff int) time.Duration {
+	if maxBackoff <= 0 {
+		maxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	delay := time.Second
+	for i := 1; i < attempts && delay < time.Duration(maxBackoff)*time.Second; i++ {
+		delay *= 2
+	}
+	if limit := time.Duration(maxBackoff) * time.Second; delay > limit {
+		delay = limit
+	}
+	return delay
+}
+
+// Sign returns the value of the X-Registry-Signature header for body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func send(endpoint *Endpoint, body []byte) error {
+	req, err := http.NewRequest("POST", endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var event Event
+	if json.Unmarshal(body, &event) == nil {
+		req.Header.Set("X-Registry-Event", event.Action)
+		req.Header.Set("X-Registry-Delivery", event.ID)
+	}
+	if endpoint.Secret != "" {
+		req.Header.Set("X-Registry-Signature", Sign(endpoint.Secret, body))
+	}
+	timeout := endpoint.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDelivery(t *testing.T) {
+	outbox := "/tmp/go-docker-registry-test-webhooks"
+	os.RemoveAll(outbox)
+	defer os.RemoveAll(outbox)
+
+	failures := 1
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Registry-Signature") != Sign("secret", body) {
+			t.Errorf("Bad signature %q", r.Header.Get("X-Registry-Signature"))
+		}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received++
+	}))
+	defer server.Close()
+
+	cfg := &Config{
+		OutboxDir: outbox,
+		Endpoints: []*Endpoint{
+			&Endpoint{URL: server.URL, Secret: "secret"},
+			&Endpoint{URL: server.URL + "/other", Namespaces: []string{"other"}},
+		},
+	}
+	// no loop, deliveries are made by hand below
+	n := &Notifier{cfg: cfg, wake: make(chan bool, 1)}
+	n.Notify(&Event{Action: ACTION_TAG, Namespace: "library", Repo: "test", Tag: "latest", ImageID: "1"})
+	if infos, _ := ioutil.ReadDir(outbox); len(infos) != 1 {
+		t.Fatalf("Expected the event to be queued for one endpoint, got %d", len(infos))
+	}
+
+	n.deliverDue(cfg).Wait()
+	if infos, _ := ioutil.ReadDir(outbox); len(infos) != 1 || received != 0 {
+		t.Fatal("Failed delivery should stay in the outbox")
+	}
+	// the retry isn't due yet
+	n.deliverDue(cfg).Wait()
+	if received != 0 {
+		t.Fatal("Retried before the backoff passed")
+	}
+	infos, _ := ioutil.ReadDir(outbox)
+	filename := path.Join(outbox, infos[0].Name())
+	var d delivery
+	content, _ := ioutil.ReadFile(filename)
+	json.Unmarshal(content, &d)
+	if d.Attempts != 1 {
+		t.Fatalf("Expected 1 attempt to be recorded, got %d", d.Attempts)
+	}
+	d.NextAttempt = time.Now()
+	writeDelivery(filename, &d)
+	n.deliverDue(cfg).Wait()
+	if infos, _ := ioutil.ReadDir(outbox); len(infos) != 0 || received != 1 {
+		t.Fatalf("Expected the retry to be delivered, received %d", received)
+	}
+}
+
+func TestDeliveryPerEndpoint(t *testing.T) {
+	outbox := t.TempDir()
+	stuck := make(chan bool)
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stuck
+	}))
+	defer dead.Close()
+	defer close(stuck)
+	received := make(chan bool, 10)
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- true
+	}))
+	defer live.Close()
+
+	cfg := &Config{OutboxDir: outbox, Endpoints: []*Endpoint{&Endpoint{URL: dead.URL}, &Endpoint{URL: live.URL}}}
+	n := &Notifier{cfg: cfg, wake: make(chan bool, 1)}
+	n.Notify(&Event{Action: ACTION_TAG, Namespace: "library", Repo: "test", Tag: "latest", ImageID: "1"})
+	n.Notify(&Event{Action: ACTION_TAG, Namespace: "library", Repo: "test", Tag: "latest", ImageID: "2"})
+	// passes like the loop makes them, the dead endpoint stays busy with the first event all along
+	deadline := time.Now().Add(5 * time.Second)
+	for delivered := 0; delivered < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("Delivery to the live endpoint waited for the dead one")
+		}
+		n.deliverDue(cfg)
+		select {
+		case <-received:
+			delivered++
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}